@@ -0,0 +1,42 @@
+package betterbox
+
+import "errors"
+
+// WithPreserveACLs sends the POSIX access ACLs of the files and directories,
+// on platforms and filesystems supporting them (Linux), for servers preserving
+// ACLs to apply them. Entries without extended ACLs have none to send, their
+// mode being all of it.
+func WithPreserveACLs() ClientOption {
+	return func(c *Client) error {
+		c.preserveACLs = true
+		return nil
+	}
+}
+
+// WithServerPreserveACLs applies the access ACLs sent by clients preserving
+// ACLs to the created files and directories, and on their mode changes, on
+// platforms and filesystems supporting them (Linux). They are skipped
+// elsewhere.
+func WithServerPreserveACLs() ServerOption {
+	return func(sv *Server) error {
+		sv.preserveACLs = true
+		return nil
+	}
+}
+
+// errACLUnsupported is returned when setting ACLs is unsupported on the
+// platform or filesystem.
+var errACLUnsupported = errors.New("Setting ACLs unsupported on this platform")
+
+// applyACL applies the access ACL of a Request to the file or directory at
+// path, if ACLs are preserved and supported.
+func (sv *Server) applyACL(req *Request, path string) error {
+	if !sv.preserveACLs || len(req.ACL) == 0 {
+		return nil
+	}
+	if err := setACL(path, req.ACL); err != errACLUnsupported {
+		return err
+	}
+	sv.logger.Log(LevelWarning, "Skipping unsupported ACL", Fields{"path": req.Path})
+	return nil
+}
@@ -0,0 +1,51 @@
+//go:build linux
+// +build linux
+
+package betterbox
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+	"syscall"
+)
+
+// aclAccessXattr is the extended attribute of the POSIX access ACLs.
+const aclAccessXattr = "system.posix_acl_access"
+
+// accessACL returns the access ACL of the file or directory at path, with its
+// info, in the extended attribute's format, or nil if it has none or its
+// filesystem doesn't support them.
+func accessACL(path string, info os.FileInfo) []byte {
+	// Only the OS filesystem's entries have ACLs.
+	if _, ok := info.Sys().(*syscall.Stat_t); !ok {
+		return nil
+	}
+	for {
+		size, err := unix.Getxattr(path, aclAccessXattr, nil)
+		if err != nil || size == 0 {
+			return nil
+		}
+		acl := make([]byte, size)
+		size, err = unix.Getxattr(path, aclAccessXattr, acl)
+		if err == unix.ERANGE {
+			// Changed since its size was read.
+			continue
+		}
+		if err != nil {
+			return nil
+		}
+		return acl[:size]
+	}
+}
+
+// setACL sets the access ACL of the file or directory at path.
+func setACL(path string, acl []byte) error {
+	err := unix.Setxattr(path, aclAccessXattr, acl, 0)
+	if err == unix.ENOTSUP {
+		return errACLUnsupported
+	}
+	if err != nil {
+		return &os.PathError{Op: "setxattr", Path: path, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package betterbox_test
+
+import (
+	"betterbox"
+	"bytes"
+	"encoding/binary"
+	"golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// accessACL encodes a POSIX access ACL granting uid read access, in the format
+// of its extended attribute.
+func accessACL(uid uint32) []byte {
+	const undefinedID = 0xffffffff
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(2)) // Version.
+	for _, entry := range []struct {
+		tag  uint16
+		perm uint16
+		id   uint32
+	}{
+		{0x01, 6, undefinedID}, // Owner.
+		{0x02, 4, uid},         // Named user.
+		{0x04, 4, undefinedID}, // Owning group.
+		{0x10, 4, undefinedID}, // Mask.
+		{0x20, 0, undefinedID}, // Others.
+	} {
+		binary.Write(&buf, binary.LittleEndian, entry)
+	}
+	return buf.Bytes()
+}
+
+func TestPreserveACLs(t *testing.T) {
+	tFiles := []testEntry{
+		{"dir1", DIR, nil},
+		{"dir1/file1", FILE, []byte("file1 content")},
+		{"file2", FILE, []byte("file2 content")},
+	}
+	acl := accessACL(12345)
+	for _, batch := range []bool{false, true} {
+		sopts := []betterbox.ServerOption{betterbox.WithServerPreserveACLs()}
+		copts := []betterbox.ClientOption{betterbox.WithPreserveACLs()}
+		if batch {
+			sopts = append(sopts, betterbox.WithTransactionalBatches())
+			copts = append(copts, betterbox.WithBatchRequests())
+		}
+		sdir, port := newTestServer(t, sopts...)
+		defer os.RemoveAll(sdir)
+		cdir := createTempDirWithFiles(t, tFiles)
+		defer os.RemoveAll(cdir)
+		for _, name := range []string{"dir1", "dir1/file1"} {
+			err := unix.Setxattr(filepath.Join(cdir, name), "system.posix_acl_access", acl, 0)
+			if err == unix.ENOTSUP || err == unix.EOPNOTSUPP {
+				t.Skipf("ACLs unsupported: %v", err)
+			}
+			if err != nil {
+				t.Fatalf("Can't set ACL: %v", err)
+			}
+		}
+		client, err := betterbox.NewClient(serverAddress, port, cdir, copts...)
+		if err != nil {
+			t.Fatalf("Can't instantiate new client: %v", err)
+		}
+		if err = client.Sync(); err != nil {
+			t.Fatalf("Client can't send files to server: %v", err)
+		}
+		for _, tc := range []struct {
+			name string
+			acl  []byte
+		}{
+			{"dir1", acl},
+			{"dir1/file1", acl},
+			// Entries without extended ACLs have none.
+			{"file2", nil},
+		} {
+			stored := make([]byte, 256)
+			n, err := unix.Getxattr(filepath.Join(sdir, tc.name), "system.posix_acl_access", stored)
+			if err == unix.ENODATA {
+				n = 0
+			} else if err != nil {
+				t.Fatalf("Can't get ACL: %v", err)
+			}
+			if !bytes.Equal(stored[:n], tc.acl) {
+				t.Errorf("%s: ACL %x stored, expected %x", tc.name, stored[:n], tc.acl)
+			}
+		}
+	}
+}
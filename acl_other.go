@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package betterbox
+
+import "os"
+
+// accessACL returns the access ACL of the file or directory at path, which
+// isn't supported on this platform.
+func accessACL(path string, info os.FileInfo) []byte {
+	return nil
+}
+
+// setACL sets the access ACL of the file or directory at path, which this
+// platform doesn't support.
+func setACL(path string, acl []byte) error {
+	return errACLUnsupported
+}
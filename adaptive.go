@@ -0,0 +1,82 @@
+package betterbox
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// throughputSampleSize is the number of bytes a call has to write for its
+// duration to measure the link's throughput, rather than its latency.
+const throughputSampleSize = 32 << 10
+
+// WithAdaptiveCompression makes the client measure the throughput of its
+// connections to the servers, and ask for the compression of the RPC streams,
+// as WithStreamCompression does, only while it is below threshold bytes per
+// second: compression then helps the slow links, without wasting CPU on the
+// fast ones. It applies to new connections, starting without compression
+// until measured, so not to a connection provided to NewClientWithConn.
+func WithAdaptiveCompression(threshold int64) ClientOption {
+	return func(c *Client) error {
+		if threshold <= 0 {
+			return fmt.Errorf("Invalid compression threshold: %d", threshold)
+		}
+		c.compressThreshold = threshold
+		return nil
+	}
+}
+
+// meteredConn counts the bytes written to a connection.
+type meteredConn struct {
+	net.Conn
+	written int64
+}
+
+func (mc *meteredConn) Write(p []byte) (int, error) {
+	n, err := mc.Conn.Write(p)
+	atomic.AddInt64(&mc.written, int64(n))
+	return n, err
+}
+
+// wireBytes returns the number of bytes written to the connection, 0 if not
+// metered.
+func (sc *serverConn) wireBytes() int64 {
+	if sc.metered == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&sc.metered.written)
+}
+
+// recordThroughput records that a call wrote n bytes in d, which updates the
+// measured throughput of the links if enough bytes were written. The streams
+// of the next connections are compressed while it is below the threshold.
+func (c *Client) recordThroughput(n int64, d time.Duration) {
+	if c.compressThreshold == 0 || n < throughputSampleSize || d <= 0 {
+		return
+	}
+	sample := float64(n) / d.Seconds()
+	c.throughputMutex.Lock()
+	defer c.throughputMutex.Unlock()
+	// Moving average, favoring the recent calls.
+	if c.throughput == 0 {
+		c.throughput = sample
+	} else {
+		c.throughput = 0.75*c.throughput + 0.25*sample
+	}
+	if compressing := c.throughput < float64(c.compressThreshold); compressing != c.compressing {
+		c.compressing = compressing
+		c.logger.Log(LevelInfo, "Switching stream compression", Fields{"enabled": compressing, "throughput": int64(c.throughput)})
+	}
+}
+
+// compressStreams checks whether new connections ask for the compression of
+// their RPC streams.
+func (c *Client) compressStreams() bool {
+	if c.streamCompression || c.compressThreshold == 0 {
+		return c.streamCompression
+	}
+	c.throughputMutex.Lock()
+	defer c.throughputMutex.Unlock()
+	return c.compressing
+}
@@ -0,0 +1,224 @@
+package betterbox
+
+import (
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// WithAppends makes the client send only the bytes appended to the files that
+// grew since they were sent, eg. logs, instead of the whole files. It assumes
+// that files that grew were only appended to: other changes keeping larger
+// files are missed. Files whose server copies diverged are sent whole again.
+// As data transforms and encryption apply to whole files, and servers may
+// diverge from each other, files are sent whole with them, and in fan-out
+// mode.
+func WithAppends() ClientOption {
+	return func(c *Client) error {
+		c.appends = true
+		return nil
+	}
+}
+
+// sentFile is a file whose content was sent to the server.
+type sentFile struct {
+	path string // Absolute path of the file.
+	size int64  // Size of the content sent.
+}
+
+// appendable checks whether the client sends the bytes appended to files.
+func (c *Client) appendable() bool {
+	return c.appends && c.transform == nil && c.aead == nil && c.serverMode != ServersFanOut
+}
+
+// recordSent records the size of the content of the file at path sent at
+// the remote path name, to send only what is appended to it later.
+func (c *Client) recordSent(path, name string, size int64) {
+	if !c.appendable() {
+		return
+	}
+	c.appendMutex.Lock()
+	defer c.appendMutex.Unlock()
+	if c.sentFiles == nil {
+		c.sentFiles = make(map[string]sentFile)
+	}
+	c.sentFiles[name] = sentFile{path: path, size: size}
+}
+
+// forgetSent forgets the files sent at or within a removed or renamed remote
+// path, which are sent whole if recreated.
+func (c *Client) forgetSent(name string) {
+	c.appendMutex.Lock()
+	defer c.appendMutex.Unlock()
+	for path := range c.sentFiles {
+		if path == name || isWithin(path, name) {
+			delete(c.sentFiles, path)
+		}
+	}
+}
+
+// appendRequest returns the Append Request of the bytes appended to the file
+// at path since it was sent, nil if it has to be sent whole.
+func (c *Client) appendRequest(path, name string) (*Request, error) {
+	if !c.appendable() {
+		return nil, nil
+	}
+	c.appendMutex.Lock()
+	sent, ok := c.sentFiles[name]
+	c.appendMutex.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	f, err := c.openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r, ok := f.(io.ReaderAt)
+	// Files that didn't grow were rewritten.
+	if !ok || info.Size() <= sent.size {
+		return nil, nil
+	}
+	data := make([]byte, info.Size()-sent.size)
+	n, err := r.ReadAt(data, sent.size)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	c.recordSent(path, name, sent.size+int64(n))
+	return &Request{Type: requestAppend, Path: name, Data: data[:n], Offset: sent.size}, nil
+}
+
+// sendAppending sends a list of Requests on a server connection as sendTracked
+// does. The files whose Appends the server rejects are sent whole instead. On
+// failure after such a rejection, none of the Requests after it are counted
+// as applied.
+func (c *Client) sendAppending(rconn *serverConn, reqs []*Request) (int, error) {
+	applied, err := c.sendTracked(rconn, reqs)
+	for pending := reqs[applied:]; err != nil; {
+		retry, ferr := c.appendFallback(pending, err)
+		if ferr != nil {
+			return applied, ferr
+		}
+		if retry == nil {
+			return applied, err
+		}
+		var n int
+		n, err = c.sendTracked(rconn, retry)
+		pending = retry[n:]
+	}
+	return len(reqs), nil
+}
+
+// appendFallback returns the Requests to send again when err is the error
+// Response of an Append of reqs, which the server rejected as its file
+// diverged, or as it doesn't support appends. The Append is replaced by a
+// Create of the whole file, and the following Appends of the file are dropped.
+// It returns nil for other errors.
+func (c *Client) appendFallback(reqs []*Request, err error) ([]*Request, error) {
+	rerr, ok := errors.Cause(err).(*RequestError)
+	if !ok || rerr.Request.Type != requestAppend || (rerr.Code() != CodeConflict && rerr.Code() != CodeUnsupported) {
+		return nil, nil
+	}
+	failed := -1
+	for i, req := range reqs {
+		if req == rerr.Request {
+			failed = i
+		}
+	}
+	c.appendMutex.Lock()
+	sent, ok := c.sentFiles[rerr.Request.Path]
+	c.appendMutex.Unlock()
+	if failed < 0 || !ok {
+		return nil, nil
+	}
+	c.logger.Log(LevelWarning, "Append rejected by server, sending whole file", Fields{"path": rerr.Request.Path, "error": rerr.Response.Message})
+	retry := append([]*Request{}, reqs[:failed]...)
+	req, err := c.newCreateRequest(sent.path, rerr.Request.Path)
+	// Removed files have their Remove Request following.
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if req != nil {
+		// Keeps the sequence numbers of resumable sendings in order.
+		req.LogSeq = rerr.Request.LogSeq
+		retry = append(retry, req)
+	}
+	for _, req := range reqs[failed+1:] {
+		if req.Type != requestAppend || req.Path != rerr.Request.Path {
+			retry = append(retry, req)
+		}
+	}
+	return retry, nil
+}
+
+// checkAppend checks that the file at path is the one an Append Request was
+// sent for, of the size it had on the client before the appended data.
+func checkAppend(req *Request, path string) (os.FileInfo, error) {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil, newCodedError(CodeConflict, "%s: Missing file to append to", req.Path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, newCodedError(CodeConflict, "%s: Not a regular file", req.Path)
+	}
+	if info.Size() != req.Offset {
+		return nil, newCodedError(CodeConflict, "%s: Size is %d, instead of %d", req.Path, info.Size(), req.Offset)
+	}
+	return info, nil
+}
+
+// appendFile appends the data of an Append Request to the file at path.
+func (sv *Server) appendFile(req *Request, path string) error {
+	if _, err := checkAppend(req, path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(req.Data)
+	if err == nil && sv.fsync {
+		err = syncFile(f)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// appendFile stages a copy of the file at path with the data of an Append
+// Request appended, which then replaces the file.
+func (tx *transaction) appendFile(req *Request, path string) error {
+	info, err := checkAppend(req, path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	staged, err := tx.stage(append(data, req.Data...))
+	if err == nil {
+		err = os.Chmod(staged, info.Mode().Perm())
+	}
+	if err != nil {
+		return err
+	}
+	// Appended files aren't versioned, as outside of transactions.
+	_, versioned := tx.asides[path]
+	if err := tx.create(staged, path); err != nil {
+		return err
+	}
+	if !versioned {
+		delete(tx.asides, path)
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package betterbox
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// WithAppliedLog makes the server persist, in dir, the sequence number of the
+// last Request applied for each client with resumable sendings, which the
+// clients query with LastApplied on reconnection. Clients are identified by
+// the common name of their certificate, or by the ID they send on handshake
+// without one. That ID isn't authenticated, so that a client may use another's
+// to have it skip Requests on its next connection: require client
+// certificates, with WithClientCAs, unless all the clients are trusted.
+func WithAppliedLog(dir string) ServerOption {
+	return func(sv *Server) error {
+		if err := os.MkdirAll(dir, 0700|os.ModeDir); err != nil {
+			return errors.Wrapf(err, "Invalid applied log directory: %s", dir)
+		}
+		sv.appliedLog = &appliedLog{dir: dir, seqs: make(map[string]uint64), records: make(map[string]int)}
+		return nil
+	}
+}
+
+// WithResumableSends makes the client number its Requests, and ask the server
+// on each connection for the last of them it applied, so that the Requests
+// whose sending was interrupted are sent again only if they weren't applied,
+// eg. when the connection broke before their Response. The servers need an
+// applied log, and identify the client by clientID, unless it has a
+// certificate. Fan-out mode isn't supported.
+func WithResumableSends(clientID string) ClientOption {
+	return func(c *Client) error {
+		if !validClientName(clientID) {
+			return fmt.Errorf("Invalid client ID: %s", clientID)
+		}
+		c.clientID = clientID
+		return nil
+	}
+}
+
+// validClientName checks that a client's name is usable as a file name.
+func validClientName(name string) bool {
+	return name != "" && name != "." && name != ".." && name != stagingDirName && !strings.ContainsAny(name, `/\`)
+}
+
+// maxAppliedRecords is the number of records appended to a client's applied
+// log file before it is rewritten with only the last one.
+const maxAppliedRecords = 1000
+
+// appliedLog persists the sequence number of the last Request applied for each
+// client, one file per client, to which they are appended one per line.
+type appliedLog struct {
+	dir     string
+	mutex   sync.Mutex        // Protects seqs, records, and the writing of the files.
+	seqs    map[string]uint64 // Sequence numbers read or written, by client.
+	records map[string]int    // Number of records in the files, by client.
+}
+
+// last returns the sequence number of the last Request applied for client, 0 if
+// none.
+func (l *appliedLog) last(client string) (uint64, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.load(client)
+}
+
+// load returns the sequence number of the last Request applied for client,
+// reading it on first use.
+func (l *appliedLog) load(client string) (uint64, error) {
+	if seq, ok := l.seqs[client]; ok {
+		return seq, nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(l.dir, client))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	l.records[client] = bytes.Count(data, []byte("\n"))
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		// A record was partially appended: rewrite the file on the next one.
+		l.records[client] = maxAppliedRecords
+		data = data[:bytes.LastIndexByte(data, '\n')+1]
+	}
+	var seq uint64
+	if lines := strings.Fields(string(data)); len(lines) > 0 {
+		if seq, err = strconv.ParseUint(lines[len(lines)-1], 10, 64); err != nil {
+			return 0, fmt.Errorf("Corrupted applied log of client '%s': %v", client, err)
+		}
+	}
+	l.seqs[client] = seq
+	return seq, nil
+}
+
+// record durably records that the Request numbered seq was applied for client,
+// unless a later one was, with a single fsync.
+func (l *appliedLog) record(client string, seq uint64) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	last, err := l.load(client)
+	if err != nil || seq <= last {
+		return err
+	}
+	path := filepath.Join(l.dir, client)
+	data := []byte(strconv.FormatUint(seq, 10) + "\n")
+	if l.records[client] >= maxAppliedRecords {
+		err = writeFileAtomic(path, data, 0600, true)
+		l.records[client] = 0
+	} else {
+		err = appendFileSynced(path, data)
+	}
+	if err != nil {
+		return err
+	}
+	l.records[client]++
+	l.seqs[client] = seq
+	return nil
+}
+
+// appendFileSynced appends data to the file at path, creating it if needed, and
+// syncs it.
+func appendFileSynced(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = syncFile(f)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// peerName returns the common name of the certificate of the client on conn, ""
+// if it has none.
+func peerName(conn net.Conn) string {
+	if ic, ok := conn.(*idleConn); ok {
+		conn = ic.Conn
+	}
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	return certs[0].Subject.CommonName
+}
+
+// recordApplied records the last of the applied Requests with a sequence
+// number in the server's applied log, if enabled, once for all of them.
+func (s *session) recordApplied(reqs []*Request, resps []Response) {
+	var seq uint64
+	for i, req := range reqs {
+		if i < len(resps) && resps[i].Type == responseOk && req.LogSeq > seq {
+			seq = req.LogSeq
+		}
+	}
+	s.mutex.Lock()
+	client := s.clientID
+	s.mutex.Unlock()
+	if s.appliedLog == nil || seq == 0 || client == "" {
+		return
+	}
+	if err := s.appliedLog.record(client, seq); err != nil {
+		s.logger.Log(LevelError, "Recording applied request failed", Fields{"client": client, "seq": seq, "error": err})
+	}
+}
+
+// LastApplied returns the sequence number of the last Request applied for the
+// session's client, which has to be the requested one unless identified by its
+// certificate.
+func (s *session) LastApplied(req *LastAppliedRequest, resp *LastAppliedResponse) error {
+	if s.appliedLog == nil {
+		return fmt.Errorf("Applied log disabled")
+	}
+	s.mutex.Lock()
+	client := s.clientID
+	s.mutex.Unlock()
+	if client == "" || (req.ClientID != client && peerName(s.conn) == "") {
+		return fmt.Errorf("Client '%s' not identified by the session", req.ClientID)
+	}
+	seq, err := s.appliedLog.last(client)
+	if err != nil {
+		return err
+	}
+	resp.Seq = seq
+	return nil
+}
+
+// queryLastApplied asks the server for the last of the client's Requests it
+// applied.
+func (sc *serverConn) queryLastApplied(clientID string) error {
+	var resp LastAppliedResponse
+	if err := sc.Call("Server.LastApplied", &LastAppliedRequest{ClientID: clientID}, &resp); err != nil {
+		return err
+	}
+	sc.lastApplied = resp.Seq
+	return nil
+}
+
+// skipApplied returns the number of Requests at the start of reqs that the
+// server already applied, as their sequence numbers show, and numbers the
+// following ones that don't have one yet. Chunks are never numbered, as they
+// are sent in parallel over other connections.
+func (c *Client) skipApplied(rconn *serverConn, reqs []*Request) int {
+	if c.clientID == "" {
+		return 0
+	}
+	skipped := 0
+	for skipped < len(reqs) && reqs[skipped].LogSeq != 0 && reqs[skipped].LogSeq <= rconn.lastApplied {
+		skipped++
+	}
+	c.logMutex.Lock()
+	defer c.logMutex.Unlock()
+	if c.logSeq < rconn.lastApplied {
+		c.logSeq = rconn.lastApplied
+	}
+	for _, req := range reqs[skipped:] {
+		if req.LogSeq == 0 && req.Type != requestWriteAt {
+			c.logSeq++
+			req.LogSeq = c.logSeq
+		}
+	}
+	if skipped > 0 {
+		c.logger.Log(LevelInfo, "Skipping requests already applied", Fields{"requests": skipped, "last": rconn.lastApplied})
+	}
+	return skipped
+}
+
+// LastApplied returns the sequence number of the last of the client's Requests
+// applied by the server, with resumable sendings.
+func (c *Client) LastApplied() (uint64, error) {
+	if c.clientID == "" {
+		return 0, fmt.Errorf("Resumable sendings disabled")
+	}
+	rconn, err := c.serverConnect()
+	if err != nil {
+		return 0, errors.Wrap(err, "Connection to server failed")
+	}
+	defer rconn.Close()
+	return rconn.lastApplied, nil
+}
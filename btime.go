@@ -0,0 +1,39 @@
+package betterbox
+
+import "errors"
+
+// WithPreserveBtime sends the birth times of the files and directories, on
+// platforms and filesystems tracking them, for servers preserving birth times
+// to apply them.
+func WithPreserveBtime() ClientOption {
+	return func(c *Client) error {
+		c.preserveBtime = true
+		return nil
+	}
+}
+
+// WithServerPreserveBtime applies the birth times sent by clients preserving
+// birth times to the created files and directories, on platforms where they
+// can be set (macOS and Windows). They are skipped elsewhere, eg. on Linux.
+func WithServerPreserveBtime() ServerOption {
+	return func(sv *Server) error {
+		sv.preserveBtime = true
+		return nil
+	}
+}
+
+// errBtimeUnsupported is returned when setting birth times is unsupported on
+// the platform.
+var errBtimeUnsupported = errors.New("Setting birth times unsupported on this platform")
+
+// applyBtime applies the birth time of a Request to the file or directory it
+// created, if birth times are preserved and the platform supports it.
+func (sv *Server) applyBtime(req *Request, path string) error {
+	if !sv.preserveBtime || req.Btime.IsZero() {
+		return nil
+	}
+	if err := setBirthTime(path, req.Btime); err != errBtimeUnsupported {
+		return err
+	}
+	return nil
+}
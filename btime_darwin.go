@@ -0,0 +1,55 @@
+//go:build darwin
+// +build darwin
+
+package betterbox
+
+import (
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// birthTime returns the birth time of the file or directory at path, with its
+// info.
+func birthTime(path string, info os.FileInfo) (time.Time, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(st.Birthtimespec.Sec, st.Birthtimespec.Nsec), true
+}
+
+// attrList is the attribute list of setattrlist(2).
+type attrList struct {
+	bitmapCount uint16
+	_           uint16
+	commonAttr  uint32
+	volAttr     uint32
+	dirAttr     uint32
+	fileAttr    uint32
+	forkAttr    uint32
+}
+
+const (
+	attrBitMapCount = 5
+	attrCmnCrtime   = 0x200
+	fsoptNofollow   = 0x1
+)
+
+// setBirthTime sets the birth time of the file or directory at path, with
+// setattrlist(2). Symbolic links aren't followed.
+func setBirthTime(path string, btime time.Time) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	list := attrList{bitmapCount: attrBitMapCount, commonAttr: attrCmnCrtime}
+	ts := syscall.NsecToTimespec(btime.UnixNano())
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETATTRLIST, uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&list)), uintptr(unsafe.Pointer(&ts)), unsafe.Sizeof(ts), fsoptNofollow, 0)
+	if errno != 0 {
+		return &os.PathError{Op: "setattrlist", Path: path, Err: errno}
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+//go:build linux
+// +build linux
+
+package betterbox
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+	"syscall"
+	"time"
+)
+
+// birthTime returns the birth time of the file or directory at path, with its
+// info, if its filesystem tracks it.
+func birthTime(path string, info os.FileInfo) (time.Time, bool) {
+	// Only the OS filesystem's entries have birth times.
+	if _, ok := info.Sys().(*syscall.Stat_t); !ok {
+		return time.Time{}, false
+	}
+	var stx unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, path, 0, unix.STATX_BTIME, &stx); err != nil {
+		return time.Time{}, false
+	}
+	// Some filesystems report zero birth times for the entries created before
+	// they tracked them.
+	if stx.Mask&unix.STATX_BTIME == 0 || (stx.Btime.Sec == 0 && stx.Btime.Nsec == 0) {
+		return time.Time{}, false
+	}
+	return time.Unix(stx.Btime.Sec, int64(stx.Btime.Nsec)), true
+}
+
+// setBirthTime sets the birth time of the file or directory at path, which
+// Linux doesn't support.
+func setBirthTime(path string, btime time.Time) error {
+	return errBtimeUnsupported
+}
@@ -0,0 +1,21 @@
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package betterbox
+
+import (
+	"os"
+	"time"
+)
+
+// birthTime returns the birth time of the file or directory at path, which
+// isn't known on this platform.
+func birthTime(path string, info os.FileInfo) (time.Time, bool) {
+	return time.Time{}, false
+}
+
+// setBirthTime sets the birth time of the file or directory at path, which
+// this platform doesn't support.
+func setBirthTime(path string, btime time.Time) error {
+	return errBtimeUnsupported
+}
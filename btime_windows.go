@@ -0,0 +1,41 @@
+//go:build windows
+// +build windows
+
+package betterbox
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// birthTime returns the creation time of the file or directory at path, with
+// its info.
+func birthTime(path string, info os.FileInfo) (time.Time, bool) {
+	data, ok := info.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, data.CreationTime.Nanoseconds()), true
+}
+
+// setBirthTime sets the creation time of the file or directory at path.
+// Symbolic links aren't followed.
+func setBirthTime(path string, btime time.Time) error {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	// Directories are only opened with backup semantics.
+	h, err := syscall.CreateFile(p, syscall.FILE_WRITE_ATTRIBUTES, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE,
+		nil, syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS|syscall.FILE_FLAG_OPEN_REPARSE_POINT, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	defer syscall.CloseHandle(h)
+	ctime := syscall.NsecToFiletime(btime.UnixNano())
+	if err := syscall.SetFileTime(h, &ctime, nil, nil); err != nil {
+		return &os.PathError{Op: "setfiletime", Path: path, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+package betterbox
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// uploadsDirName is the directory, within the staging directory, where the
+// chunks of files sent in parallel are written until their upload is
+// finalized.
+const uploadsDirName = "uploads"
+
+// rangesSuffix is appended to the path of an upload for the file recording
+// the offsets and lengths of the chunks written, as pairs of big-endian 64-bit
+// integers.
+const rangesSuffix = ".ranges"
+
+// WithParallelChunks sends the files larger than chunkSize in chunks of that
+// size when syncing, up to connections of them at once, each over its own
+// connection to the server. As data transforms and encryption apply to whole
+// files, files are sent whole with them, as they are to multiple servers and
+// over a connection provided to NewClientWithConn.
+func WithParallelChunks(connections int, chunkSize int64) ClientOption {
+	return func(c *Client) error {
+		if connections < 1 {
+			return fmt.Errorf("Invalid number of connections: %d", connections)
+		}
+		if chunkSize <= 0 {
+			return fmt.Errorf("Invalid chunk size: %d", chunkSize)
+		}
+		c.chunkConns = connections
+		c.chunkSize = chunkSize
+		return nil
+	}
+}
+
+// chunked checks whether a file is sent in parallel chunks.
+func (c *Client) chunked(info os.FileInfo) bool {
+	return c.chunkConns > 0 && info.Size() > c.chunkSize && len(c.servers) == 1 &&
+		c.transform == nil && c.aead == nil && c.conn == nil
+}
+
+// sendChunks sends the file at path in chunks, over parallel connections, then
+// finalizes its upload once all of them are written by the server. The file is
+// sent whole to servers that don't support chunks.
+func (c *Client) sendChunks(path, relPath string, size int64) error {
+	if skip, err := c.oversized(relPath, size); err != nil || skip {
+		return err
+	}
+	err := c.sendChunksParallel(path, relPath, size)
+	if rerr, ok := errors.Cause(err).(*RequestError); ok && rerr.Code() == CodeUnsupported {
+		c.logger.Log(LevelWarning, "Chunks unsupported by server, sending whole file", Fields{"path": relPath})
+		req, err := c.newCreateRequest(path, relPath)
+		if err != nil || req == nil {
+			return err
+		}
+		return c.sendRequests([]*Request{req})
+	}
+	return err
+}
+
+// sendChunksParallel sends the file at path in chunks, as sendChunks does.
+func (c *Client) sendChunksParallel(path, relPath string, size int64) error {
+	f, err := c.openFile(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, ok := f.(io.ReaderAt)
+	if !ok {
+		return fmt.Errorf("%s: File can't be read in chunks", path)
+	}
+	offsets := make(chan int64, (size+c.chunkSize-1)/c.chunkSize)
+	for offset := int64(0); offset < size; offset += c.chunkSize {
+		offsets <- offset
+	}
+	close(offsets)
+	errc := make(chan error, c.chunkConns)
+	for i := 0; i < c.chunkConns; i++ {
+		go func() { errc <- c.sendChunksOn(r, relPath, size, offsets) }()
+	}
+	for i := 0; i < c.chunkConns; i++ {
+		if e := <-errc; e != nil && err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Sending chunks of '%s' failed", relPath)
+	}
+	req, err := c.setMode(&Request{Type: requestFinalize, Path: relPath, Size: size}, path)
+	if err != nil {
+		return err
+	}
+	return c.sendRequests([]*Request{req})
+}
+
+// sendChunksOn sends chunks of a file, at the received offsets, over its own
+// connection to the server.
+func (c *Client) sendChunksOn(r io.ReaderAt, relPath string, size int64, offsets <-chan int64) error {
+	rconn, err := c.dial(c.server)
+	if err != nil {
+		return errors.Wrapf(err, "Connection to server '%s' failed", c.server)
+	}
+	defer rconn.Close()
+	buf := make([]byte, c.chunkSize)
+	for offset := range offsets {
+		n, err := r.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		req := &Request{Type: requestWriteAt, Path: relPath, Data: buf[:n], Offset: offset, Size: size}
+		if _, err := c.sendOn(rconn, []*Request{req}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadPath returns the path where the chunks of the file at path, relative
+// to the destination, are written.
+func (sv *Server) uploadPath(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return filepath.Join(sv.path, stagingDirName, uploadsDirName, hex.EncodeToString(sum[:]))
+}
+
+// writeChunk writes a chunk of a file being uploaded, at its offset. Chunks may
+// be received in any order, the file being created with its full size by the
+// first of them. Their ranges are recorded once written, for the upload to be
+// finalized only when complete.
+func (sv *Server) writeChunk(req *Request) error {
+	path := sv.uploadPath(req.Path)
+	// The staging directory is shared with transactions.
+	sv.txMutex.Lock()
+	f, err := openUpload(path, req.Size)
+	sv.txMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(req.Data, req.Offset); err != nil {
+		f.Close()
+		return err
+	}
+	if sv.fsync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return sv.recordChunk(path, req.Offset, int64(len(req.Data)))
+}
+
+// recordChunk appends the range of a written chunk to the ranges of an upload.
+func (sv *Server) recordChunk(path string, offset, length int64) error {
+	f, err := os.OpenFile(path+rangesSuffix, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	var record [16]byte
+	binary.BigEndian.PutUint64(record[:8], uint64(offset))
+	binary.BigEndian.PutUint64(record[8:], uint64(length))
+	// Appends this small are atomic, so chunks may be recorded concurrently.
+	if _, err := f.Write(record[:]); err != nil {
+		f.Close()
+		return err
+	}
+	if sv.fsync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// openUpload opens the file of an upload, creating it with its full size if
+// needed. The ranges of a file created or resized are reset.
+func openUpload(path string, size int64) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700|os.ModeDir); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err == nil && info.Size() != size {
+		if err = os.Remove(path + rangesSuffix); os.IsNotExist(err) {
+			err = nil
+		}
+		if err == nil {
+			err = f.Truncate(size)
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// missingChunk returns the offset of the first byte of an upload of size bytes
+// that no recorded chunk covers, or size if they cover all of them.
+func missingChunk(path string, size int64) (int64, error) {
+	data, err := ioutil.ReadFile(path + rangesSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	type chunk struct{ offset, end int64 }
+	chunks := make([]chunk, 0, len(data)/16)
+	for ; len(data) >= 16; data = data[16:] {
+		offset := int64(binary.BigEndian.Uint64(data[:8]))
+		chunks = append(chunks, chunk{offset, offset + int64(binary.BigEndian.Uint64(data[8:16]))})
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].offset < chunks[j].offset })
+	covered := int64(0)
+	for _, c := range chunks {
+		if c.offset > covered {
+			break
+		}
+		if c.end > covered {
+			covered = c.end
+		}
+	}
+	if covered > size {
+		covered = size
+	}
+	return covered, nil
+}
+
+// finalizeUpload moves a file whose chunks were all written into place,
+// replacing any existing file. Its directory is synced, or collected in syncs
+// if not nil.
+func (sv *Server) finalizeUpload(req *Request, path string, syncs dirSyncs) error {
+	staged := sv.uploadPath(req.Path)
+	info, err := os.Stat(staged)
+	if err != nil {
+		return err
+	}
+	if info.Size() != req.Size {
+		return fmt.Errorf("Incomplete upload of '%s': %d of %d bytes", req.Path, info.Size(), req.Size)
+	}
+	if missing, err := missingChunk(staged, req.Size); err != nil {
+		return err
+	} else if missing < req.Size {
+		return fmt.Errorf("Incomplete upload of '%s': missing chunk at offset %d", req.Path, missing)
+	}
+	if info, err := os.Lstat(path); err == nil && info.IsDir() {
+		return fmt.Errorf("%s: Is a directory", path)
+	}
+	if err := moveFile(staged, path); err != nil {
+		return err
+	}
+	// Remove the directories of the uploads, unless they are still in use.
+	sv.txMutex.Lock()
+	os.Remove(staged + rangesSuffix)
+	if os.Remove(filepath.Dir(staged)) == nil {
+		os.Remove(filepath.Dir(filepath.Dir(staged)))
+	}
+	sv.txMutex.Unlock()
+	if sv.fsyncDir {
+		return syncs.sync(filepath.Dir(path))
+	}
+	return nil
+}
@@ -1,17 +1,23 @@
 package betterbox
 
 import (
+	"crypto/cipher"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"github.com/fsnotify/fsnotify"
 	"github.com/pkg/errors"
+	"io"
+	"io/fs"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/rpc"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -19,16 +25,592 @@ const (
 	// Max number of requests (file/dir creations/modifications/deletions)
 	// to buffer before sending them to server.
 	requestsBufferSize = 100
-	// Max time of requests buffering before sending them to server.
-	requestsWaitTime = 5 * time.Second
+)
+
+// Max time of requests buffering before sending them to server.
+var requestsWaitTime = 5 * time.Second
+
+// PausePolicy defines what happens to the filesystem events that occur while
+// the client's monitoring is paused.
+type PausePolicy int
+
+const (
+	// PauseBuffer keeps buffering the events while paused, and sends them
+	// to the server on resume.
+	PauseBuffer PausePolicy = iota
+	// PauseDiscard drops the events that occur while paused.
+	PauseDiscard
 )
 
 type Client struct {
 	path    string            // Path of directory to sync and monitor.
+	file    string            // Name of the only file synced in path, if any.
 	server  string            // Server's address:port
 	watcher *fsnotify.Watcher // Watcher for filsystem events.
 	config  *tls.Config       // TLS config.
-	// XXX Add custom logger
+	prefix  string            // Prefix prepended to every Request's Path.
+	batch   bool              // Send buffered requests in a single call.
+	// Connects to the servers instead of TLS, if not nil.
+	dialer func(server string) (net.Conn, error)
+	// Connection to the server provided to NewClientWithConn, used instead
+	// of connecting, if not nil.
+	conn *serverConn
+	// Directories watched by watcher. Only used by the monitoring goroutine.
+	watched map[string]bool
+	// All the servers' address:port, starting with server.
+	servers    []string
+	serverMode ServerMode // How requests are sent to multiple servers.
+	// Index in servers of the server to connect to first, in failover mode.
+	preferred int
+	// Retries of the first connection to the servers, and delay before the
+	// first of them, doubled for each of the following ones.
+	connectRetries int
+	connectBackoff time.Duration
+	// Whether a connection to the servers already succeeded.
+	connected bool
+	// Max cumulative size of the buffered requests' data, 0 for no limit.
+	bufferBytes int64
+	// Kinds of filesystem events that are sent to the server.
+	eventMask fsnotify.Op
+	// What SyncAndMonitor sends before monitoring.
+	initialSync InitialSyncMode
+	// Transforms the files' content before sending it.
+	transform DataTransform
+	// Log of the pending changes, surviving restarts. nil if disabled.
+	queue *pendingQueue
+	// Encrypts the files' content before sending it. nil if disabled.
+	aead cipher.AEAD
+	// Send the files' and directories' modes.
+	preserveMode bool
+	// Send the files' and directories' birth times.
+	preserveBtime bool
+	// Send the files' and directories' access ACLs.
+	preserveACLs bool
+	// Ask the servers to compress the RPC streams.
+	streamCompression bool
+	// Throughput of the links, in bytes per second, below which the RPC
+	// streams are compressed, if not 0.
+	compressThreshold int64
+	throughputMutex   sync.Mutex // Protects throughput and compressing.
+	// Measured throughput of the links, 0 until measured, and whether it is
+	// below compressThreshold.
+	throughput  float64
+	compressing bool
+	// Send the mode changes of the monitored files and directories.
+	syncChmod bool
+	// Send the special files to recreate, instead of skipping them.
+	syncSpecial bool
+	// Capacity of the queue of buffers of requests waiting to be sent.
+	sendQueue int
+	// Remove the server's entries missing locally on Reconcile.
+	deleteExcess bool
+	// Patterns of the server's entries never removed on Reconcile.
+	protectedPaths []string
+	// How Reconcile decides that the server's files are up to date.
+	skipPolicy SkipPolicy
+	// Interval of the reconciliations while monitoring, if not 0.
+	reconcileInterval time.Duration
+	// How long SyncAndMonitor monitors for, if not 0, and when it stops
+	// monitoring then. Only used by the monitoring goroutine.
+	monitorDuration time.Duration
+	monitorEnd      time.Time
+	// Filesystem of the files to sync, the client's directory by default.
+	fsys fs.FS
+	// Cache of the files' content hashes, nil if disabled.
+	hashCache *hashCache
+	// Algorithm of the content hashes compared with the server's.
+	hashAlgorithm HashAlgorithm
+	// Recreate the client's directory itself on the server, under its name.
+	includeRootDir bool
+	// Resolve the symlinks of the client's directory's path.
+	resolveRoot bool
+	// Skip the files exceeding the server's maximum file size, learnt on
+	// handshake, if known.
+	skipOversized bool
+	limitsMutex   sync.Mutex // Protects maxFileSize and limitsKnown.
+	maxFileSize   int64
+	limitsKnown   bool
+	// Carry on sending after the Requests the server fails to apply, up to
+	// maxErrors failures if not 0.
+	continueOnError bool
+	maxErrors       int
+	failedMutex     sync.Mutex // Protects failed.
+	// Requests that failed since the sync started, nil if none.
+	failed    *FailedRequestsError
+	treeMutex sync.Mutex // Protects treeCache.
+	// Hashes of the client's entries, kept while monitoring with filesystem
+	// events, nil otherwise.
+	treeCache *treeCache
+	// Directory of the run's snapshot on the server, prepended to the remote
+	// prefix, if not "".
+	snapshotPrefix string
+	// Depth of the deepest synced entries, relative to the client's
+	// directory, if not 0.
+	maxDepth int
+	// Extensions of the only synced files, with their dot, if any.
+	extensions []string
+	// Time Close waits for the requests being sent, before cancelling them.
+	closeTimeout time.Duration
+	// Number of parallel connections for sending large files in chunks, 0 to
+	// send them whole.
+	chunkConns int
+	// Size of the chunks of large files, which are files larger than it.
+	chunkSize int64
+	// Sync without monitoring when the watcher can't be created.
+	watcherFallback bool
+	// Interval of the reconciliations replacing monitoring, if not 0.
+	pollInterval time.Duration
+	// Send only the bytes appended to the files that grew.
+	appends bool
+	// Skip the files newer on the server on Sync.
+	refuseNewer bool
+	// Priority of the requests, sent in decreasing order, if not nil.
+	priority PriorityFunc
+	// ID of the client in the servers' applied logs, for resumable
+	// sendings, if not "", and sequence number of its last numbered
+	// Request.
+	clientID string
+	logMutex sync.Mutex // Protects logSeq.
+	logSeq   uint64
+
+	// Drop the events' requests sending again what the initial sync sent.
+	initialCoalescing bool
+
+	initialMutex     sync.Mutex                   // Protects initialSent and recordingInitial.
+	initialSent      map[string][sha256.Size]byte // Digests of the initial sync's requests, by path.
+	recordingInitial bool                         // Whether the initial sync is running.
+
+	appendMutex sync.Mutex          // Protects sentFiles.
+	sentFiles   map[string]sentFile // Files sent, by remote path, for appends.
+
+	closeMutex  sync.Mutex    // Protects stopped and sendingConn.
+	closeOnce   sync.Once     // Closes closing once.
+	closing     chan struct{} // Closed by Close, to stop the sending.
+	stopped     chan struct{} // Closed once SyncAndMonitor returns, if running.
+	sendingConn *serverConn   // Connection of the requests being sent.
+
+	statsMutex sync.Mutex                // Protects stats, latencies and result.
+	stats      Stats                     // Transfer counters.
+	latencies  map[string]*latencyRecord // Latencies of the calls, by key.
+	result     *SyncResult               // Result of the running sync, if any.
+
+	pauseMutex  sync.Mutex    // Protects paused.
+	paused      bool          // Whether sending to the server is suspended.
+	pausePolicy PausePolicy   // Handling of events while paused.
+	resumed     chan struct{} // Signals watcherLoop to flush on resume.
+
+	logger Logger // Logger of the client's events.
+}
+
+// ClientOption configures optional Client settings in NewClient.
+type ClientOption func(*Client) error
+
+// WithRemotePrefix prepends prefix to the path of every request sent to the
+// server, so that the client's directory is synchronized into a subtree of the
+// server's destination.
+func WithRemotePrefix(prefix string) ClientOption {
+	return func(c *Client) error {
+		prefix = filepath.Clean(prefix)
+		if filepath.IsAbs(prefix) || !isLocalPath(prefix) {
+			return fmt.Errorf("%s: Remote prefix not a relative path within destination", prefix)
+		}
+		if prefix == "." {
+			prefix = ""
+		}
+		c.prefix = prefix
+		return nil
+	}
+}
+
+// WithSnapshotPrefix prepends prefix, eg. the run's timestamp, to the path of
+// every request sent to the server, before any remote prefix, so that each run
+// of the client keeps its own point-in-time copy of the client's directory in
+// the server's destination.
+func WithSnapshotPrefix(prefix string) ClientOption {
+	return func(c *Client) error {
+		prefix = filepath.Clean(prefix)
+		if filepath.IsAbs(prefix) || !isLocalPath(prefix) || prefix == "." {
+			return fmt.Errorf("%s: Snapshot prefix not a relative path within destination", prefix)
+		}
+		c.snapshotPrefix = prefix
+		return nil
+	}
+}
+
+// WithConnectRetry makes the client retry its first connection to the servers
+// up to attempts times before giving up, eg. when started before them. It waits
+// for backoff before the first retry, doubling it for each of the following
+// ones. Later connections aren't retried.
+func WithConnectRetry(attempts int, backoff time.Duration) ClientOption {
+	return func(c *Client) error {
+		if attempts < 0 {
+			return fmt.Errorf("Invalid number of connection attempts: %d", attempts)
+		}
+		if backoff <= 0 {
+			return fmt.Errorf("Invalid connection backoff: %s", backoff)
+		}
+		c.connectRetries = attempts
+		c.connectBackoff = backoff
+		return nil
+	}
+}
+
+// WithWatcherFallback makes SyncAndMonitor log a warning, instead of failing,
+// when the directory's watcher can't be created, eg. on unsupported platforms.
+// The initial sync is still done, and followed by reconciliations every
+// pollInterval until the client is closed, unless pollInterval is 0.
+func WithWatcherFallback(pollInterval time.Duration) ClientOption {
+	return func(c *Client) error {
+		if pollInterval < 0 {
+			return fmt.Errorf("Invalid poll interval: %s", pollInterval)
+		}
+		c.watcherFallback = true
+		c.pollInterval = pollInterval
+		return nil
+	}
+}
+
+// WithCloseTimeout sets how long Close waits for the requests being sent to be
+// applied by the server, before cancelling them. Defaults to 10 seconds.
+func WithCloseTimeout(d time.Duration) ClientOption {
+	return func(c *Client) error {
+		if d <= 0 {
+			return fmt.Errorf("Invalid close timeout: %s", d)
+		}
+		c.closeTimeout = d
+		return nil
+	}
+}
+
+// WithIncludeRootDir synchronizes the client's directory itself, instead of
+// only its contents, by prefixing every request's path with the directory's
+// name. eg. a client of /home/me/project sends its file "notes" as
+// "project/notes". The name comes after any remote prefix.
+func WithIncludeRootDir() ClientOption {
+	return func(c *Client) error {
+		c.includeRootDir = true
+		return nil
+	}
+}
+
+// WithResolvedRoot makes the client resolve the symlinks of its directory's
+// path, eg. a directory that is itself a symlink, and work with the real path,
+// which the watched directories and the paths of their events then agree on.
+// The name of the directory included with WithIncludeRootDir is the real one.
+// A single file's link isn't resolved, only its parent directory.
+func WithResolvedRoot() ClientOption {
+	return func(c *Client) error {
+		c.resolveRoot = true
+		return nil
+	}
+}
+
+// WithMaxDepth makes the client sync and monitor the entries up to depth levels
+// deep only. Entries of the client's directory are 1 level deep, the entries of
+// its subdirectories 2 levels deep, and so on. Deeper entries are skipped.
+func WithMaxDepth(depth int) ClientOption {
+	return func(c *Client) error {
+		if depth <= 0 {
+			return fmt.Errorf("Invalid maximum depth: %d", depth)
+		}
+		c.maxDepth = depth
+		return nil
+	}
+}
+
+// WithIncludeExtensions makes the client sync and monitor only the files with
+// one of extensions, as in ".md" or "md". Directories are always synced, and
+// walked through. Symbolic links and special files are considered files.
+func WithIncludeExtensions(extensions ...string) ClientOption {
+	return func(c *Client) error {
+		for _, ext := range extensions {
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			if ext == "." || strings.ContainsAny(ext, `/\`) {
+				return fmt.Errorf("Invalid file extension: '%s'", ext)
+			}
+			c.extensions = append(c.extensions, ext)
+		}
+		return nil
+	}
+}
+
+// WithBatchRequests makes the client send all the buffered requests to the
+// server in a single BatchApplyRequest call, instead of one call per request.
+func WithBatchRequests() ClientOption {
+	return func(c *Client) error {
+		c.batch = true
+		return nil
+	}
+}
+
+// WithPausePolicy sets how the events occurring while the client is paused
+// are handled. Defaults to PauseBuffer.
+func WithPausePolicy(policy PausePolicy) ClientOption {
+	return func(c *Client) error {
+		if policy != PauseBuffer && policy != PauseDiscard {
+			return fmt.Errorf("Unknown pause policy: %d", policy)
+		}
+		c.pausePolicy = policy
+		return nil
+	}
+}
+
+// WithBufferBytes limits the cumulative size of the buffered requests' file
+// contents. Buffered requests are sent once it is exceeded, even if there are
+// fewer than requestsBufferSize of them.
+func WithBufferBytes(size int64) ClientOption {
+	return func(c *Client) error {
+		if size <= 0 {
+			return fmt.Errorf("Invalid buffer size: %d", size)
+		}
+		c.bufferBytes = size
+		return nil
+	}
+}
+
+// allEvents is the mask of all the kinds of filesystem events.
+const allEvents = fsnotify.Create | fsnotify.Write | fsnotify.Remove | fsnotify.Rename | fsnotify.Chmod
+
+// WithEventMask selects the kinds of filesystem events (fsnotify.Create,
+// fsnotify.Write, fsnotify.Remove, fsnotify.Rename) that are sent to the server
+// while monitoring. eg. without fsnotify.Remove and fsnotify.Rename, files are
+// never removed from the server. New directories are watched regardless.
+func WithEventMask(mask fsnotify.Op) ClientOption {
+	return func(c *Client) error {
+		if mask&^allEvents != 0 {
+			return fmt.Errorf("Erroneous event mask value: %d", mask)
+		}
+		c.eventMask = mask
+		return nil
+	}
+}
+
+// InitialSyncMode defines what SyncAndMonitor sends to the server before
+// monitoring the client's directory.
+type InitialSyncMode int
+
+const (
+	// InitialSyncFull sends all the files and directories.
+	InitialSyncFull InitialSyncMode = iota
+	// InitialSyncNone sends nothing, only the changes while monitoring.
+	InitialSyncNone
+	// InitialSyncReconcile sends the files and directories that are
+	// missing or different on the server, as Reconcile does.
+	InitialSyncReconcile
+)
+
+func (mode InitialSyncMode) String() string {
+	switch mode {
+	case InitialSyncFull:
+		return "full"
+	case InitialSyncNone:
+		return "none"
+	case InitialSyncReconcile:
+		return "reconcile"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(mode))
+	}
+}
+
+// WithInitialSync sets what SyncAndMonitor sends to the server before
+// monitoring. Defaults to InitialSyncFull.
+func WithInitialSync(mode InitialSyncMode) ClientOption {
+	return func(c *Client) error {
+		if mode < InitialSyncFull || mode > InitialSyncReconcile {
+			return fmt.Errorf("Unknown initial sync mode: %d", mode)
+		}
+		c.initialSync = mode
+		return nil
+	}
+}
+
+// DataTransform transforms a file's content before it is sent to the server,
+// given the file's path relative to the client's directory.
+type DataTransform func(relPath string, data []byte) ([]byte, error)
+
+// WithDataTransform sets a transform applied to the files' content before they
+// are sent to the server, eg. to redact secrets. Files for which the transform
+// fails are skipped, with a warning.
+func WithDataTransform(transform DataTransform) ClientOption {
+	return func(c *Client) error {
+		c.transform = transform
+		return nil
+	}
+}
+
+// WithDialer makes the client connect to its servers (as address:port) with
+// dial, instead of over TLS, eg. to servers listening on an in-memory pipe with
+// WithListener in tests. The client's TLS configuration isn't needed then.
+func WithDialer(dial func(server string) (net.Conn, error)) ClientOption {
+	return func(c *Client) error {
+		c.dialer = dial
+		return nil
+	}
+}
+
+// ServerMode defines how a client with multiple servers sends its requests.
+type ServerMode int
+
+const (
+	// ServersFailover sends requests to the first server that can be
+	// connected to, trying them in order starting with the last one that
+	// could be.
+	ServersFailover ServerMode = iota
+	// ServersFanOut sends every request to all the servers.
+	ServersFanOut
+)
+
+// WithServers adds servers (as address:port, or unix:// addresses) to the one
+// provided to NewClient, which are either failed over to or all sent to,
+// depending on mode.
+func WithServers(mode ServerMode, servers ...string) ClientOption {
+	return func(c *Client) error {
+		if mode != ServersFailover && mode != ServersFanOut {
+			return fmt.Errorf("Unknown server mode: %d", mode)
+		}
+		for _, server := range servers {
+			if _, unix := unixSocketPath(server); unix {
+				continue
+			}
+			if _, err := net.ResolveTCPAddr("tcp", server); err != nil {
+				return err
+			}
+		}
+		c.serverMode = mode
+		c.servers = append(c.servers, servers...)
+		return nil
+	}
+}
+
+// WithSendQueue sets how many buffers of requests can wait to be sent while
+// the client keeps handling filesystem events. Past it, the handling of events
+// waits for the sending to catch up, so that a slow server doesn't make the
+// client buffer ever more requests. Defaults to 0: only the buffer being
+// filled waits for the one being sent.
+func WithSendQueue(capacity int) ClientOption {
+	return func(c *Client) error {
+		if capacity < 0 {
+			return fmt.Errorf("Invalid send queue capacity: %d", capacity)
+		}
+		c.sendQueue = capacity
+		return nil
+	}
+}
+
+// WithDeleteExcess makes Reconcile remove the server's files and directories
+// that don't exist in the client's directory.
+func WithDeleteExcess() ClientOption {
+	return func(c *Client) error {
+		c.deleteExcess = true
+		return nil
+	}
+}
+
+// WithProtectedPaths makes Reconcile keep the server's entries matching any of
+// patterns, and the entries within them, even if they don't exist in the
+// client's directory, eg. configuration files managed on the server. Patterns
+// have the syntax of path.Match, and are matched against the slash-separated
+// paths relative to the server's destination, or against the base names for
+// patterns without a slash. Directories containing protected entries are kept
+// too.
+func WithProtectedPaths(patterns ...string) ClientOption {
+	return func(c *Client) error {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("Invalid protected path pattern '%s': %v", pattern, err)
+			}
+		}
+		c.protectedPaths = append(c.protectedPaths, patterns...)
+		return nil
+	}
+}
+
+// SkipPolicy defines how Reconcile decides that a file of the server is up to
+// date, and doesn't have to be sent.
+type SkipPolicy int
+
+const (
+	// SkipHash skips the files whose content hash matches the server's.
+	SkipHash SkipPolicy = iota
+	// SkipSizeMTime skips the files whose size matches the server's, when
+	// the server's is modified at the same time or later, sparing the
+	// server to hash its files. Only the modification times of transformed
+	// files are compared. It relies on the client's and server's clocks
+	// being in sync.
+	SkipSizeMTime
+)
+
+func (policy SkipPolicy) String() string {
+	switch policy {
+	case SkipHash:
+		return "hash"
+	case SkipSizeMTime:
+		return "size-mtime"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(policy))
+	}
+}
+
+// WithSkipPolicy sets how Reconcile decides that a file of the server is up to
+// date. Defaults to SkipHash.
+func WithSkipPolicy(policy SkipPolicy) ClientOption {
+	return func(c *Client) error {
+		if policy < SkipHash || policy > SkipSizeMTime {
+			return fmt.Errorf("Unknown skip policy: %d", policy)
+		}
+		c.skipPolicy = policy
+		return nil
+	}
+}
+
+// WithReconcileInterval makes SyncAndMonitor reconcile the server with the
+// client's directory every interval, as a safety net for changes that are
+// missed, or made to the server out-of-band. Reconciliations are skipped while
+// paused.
+func WithReconcileInterval(interval time.Duration) ClientOption {
+	return func(c *Client) error {
+		if interval <= 0 {
+			return fmt.Errorf("Invalid reconcile interval: %s", interval)
+		}
+		c.reconcileInterval = interval
+		return nil
+	}
+}
+
+// WithMonitorDuration makes SyncAndMonitor stop after monitoring for
+// duration, counted from its start, eg. for scheduled sync windows. The
+// buffered changes are sent before it returns. Changes made too close to the
+// end may not be seen.
+func WithMonitorDuration(duration time.Duration) ClientOption {
+	return func(c *Client) error {
+		if duration <= 0 {
+			return fmt.Errorf("Invalid monitor duration: %s", duration)
+		}
+		c.monitorDuration = duration
+		return nil
+	}
+}
+
+// WithLogger sets the Logger of the client's events. Defaults to free-form
+// lines logged with the standard library's logger.
+func WithLogger(logger Logger) ClientOption {
+	return func(c *Client) error {
+		c.logger = logger
+		return nil
+	}
+}
+
+// WithJSONLogging makes the client log its events to w as JSON objects, one
+// per line.
+func WithJSONLogging(w io.Writer) ClientOption {
+	return WithLogger(NewJSONLogger(w))
+}
+
+// isLocalPath checks that a clean relative path doesn't escape its root.
+func isLocalPath(path string) bool {
+	return path != ".." && !strings.HasPrefix(path, ".."+string(filepath.Separator))
 }
 
 // getClientTLSConfig returns a TLS config for the client to verify the server.
@@ -44,52 +626,424 @@ func getClientTLSConfig() (*tls.Config, error) {
 }
 
 // NewClient creates a new client, given the server's address and port and the
-// path to a directory that would be synchronized with the server.
-func NewClient(address string, port uint16, path string) (*Client, error) {
+// path to a directory that would be synchronized with the server. The path may
+// also be a regular file's, synchronized alone under its base name, while its
+// siblings are ignored. A unix:// address, as in "unix:///run/betterbox.sock",
+// connects to a server listening on a Unix domain socket instead, without TLS
+// and ignoring port.
+func NewClient(address string, port uint16, path string, opts ...ClientOption) (*Client, error) {
+	// Unix socket addresses are kept as is, without port.
+	addrport := address
+	if _, unix := unixSocketPath(address); !unix {
+		addrport = net.JoinHostPort(unbracketHost(address), fmt.Sprintf("%d", port))
+		if _, err := net.ResolveTCPAddr("tcp", addrport); err != nil {
+			return nil, err
+		}
+	}
+	return newClient(addrport, path, nil, opts)
+}
+
+// NewClientWithConn creates a new client, as NewClient does, sending its
+// requests over conn instead of connecting to a server, eg. over a connection
+// already established and authenticated by the caller, such as an SSH tunnel
+// or a multiplexed stream, to a server created with NewServerWithConn. The
+// client doesn't close conn, unless Close cancels the requests being sent.
+// Files are sent whole, without parallel chunks, and multiple servers aren't
+// supported.
+func NewClientWithConn(conn net.Conn, path string, opts ...ClientOption) (*Client, error) {
+	return newClient(conn.RemoteAddr().String(), path, conn, opts)
+}
+
+// newClient creates a new client of the server at addrport, sending its
+// requests over conn if not nil.
+func newClient(addrport, path string, conn net.Conn, opts []ClientOption) (*Client, error) {
 	// XXX Other directory checks ? eg. permissions of directory (and contained files/dirs) ?
-	if !isDirectory(path) {
-		return nil, fmt.Errorf("%s: Path not a directory", path)
+	info, err := os.Stat(path)
+	if err != nil || !(info.IsDir() || info.Mode().IsRegular()) {
+		return nil, fmt.Errorf("%s: Path not a directory or regular file", path)
 	}
 	absPath, err := filepath.Abs(path)
 	if err != nil {
 		return nil, err
 	}
-	addrport := net.JoinHostPort(address, fmt.Sprintf("%d", port))
-	if _, err = net.ResolveTCPAddr("tcp", addrport); err != nil {
-		return nil, err
+	// A single file is synced from its parent directory.
+	var file string
+	if !info.IsDir() {
+		absPath, file = filepath.Split(absPath)
+		absPath = filepath.Clean(absPath)
 	}
-	config, err := getClientTLSConfig()
-	if err != nil {
+	// Clients with a dialer or a connection, or only connecting to Unix
+	// sockets, don't need a TLS config.
+	config, configErr := getClientTLSConfig()
+	if configErr != nil {
+		config = &tls.Config{}
+	}
+
+	c := &Client{
+		server:        addrport,
+		servers:       []string{addrport},
+		path:          absPath,
+		file:          file,
+		config:        config,
+		eventMask:     allEvents,
+		resumed:       make(chan struct{}, 1),
+		logger:        stdLogger{},
+		hashAlgorithm: HashSHA256,
+		closeTimeout:  10 * time.Second,
+		closing:       make(chan struct{}),
+	}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	if c.clientID != "" && c.serverMode == ServersFanOut && len(c.servers) > 1 {
+		return nil, fmt.Errorf("Resumable sendings unsupported in fan-out mode")
+	}
+	if conn != nil {
+		if len(c.servers) > 1 {
+			return nil, fmt.Errorf("Multiple servers unsupported over a connection")
+		}
+		c.conn = c.newServerConn(conn, addrport)
+		c.conn.shared = true
+	} else if configErr != nil && c.dialer == nil {
+		for _, server := range c.servers {
+			if _, unix := unixSocketPath(server); !unix {
+				return nil, configErr
+			}
+		}
+	}
+	if c.resolveRoot {
+		if absPath, err = filepath.EvalSymlinks(absPath); err != nil {
+			return nil, err
+		}
+		c.path = absPath
+	}
+	if c.fsys == nil {
+		c.fsys = os.DirFS(absPath)
+	}
+	if c.includeRootDir {
+		name := filepath.Base(absPath)
+		if name == string(filepath.Separator) {
+			return nil, fmt.Errorf("%s: Directory has no name to include", absPath)
+		}
+		c.prefix = filepath.Join(c.prefix, name)
+	}
+	c.prefix = filepath.Join(c.snapshotPrefix, c.prefix)
+	return c, nil
+}
+
+func (c *Client) String() string {
+	return fmt.Sprintf("%s -> %s", c.path, strings.Join(c.servers, ", "))
+}
+
+// Describe summarizes the client's effective configuration.
+func (c *Client) Describe() string {
+	bufferBytes := "unlimited"
+	if c.bufferBytes > 0 {
+		bufferBytes = fmt.Sprintf("%d", c.bufferBytes)
+	}
+	return fmt.Sprintf("%s (remote prefix: '%s', buffer: %d requests / %s bytes, wait: %s, batch: %v, initial sync: %s, events: %s)",
+		c, c.prefix, requestsBufferSize, bufferBytes, requestsWaitTime, c.batch, c.initialSync, c.eventMask)
+}
+
+// serverConnect connects to one of the client's servers, failing over to the
+// next ones in order when the connection fails. The first connection is retried
+// depending on the client's settings.
+func (c *Client) serverConnect() (*serverConn, error) {
+	rconn, err := c.failoverConnect()
+	if c.connected {
+		return rconn, err
+	}
+	backoff := c.connectBackoff
+	for attempt := 1; err != nil && attempt <= c.connectRetries; attempt++ {
+		c.logger.Log(LevelWarning, "Retrying connection", Fields{"attempt": attempt, "backoff": backoff, "error": err})
+		time.Sleep(backoff)
+		backoff *= 2
+		rconn, err = c.failoverConnect()
+	}
+	c.connected = err == nil
+	return rconn, err
+}
+
+// failoverConnect connects to one of the client's servers, as serverConnect
+// does, without retrying.
+func (c *Client) failoverConnect() (*serverConn, error) {
+	var err error
+	for i := 0; i < len(c.servers); i++ {
+		index := (c.preferred + i) % len(c.servers)
+		var rconn *serverConn
+		if rconn, err = c.dial(c.servers[index]); err == nil {
+			c.preferred = index
+			return rconn, nil
+		}
+		if len(c.servers) > 1 {
+			c.logger.Log(LevelWarning, "Connection to server failed", Fields{"server": c.servers[index], "error": err})
+		}
+	}
+	return nil, err
+}
+
+// dial connects to a server through RPC over TLS, a Unix socket or the
+// client's dialer, or reuses the client's connection, and establishes a new
+// session.
+func (c *Client) dial(server string) (*serverConn, error) {
+	rconn := c.conn
+	if rconn == nil {
+		var conn net.Conn
+		var err error
+		if socket, unix := unixSocketPath(server); c.dialer != nil {
+			conn, err = c.dialer(server)
+		} else if unix {
+			conn, err = net.Dial("unix", socket)
+		} else {
+			conn, err = tls.Dial("tcp", server, c.config)
+		}
+		if err != nil {
+			return nil, err
+		}
+		rconn = c.newServerConn(conn, server)
+	}
+	if err := rconn.checkVersion(); err != nil {
+		rconn.Close()
 		return nil, err
 	}
+	if err := rconn.handshake(); err != nil {
+		rconn.Close()
+		return nil, errors.Wrap(err, "Session handshake failed")
+	}
+	if c.skipOversized {
+		c.recordMaxFileSize(rconn.maxFileSize)
+	}
+	if c.clientID != "" {
+		if err := rconn.queryLastApplied(c.clientID); err != nil {
+			rconn.Close()
+			return nil, errors.Wrap(err, "Querying last applied request failed")
+		}
+	}
+	return rconn, nil
+}
+
+// newServerConn creates a new RPC connection to server over conn.
+func (c *Client) newServerConn(conn net.Conn, server string) *serverConn {
+	// XXX Use a custom RPC encoder, to not buffer file content in
+	// Request.Data
+	var metered *meteredConn
+	if c.compressThreshold != 0 {
+		metered = &meteredConn{Conn: conn}
+		conn = metered
+	}
+	codec := &streamClientCodec{streamCodec: newStreamCodec(conn)}
+	return &serverConn{Client: rpc.NewClientWithCodec(codec), server: server, compress: c.compressStreams(), clientID: c.clientID, metered: metered}
+}
 
-	return &Client{server: addrport, path: absPath, config: config}, nil
+// PreflightResult reports the outcome of the checks done by Client.Preflight.
+type PreflightResult struct {
+	Server    string        // Server's address:port.
+	Connected bool          // Whether the TLS connection succeeded.
+	Healthy   bool          // Whether the server reported being healthy.
+	Message   string        // Server's health message.
+	Latency   time.Duration // Round trip time of the health check.
+	Usage     UsageResponse // Usage of the server destination's filesystem.
+	Required  uint64        // Size of the files to sync, in bytes.
 }
 
-// serverConnect connects to the server through RPC over TLS.
-func (c *Client) serverConnect() (*rpc.Client, error) {
-	conn, err := tls.Dial("tcp", c.server, c.config)
+// Preflight checks that the server can be resolved, connected to over TLS,
+// reports being healthy and has room for the directory's files, without
+// sending any file or starting the directory's monitoring.
+func (c *Client) Preflight() (*PreflightResult, error) {
+	result := &PreflightResult{Server: c.server}
+	// Connections provided to the client have no address to resolve.
+	for i := 0; i < len(c.servers) && c.conn == nil; i++ {
+		if _, err := net.ResolveTCPAddr("tcp", c.servers[i]); err != nil {
+			return result, errors.Wrap(err, "Resolving server address failed")
+		}
+	}
+	rconn, err := c.serverConnect()
 	if err != nil {
-		return nil, err
+		return result, errors.Wrap(err, "Connection to server failed")
+	}
+	defer rconn.Close()
+	result.Server = rconn.server
+	result.Connected = true
+
+	var resp PingResponse
+	start := time.Now()
+	if err := rconn.Call("Server.Ping", &PingRequest{}, &resp); err != nil {
+		return result, errors.Wrap(err, "Health check failed")
+	}
+	result.Latency = time.Since(start)
+	result.Healthy = resp.Healthy
+	result.Message = resp.Message
+	if !resp.Healthy {
+		return result, fmt.Errorf("Server unhealthy: %s", resp.Message)
+	}
+
+	if err := rconn.Call("Server.Usage", &UsageRequest{}, &result.Usage); err != nil {
+		return result, errors.Wrap(err, "Usage check failed")
+	}
+	if result.Required, err = c.treeSize(); err != nil {
+		return result, errors.Wrapf(err, "Measuring directory '%s' failed", c.path)
+	}
+	// Files replaced on the server may free some space, but a Sync that
+	// doesn't fit in the free space is likely to fail.
+	if result.Required > result.Usage.Free {
+		return result, fmt.Errorf("Not enough space on server: %d bytes free, %d required", result.Usage.Free, result.Required)
 	}
-	// XXX Replace with NewClientWithCodec() to use a custom RPC encoder,
-	// to not buffer file content in Request.Data
-	return rpc.NewClient(conn), nil
+	return result, nil
 }
 
-// sendRequests sends a list of Requests to the server. In case of a Request
-// receiving an error Response by the server, the sending will stop.
+// treeSize returns the cumulative size of the files in the client's directory.
+func (c *Client) treeSize() (uint64, error) {
+	var size uint64
+	err := c.walk(func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += uint64(info.Size())
+		}
+		return nil
+	})
+	return size, err
+}
+
+// sendRequests sends a list of Requests to the server, or to all the servers in
+// fan-out mode. In case of a Request receiving an error Response by the server,
+// the sending will stop.
 func (c *Client) sendRequests(reqs []*Request) error {
+	_, err := c.sendCounted(reqs)
+	return err
+}
+
+// sendCounted sends a list of Requests as sendRequests does, returning the
+// number of them applied by the server. In fan-out mode, none of them are
+// counted as applied on failure. The Requests are sorted by priority first.
+func (c *Client) sendCounted(reqs []*Request) (int, error) {
 	if len(reqs) == 0 {
-		return nil
+		return 0, nil
+	}
+	c.prioritize(reqs)
+	if c.isClosing() {
+		return 0, ErrClosed
+	}
+	if c.serverMode == ServersFanOut {
+		for _, server := range c.servers {
+			rconn, err := c.dial(server)
+			if err != nil {
+				return 0, errors.Wrapf(err, "Connection to server '%s' failed", server)
+			}
+			_, err = c.sendTracked(rconn, reqs)
+			rconn.Close()
+			if err != nil {
+				return 0, errors.Wrapf(err, "Sending to server '%s' failed", server)
+			}
+		}
+		c.recordSync()
+		return len(reqs), nil
 	}
 	rconn, err := c.serverConnect()
 	if err != nil {
-		return errors.Wrap(err, "Connection to server failed")
+		return 0, errors.Wrap(err, "Connection to server failed")
 	}
 	defer rconn.Close()
+	applied, err := c.sendContinuing(rconn, reqs)
+	if err != nil {
+		return applied, err
+	}
+	c.recordSync()
+	return applied, nil
+}
 
-	for _, req := range reqs {
+// sendTracked sends a list of Requests on a server connection, which Close
+// cancels the sending of once its timeout expires.
+func (c *Client) sendTracked(rconn *serverConn, reqs []*Request) (int, error) {
+	c.closeMutex.Lock()
+	c.sendingConn = rconn
+	c.closeMutex.Unlock()
+	defer func() {
+		c.closeMutex.Lock()
+		c.sendingConn = nil
+		c.closeMutex.Unlock()
+	}()
+	applied, err := c.sendOn(rconn, reqs)
+	if err != nil && c.isClosing() {
+		c.logger.Log(LevelWarning, "Sending cancelled", Fields{"applied": applied, "requests": len(reqs), "error": err})
+		return applied, ErrClosed
+	}
+	return applied, err
+}
+
+// syncRetries is the number of times the sending of a sync's Requests is
+// retried, after failures other than error Responses.
+const syncRetries = 3
+
+// syncRetryDelay is the delay before the first retry, increased for each of
+// the following ones.
+var syncRetryDelay = 500 * time.Millisecond
+
+// syncSend sends the Requests of a sync, reconnecting to retry the ones that
+// weren't applied when the sending fails, eg. on a network error. Requests
+// receiving error Responses aren't retried, nor are fan-out sendings.
+func (c *Client) syncSend(reqs []*Request) error {
+	c.recordInitial(reqs)
+	for attempt := 1; ; attempt++ {
+		applied, err := c.sendCounted(reqs)
+		if err == nil || err == ErrClosed || attempt > syncRetries || c.serverMode == ServersFanOut {
+			return err
+		}
+		if _, ok := errors.Cause(err).(*RequestError); ok {
+			return err
+		}
+		if _, ok := errors.Cause(err).(*IncompatibleServerError); ok {
+			return err
+		}
+		if _, ok := errors.Cause(err).(*FailedRequestsError); ok {
+			return err
+		}
+		reqs = reqs[applied:]
+		c.logger.Log(LevelWarning, "Retrying sending", Fields{"attempt": attempt, "requests": len(reqs), "error": err})
+		time.Sleep(time.Duration(attempt) * syncRetryDelay)
+	}
+}
+
+// sendOn sends a list of Requests on a server connection, stopping on the
+// first error Response. It returns the number of Requests applied, including
+// the ones the server applied before.
+func (c *Client) sendOn(rconn *serverConn, reqs []*Request) (int, error) {
+	c.recordFlush()
+	skipped := c.skipApplied(rconn, reqs)
+	applied, err := c.sendUnapplied(rconn, reqs[skipped:])
+	return skipped + applied, err
+}
+
+// sendUnapplied sends a list of Requests on a server connection, as sendOn
+// does.
+func (c *Client) sendUnapplied(rconn *serverConn, reqs []*Request) (int, error) {
+	if c.batch {
+		for _, req := range reqs {
+			rconn.stamp(req)
+		}
+		batch := &BatchRequest{Requests: reqs}
+		var resp BatchResponse
+		start, written := time.Now(), rconn.wireBytes()
+		if err := rconn.Call("Server.BatchApplyRequest", batch, &resp); err != nil {
+			return 0, errors.Wrap(err, "Sending batch to server failed")
+		}
+		c.recordLatency(batchLatency, time.Since(start))
+		c.recordThroughput(rconn.wireBytes()-written, time.Since(start))
+		if err := resp.err(batch); err != nil {
+			applied := len(resp.Responses) - 1
+			if resp.RolledBack {
+				applied = 0
+			}
+			c.recordApplied(reqs[:applied], resp.Responses)
+			return applied, err
+		}
+		c.recordApplied(reqs, resp.Responses)
+		return len(reqs), nil
+	}
+	for i, req := range reqs {
 		var resp Response
 		// XXX On concurrency: We have to synchronize order for
 		// Requests that are not interchangeable (eg. Create and Remove of the same file.)
@@ -99,14 +1053,37 @@ func (c *Client) sendRequests(reqs []*Request) error {
 		// - Send file in chunks (send/compare checksum with server first)
 		// XXX Zero-copy: Remove Data buffer from Request, use
 		// sendfile()/splice()/copy_file_range() + rpc.ClientCodec.
-		rconn.Call("Server.ApplyRequest", req, &resp)
+		rconn.stamp(req)
+		start, written := time.Now(), rconn.wireBytes()
+		if err := rconn.Call("Server.ApplyRequest", req, &resp); err != nil {
+			return i, errors.Wrapf(err, "Sending request to server '%s' failed", req)
+		}
+		c.recordLatency(req.Type.String(), time.Since(start))
+		c.recordThroughput(rconn.wireBytes()-written, time.Since(start))
 		// Stop sending of requests on first error from server.
 		if resp.Type == responseErr {
 			// XXX Should we continue ? How to handle files that caused errors in that case ?
-			return fmt.Errorf("Sending request to server '%s' failed: %s", req, resp)
+			return i, &RequestError{Request: req, Response: resp}
 		}
+		c.recordApplied([]*Request{req}, []Response{resp})
 	}
-	return nil
+	return len(reqs), nil
+}
+
+// bufferFull checks whether buffered requests should be sent, as their number
+// or the cumulative size of their data reached the limits.
+func (c *Client) bufferFull(reqs []*Request) bool {
+	if len(reqs) >= requestsBufferSize {
+		return true
+	}
+	if c.bufferBytes == 0 {
+		return false
+	}
+	var size int64
+	for _, req := range reqs {
+		size += int64(len(req.Data))
+	}
+	return size > c.bufferBytes
 }
 
 // newMkdirRequest creates a new Mkdir Request.
@@ -114,18 +1091,71 @@ func newMkdirRequest(name string) *Request {
 	return &Request{Type: requestMkdir, Path: name}
 }
 
-// newCreateRequest creates a new Create Request.
-func newCreateRequest(path, name string) (*Request, error) {
+// newCreateRequest creates a new Create Request. If the client's data
+// transform fails for the file, it is skipped and nil is returned.
+func (c *Client) newCreateRequest(path, name string) (*Request, error) {
 	// XXX Better to delay reading the file content until it is needed
 	// inside sendRequests() loop, and skip the overhead from copying data.
 	// ==> Replace Request.Data by the file descriptor, then use
 	// splice(2) (or other) for zero-copying (use
 	// rpc.NewClientWithCodec() instead of rpc.NewClient())
-	content, err := ioutil.ReadFile(path)
+	if info, err := c.stat(path); err == nil && c.transform == nil && c.aead == nil {
+		if skip, err := c.oversized(name, info.Size()); err != nil || skip {
+			return nil, err
+		}
+	}
+	content, err := c.readContent(path)
+	if _, ok := err.(*transformError); ok {
+		c.logger.Log(LevelWarning, "Skipping file", Fields{"path": name, "error": err})
+		return nil, nil
+	}
+	if _, ok := err.(*notRegularError); ok {
+		// The replacing entry is sent on its own events.
+		c.logger.Log(LevelInfo, "Skipping replaced file", Fields{"path": name, "error": err})
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	return &Request{Type: requestCreate, Path: name, Data: content}, nil
+	if c.aead != nil {
+		if content, err = c.encrypt(name, content); err != nil {
+			return nil, errors.Wrapf(err, "Encrypting '%s' failed", name)
+		}
+	}
+	if c.transform != nil || c.aead != nil {
+		if skip, err := c.oversized(name, int64(len(content))); err != nil || skip {
+			return nil, err
+		}
+	}
+	c.recordSent(path, name, int64(len(content)))
+	sum := sha256.Sum256(content)
+	return c.setMode(&Request{Type: requestCreate, Path: name, Data: content, Checksum: sum[:]}, path)
+}
+
+// transformError is returned when the client's data transform fails.
+type transformError struct {
+	path string
+	err  error
+}
+
+func (e *transformError) Error() string {
+	return fmt.Sprintf("Transforming '%s' failed: %v", e.path, e.err)
+}
+
+// readContent reads a file's content, as it is sent to the server.
+func (c *Client) readContent(path string) ([]byte, error) {
+	content, err := c.readFile(path)
+	if err != nil || c.transform == nil {
+		return content, err
+	}
+	relPath, err := filepath.Rel(c.path, path)
+	if err != nil {
+		return nil, err
+	}
+	if content, err = c.transform(relPath, content); err != nil {
+		return nil, &transformError{path: relPath, err: err}
+	}
+	return content, nil
 }
 
 // newRemoveRequest creates a new Remove Request.
@@ -133,71 +1163,391 @@ func newRemoveRequest(name string) *Request {
 	return &Request{Type: requestRemove, Path: name}
 }
 
+// remotePath returns the path on the server's side of a path relative to the
+// client's directory. Remote paths are slash-separated on every platform.
+func (c *Client) remotePath(relPath string) string {
+	return filepath.ToSlash(filepath.Join(c.prefix, relPath))
+}
+
+// prefixRequests returns Mkdir Requests for each of the remote prefix's
+// directories, as they have to exist on the server before anything is
+// created within them.
+func (c *Client) prefixRequests() []*Request {
+	if c.prefix == "" {
+		return nil
+	}
+	var reqs []*Request
+	dir := ""
+	for _, name := range strings.Split(c.prefix, string(filepath.Separator)) {
+		dir = filepath.Join(dir, name)
+		reqs = append(reqs, newMkdirRequest(filepath.ToSlash(dir)))
+	}
+	return reqs
+}
+
 // Sync walks through all the files and subdirectories in the client's
 // directory, and sends them to the server.
 func (c *Client) Sync() error {
+	c.resetFailures()
+	var err error
+	if c.refuseNewer {
+		err = c.syncKeepingNewer()
+	} else {
+		err = c.sync(c.prefixRequests(), nil)
+	}
+	if err != nil {
+		return err
+	}
+	return c.failures()
+}
+
+// SyncWithResult syncs the client's directory as Sync does, returning a
+// summary of what the server applied, even if the sync fails. Requests sent
+// concurrently, eg. by monitoring, are counted too, and requests sent to
+// multiple servers are counted once per server.
+func (c *Client) SyncWithResult() (*SyncResult, error) {
+	result := &SyncResult{}
+	c.statsMutex.Lock()
+	c.result = result
+	c.statsMutex.Unlock()
+	start := time.Now()
+	err := c.Sync()
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+	c.result = nil
+	result.Duration = time.Since(start)
+	return result, err
+}
+
+// SyncPaths sends only the files and directories at paths, relative to the
+// client's directory, with the entries of directories and the parent
+// directories of all of them, instead of walking through the whole directory,
+// eg. for updates driven by an external tool. Paths not synced by the client,
+// eg. beyond its maximum depth, are skipped.
+func (c *Client) SyncPaths(paths []string) error {
+	c.resetFailures()
+	reqs := c.prefixRequests()
+	sent := make(map[string]bool)
+	for _, path := range paths {
+		localPath := filepath.Clean(filepath.FromSlash(path))
+		if filepath.IsAbs(localPath) || !isLocalPath(localPath) || localPath == "." {
+			return fmt.Errorf("%s: Path not relative within the client's directory", path)
+		}
+		if !c.included(localPath) {
+			c.logger.Log(LevelInfo, "Skipping path not synced", Fields{"path": path})
+			continue
+		}
+		// Parent directories first, from the outermost one.
+		var parents []string
+		for dir := filepath.Dir(localPath); dir != "."; dir = filepath.Dir(dir) {
+			parents = append([]string{dir}, parents...)
+		}
+		for _, dir := range parents {
+			if sent[dir] {
+				continue
+			}
+			req, err := c.newDirRequest(filepath.Join(c.path, dir), c.remotePath(dir))
+			if err != nil {
+				return err
+			}
+			reqs = append(reqs, req)
+			sent[dir] = true
+		}
+		var err error
+		if reqs, err = c.syncFrom(filepath.ToSlash(localPath), reqs, nil); err != nil {
+			return err
+		}
+	}
+	if err := c.syncSend(reqs); err != nil {
+		return err
+	}
+	return c.failures()
+}
+
+// filterFunc decides whether a file or directory is left out of a sync, or has
+// to be removed from the server before being sent, given its absolute path,
+// remote path and file info.
+type filterFunc func(absPath, relPath string, info os.FileInfo) (skip, replace bool, err error)
+
+// sync walks through all the files and subdirectories in the client's
+// directory, and sends them to the server after the provided initial requests,
+// except the ones that filter skips.
+func (c *Client) sync(reqs []*Request, filter filterFunc) error {
+	reqs, err := c.syncFrom(".", reqs, filter)
+	if err != nil {
+		// No partial sending on filepath errors.
+		if _, statErr := os.Stat(c.path); os.IsNotExist(statErr) {
+			return &RootRemovedError{Path: c.path, Err: err}
+		}
+		return err
+	}
+	return c.syncSend(reqs)
+}
+
+// syncFrom walks through the file or directory at root, a slash-separated path
+// relative to the client's directory, and its entries, appending their requests
+// to reqs, except the ones that filter skips, and returning the requests left to
+// send.
+func (c *Client) syncFrom(root string, reqs []*Request, filter filterFunc) ([]*Request, error) {
 	// Regroups commands (directory and file creations) before sending them.
-	var reqs []*Request
-	err := filepath.Walk(c.path, func(absPath string, info os.FileInfo, err error) error {
+	err := c.walkFrom(root, func(absPath string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		// filepath.Walk() returns the root path too. Skip it.
+		// c.walk() returns the root path too. Skip it.
 		if absPath == c.path {
 			return nil
 		}
 		// Get rel path: absPath minus c.path
-		relPath, err := filepath.Rel(c.path, absPath)
+		localPath, err := filepath.Rel(c.path, absPath)
 		if err != nil {
 			return err
 		}
-		if info.IsDir() {
-			req := newMkdirRequest(relPath)
+		relPath := c.remotePath(localPath)
+		if isSpecial(info) && !c.syncSpecial {
+			return nil
+		}
+		if filter != nil {
+			skip, replace, err := filter(absPath, relPath, info)
+			if skip && !info.IsDir() {
+				c.recordSkipped()
+			}
+			if err != nil || skip {
+				return err
+			}
+			if replace {
+				reqs = append(reqs, newRemoveRequest(relPath))
+			}
+		}
+		if isSymlink(info) {
+			// Copies of external directories are sent as they are
+			// walked through, as the other entries.
+			err := c.walkLink(absPath, localPath, map[string]bool{}, func(linkReqs ...*Request) error {
+				reqs = append(reqs, linkReqs...)
+				if !c.bufferFull(reqs) {
+					return nil
+				}
+				err := c.syncSend(reqs)
+				reqs = nil
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		} else if info.IsDir() {
+			req, err := c.newDirRequest(absPath, relPath)
+			if err != nil {
+				return err
+			}
 			reqs = append(reqs, req)
+		} else if isSpecial(info) {
+			reqs = append(reqs, c.specialRequests(absPath, relPath, info)...)
+		} else if c.chunked(info) {
+			// The file's parent directory is created first.
+			if err := c.syncSend(reqs); err != nil {
+				return err
+			}
+			reqs = nil
+			return c.sendChunks(absPath, relPath, info.Size())
 		} else {
-			req, err := newCreateRequest(absPath, relPath)
+			req, err := c.newCreateRequest(absPath, relPath)
 			if err != nil {
 				return err
 			}
-			reqs = append(reqs, req)
+			if req != nil {
+				reqs = append(reqs, req)
+			}
 		}
 		// Don't buffer requests forever. Especially important as
-		// the Requests contain the full file content.
-		if len(reqs) == requestsBufferSize {
-			if err := c.sendRequests(reqs); err != nil {
+		// the Requests contain the full file content, hence the
+		// optional cap on their cumulative size.
+		if c.bufferFull(reqs) {
+			if err := c.syncSend(reqs); err != nil {
 				return err
 			}
 			reqs = nil
 		}
 		return nil
 	})
-	if err != nil {
-		// No partial sending on filepath errors.
-		return err
-	}
-	return c.sendRequests(reqs)
+	return reqs, err
+}
+
+// ErrClosed is returned when the sending of requests is cancelled by Close.
+var ErrClosed = errors.New("Client closed")
+
+// RootRemovedError is returned when the client's directory is removed while
+// it is being synced. The sync can be retried once it is restored.
+type RootRemovedError struct {
+	Path string // Path of the client's directory.
+	Err  error  // Error of the interrupted walk.
+}
+
+func (e *RootRemovedError) Error() string {
+	return fmt.Sprintf("Directory '%s' removed during sync: %v", e.Path, e.Err)
 }
 
 // startWatcher starts the monitoring of the client's directory for filesystem
 // events (file creations, chmod's, dir creations etc,.)
 func (c *Client) startWatcher() error {
-	watcher, err := fsnotify.NewWatcher()
+	watcher, err := newWatcher()
 	if err != nil {
 		return err
 	}
 	c.watcher = watcher
-	if err = c.recursiveAddWatchers(c.path); err != nil {
+	c.watched = make(map[string]bool)
+	if c.file != "" {
+		// Only the events of the file matter, not of its siblings'
+		// subdirectories.
+		if err = watcher.Add(c.path); err == nil {
+			c.watched[c.path] = true
+			c.recordWatches(len(c.watched))
+		}
+	} else {
+		err = c.recursiveAddWatchers(c.path)
+	}
+	if err != nil {
 		watcher.Close()
 		return err
 	}
 	return nil
 }
 
+// newWatcher creates a filesystem events watcher. Replaceable for tests.
+var newWatcher = fsnotify.NewWatcher
+
 // recursiveAddWatchers recursively adds directories within the provided root directory.
+// Directories beyond the maximum depth aren't walked through.
 func (c *Client) recursiveAddWatchers(root string) error {
 	return walkDir(root, func(path string) error {
-		return c.watcher.Add(path)
+		if localPath, err := filepath.Rel(c.path, path); err == nil && c.tooDeep(localPath) {
+			return filepath.SkipDir
+		}
+		return c.addWatcher(path)
+	})
+}
+
+// addWatcher watches a directory, unless it is already watched or its entries
+// are too deep to be synced.
+func (c *Client) addWatcher(path string) error {
+	if c.watched[path] {
+		return nil
+	}
+	localPath, err := filepath.Rel(c.path, path)
+	if err != nil || (c.maxDepth > 0 && pathDepth(localPath) >= c.maxDepth) {
+		return err
+	}
+	if err := c.watcher.Add(path); err != nil {
+		return err
+	}
+	c.watched[path] = true
+	c.recordWatches(len(c.watched))
+	return nil
+}
+
+// forgetWatchers forgets the watched directories at or within a removed or
+// renamed path, whose watches are removed with them, so that they are watched
+// again if recreated.
+func (c *Client) forgetWatchers(path string) {
+	prefix := path + string(filepath.Separator)
+	for dir := range c.watched {
+		if dir == path || strings.HasPrefix(dir, prefix) {
+			delete(c.watched, dir)
+		}
+	}
+	c.recordWatches(len(c.watched))
+}
+
+// newDirRequests watches a directory created while monitoring, along with its
+// subdirectories, and returns the Requests of it and of its entries, as these
+// may be created before the watches are added, without events.
+func (c *Client) newDirRequests(root string) ([]*Request, error) {
+	var reqs []*Request
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		// Entries may be removed as soon as created.
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		localPath, err := filepath.Rel(c.path, path)
+		if err != nil {
+			return err
+		}
+		if !c.included(localPath) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() && c.extensionExcluded(localPath) {
+			return nil
+		}
+		if info.IsDir() {
+			if err := c.addWatcher(path); err != nil {
+				return err
+			}
+		}
+		if !c.propagates(fsnotify.Create) {
+			return nil
+		}
+		var entryReqs []*Request
+		switch {
+		case isSymlink(info):
+			entryReqs, err = c.linkRequests(path, localPath, map[string]bool{})
+		case info.IsDir():
+			var req *Request
+			if req, err = c.newDirRequest(path, c.remotePath(localPath)); err == nil {
+				entryReqs = []*Request{req}
+			}
+		case isSpecial(info):
+			entryReqs = c.specialRequests(path, c.remotePath(localPath), info)
+		default:
+			entryReqs, err = c.createRequests(path, c.remotePath(localPath))
+		}
+		reqs = append(reqs, entryReqs...)
+		return err
 	})
+	return reqs, err
+}
+
+// appendRequests appends the Requests of an event to the buffered ones. A
+// Request identical in type and path to the last buffered one of its path
+// replaces it, eg. for the Create and Write events of a new file, or for
+// the events of a directory's entries created before it was watched. The
+// Append of the bytes written after a buffered Create is merged into it, as
+// for the Create and Write events of a new file with appends, so that a
+// single Create of the final content is sent.
+func appendRequests(reqs, eventReqs []*Request) []*Request {
+	for _, req := range eventReqs {
+		last := -1
+		for i := len(reqs) - 1; i >= 0 && last < 0; i-- {
+			if reqs[i].Path == req.Path {
+				last = i
+			}
+		}
+		if last >= 0 && reqs[last].Type == req.Type && req.Type != requestRemove && req.Type != requestAppend {
+			reqs[last] = req
+		} else if last >= 0 && reqs[last].Type == requestCreate && req.Type == requestAppend && req.Offset == int64(len(reqs[last].Data)) {
+			reqs[last] = mergeAppend(reqs[last], req)
+		} else {
+			reqs = append(reqs, req)
+		}
+	}
+	return reqs
+}
+
+// mergeAppend returns a Create Request of the content of create, followed by
+// the bytes of an Append Request.
+func mergeAppend(create, app *Request) *Request {
+	merged := *create
+	merged.Data = make([]byte, 0, len(create.Data)+len(app.Data))
+	merged.Data = append(append(merged.Data, create.Data...), app.Data...)
+	if len(create.Checksum) > 0 {
+		sum := sha256.Sum256(merged.Data)
+		merged.Checksum = sum[:]
+	}
+	return &merged
 }
 
 // walkDir calls dirFunc function for all the subdirectories of the provided root directory.
@@ -213,14 +1563,76 @@ func walkDir(root string, dirFunc func(string) error) error {
 	})
 }
 
-// Close closes the client's directory watcher.
+// Close stops the monitoring of the client's directory. The requests being sent
+// are waited for, up to the client's close timeout, after which their sending
+// is cancelled: SyncAndMonitor then returns ErrClosed. Buffered requests that
+// weren't being sent yet are dropped, but kept in the persistent queue if any.
 func (c *Client) Close() {
+	c.closeOnce.Do(func() { close(c.closing) })
+	c.closeMutex.Lock()
+	stopped := c.stopped
+	c.closeMutex.Unlock()
+	if stopped != nil {
+		select {
+		case <-stopped:
+		case <-time.After(c.closeTimeout):
+			c.closeMutex.Lock()
+			if c.sendingConn != nil {
+				c.sendingConn.Client.Close()
+			}
+			c.closeMutex.Unlock()
+			<-stopped
+		}
+	}
 	if c.watcher != nil {
 		c.watcher.Close()
+		c.recordWatches(0)
+	}
+}
+
+// isClosing checks whether Close was called.
+func (c *Client) isClosing() bool {
+	select {
+	case <-c.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// Pause suspends the sending of monitored changes to the server, which are
+// then buffered or discarded depending on the client's PausePolicy. Directories
+// created while paused are still watched.
+func (c *Client) Pause() {
+	c.pauseMutex.Lock()
+	defer c.pauseMutex.Unlock()
+	c.paused = true
+}
+
+// Resume resumes the sending of monitored changes to the server. With the
+// PauseBuffer policy, the changes buffered while paused are sent right away.
+func (c *Client) Resume() {
+	c.pauseMutex.Lock()
+	defer c.pauseMutex.Unlock()
+	if !c.paused {
+		return
+	}
+	c.paused = false
+	select {
+	case c.resumed <- struct{}{}:
+	default:
 	}
 }
 
-// SyncAndMonitor sends all files and directories to the server and watches for
+// isPaused checks whether the client's monitoring is paused.
+func (c *Client) isPaused() bool {
+	c.pauseMutex.Lock()
+	defer c.pauseMutex.Unlock()
+	return c.paused
+}
+
+// SyncAndMonitor sends all files and directories to the server (or only the
+// differing ones, or none, depending on the initial sync mode) and watches for
 // filesystem events in that directory (eg. a file is modified, a directory is
 // removed etc,.) to send them to the server.
 func (c *Client) SyncAndMonitor() error {
@@ -228,18 +1640,148 @@ func (c *Client) SyncAndMonitor() error {
 	// where files are created/modified/deleted while data is initially
 	// sent to the server. The events will be handled after the initial
 	// sending by watcherLoop() accordingly.
+	if c.monitorDuration > 0 {
+		c.monitorEnd = time.Now().Add(c.monitorDuration)
+	}
+	polling := false
 	if err := c.startWatcher(); err != nil {
-		return errors.Wrapf(err, "Monitoring directory '%s' failed", c.path)
+		if !c.watcherFallback {
+			return errors.Wrapf(err, "Monitoring directory '%s' failed", c.path)
+		}
+		c.logger.Log(LevelWarning, "Monitoring unavailable, falling back to polling", Fields{"error": err, "interval": c.pollInterval})
+		polling = true
+	}
+	stopped := make(chan struct{})
+	defer close(stopped)
+	c.closeMutex.Lock()
+	c.stopped = stopped
+	c.closeMutex.Unlock()
+	if c.queue != nil {
+		if err := c.replayQueue(); err != nil {
+			return errors.Wrap(err, "Replaying pending changes failed")
+		}
+	}
+	c.startInitialCoalescing()
+	switch c.initialSync {
+	case InitialSyncFull:
+		// The files newer on the server were logged, and are kept.
+		result, err := c.SyncWithResult()
+		if err != nil {
+			_, newer := err.(*NewerOnServerError)
+			// The failed files are sent again once modified.
+			ferr, failed := err.(*FailedRequestsError)
+			if !newer && !(failed && !ferr.Aborted) {
+				return errors.Wrap(err, "Initial files sending failure")
+			}
+		}
+		c.logger.Log(LevelInfo, "Initial sync done", result.fields())
+	case InitialSyncReconcile:
+		if err := c.Reconcile(); err != nil {
+			return errors.Wrap(err, "Initial reconciliation failure")
+		}
 	}
-	if err := c.Sync(); err != nil {
-		return errors.Wrap(err, "Initial files sending failure")
+	c.stopRecordingInitial()
+	if polling {
+		c.stopInitialCoalescing()
+		return c.pollLoop()
 	}
 	return c.watcherLoop()
 }
 
+// pollLoop reconciles the client directory with the server every poll interval,
+// in place of monitoring it, until the client is closed.
+func (c *Client) pollLoop() error {
+	if c.pollInterval == 0 {
+		return nil
+	}
+	ticker := time.NewTicker(c.pollInterval)
+	defer ticker.Stop()
+	end, stop := c.monitorTimer()
+	defer stop()
+	for {
+		select {
+		case <-ticker.C:
+			if c.isPaused() {
+				break
+			}
+			if err := c.Reconcile(); err != nil {
+				return errors.Wrap(err, "Polling reconciliation failure")
+			}
+		case <-end:
+			// The changes since the last poll are sent.
+			if !c.isPaused() {
+				if err := c.Reconcile(); err != nil {
+					return errors.Wrap(err, "Polling reconciliation failure")
+				}
+			}
+			c.logger.Log(LevelInfo, "Done polling, monitor duration elapsed", nil)
+			return nil
+		case <-c.closing:
+			c.logger.Log(LevelInfo, "Done polling", nil)
+			return nil
+		}
+	}
+}
+
+// monitorTimer returns a channel receiving once the monitor duration, if any,
+// elapsed, and a function releasing its timer.
+func (c *Client) monitorTimer() (<-chan time.Time, func()) {
+	if c.monitorEnd.IsZero() {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(time.Until(c.monitorEnd))
+	return timer.C, func() { timer.Stop() }
+}
+
 // watcherLoop watches the client directory for any filesystem events and sends
-// to the server.
+// to the server. Events are handled while buffers of requests are being sent,
+// up to the client's send queue capacity: past it, the handling of events waits
+// for the sending to catch up.
 func (c *Client) watcherLoop() error {
+	// The events invalidate the hashes of the modified entries.
+	c.setLocalTreeCache(newTreeCache())
+	defer c.setLocalTreeCache(nil)
+	batches := make(chan *pendingBatch, c.sendQueue)
+	failed := make(chan struct{})
+	sent := make(chan struct{})
+	var sendErr error
+	go func() {
+		defer close(sent)
+		sendErr = c.sendLoop(batches, failed)
+	}()
+	err := c.eventLoop(batches, failed)
+	close(batches)
+	<-sent
+	if sendErr != nil {
+		return sendErr
+	}
+	return err
+}
+
+// sendLoop sends the buffers of requests handed off by eventLoop, until batches
+// is closed. On the first failure, failed is closed, and the remaining buffers
+// are dropped, as they are once the client is closing.
+func (c *Client) sendLoop(batches <-chan *pendingBatch, failed chan<- struct{}) error {
+	var err error
+	for batch := range batches {
+		if err == nil && !c.isClosing() {
+			if batch.reconcile {
+				err = errors.Wrap(c.Reconcile(), "Periodic reconciliation failure")
+			} else {
+				err = c.flush(batch)
+			}
+			if err != nil {
+				close(failed)
+			}
+		}
+		c.recordInFlight(-len(batch.reqs))
+	}
+	return err
+}
+
+// eventLoop handles the filesystem events, handing off buffers of requests to
+// sendLoop, until the client is closed or a sending fails.
+func (c *Client) eventLoop(batches chan<- *pendingBatch, failed <-chan struct{}) error {
 	var reqs []*Request
 	// Events (File/Directory creation/modification/removal) are buffered
 	// instead of being directly. This allows us to use the same TLS/TCP
@@ -250,44 +1792,132 @@ func (c *Client) watcherLoop() error {
 	// requestsWaitTime time of no-activity.
 	// The requestsBufferSize cap is added in order to prevent constant
 	// events (eg. a file modified every 1 second) from being held forever.
+	// While paused, nothing is sent, and the buffer grows past the cap.
+	handOff := func(trigger flushTrigger) bool {
+		batch := &pendingBatch{reqs: reqs}
+		if c.queue != nil {
+			batch.queued = c.queue.count()
+		}
+		select {
+		case batches <- batch:
+			c.recordHandOff(len(reqs), trigger)
+			reqs = nil
+			return true
+		case <-failed:
+			return false
+		case <-c.closing:
+			return false
+		}
+	}
+	// Reconciliations are sent after the buffered requests.
+	handOffReconcile := func() bool {
+		if len(reqs) > 0 && !handOff(triggerOther) {
+			return false
+		}
+		select {
+		case batches <- &pendingBatch{reconcile: true}:
+			return true
+		case <-failed:
+			return false
+		case <-c.closing:
+			return false
+		}
+	}
+	var reconcile <-chan time.Time
+	if c.reconcileInterval > 0 {
+		ticker := time.NewTicker(c.reconcileInterval)
+		defer ticker.Stop()
+		reconcile = ticker.C
+	}
+	end, stop := c.monitorTimer()
+	defer stop()
 	for {
 		select {
 		case event, ok := <-c.watcher.Events:
 			if !ok {
 				// Exit on watcher close.
-				log.Println("Done monitoring")
+				c.logger.Log(LevelInfo, "Done monitoring", nil)
 				return nil
 			}
-			req, err := c.handleEvent(event)
+			c.invalidateTree(event)
+			event, ok = c.normalizeEvent(event)
+			if !ok {
+				break
+			}
+			localPath, ok := c.eventPath(event)
+			if !ok || !c.included(localPath) {
+				break
+			}
+			eventReqs, err := c.handleEvent(event)
 			if err != nil {
 				// Stop monitoring on first error.
 				return errors.Wrap(err, "Handling file event failed")
 			}
-			if req != nil {
-				reqs = append(reqs, req)
+			eventReqs = c.coalesceInitial(eventReqs)
+			paused := c.isPaused()
+			if len(eventReqs) > 0 && !(paused && c.pausePolicy == PauseDiscard) {
+				if c.queue != nil {
+					if err := c.queue.add(localPath); err != nil {
+						return errors.Wrap(err, "Logging pending change failed")
+					}
+				}
+				reqs = appendRequests(reqs, eventReqs)
 			}
 			// Don't keep buffering requests forever, in case of
 			// constant filesystem activity in the watched directories.
-			if len(reqs) == requestsBufferSize {
-				if err := c.sendRequests(reqs); err != nil {
-					return err
+			if c.bufferFull(reqs) && !paused {
+				c.logger.Log(LevelWarning, "Requests buffer cap reached", Fields{"requests": len(reqs)})
+				if !handOff(triggerCap) {
+					return nil
 				}
-				reqs = nil
 			}
 		case err, ok := <-c.watcher.Errors:
 			if !ok {
-				log.Println("Done monitoring")
+				c.logger.Log(LevelInfo, "Done monitoring", nil)
+				return nil
+			}
+			c.recordWatcherError(err == fsnotify.ErrEventOverflow)
+			// The modified entries are unknown.
+			c.localTreeCache().invalidatePath("", true)
+			if err != fsnotify.ErrEventOverflow {
+				return err
+			}
+			// The changes of the dropped events are found by reconciling.
+			c.logger.Log(LevelWarning, "Filesystem events dropped", Fields{"error": err})
+			if !c.isPaused() && !handOffReconcile() {
+				return nil
+			}
+		case <-c.resumed:
+			if len(reqs) > 0 && !handOff(triggerOther) {
 				return nil
 			}
-			return err
 		case <-time.After(requestsWaitTime):
-			if len(reqs) > 0 {
-				if err := c.sendRequests(reqs); err != nil {
-					return err
-				}
-				reqs = nil
+			// The events fired during the initial sync are handled.
+			c.stopInitialCoalescing()
+			if len(reqs) > 0 && !c.isPaused() && !handOff(triggerTimer) {
+				return nil
+			}
+		case <-reconcile:
+			if c.isPaused() {
+				break
+			}
+			if !handOffReconcile() {
+				return nil
 			}
+		case <-end:
+			c.stopInitialCoalescing()
+			if len(reqs) > 0 && !c.isPaused() {
+				handOff(triggerOther)
+			}
+			c.logger.Log(LevelInfo, "Done monitoring, monitor duration elapsed", nil)
+			return nil
+		case <-failed:
+			return nil
+		case <-c.closing:
+			c.logger.Log(LevelInfo, "Done monitoring", nil)
+			return nil
 		}
+		c.recordPending(len(reqs))
 	}
 }
 
@@ -297,44 +1927,139 @@ func isDirectory(path string) bool {
 	return err == nil && fi.IsDir()
 }
 
-// handleEvent handles a filesystem event, returing an adequate Request
-// eventually. In case of a Chmod event, nil is returned.
-func (c *Client) handleEvent(event fsnotify.Event) (*Request, error) {
-	relPath, err := filepath.Rel(c.path, event.Name)
-	if err != nil {
-		return nil, err
+// propagates checks whether the kind of filesystem events op is sent to the
+// server.
+func (c *Client) propagates(op fsnotify.Op) bool {
+	return c.eventMask&op == op
+}
+
+// eventPath returns the path of a filesystem event, relative to the client's
+// directory. Events of paths outside of it, eg. after racy renames, are dropped
+// with a warning.
+func (c *Client) eventPath(event fsnotify.Event) (string, bool) {
+	localPath, err := filepath.Rel(c.path, event.Name)
+	if err != nil || !isLocalPath(localPath) {
+		c.logger.Log(LevelWarning, "Dropping event outside of directory", Fields{"path": event.Name, "op": event.Op})
+		return "", false
+	}
+	return localPath, true
+}
+
+// handleEvent handles a filesystem event, returing adequate Requests
+// eventually. In case of a Chmod event, nil is returned unless mode changes are
+// sent.
+func (c *Client) handleEvent(event fsnotify.Event) ([]*Request, error) {
+	localPath, ok := c.eventPath(event)
+	if !ok {
+		return nil, nil
 	}
+	if !c.eventIsDir(event) && c.extensionExcluded(localPath) {
+		return nil, nil
+	}
+	relPath := c.remotePath(localPath)
 	switch {
 	case event.Op&fsnotify.Create == fsnotify.Create:
-		if isDir := isDirectory(event.Name); isDir {
-			if err := c.recursiveAddWatchers(event.Name); err != nil {
-				return nil, err
+		if info, err := os.Lstat(event.Name); err == nil && isSymlink(info) {
+			if !c.propagates(fsnotify.Create) {
+				return nil, nil
+			}
+			return c.linkRequests(event.Name, localPath, map[string]bool{})
+		} else if err == nil && isSpecial(info) {
+			if !c.propagates(fsnotify.Create) {
+				return nil, nil
 			}
-			return newMkdirRequest(relPath), nil
+			return c.specialRequests(event.Name, relPath, info), nil
+		}
+		if isDir := isDirectory(event.Name); isDir {
+			return c.newDirRequests(event.Name)
 		} else {
-			req, err := newCreateRequest(event.Name, relPath)
-			if err != nil {
-				return nil, err
+			if !c.propagates(fsnotify.Create) {
+				return nil, nil
 			}
-			return req, err
+			return c.stableCreateRequests(event.Name, relPath)
 		}
 	case event.Op&fsnotify.Remove == fsnotify.Remove:
-		return newRemoveRequest(relPath), nil
+		c.forgetWatchers(event.Name)
+		c.forgetSent(relPath)
+		if !c.propagates(fsnotify.Remove) {
+			return nil, nil
+		}
+		return []*Request{newRemoveRequest(relPath)}, nil
 	case event.Op&fsnotify.Rename == fsnotify.Rename:
 		// Rename is treated like a delete. If the new
 		// filename is within watched directories,
 		// fsnotify will send a Create even accordingly.
-		return newRemoveRequest(relPath), nil
+		c.forgetWatchers(event.Name)
+		c.forgetSent(relPath)
+		if !c.propagates(fsnotify.Rename) {
+			return nil, nil
+		}
+		return []*Request{newRemoveRequest(relPath)}, nil
 	case event.Op&fsnotify.Write == fsnotify.Write:
-		req, err := newCreateRequest(event.Name, relPath)
-		if err != nil {
-			return nil, err
+		if !c.propagates(fsnotify.Write) {
+			return nil, nil
 		}
-		return req, nil
+		return c.stableCreateRequests(event.Name, relPath)
 	case event.Op&fsnotify.Chmod == fsnotify.Chmod:
-		// XXX Nothing to do on the server's side ?
-		return nil, nil
+		if !c.propagates(fsnotify.Chmod) {
+			return nil, nil
+		}
+		return c.chmodRequests(event.Name, relPath)
 	default:
 		return nil, fmt.Errorf("Erroneous event value (%d): %s", event.Op, event.Name)
 	}
 }
+
+// eventIsDir checks whether the entry of a filesystem event is a directory.
+// Removed and renamed entries are, if they were watched.
+func (c *Client) eventIsDir(event fsnotify.Event) bool {
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		return c.watched[event.Name]
+	}
+	info, err := os.Lstat(event.Name)
+	return err == nil && info.IsDir()
+}
+
+// stableCreateRequests returns the Requests of a created or written file, as
+// createRequests does, once it is read in a stable state. Files that vanished,
+// eg. temporary files renamed or removed right away, are skipped, as are files
+// rewritten while read, whose next events send them.
+func (c *Client) stableCreateRequests(path, name string) ([]*Request, error) {
+	before, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		c.logger.Log(LevelInfo, "Skipping vanished file", Fields{"path": name})
+		return nil, nil
+	}
+	reqs, err := c.createRequests(path, name)
+	if os.IsNotExist(err) {
+		c.forgetSent(name)
+		c.logger.Log(LevelInfo, "Skipping vanished file", Fields{"path": name})
+		return nil, nil
+	}
+	if err != nil || len(reqs) == 0 || reqs[0].Type != requestCreate {
+		return reqs, err
+	}
+	after, err := os.Lstat(path)
+	if err != nil || !os.SameFile(before, after) || before.Size() != after.Size() || !before.ModTime().Equal(after.ModTime()) {
+		c.forgetSent(name)
+		c.logger.Log(LevelInfo, "Skipping file changed while read", Fields{"path": name})
+		return nil, nil
+	}
+	return reqs, nil
+}
+
+// createRequests returns the Create Request of a file, if it isn't skipped.
+// Special files aren't read, eg. named pipes would block.
+func (c *Client) createRequests(path, name string) ([]*Request, error) {
+	if info, err := os.Lstat(path); err == nil && isSpecial(info) {
+		return nil, nil
+	}
+	req, err := c.appendRequest(path, name)
+	if err == nil && req == nil {
+		req, err = c.newCreateRequest(path, name)
+	}
+	if err != nil || req == nil {
+		return nil, err
+	}
+	return []*Request{req}, nil
+}
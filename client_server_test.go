@@ -1,13 +1,36 @@
 package betterbox_test
 
 import (
+	"archive/tar"
 	"betterbox"
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"log"
+	"math/big"
+	"net"
+	"net/rpc"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
 	"time"
 )
 
@@ -27,7 +50,7 @@ const (
 	FILE = 1
 )
 
-func createTempDirWithFiles(t *testing.T, tFiles []testEntry) string {
+func createTempDirWithFiles(t testing.TB, tFiles []testEntry) string {
 	t.Helper()
 	dir, err := ioutil.TempDir("", "betterbox_test")
 	if err != nil {
@@ -50,6 +73,74 @@ func createTempDirWithFiles(t *testing.T, tFiles []testEntry) string {
 	return dir
 }
 
+// lastPort is the last TCP port used by a test server.
+var lastPort uint32 = serverPort
+
+// newTestServer starts a new server listening on an unused port, with an empty
+// destination directory.
+func newTestServer(t testing.TB, opts ...betterbox.ServerOption) (string, uint16) {
+	t.Helper()
+	return newTestServerOn(t, serverAddress, opts...)
+}
+
+// newTestServerOn starts a new server as newTestServer does, listening on the
+// provided address.
+func newTestServerOn(t testing.TB, address string, opts ...betterbox.ServerOption) (string, uint16) {
+	t.Helper()
+	_, sdir, port := startTestServer(t, address, opts...)
+	return sdir, port
+}
+
+// startTestServer starts a new server as newTestServerOn does, also returning
+// the server.
+func startTestServer(t testing.TB, address string, opts ...betterbox.ServerOption) (*betterbox.Server, string, uint16) {
+	t.Helper()
+	port := uint16(atomic.AddUint32(&lastPort, 1))
+	sdir := createTempDirWithFiles(t, nil)
+	server, err := betterbox.NewServer(address, port, sdir, opts...)
+	if err != nil {
+		t.Fatalf("Can't instantiate new server: %v", err)
+	}
+	go server.Listen()
+	waitForServer(t, address, port)
+	return server, sdir, port
+}
+
+// waitForServer waits until the server accepts connections on the provided
+// address and port.
+func waitForServer(t testing.TB, address string, port uint16) {
+	t.Helper()
+	address = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+	addrport := net.JoinHostPort(address, strconv.Itoa(int(port)))
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", addrport)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("Server not listening on %s", addrport)
+}
+
+// dialTestServer opens a raw RPC connection to the server, to send Requests
+// that a Client wouldn't.
+func dialTestServer(t testing.TB, port uint16) *rpc.Client {
+	t.Helper()
+	caCert, err := ioutil.ReadFile("./certs/server.cert")
+	if err != nil {
+		t.Fatalf("Can't read server certificate: %v", err)
+	}
+	certPool := x509.NewCertPool()
+	certPool.AppendCertsFromPEM(caCert)
+	addrport := net.JoinHostPort(serverAddress, strconv.Itoa(int(port)))
+	conn, err := tls.Dial("tcp", addrport, &tls.Config{RootCAs: certPool})
+	if err != nil {
+		t.Fatalf("Can't connect to server: %v", err)
+	}
+	return rpc.NewClient(conn)
+}
+
 func TestClientServerIntegration(t *testing.T) {
 	tFiles := []testEntry{
 		{"file1", FILE, []byte("file1 content")},
@@ -83,12 +174,5132 @@ func TestClientServerIntegration(t *testing.T) {
 	compareDirectories(t, cdir, sdir)
 }
 
-func compareDirectories(t *testing.T, dir1, dir2 string) {
+func compareDirectories(t testing.TB, dir1, dir2 string) {
+	t.Helper()
+	diffs, err := betterbox.CompareTrees(dir1, dir2, betterbox.CompareContent)
+	if err != nil {
+		t.Fatalf("Can't compare directories: %v", err)
+	}
+	if len(diffs) > 0 {
+		t.Fatalf("Directories differ: %v", diffs)
+	}
+}
+
+func TestCompareTrees(t *testing.T) {
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"dir1", DIR, nil},
+		{"dir1/file2", FILE, []byte("file2 content")},
+	}
+	dir1 := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(dir1)
+	dir2 := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(dir2)
+	if err := os.Chmod(filepath.Join(dir2, "file1"), 0644); err != nil {
+		t.Fatalf("Can't change mode: %v", err)
+	}
+	mode := betterbox.CompareContent | betterbox.CompareMode
+	for _, tc := range []struct {
+		flags betterbox.CompareFlags
+		diffs []betterbox.DiffKind
+	}{
+		// Modes are ignored in content-only comparison.
+		{betterbox.CompareContent, nil},
+		{mode, []betterbox.DiffKind{betterbox.DiffMode}},
+	} {
+		diffs, err := betterbox.CompareTrees(dir1, dir2, tc.flags)
+		if err != nil {
+			t.Fatalf("Can't compare directories: %v", err)
+		}
+		if len(diffs) != len(tc.diffs) {
+			t.Errorf("Flags %d: Differences %v, expected %v", tc.flags, diffs, tc.diffs)
+			continue
+		}
+		for i, d := range diffs {
+			if d.Path != "file1" || d.Kind != tc.diffs[i] {
+				t.Errorf("Flags %d: Unexpected difference %v", tc.flags, d)
+			}
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir2, "dir1", "file2"), []byte("new content"), 0600); err != nil {
+		t.Fatalf("Can't write file: %v", err)
+	}
+	if err := os.Remove(filepath.Join(dir1, "file1")); err != nil {
+		t.Fatalf("Can't remove file: %v", err)
+	}
+	diffs, err := betterbox.CompareTrees(dir1, dir2, mode)
+	if err != nil {
+		t.Fatalf("Can't compare directories: %v", err)
+	}
+	expected := []betterbox.Difference{
+		{Path: filepath.Join("dir1", "file2"), Kind: betterbox.DiffContent},
+		{Path: "file1", Kind: betterbox.DiffMissing},
+	}
+	if len(diffs) != len(expected) {
+		t.Fatalf("Differences %v, expected %v", diffs, expected)
+	}
+	for i, d := range diffs {
+		if d.Path != expected[i].Path || d.Kind != expected[i].Kind {
+			t.Errorf("Difference %v, expected %v", d, expected[i])
+		}
+	}
+}
+
+func TestSyncPaths(t *testing.T) {
+	tFiles := []testEntry{
+		{"file0", FILE, []byte("file0 content")},
+		{"a", DIR, nil},
+		{"a/file1", FILE, []byte("file1 content")},
+		{"a/b", DIR, nil},
+		{"a/b/file2", FILE, []byte("file2 content")},
+		{"c", DIR, nil},
+		{"c/file3", FILE, []byte("file3 content")},
+		{"c/d", DIR, nil},
+		{"c/d/file4", FILE, []byte("file4 content")},
+	}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	for _, path := range []string{"../outside", "/etc/passwd", ".", "missing"} {
+		if err := client.SyncPaths([]string{path}); err == nil {
+			t.Errorf("Path '%s' synced", path)
+		}
+	}
+	if err := client.SyncPaths([]string{"a/b/file2", "c"}); err != nil {
+		t.Fatalf("Client can't send paths to server: %v", err)
+	}
+	for _, name := range []string{"a", "a/b", "a/b/file2", "c", "c/file3", "c/d", "c/d/file4"} {
+		if _, err := os.Lstat(filepath.Join(sdir, name)); err != nil {
+			t.Errorf("'%s' not synced: %v", name, err)
+		}
+	}
+	for _, name := range []string{"file0", "a/file1"} {
+		if _, err := os.Lstat(filepath.Join(sdir, name)); !os.IsNotExist(err) {
+			t.Errorf("'%s' outside of the paths synced: %v", name, err)
+		}
+	}
+}
+
+func TestPreserveBtime(t *testing.T) {
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"dir1", DIR, nil},
+	}
+	sdir, port := newTestServer(t, betterbox.WithServerPreserveBtime())
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	// Older birth times than the server's copies would get, where settable.
+	past := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	settable := true
+	for _, entry := range tFiles {
+		err := betterbox.SetBirthTime(filepath.Join(cdir, entry.name), past)
+		if err == betterbox.ErrBtimeUnsupported {
+			settable = false
+			break
+		}
+		if err != nil {
+			t.Fatalf("Can't set birth time of %s: %v", entry.name, err)
+		}
+	}
+	btime, ok := betterbox.BirthTime(filepath.Join(cdir, "file1"))
+	if !ok {
+		t.Skip("Birth times unknown on this filesystem")
+	}
+	client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithPreserveBtime())
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	event := fsnotify.Event{Name: filepath.Join(cdir, "file1"), Op: fsnotify.Create}
+	if reqs, err := betterbox.HandleEvent(client, event); err != nil || len(reqs) != 1 || !reqs[0].Btime.Equal(btime) {
+		t.Errorf("Requests %v (%v), expected a Create with birth time %s", reqs, err, btime)
+	}
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+	compareDirectories(t, cdir, sdir)
+	if !settable {
+		return
+	}
+	for _, entry := range tFiles {
+		if sbtime, ok := betterbox.BirthTime(filepath.Join(sdir, entry.name)); !ok || !sbtime.Equal(past) {
+			t.Errorf("Server's %s birth time %s, expected %s", entry.name, sbtime, past)
+		}
+	}
+}
+
+func TestRemotePrefix(t *testing.T) {
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"dir1", DIR, nil},
+		{"dir1/file2", FILE, []byte("file2 content")},
+	}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+
+	client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithRemotePrefix("team/docs"))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+	compareDirectories(t, cdir, filepath.Join(sdir, "team", "docs"))
+}
+
+func TestIncludeRootDir(t *testing.T) {
+	tFiles := []testEntry{
+		{"project", DIR, nil},
+		{"project/file1", FILE, []byte("file1 content")},
+		{"project/dir1", DIR, nil},
+		{"project/dir1/file2", FILE, []byte("file2 content")},
+	}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+
+	client, err := betterbox.NewClient(serverAddress, port, filepath.Join(cdir, "project"), betterbox.WithIncludeRootDir())
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+	compareDirectories(t, cdir, sdir)
+}
+
+func TestResolvedRoot(t *testing.T) {
+	defer betterbox.SetRequestsWaitTime(50 * time.Millisecond)()
+	tFiles := []testEntry{
+		{"project", DIR, nil},
+		{"project/file1", FILE, []byte("file1 content")},
+		{"project/dir1", DIR, nil},
+	}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	linkDir := createTempDirWithFiles(t, nil)
+	defer os.RemoveAll(linkDir)
+	root := filepath.Join(linkDir, "current")
+	if err := os.Symlink(filepath.Join(cdir, "project"), root); err != nil {
+		t.Fatalf("Can't create symlink: %v", err)
+	}
+
+	client, err := betterbox.NewClient(serverAddress, port, root, betterbox.WithResolvedRoot(), betterbox.WithIncludeRootDir())
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	defer client.Close()
+	// Synced under the real directory's name.
+	startMonitoring(t, client, filepath.Join(sdir, "project", "file1"), tFiles[1].content)
+	if err := ioutil.WriteFile(filepath.Join(root, "dir1", "file2"), []byte("file2 content"), 0600); err != nil {
+		t.Fatalf("Can't write file: %v", err)
+	}
+	if !waitForFile(filepath.Join(sdir, "project", "dir1", "file2"), []byte("file2 content"), 5*time.Second) {
+		t.Errorf("File created through the symlink not synced")
+	}
+}
+
+func TestRemotePrefixOutsideDestination(t *testing.T) {
+	cdir := createTempDirWithFiles(t, nil)
+	defer os.RemoveAll(cdir)
+	for _, prefix := range []string{"../docs", "/docs", "team/../../docs"} {
+		_, err := betterbox.NewClient(serverAddress, serverPort, cdir, betterbox.WithRemotePrefix(prefix))
+		if err == nil {
+			t.Errorf("Remote prefix '%s' accepted", prefix)
+		}
+	}
+}
+
+func TestSnapshotPrefix(t *testing.T) {
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"dir1", DIR, nil},
+		{"dir1/file2", FILE, []byte("file2 content")},
+	}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	for _, prefix := range []string{"", ".", "../runs", "/runs"} {
+		if _, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithSnapshotPrefix(prefix)); err == nil {
+			t.Errorf("Snapshot prefix '%s' accepted", prefix)
+		}
+	}
+
+	// Each run is synced into its own snapshot, under the remote prefix.
+	snapshot := func(prefix string) string {
+		return filepath.Join(sdir, prefix, "team", "docs")
+	}
+	for _, prefix := range []string{"20261014T093000", "20261014T103000"} {
+		client, err := betterbox.NewClient(serverAddress, port, cdir,
+			betterbox.WithRemotePrefix("team/docs"), betterbox.WithSnapshotPrefix(prefix))
+		if err != nil {
+			t.Fatalf("Can't instantiate new client: %v", err)
+		}
+		if err = client.Sync(); err != nil {
+			t.Fatalf("Client can't send files to server: %v", err)
+		}
+		compareDirectories(t, cdir, snapshot(prefix))
+		if err := ioutil.WriteFile(filepath.Join(cdir, "file1"), []byte("file1 changed"), 0600); err != nil {
+			t.Fatalf("Can't write file: %v", err)
+		}
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(snapshot("20261014T093000"), "file1")); err != nil || string(content) != "file1 content" {
+		t.Errorf("First snapshot's file1 is '%s' (%v), expected 'file1 content'", content, err)
+	}
+}
+
+func TestServerRejectsPathOutsideDestination(t *testing.T) {
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	rconn := dialTestServer(t, port)
+	defer rconn.Close()
+
+	var resp betterbox.Response
+	req := &betterbox.Request{Path: "../escaped"}
+	if err := rconn.Call("Server.ApplyRequest", req, &resp); err != nil {
+		t.Fatalf("Sending request failed: %v", err)
+	}
+	if resp.Message == "" {
+		t.Errorf("Request '%s' accepted", req)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(sdir), "escaped")); err == nil {
+		t.Errorf("Directory created outside of destination")
+	}
+}
+
+func TestServerChecksContentChecksum(t *testing.T) {
+	for _, batch := range []bool{false, true} {
+		var opts []betterbox.ServerOption
+		if batch {
+			opts = append(opts, betterbox.WithTransactionalBatches())
+		}
+		sdir, port := newTestServer(t, opts...)
+		defer os.RemoveAll(sdir)
+		rconn := dialTestServer(t, port)
+		defer rconn.Close()
+
+		content := []byte("file1 content")
+		sum := sha256.Sum256(content)
+		for _, tc := range []struct {
+			name     string
+			data     []byte
+			checksum []byte
+			applied  bool
+		}{
+			{"truncated", content[:4], sum[:], false},
+			{"valid", content, sum[:], true},
+			{"unchecked", content, nil, true},
+		} {
+			req := betterbox.NewCreateRequest(tc.name, tc.data, tc.checksum)
+			var r betterbox.Response
+			if batch {
+				var resp betterbox.BatchResponse
+				batch := &betterbox.BatchRequest{Requests: []*betterbox.Request{req}}
+				if err := rconn.Call("Server.BatchApplyRequest", batch, &resp); err != nil {
+					t.Fatalf("Sending batch failed: %v", err)
+				}
+				r = resp.Responses[0]
+			} else if err := rconn.Call("Server.ApplyRequest", req, &r); err != nil {
+				t.Fatalf("Sending request failed: %v", err)
+			}
+			_, err := os.Stat(filepath.Join(sdir, tc.name))
+			if tc.applied && (r.Message != "" || err != nil) {
+				t.Errorf("%s content: Unexpected response: %s (%v)", tc.name, r, err)
+			}
+			if !tc.applied && (r.Code != betterbox.CodeCorrupted || !os.IsNotExist(err)) {
+				t.Errorf("%s content: Unexpected response: %s (code %d, %v)", tc.name, r, r.Code, err)
+			}
+		}
+	}
+}
+
+func TestOnSecurityReject(t *testing.T) {
+	type rejection struct {
+		addr string
+		req  *betterbox.Request
+	}
+	rejected := make(chan rejection, 2)
+	onReject := func(addr string, req *betterbox.Request) { rejected <- rejection{addr, req} }
+	server, sdir, port := startTestServer(t, serverAddress, betterbox.WithOnSecurityReject(onReject))
+	defer os.RemoveAll(sdir)
+	rconn := dialTestServer(t, port)
+	defer rconn.Close()
+
+	var resp betterbox.Response
+	for _, req := range []*betterbox.Request{betterbox.NewMkdirRequest("dir1"), {Path: "../etc/passwd"}} {
+		if err := rconn.Call("Server.ApplyRequest", req, &resp); err != nil {
+			t.Fatalf("Sending request failed: %v", err)
+		}
+	}
+	clients := server.ConnectedClients()
+	if len(clients) != 1 {
+		t.Fatalf("%d connected clients, expected 1", len(clients))
+	}
+	select {
+	case r := <-rejected:
+		if r.addr != clients[0].Address || r.req.Path != "../etc/passwd" {
+			t.Errorf("Unexpected rejection of '%s' from %s", r.req, r.addr)
+		}
+	default:
+		t.Fatalf("Rejection not reported")
+	}
+	if len(rejected) != 0 {
+		t.Errorf("Valid request reported")
+	}
+}
+
+func TestTransactionalBatchRollback(t *testing.T) {
+	tFiles := []testEntry{
+		{"dir1", DIR, nil},
+		{"dir1/file1", FILE, []byte("file1 content")},
+		{"file2", FILE, []byte("file2 content")},
+		{"file3", FILE, []byte("file3 content")},
+	}
+	sdir, port := newTestServer(t, betterbox.WithTransactionalBatches())
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	// Creating file3 on the server fails, as a directory exists there.
+	if err := os.Mkdir(filepath.Join(sdir, "file3"), 0700); err != nil {
+		t.Fatalf("Can't create directory on server: %v", err)
+	}
+
+	client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithBatchRequests())
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err == nil {
+		t.Fatalf("Sync succeeded despite failing request")
+	}
+	entries, err := ioutil.ReadDir(sdir)
+	if err != nil {
+		t.Fatalf("Can't read server directory: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "file3" {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Errorf("Batch partially applied, server directory contains: %v", names)
+	}
+}
+
+func TestIPv6(t *testing.T) {
+	if ln, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	} else {
+		ln.Close()
+	}
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+	}
+	sdir, port := newTestServerOn(t, "[::1]")
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+
+	client, err := betterbox.NewClient("::1", port, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+	compareDirectories(t, cdir, sdir)
+}
+
+func TestPreflight(t *testing.T) {
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, []testEntry{{"file1", FILE, []byte("file1 content")}})
+	defer os.RemoveAll(cdir)
+
+	client, err := betterbox.NewClient(serverAddress, port, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	result, err := client.Preflight()
+	if err != nil {
+		t.Fatalf("Preflight failed: %v", err)
+	}
+	if !result.Connected || !result.Healthy || result.Required != 13 || result.Usage.Free == 0 {
+		t.Errorf("Unexpected preflight result: %+v", *result)
+	}
+	if entries, _ := ioutil.ReadDir(sdir); len(entries) != 0 {
+		t.Errorf("Preflight modified server directory")
+	}
+
+	// No server listening on the next port.
+	downPort := uint16(atomic.AddUint32(&lastPort, 1))
+	client, err = betterbox.NewClient(serverAddress, downPort, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	result, err = client.Preflight()
+	if err == nil {
+		t.Fatalf("Preflight succeeded against down server")
+	}
+	if result.Connected || !strings.Contains(err.Error(), "Connection to server failed") {
+		t.Errorf("Unexpected preflight failure: %+v: %v", *result, err)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	rpcClient := dialTestServer(t, port)
+	defer rpcClient.Close()
+	var usage betterbox.UsageResponse
+	if err := rpcClient.Call("Server.Usage", &betterbox.UsageRequest{}, &usage); err != nil {
+		t.Fatalf("Calling server failed: %v", err)
+	}
+	if usage.Total == 0 || usage.Free == 0 || usage.Free > usage.Total || usage.Used > usage.Total {
+		t.Errorf("Implausible usage: %+v", usage)
+	}
+}
+
+// waitForFile waits until the file at path has the provided content, returning
+// whether it did before the timeout.
+func waitForFile(path string, content []byte, timeout time.Duration) bool {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if data, err := ioutil.ReadFile(path); err == nil && string(data) == string(content) {
+			return true
+		}
+	}
+	return false
+}
+
+// startMonitoring runs the client's SyncAndMonitor in the background, waiting
+// for the initial sync of the provided file.
+func startMonitoring(t testing.TB, client *betterbox.Client, syncedFile string, content []byte) <-chan error {
 	t.Helper()
-	// XXX Walk directories, compare file names, last modified, size, content hash etc,.
-	output, err := exec.Command("diff", "--brief", "-r", dir1, dir2).Output()
+	errc := make(chan error, 1)
+	go func() { errc <- client.SyncAndMonitor() }()
+	if !waitForFile(syncedFile, content, 5*time.Second) {
+		t.Fatalf("Initial sync not done")
+	}
+	return errc
+}
+
+func TestWatcherStats(t *testing.T) {
+	errs, restore := betterbox.InjectWatcherErrors()
+	defer restore()
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"dir1", DIR, nil},
+		{"dir1/dir2", DIR, nil},
+	}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	errc := startMonitoring(t, client, filepath.Join(sdir, "file1"), tFiles[0].content)
+	if stats := client.Stats(); stats.ActiveWatches != 3 || stats.WatcherErrors != 0 {
+		t.Errorf("%d active watches and %d watcher errors, expected 3 and 0", stats.ActiveWatches, stats.WatcherErrors)
+	}
+
+	// Overflows are counted, and monitoring goes on.
+	errs <- fsnotify.ErrEventOverflow
+	errs <- errors.New("Watcher failure")
+	select {
+	case err := <-errc:
+		if err == nil || err.Error() != "Watcher failure" {
+			t.Errorf("Monitoring stopped with %v, expected the watcher's error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Monitoring not stopped on watcher error")
+	}
+	if stats := client.Stats(); stats.WatcherErrors != 2 || stats.EventOverflows != 1 {
+		t.Errorf("%d watcher errors and %d overflows, expected 2 and 1", stats.WatcherErrors, stats.EventOverflows)
+	}
+	client.Close()
+	if stats := client.Stats(); stats.ActiveWatches != 0 {
+		t.Errorf("%d active watches after close, expected 0", stats.ActiveWatches)
+	}
+}
+
+func TestMonitorDuration(t *testing.T) {
+	// Changes stay buffered until the end of the monitoring.
+	defer betterbox.SetRequestsWaitTime(10 * time.Second)()
+	const duration = time.Second
+	tFiles := []testEntry{{"file1", FILE, []byte("file1 content")}}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	if _, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithMonitorDuration(0)); err == nil {
+		t.Errorf("Client created with a zero monitor duration")
+	}
+	client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithMonitorDuration(duration))
 	if err != nil {
-		// exit status not 0
-		t.Fatalf("Directories differ: %s", output)
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	defer client.Close()
+	start := time.Now()
+	errc := startMonitoring(t, client, filepath.Join(sdir, "file1"), tFiles[0].content)
+	content := []byte("file2 content")
+	if err := ioutil.WriteFile(filepath.Join(cdir, "file2"), content, 0600); err != nil {
+		t.Fatalf("Can't write file: %v", err)
+	}
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("Monitoring failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Monitoring not stopped after its duration")
+	}
+	if elapsed := time.Since(start); elapsed < duration {
+		t.Errorf("Monitoring stopped after %s, expected %s", elapsed, duration)
+	}
+	if synced, err := ioutil.ReadFile(filepath.Join(sdir, "file2")); err != nil || !bytes.Equal(synced, content) {
+		t.Errorf("Buffered change not sent: '%s' (%v)", synced, err)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	defer betterbox.SetRequestsWaitTime(200 * time.Millisecond)()
+	for _, tc := range []struct {
+		policy betterbox.PausePolicy
+		synced bool
+	}{
+		{betterbox.PauseBuffer, true},
+		{betterbox.PauseDiscard, false},
+	} {
+		tFiles := []testEntry{{"file1", FILE, []byte("file1 content")}}
+		sdir, port := newTestServer(t)
+		defer os.RemoveAll(sdir)
+		cdir := createTempDirWithFiles(t, tFiles)
+		defer os.RemoveAll(cdir)
+		client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithPausePolicy(tc.policy))
+		if err != nil {
+			t.Fatalf("Can't instantiate new client: %v", err)
+		}
+		errc := startMonitoring(t, client, filepath.Join(sdir, "file1"), tFiles[0].content)
+
+		client.Pause()
+		content := []byte("file2 content")
+		if err := ioutil.WriteFile(filepath.Join(cdir, "file2"), content, 0600); err != nil {
+			t.Fatalf("Can't write file: %v", err)
+		}
+		if waitForFile(filepath.Join(sdir, "file2"), content, time.Second) {
+			t.Errorf("Policy %d: File sent while paused", tc.policy)
+		}
+		client.Resume()
+		if synced := waitForFile(filepath.Join(sdir, "file2"), content, time.Second); synced != tc.synced {
+			t.Errorf("Policy %d: File synced on resume: %v, expected %v", tc.policy, synced, tc.synced)
+		}
+		client.Close()
+		if err := <-errc; err != nil {
+			t.Errorf("Monitoring failed: %v", err)
+		}
+	}
+}
+
+func TestBufferBytes(t *testing.T) {
+	content := make([]byte, 1000)
+	tFiles := []testEntry{
+		{"file1", FILE, content},
+		{"file2", FILE, content},
+		{"file3", FILE, content},
+		{"file4", FILE, []byte("small")},
+	}
+	for _, tc := range []struct {
+		opts    []betterbox.ClientOption
+		flushes int
+	}{
+		{nil, 1},
+		// Flushed when file2 makes the buffer exceed the cap, then with file4.
+		{[]betterbox.ClientOption{betterbox.WithBufferBytes(1500)}, 2},
+	} {
+		sdir, port := newTestServer(t)
+		defer os.RemoveAll(sdir)
+		cdir := createTempDirWithFiles(t, tFiles)
+		defer os.RemoveAll(cdir)
+		client, err := betterbox.NewClient(serverAddress, port, cdir, tc.opts...)
+		if err != nil {
+			t.Fatalf("Can't instantiate new client: %v", err)
+		}
+		if err = client.Sync(); err != nil {
+			t.Fatalf("Client can't send files to server: %v", err)
+		}
+		compareDirectories(t, cdir, sdir)
+		if stats := client.Stats(); stats.Flushes != tc.flushes {
+			t.Errorf("%d flushes, expected %d", stats.Flushes, tc.flushes)
+		}
+	}
+}
+
+func TestBufferedLinkCopies(t *testing.T) {
+	content := make([]byte, 1000)
+	external := createTempDirWithFiles(t, []testEntry{
+		{"file1", FILE, content},
+		{"file2", FILE, content},
+		{"file3", FILE, content},
+	})
+	defer os.RemoveAll(external)
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, nil)
+	defer os.RemoveAll(cdir)
+	if err := os.Symlink(external, filepath.Join(cdir, "link")); err != nil {
+		t.Fatalf("Can't create symlink: %v", err)
+	}
+	client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithBufferBytes(1500))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+	compareDirectories(t, external, filepath.Join(sdir, "link"))
+	// Flushed when file2 makes the buffer exceed the cap, then with file3.
+	if stats := client.Stats(); stats.Flushes != 2 {
+		t.Errorf("%d flushes, expected 2", stats.Flushes)
+	}
+}
+
+func TestSingleFile(t *testing.T) {
+	defer betterbox.SetRequestsWaitTime(50 * time.Millisecond)()
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"file2", FILE, []byte("file2 content")},
+		{"dir1", DIR, nil},
+	}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, port, filepath.Join(cdir, "file1"))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	errc := startMonitoring(t, client, filepath.Join(sdir, "file1"), tFiles[0].content)
+	content := []byte("modified content")
+	for _, name := range []string{"file2", "dir1/file3", "file1"} {
+		if err := ioutil.WriteFile(filepath.Join(cdir, name), content, 0600); err != nil {
+			t.Fatalf("Can't write file: %v", err)
+		}
+	}
+	if !waitForFile(filepath.Join(sdir, "file1"), content, 5*time.Second) {
+		t.Errorf("File modification not synced")
+	}
+	client.Close()
+	if err := <-errc; err != nil {
+		t.Errorf("Monitoring failed: %v", err)
+	}
+	if entries, _ := ioutil.ReadDir(sdir); len(entries) != 1 {
+		t.Errorf("%d entries synced, expected only the file", len(entries))
+	}
+}
+
+func TestWatcherFallback(t *testing.T) {
+	defer betterbox.FailWatchers()()
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"dir1", DIR, nil},
+		{"dir1/file2", FILE, []byte("file2 content")},
+	}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err := client.SyncAndMonitor(); err == nil {
+		t.Errorf("Monitoring without watcher succeeded")
+	}
+
+	client, err = betterbox.NewClient(serverAddress, port, cdir, betterbox.WithWatcherFallback(0))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err := client.SyncAndMonitor(); err != nil {
+		t.Fatalf("Falling back to syncing failed: %v", err)
+	}
+	compareDirectories(t, cdir, sdir)
+
+	client, err = betterbox.NewClient(serverAddress, port, cdir, betterbox.WithWatcherFallback(50*time.Millisecond), betterbox.WithInitialSync(betterbox.InitialSyncReconcile))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- client.SyncAndMonitor() }()
+	content := []byte("polled content")
+	if err := ioutil.WriteFile(filepath.Join(cdir, "file1"), content, 0600); err != nil {
+		t.Fatalf("Can't write file: %v", err)
+	}
+	if !waitForFile(filepath.Join(sdir, "file1"), content, 5*time.Second) {
+		t.Errorf("File modification not polled")
+	}
+	client.Close()
+	if err := <-errc; err != nil {
+		t.Errorf("Polling failed: %v", err)
+	}
+}
+
+func TestConnectRetry(t *testing.T) {
+	tFiles := []testEntry{{"file1", FILE, []byte("file1 content")}}
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	// The client syncs before the server is started.
+	port := uint16(atomic.AddUint32(&lastPort, 1))
+	client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithConnectRetry(8, 20*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- client.Sync() }()
+	time.Sleep(200 * time.Millisecond)
+	sdir := createTempDirWithFiles(t, nil)
+	defer os.RemoveAll(sdir)
+	server, err := betterbox.NewServer(serverAddress, port, sdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new server: %v", err)
+	}
+	go server.Listen()
+	if err := <-errc; err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+	compareDirectories(t, cdir, sdir)
+}
+
+func TestLatencies(t *testing.T) {
+	tFiles := []testEntry{
+		{"dir1", DIR, nil},
+		{"dir1/fast", FILE, []byte("fast content")},
+		{"dir1/slow", FILE, []byte("slow content")},
+	}
+	const delay = 200 * time.Millisecond
+	sdir, port := newTestServer(t, betterbox.WithServerLogger(delayLogger{"dir1/slow", delay}))
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+	latencies := client.Stats().Latencies
+	if create := latencies["Create"]; create.Count != 2 || create.Max < delay || create.P99 != create.Max || create.Min >= delay {
+		t.Errorf("Unexpected Create latencies: %+v", create)
+	}
+	if mkdir := latencies["Mkdir"]; mkdir.Count != 1 || mkdir.Max >= delay || mkdir.Avg != mkdir.Max {
+		t.Errorf("Unexpected Mkdir latencies: %+v", mkdir)
+	}
+}
+
+func TestEventOutsideDirectory(t *testing.T) {
+	base := createTempDirWithFiles(t, []testEntry{
+		{"client", DIR, nil},
+		{"client/file1", FILE, []byte("file1 content")},
+		{"client-other", DIR, nil},
+		{"client-other/file1", FILE, []byte("file1 content")},
+		{"outside", FILE, []byte("outside content")},
+	})
+	defer os.RemoveAll(base)
+	client, err := betterbox.NewClient(serverAddress, serverPort, filepath.Join(base, "client"))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	for _, name := range []string{"outside", "client-other/file1"} {
+		event := fsnotify.Event{Name: filepath.Join(base, name), Op: fsnotify.Create}
+		if reqs, err := betterbox.HandleEvent(client, event); err != nil || len(reqs) != 0 {
+			t.Errorf("Event of '%s' not ignored: %v %v", name, reqs, err)
+		}
+	}
+	event := fsnotify.Event{Name: filepath.Join(base, "client", "file1"), Op: fsnotify.Create}
+	if reqs, err := betterbox.HandleEvent(client, event); err != nil || len(reqs) != 1 {
+		t.Errorf("Event within directory ignored: %v %v", reqs, err)
+	}
+}
+
+func TestFileReplacedBeforeRead(t *testing.T) {
+	cdir := createTempDirWithFiles(t, []testEntry{{"file1", FILE, []byte("file1 content")}})
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, serverPort, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	// The file is replaced by a directory after being stat'ed.
+	path := filepath.Join(cdir, "file1")
+	defer betterbox.SetBeforeRead(func(name string) {
+		if name != path {
+			return
+		}
+		if err := os.Remove(path); err != nil {
+			t.Fatalf("Can't remove file: %v", err)
+		}
+		if err := os.Mkdir(path, 0700); err != nil {
+			t.Fatalf("Can't create directory: %v", err)
+		}
+	})()
+	for _, op := range []fsnotify.Op{fsnotify.Create, fsnotify.Write} {
+		if err := os.RemoveAll(path); err != nil {
+			t.Fatalf("Can't remove directory: %v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte("file1 content"), 0600); err != nil {
+			t.Fatalf("Can't write file: %v", err)
+		}
+		// Left to the events of the directory.
+		reqs, err := betterbox.HandleEvent(client, fsnotify.Event{Name: path, Op: op})
+		if err != nil || len(reqs) != 0 {
+			t.Errorf("%s event of replaced file: Unexpected requests %v (%v)", op, reqs, err)
+		}
+	}
+}
+
+func TestUnstableFileEvents(t *testing.T) {
+	cdir := createTempDirWithFiles(t, nil)
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, serverPort, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	path := filepath.Join(cdir, "file1")
+	for name, change := range map[string]func() error{
+		"vanished": func() error { return os.Remove(path) },
+		"rewritten": func() error {
+			return ioutil.WriteFile(path, []byte("file1 longer content"), 0600)
+		},
+	} {
+		restore := betterbox.SetBeforeRead(func(read string) {
+			if read == path {
+				if err := change(); err != nil {
+					t.Fatalf("Can't change file: %v", err)
+				}
+			}
+		})
+		for _, op := range []fsnotify.Op{fsnotify.Create, fsnotify.Write} {
+			if err := ioutil.WriteFile(path, []byte("file1 content"), 0600); err != nil {
+				t.Fatalf("Can't write file: %v", err)
+			}
+			// Left to the following events of the file.
+			reqs, err := betterbox.HandleEvent(client, fsnotify.Event{Name: path, Op: op})
+			if err != nil || len(reqs) != 0 {
+				t.Errorf("%s event of %s file: Unexpected requests %v (%v)", op, name, reqs, err)
+			}
+		}
+		restore()
+	}
+}
+
+func TestCreateThenWrite(t *testing.T) {
+	for _, appends := range []bool{false, true} {
+		cdir := createTempDirWithFiles(t, nil)
+		defer os.RemoveAll(cdir)
+		var opts []betterbox.ClientOption
+		if appends {
+			opts = append(opts, betterbox.WithAppends())
+		}
+		client, err := betterbox.NewClient(serverAddress, serverPort, cdir, opts...)
+		if err != nil {
+			t.Fatalf("Can't instantiate new client: %v", err)
+		}
+		// A new file, written to after the Create event is handled.
+		path := filepath.Join(cdir, "new")
+		if err := ioutil.WriteFile(path, []byte("first part, "), 0600); err != nil {
+			t.Fatalf("Can't write file: %v", err)
+		}
+		var reqs []*betterbox.Request
+		for _, op := range []fsnotify.Op{fsnotify.Create, fsnotify.Write} {
+			if op == fsnotify.Write {
+				appendFile(t, path, []byte("second part"))
+			}
+			eventReqs, err := betterbox.HandleEvent(client, fsnotify.Event{Name: path, Op: op})
+			if err != nil {
+				t.Fatalf("Handling %s event failed: %v", op, err)
+			}
+			reqs = betterbox.AppendRequests(reqs, eventReqs)
+		}
+		content := "first part, second part"
+		sum := sha256.Sum256([]byte(content))
+		if len(reqs) != 1 || reqs[0].Type.String() != "Create" || string(reqs[0].Data) != content || !bytes.Equal(reqs[0].Checksum, sum[:]) {
+			t.Errorf("Appends %v: Requests %v, expected a single Create of %q", appends, reqs, content)
+		}
+	}
+}
+
+func TestRenameIntoPlace(t *testing.T) {
+	defer betterbox.SetRequestsWaitTime(100 * time.Millisecond)()
+	tFiles := []testEntry{{"file1", FILE, []byte("file1 content")}}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	errc := startMonitoring(t, client, filepath.Join(sdir, "file1"), tFiles[0].content)
+	// The file is written next to the directory, then renamed into it.
+	tmp := cdir + ".tmp"
+	defer os.Remove(tmp)
+	content := []byte("file2 complete content")
+	for _, part := range [][]byte{content[:5], content} {
+		if err := ioutil.WriteFile(tmp, part, 0600); err != nil {
+			t.Fatalf("Can't write file: %v", err)
+		}
+	}
+	if err := os.Rename(tmp, filepath.Join(cdir, "file2")); err != nil {
+		t.Fatalf("Can't rename file: %v", err)
+	}
+	if !waitForFile(filepath.Join(sdir, "file2"), content, 5*time.Second) {
+		t.Errorf("File renamed into place not synced")
+	}
+	client.Close()
+	if err := <-errc; err != nil {
+		t.Errorf("Monitoring failed: %v", err)
+	}
+}
+
+func TestNestedDirectories(t *testing.T) {
+	defer betterbox.SetRequestsWaitTime(300 * time.Millisecond)()
+	tFiles := []testEntry{{"file0", FILE, []byte("initial content")}}
+	logger := &receivedLogger{received: make(map[string]int)}
+	sdir, port := newTestServer(t, betterbox.WithServerLogger(logger))
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	errc := startMonitoring(t, client, filepath.Join(sdir, "file0"), tFiles[0].content)
+	var files []string
+	for i := 0; i < 3; i++ {
+		dir := filepath.Join(fmt.Sprintf("a%d", i), "b", "c", "d")
+		if err := os.MkdirAll(filepath.Join(cdir, dir), 0700); err != nil {
+			t.Fatalf("Can't create directories: %v", err)
+		}
+		for ; dir != "."; dir = filepath.Dir(dir) {
+			name := filepath.Join(dir, "file")
+			if err := ioutil.WriteFile(filepath.Join(cdir, name), []byte(name), 0600); err != nil {
+				t.Fatalf("Can't write file: %v", err)
+			}
+			files = append(files, name)
+		}
+	}
+	for _, name := range files {
+		if !waitForFile(filepath.Join(sdir, name), []byte(name), 5*time.Second) {
+			t.Fatalf("'%s' not synced", name)
+		}
+	}
+	client.Close()
+	if err := <-errc; err != nil {
+		t.Errorf("Monitoring failed: %v", err)
+	}
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+	for _, name := range files {
+		if n := logger.received[filepath.ToSlash(name)]; n != 1 {
+			t.Errorf("'%s' received %d times", name, n)
+		}
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	defer betterbox.SetRequestsWaitTime(100 * time.Millisecond)()
+	tFiles := []testEntry{
+		{"file0", FILE, []byte("file0 content")},
+		{"a", DIR, nil},
+		{"a/file1", FILE, []byte("file1 content")},
+		{"a/b", DIR, nil},
+		{"a/b/file2", FILE, []byte("file2 content")},
+		{"a/b/c", DIR, nil},
+		{"a/b/c/file3", FILE, []byte("file3 content")},
+	}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithMaxDepth(2))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	errc := startMonitoring(t, client, filepath.Join(sdir, "a", "file1"), []byte("file1 content"))
+	// Changes within the depth are synced, but not the deeper ones.
+	for _, name := range []string{"a/b/file4", "a/file5"} {
+		if err := ioutil.WriteFile(filepath.Join(cdir, name), []byte(name), 0600); err != nil {
+			t.Fatalf("Can't write file: %v", err)
+		}
+	}
+	if !waitForFile(filepath.Join(sdir, "a", "file5"), []byte("a/file5"), 5*time.Second) {
+		t.Fatalf("File within the maximum depth not synced")
+	}
+	client.Close()
+	if err := <-errc; err != nil {
+		t.Errorf("Monitoring failed: %v", err)
+	}
+	for _, name := range []string{"file0", "a/file1", "a/b", "a/file5"} {
+		if _, err := os.Lstat(filepath.Join(sdir, name)); err != nil {
+			t.Errorf("'%s' not synced: %v", name, err)
+		}
+	}
+	for _, name := range []string{"a/b/file2", "a/b/c", "a/b/file4"} {
+		if _, err := os.Lstat(filepath.Join(sdir, name)); !os.IsNotExist(err) {
+			t.Errorf("'%s' beyond the maximum depth synced: %v", name, err)
+		}
+	}
+	if watched := betterbox.WatchedDirs(client); fmt.Sprint(watched) != "[. a]" {
+		t.Errorf("Watched %v, expected [. a]", watched)
+	}
+}
+
+func TestIncludeExtensions(t *testing.T) {
+	defer betterbox.SetRequestsWaitTime(100 * time.Millisecond)()
+	tFiles := []testEntry{
+		{"readme.md", FILE, []byte("readme.md content")},
+		{"logo.png", FILE, []byte("logo.png content")},
+		{"notes.txt", FILE, []byte("notes.txt content")},
+		{"docs", DIR, nil},
+		{"docs/guide.md", FILE, []byte("guide.md content")},
+		{"docs/main.go", FILE, []byte("main.go content")},
+		{"empty", DIR, nil},
+	}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	if _, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithIncludeExtensions("")); err == nil {
+		t.Errorf("Client created with an empty extension")
+	}
+	client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithIncludeExtensions(".md", "png"))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	errc := startMonitoring(t, client, filepath.Join(sdir, "readme.md"), []byte("readme.md content"))
+	for _, name := range []string{"docs/changes.txt", "docs/changes.md"} {
+		if err := ioutil.WriteFile(filepath.Join(cdir, name), []byte(name), 0600); err != nil {
+			t.Fatalf("Can't write file: %v", err)
+		}
+	}
+	if !waitForFile(filepath.Join(sdir, "docs", "changes.md"), []byte("docs/changes.md"), 5*time.Second) {
+		t.Fatalf("Monitored file with an included extension not synced")
+	}
+	client.Close()
+	if err := <-errc; err != nil {
+		t.Errorf("Monitoring failed: %v", err)
+	}
+	for _, name := range []string{"readme.md", "logo.png", "docs", "docs/guide.md", "empty"} {
+		if _, err := os.Lstat(filepath.Join(sdir, name)); err != nil {
+			t.Errorf("'%s' not synced: %v", name, err)
+		}
+	}
+	for _, name := range []string{"notes.txt", "docs/main.go", "docs/changes.txt"} {
+		if _, err := os.Lstat(filepath.Join(sdir, name)); !os.IsNotExist(err) {
+			t.Errorf("'%s' with an excluded extension synced: %v", name, err)
+		}
+	}
+}
+
+func appendFile(t testing.TB, path string, data []byte) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("Can't open file: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("Can't append to file: %v", err)
+	}
+}
+
+func TestAppends(t *testing.T) {
+	defer betterbox.SetRequestsWaitTime(100 * time.Millisecond)()
+	for _, batch := range []bool{false, true} {
+		var sopts []betterbox.ServerOption
+		copts := []betterbox.ClientOption{betterbox.WithAppends()}
+		if batch {
+			sopts = append(sopts, betterbox.WithTransactionalBatches())
+			copts = append(copts, betterbox.WithBatchRequests())
+		}
+		tFiles := []testEntry{{"log", FILE, []byte("line 1\n")}}
+		sdir, port := newTestServer(t, sopts...)
+		defer os.RemoveAll(sdir)
+		cdir := createTempDirWithFiles(t, tFiles)
+		defer os.RemoveAll(cdir)
+		client, err := betterbox.NewClient(serverAddress, port, cdir, copts...)
+		if err != nil {
+			t.Fatalf("Can't instantiate new client: %v", err)
+		}
+		errc := startMonitoring(t, client, filepath.Join(sdir, "log"), tFiles[0].content)
+
+		// Only the appended bytes are sent.
+		before := client.Stats()
+		appendFile(t, filepath.Join(cdir, "log"), []byte("line 2\n"))
+		if !waitForFile(filepath.Join(sdir, "log"), []byte("line 1\nline 2\n"), 5*time.Second) {
+			t.Fatalf("Appended bytes not synced")
+		}
+		if sent := client.Stats().Bytes - before.Bytes; sent != int64(len("line 2\n")) {
+			t.Errorf("%d bytes sent, expected %d", sent, len("line 2\n"))
+		}
+
+		// The whole file is sent again once the server's diverged.
+		if err := ioutil.WriteFile(filepath.Join(sdir, "log"), []byte("server\n"), 0600); err != nil {
+			t.Fatalf("Can't write file: %v", err)
+		}
+		appendFile(t, filepath.Join(cdir, "log"), []byte("line 3\n"))
+		if !waitForFile(filepath.Join(sdir, "log"), []byte("line 1\nline 2\nline 3\n"), 5*time.Second) {
+			t.Errorf("Diverged file not synced")
+		}
+		client.Close()
+		if err := <-errc; err != nil {
+			t.Errorf("Monitoring failed: %v", err)
+		}
+	}
+}
+
+func TestPathTransform(t *testing.T) {
+	defer betterbox.SetRequestsWaitTime(50 * time.Millisecond)()
+	tFiles := []testEntry{
+		{"FILE1", FILE, []byte("file1 content")},
+		{"Dir1", DIR, nil},
+		{"Dir1/File2", FILE, []byte("file2 content")},
+	}
+	sdir, port := newTestServer(t, betterbox.WithPathTransform(strings.ToLower))
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	errc := startMonitoring(t, client, filepath.Join(sdir, "file1"), tFiles[0].content)
+	if !waitForFile(filepath.Join(sdir, "dir1", "file2"), tFiles[2].content, 5*time.Second) {
+		t.Errorf("File not stored under lowercased path")
+	}
+	if err := os.Remove(filepath.Join(cdir, "FILE1")); err != nil {
+		t.Fatalf("Can't remove file: %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		if _, err := os.Stat(filepath.Join(sdir, "file1")); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Lowercased file not removed")
+		}
+	}
+	client.Close()
+	if err := <-errc; err != nil {
+		t.Errorf("Monitoring failed: %v", err)
+	}
+	entries, _ := ioutil.ReadDir(sdir)
+	if len(entries) != 1 || entries[0].Name() != "dir1" {
+		t.Errorf("Unexpected server entries: %v", entries)
+	}
+
+	// Transformed paths are validated too.
+	escape := func(path string) string { return "../" + path }
+	sdir, port = newTestServer(t, betterbox.WithPathTransform(escape))
+	defer os.RemoveAll(sdir)
+	client, err = betterbox.NewClient(serverAddress, port, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err == nil {
+		t.Errorf("Transformed path outside destination accepted")
+	}
+}
+
+func TestFlushTriggers(t *testing.T) {
+	defer betterbox.SetRequestsWaitTime(50 * time.Millisecond)()
+	tFiles := []testEntry{{"file0", FILE, []byte("initial")}}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithBufferBytes(100))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	errc := startMonitoring(t, client, filepath.Join(sdir, "file0"), tFiles[0].content)
+	for _, tc := range []struct {
+		name    string
+		content []byte
+		capped  bool // Flushed on reaching the byte cap, or on the timer.
+	}{
+		{"small", []byte("small content"), false},
+		{"large", make([]byte, 1000), true},
+	} {
+		before := client.Stats()
+		if err := ioutil.WriteFile(filepath.Join(cdir, tc.name), tc.content, 0600); err != nil {
+			t.Fatalf("Can't write file: %v", err)
+		}
+		if !waitForFile(filepath.Join(sdir, tc.name), tc.content, 5*time.Second) {
+			t.Fatalf("'%s' not synced", tc.name)
+		}
+		after := client.Stats()
+		if capped := after.CapFlushes - before.CapFlushes; (capped > 0) != tc.capped {
+			t.Errorf("'%s': %d cap-triggered flushes", tc.name, capped)
+		}
+		if !tc.capped && after.TimerFlushes == before.TimerFlushes {
+			t.Errorf("'%s': No timer-triggered flush", tc.name)
+		}
+	}
+	client.Close()
+	if err := <-errc; err != nil {
+		t.Errorf("Monitoring failed: %v", err)
+	}
+}
+
+func TestEventMask(t *testing.T) {
+	defer betterbox.SetRequestsWaitTime(200 * time.Millisecond)()
+	tFiles := []testEntry{{"file1", FILE, []byte("file1 content")}}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithEventMask(fsnotify.Create|fsnotify.Write))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	errc := startMonitoring(t, client, filepath.Join(sdir, "file1"), tFiles[0].content)
+	defer func() {
+		client.Close()
+		<-errc
+	}()
+
+	if err := os.Remove(filepath.Join(cdir, "file1")); err != nil {
+		t.Fatalf("Can't remove file: %v", err)
+	}
+	// Events are handled in order: file1's removal was before file2 is synced.
+	content := []byte("file2 content")
+	if err := ioutil.WriteFile(filepath.Join(cdir, "file2"), content, 0600); err != nil {
+		t.Fatalf("Can't write file: %v", err)
+	}
+	if !waitForFile(filepath.Join(sdir, "file2"), content, 2*time.Second) {
+		t.Fatalf("Created file not synced")
+	}
+	if _, err := os.Stat(filepath.Join(sdir, "file1")); err != nil {
+		t.Errorf("Removed file not kept on server: %v", err)
+	}
+}
+
+func TestReplayRejected(t *testing.T) {
+	sdir, port := newTestServer(t, betterbox.WithReplayProtection())
+	defer os.RemoveAll(sdir)
+
+	handshake := func(rconn *rpc.Client) []byte {
+		var resp betterbox.HandshakeResponse
+		if err := rconn.Call("Server.Handshake", &betterbox.HandshakeRequest{}, &resp); err != nil {
+			t.Fatalf("Handshake failed: %v", err)
+		}
+		return resp.Nonce
+	}
+	apply := func(rconn *rpc.Client, req *betterbox.Request) betterbox.Response {
+		var resp betterbox.Response
+		if err := rconn.Call("Server.ApplyRequest", req, &resp); err != nil {
+			t.Fatalf("Sending request failed: %v", err)
+		}
+		return resp
+	}
+
+	rconn := dialTestServer(t, port)
+	defer rconn.Close()
+	if resp := apply(rconn, &betterbox.Request{Path: "dir0"}); resp.Message == "" {
+		t.Errorf("Request without handshake accepted")
+	}
+	captured := &betterbox.Request{Path: "dir1", Nonce: handshake(rconn), Seq: 1}
+	if resp := apply(rconn, captured); resp.Message != "" {
+		t.Fatalf("Request rejected: %s", resp)
+	}
+	if err := os.Remove(filepath.Join(sdir, "dir1")); err != nil {
+		t.Fatalf("Request not applied: %v", err)
+	}
+	if resp := apply(rconn, captured); resp.Message == "" {
+		t.Errorf("Request replayed in the same session accepted")
+	}
+
+	rconn2 := dialTestServer(t, port)
+	defer rconn2.Close()
+	nonce := handshake(rconn2)
+	if resp := apply(rconn2, captured); resp.Message == "" {
+		t.Errorf("Request replayed in a new session accepted")
+	}
+	if _, err := os.Stat(filepath.Join(sdir, "dir1")); err == nil {
+		t.Errorf("Replayed request applied")
+	}
+
+	// Batches are rejected whole, without using up their sequence numbers.
+	batch := &betterbox.BatchRequest{Requests: []*betterbox.Request{
+		{Path: "dir2", Nonce: nonce, Seq: 1},
+		{Path: "dir3", Nonce: captured.Nonce, Seq: 2},
+	}}
+	var bresp betterbox.BatchResponse
+	if err := rconn2.Call("Server.BatchApplyRequest", batch, &bresp); err != nil {
+		t.Fatalf("Sending batch failed: %v", err)
+	}
+	if len(bresp.Responses) != 2 || bresp.Responses[0].Message == "" || bresp.Responses[1].Message == "" || !bresp.RolledBack {
+		t.Errorf("Batch with a replayed request accepted: %v", bresp)
+	}
+	if _, err := os.Stat(filepath.Join(sdir, "dir2")); err == nil {
+		t.Errorf("Rejected batch applied")
+	}
+	batch.Requests[1].Nonce = nonce
+	bresp = betterbox.BatchResponse{}
+	if err := rconn2.Call("Server.BatchApplyRequest", batch, &bresp); err != nil {
+		t.Fatalf("Sending batch failed: %v", err)
+	}
+	if len(bresp.Responses) != 2 || bresp.Responses[0].Message != "" || bresp.Responses[1].Message != "" {
+		t.Errorf("Batch sent again rejected: %v", bresp)
+	}
+	for _, dir := range []string{"dir2", "dir3"} {
+		if err := os.Remove(filepath.Join(sdir, dir)); err != nil {
+			t.Errorf("Batch not applied: %v", err)
+		}
+	}
+
+	// Clients establish sessions.
+	cdir := createTempDirWithFiles(t, []testEntry{{"file1", FILE, []byte("file1 content")}})
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+	compareDirectories(t, cdir, sdir)
+}
+
+func TestMonitorOnly(t *testing.T) {
+	defer betterbox.SetRequestsWaitTime(200 * time.Millisecond)()
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"file2", FILE, []byte("file2 content")},
+		{"dir1", DIR, nil},
+		{"dir1/file3", FILE, []byte("file3 content")},
+	}
+	for _, mode := range []betterbox.InitialSyncMode{betterbox.InitialSyncNone, betterbox.InitialSyncReconcile} {
+		sdir, port := newTestServer(t)
+		defer os.RemoveAll(sdir)
+		cdir := createTempDirWithFiles(t, tFiles)
+		defer os.RemoveAll(cdir)
+		client, err := betterbox.NewClient(serverAddress, port, cdir)
+		if err != nil {
+			t.Fatalf("Can't instantiate new client: %v", err)
+		}
+		if err = client.Sync(); err != nil {
+			t.Fatalf("Client can't send files to server: %v", err)
+		}
+
+		// Files that are sent again get a new modification time.
+		untouched := []string{filepath.Join(sdir, "file1"), filepath.Join(sdir, "dir1", "file3")}
+		past := time.Now().Add(-time.Hour).Truncate(time.Second)
+		for _, path := range untouched {
+			if err := os.Chtimes(path, past, past); err != nil {
+				t.Fatalf("Can't change file times: %v", err)
+			}
+		}
+
+		// Restarted client.
+		client, err = betterbox.NewClient(serverAddress, port, cdir, betterbox.WithInitialSync(mode))
+		if err != nil {
+			t.Fatalf("Can't instantiate new client: %v", err)
+		}
+		errc := make(chan error, 1)
+		go func() { errc <- client.SyncAndMonitor() }()
+		time.Sleep(500 * time.Millisecond)
+		content := []byte("file2 new content")
+		if err := ioutil.WriteFile(filepath.Join(cdir, "file2"), content, 0600); err != nil {
+			t.Fatalf("Can't write file: %v", err)
+		}
+		if !waitForFile(filepath.Join(sdir, "file2"), content, 2*time.Second) {
+			t.Fatalf("Mode %d: Modified file not synced", mode)
+		}
+		client.Close()
+		if err := <-errc; err != nil {
+			t.Errorf("Mode %d: Monitoring failed: %v", mode, err)
+		}
+		for _, path := range untouched {
+			if info, err := os.Stat(path); err != nil || !info.ModTime().Equal(past) {
+				t.Errorf("Mode %d: Untouched file '%s' sent again", mode, path)
+			}
+		}
+		compareDirectories(t, cdir, sdir)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"file2", FILE, []byte("file2 content")},
+		{"dir1", DIR, nil},
+		{"dir1/file3", FILE, []byte("file3 content")},
+	}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithRemotePrefix("team/docs"))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Reconcile(); err != nil {
+		t.Fatalf("Initial reconciliation failed: %v", err)
+	}
+	compareDirectories(t, cdir, filepath.Join(sdir, "team", "docs"))
+
+	if err := ioutil.WriteFile(filepath.Join(cdir, "file2"), []byte("file2 new"), 0600); err != nil {
+		t.Fatalf("Can't write file: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(cdir, "dir2"), 0700); err != nil {
+		t.Fatalf("Can't create directory: %v", err)
+	}
+	before := client.Stats()
+	if err = client.Reconcile(); err != nil {
+		t.Fatalf("Reconciliation failed: %v", err)
+	}
+	compareDirectories(t, cdir, filepath.Join(sdir, "team", "docs"))
+	if sent := client.Stats().Requests - before.Requests; sent != 2 {
+		t.Errorf("%d requests sent, expected 2", sent)
+	}
+}
+
+func TestSkipSizeMTime(t *testing.T) {
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"file2", FILE, []byte("file2 content")},
+	}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithSkipPolicy(betterbox.SkipSizeMTime))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Reconcile(); err != nil {
+		t.Fatalf("Initial reconciliation failed: %v", err)
+	}
+	compareDirectories(t, cdir, sdir)
+
+	// The server's newer file of the same size is kept, and the older one
+	// replaced by the client's newer one.
+	newer := time.Now().Add(time.Hour)
+	for _, name := range []string{"file1", "file2"} {
+		if err := ioutil.WriteFile(filepath.Join(sdir, name), []byte(name+" changed"), 0600); err != nil {
+			t.Fatalf("Can't write file: %v", err)
+		}
+	}
+	if err := os.Chtimes(filepath.Join(sdir, "file1"), newer, newer); err != nil {
+		t.Fatalf("Can't change times: %v", err)
+	}
+	if err := os.Chtimes(filepath.Join(cdir, "file2"), newer, newer); err != nil {
+		t.Fatalf("Can't change times: %v", err)
+	}
+	if err = client.Reconcile(); err != nil {
+		t.Fatalf("Reconciliation failed: %v", err)
+	}
+	for name, expected := range map[string]string{"file1": "file1 changed", "file2": "file2 content"} {
+		if content, err := ioutil.ReadFile(filepath.Join(sdir, name)); err != nil || string(content) != expected {
+			t.Errorf("Server's %s is '%s' (%v), expected '%s'", name, content, err, expected)
+		}
+	}
+
+	// Hashes tell the server's file apart.
+	client, err = betterbox.NewClient(serverAddress, port, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Reconcile(); err != nil {
+		t.Fatalf("Reconciliation failed: %v", err)
+	}
+	compareDirectories(t, cdir, sdir)
+}
+
+func TestProtectedPaths(t *testing.T) {
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+	}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	// Entries placed on the server, missing from the client's directory.
+	for _, entry := range []testEntry{
+		{"server.ini", FILE, []byte("server config")},
+		{"dir1", DIR, nil},
+		{"dir1/app.conf", FILE, []byte("app config")},
+		{"dir1/stale", FILE, []byte("stale content")},
+		{"keep", DIR, nil},
+		{"keep/file2", FILE, []byte("file2 content")},
+		{"dir2", DIR, nil},
+		{"dir2/file3", FILE, []byte("file3 content")},
+	} {
+		path := filepath.Join(sdir, entry.name)
+		var err error
+		if entry.ftype == DIR {
+			err = os.Mkdir(path, 0700)
+		} else {
+			err = ioutil.WriteFile(path, entry.content, 0600)
+		}
+		if err != nil {
+			t.Fatalf("Can't create %s: %v", entry.name, err)
+		}
+	}
+	if _, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithProtectedPaths("[")); err == nil {
+		t.Errorf("Client created with an invalid pattern")
+	}
+	client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithDeleteExcess(),
+		betterbox.WithProtectedPaths("server.ini", "*.conf", "keep"))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Reconcile(); err != nil {
+		t.Fatalf("Reconciliation failed: %v", err)
+	}
+	for _, path := range []string{"file1", "server.ini", "dir1", "dir1/app.conf", "keep/file2"} {
+		if _, err := os.Lstat(filepath.Join(sdir, path)); err != nil {
+			t.Errorf("Server's %s not kept: %v", path, err)
+		}
+	}
+	for _, path := range []string{"dir1/stale", "dir2"} {
+		if _, err := os.Lstat(filepath.Join(sdir, path)); !os.IsNotExist(err) {
+			t.Errorf("Server's %s not removed: %v", path, err)
+		}
+	}
+}
+
+func TestManifestPages(t *testing.T) {
+	const pageSize = 7
+	defer betterbox.SetManifestPageSize(pageSize)()
+	var tFiles []testEntry
+	for i := 0; i < 30; i++ {
+		dir := fmt.Sprintf("dir%d", i)
+		tFiles = append(tFiles, testEntry{dir, DIR, nil})
+		for j := 0; j < 10; j++ {
+			tFiles = append(tFiles, testEntry{fmt.Sprintf("%s/file%d", dir, j), FILE, []byte(fmt.Sprintf("content %d %d", i, j))})
+		}
+	}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithDeleteExcess())
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+
+	// The pages list the same entries as a single response, in order.
+	rconn := dialTestServer(t, port)
+	defer rconn.Close()
+	var all betterbox.ManifestResponse
+	if err := rconn.Call("Server.Manifest", &betterbox.ManifestRequest{}, &all); err != nil {
+		t.Fatalf("Manifest failed: %v", err)
+	}
+	var paged []betterbox.ManifestEntry
+	for after := ""; ; {
+		var resp betterbox.ManifestResponse
+		if err := rconn.Call("Server.Manifest", &betterbox.ManifestRequest{Limit: pageSize, After: after}, &resp); err != nil {
+			t.Fatalf("Manifest failed: %v", err)
+		}
+		if len(resp.Entries) > pageSize {
+			t.Fatalf("%d entries in a page of %d", len(resp.Entries), pageSize)
+		}
+		paged = append(paged, resp.Entries...)
+		if after = resp.Next; after == "" {
+			break
+		}
+	}
+	if len(paged) != len(tFiles) || len(all.Entries) != len(tFiles) {
+		t.Fatalf("%d paged entries and %d entries, expected %d", len(paged), len(all.Entries), len(tFiles))
+	}
+	for i := range paged {
+		if paged[i].Path != all.Entries[i].Path {
+			t.Errorf("Paged entry %d is '%s', expected '%s'", i, paged[i].Path, all.Entries[i].Path)
+		}
+	}
+
+	// Differences spread over the pages are reconciled.
+	for _, name := range []string{"dir0/file0", "dir12/file5", "dir29/file9"} {
+		if err := ioutil.WriteFile(filepath.Join(cdir, name), []byte("new content"), 0600); err != nil {
+			t.Fatalf("Can't write file: %v", err)
+		}
+	}
+	for _, name := range []string{"dir3", "dir17/file2", "dir29/file0"} {
+		if err := os.RemoveAll(filepath.Join(cdir, name)); err != nil {
+			t.Fatalf("Can't remove: %v", err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(sdir, "dir20", "extra"), []byte("extra"), 0600); err != nil {
+		t.Fatalf("Can't write file: %v", err)
+	}
+	before := client.Stats()
+	if err = client.Reconcile(); err != nil {
+		t.Fatalf("Reconciliation failed: %v", err)
+	}
+	compareDirectories(t, cdir, sdir)
+	// The changed files, and the removal of the excess entries.
+	if sent := client.Stats().Requests - before.Requests; sent != 7 {
+		t.Errorf("%d requests sent, expected 7", sent)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"file2", FILE, []byte("file2 content")},
+		{"dir1", DIR, nil},
+		{"dir1/file3", FILE, []byte("file3 content")},
+		{"dir2", DIR, nil},
+		{"dir2/file4", FILE, []byte("file4 content")},
+	}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithRemotePrefix("team"))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+	if diffs, err := client.Verify(); err != nil || len(diffs) != 0 {
+		t.Fatalf("Verify returned %v, %v, expected no differences", diffs, err)
+	}
+
+	// Diverge, without the client knowing.
+	if err := ioutil.WriteFile(filepath.Join(sdir, "team", "file2"), []byte("file2 changed"), 0600); err != nil {
+		t.Fatalf("Can't write file: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(sdir, "team", "dir1", "extra"), []byte("extra"), 0600); err != nil {
+		t.Fatalf("Can't write file: %v", err)
+	}
+	if err := os.RemoveAll(filepath.Join(sdir, "team", "dir2")); err != nil {
+		t.Fatalf("Can't remove directory: %v", err)
+	}
+	before := client.Stats()
+	diffs, err := client.Verify()
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	expected := []betterbox.Difference{
+		{Path: "team/dir1/extra", Kind: betterbox.DiffMissing, A: "missing", B: "present"},
+		{Path: "team/dir2", Kind: betterbox.DiffMissing, A: "present", B: "missing"},
+		{Path: "team/file2", Kind: betterbox.DiffContent, A: "13 bytes", B: "13 bytes"},
+	}
+	if fmt.Sprint(diffs) != fmt.Sprint(expected) {
+		t.Errorf("Verify returned %v, expected %v", diffs, expected)
+	}
+	if sent := client.Stats().Requests - before.Requests; sent != 0 {
+		t.Errorf("%d requests sent, expected none", sent)
+	}
+	if _, err := os.Stat(filepath.Join(sdir, "team", "dir2")); !os.IsNotExist(err) {
+		t.Errorf("Verify modified the server's destination: %v", err)
+	}
+}
+
+func TestVerifyFile(t *testing.T) {
+	tFiles := []testEntry{
+		{"dir", DIR, nil},
+		{"dir/file1", FILE, []byte("file1 content")},
+		{"file2", FILE, []byte("file2 content")},
+	}
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+	if diff, err := client.VerifyFile("dir/file1", false); err != nil || diff != nil {
+		t.Fatalf("VerifyFile returned %v, %v, expected no difference", diff, err)
+	}
+
+	// Corrupt both files, without the client knowing.
+	for _, name := range []string{"dir/file1", "file2"} {
+		if err := ioutil.WriteFile(filepath.Join(sdir, name), []byte("corrupted"), 0600); err != nil {
+			t.Fatalf("Can't write file: %v", err)
+		}
+	}
+	expected := betterbox.Difference{Path: "dir/file1", Kind: betterbox.DiffContent, A: "13 bytes", B: "9 bytes"}
+	before := client.Stats()
+	diff, err := client.VerifyFile("dir/file1", false)
+	if err != nil || diff == nil || *diff != expected {
+		t.Fatalf("VerifyFile returned %v, %v, expected %v", diff, err, expected)
+	}
+	if sent := client.Stats().Requests - before.Requests; sent != 0 {
+		t.Errorf("%d requests sent without repair, expected none", sent)
+	}
+	diff, err = client.VerifyFile("dir/file1", true)
+	if err != nil || diff == nil || *diff != expected {
+		t.Fatalf("VerifyFile returned %v, %v, expected %v", diff, err, expected)
+	}
+	if diff, err := client.VerifyFile("dir/file1", false); err != nil || diff != nil {
+		t.Errorf("VerifyFile returned %v, %v after repair, expected no difference", diff, err)
+	}
+	// Only the verified file is repaired.
+	if content, err := ioutil.ReadFile(filepath.Join(sdir, "file2")); err != nil || string(content) != "corrupted" {
+		t.Errorf("Other file has content %q, %v, expected it untouched", content, err)
+	}
+
+	if err := os.Remove(filepath.Join(sdir, "file2")); err != nil {
+		t.Fatalf("Can't remove file: %v", err)
+	}
+	expected = betterbox.Difference{Path: "file2", Kind: betterbox.DiffMissing, A: "present", B: "missing"}
+	if diff, err := client.VerifyFile("file2", false); err != nil || diff == nil || *diff != expected {
+		t.Errorf("VerifyFile returned %v, %v, expected %v", diff, err, expected)
+	}
+	if _, err := client.VerifyFile("../file2", false); err == nil {
+		t.Errorf("VerifyFile of a path outside the client's directory succeeded")
+	}
+}
+
+// pipeListener accepts the server ends of in-memory pipes, whose client ends
+// are returned by Dial.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errors.New("Listener closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+func (l *pipeListener) Dial(server string) (net.Conn, error) {
+	local, remote := net.Pipe()
+	select {
+	case l.conns <- remote:
+		return local, nil
+	case <-l.closed:
+		return nil, errors.New("Listener closed")
+	}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+func TestInMemoryPipe(t *testing.T) {
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"dir1", DIR, nil},
+		{"dir1/file2", FILE, []byte("file2 content")},
+	}
+	sdir, err := ioutil.TempDir("", "betterbox_test")
+	if err != nil {
+		t.Fatalf("Can't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	// Without certificates in the working directory.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Can't get working directory: %v", err)
+	}
+	if err := os.Chdir(cdir); err != nil {
+		t.Fatalf("Can't change working directory: %v", err)
+	}
+	defer os.Chdir(wd)
+
+	listener := newPipeListener()
+	defer listener.Close()
+	server, err := betterbox.NewServer(serverAddress, 0, sdir, betterbox.WithListener(listener))
+	if err != nil {
+		t.Fatalf("Can't instantiate new server: %v", err)
+	}
+	go server.Listen()
+	client, err := betterbox.NewClient(serverAddress, 0, cdir, betterbox.WithDialer(listener.Dial))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+	compareDirectories(t, cdir, sdir)
+	if _, err := betterbox.NewClient(serverAddress, 0, cdir); err == nil {
+		t.Errorf("Client over TLS created without certificates")
+	}
+}
+
+func TestConnInjection(t *testing.T) {
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"dir1", DIR, nil},
+		{"dir1/file2", FILE, []byte("file2 content")},
+	}
+	sdir, err := ioutil.TempDir("", "betterbox_test")
+	if err != nil {
+		t.Fatalf("Can't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	server, err := betterbox.NewServerWithConn(remote, sdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new server: %v", err)
+	}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		server.Listen()
+	}()
+	client, err := betterbox.NewClientWithConn(local, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+	compareDirectories(t, cdir, sdir)
+	// The connection is kept open for the following sendings.
+	if err := ioutil.WriteFile(filepath.Join(cdir, "file3"), []byte("file3 content"), 0600); err != nil {
+		t.Fatalf("Can't write file: %v", err)
+	}
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to server again: %v", err)
+	}
+	compareDirectories(t, cdir, sdir)
+	if _, err := betterbox.NewClientWithConn(local, cdir, betterbox.WithServers(betterbox.ServersFanOut, "localhost:1")); err == nil {
+		t.Errorf("Client over a connection created with multiple servers")
+	}
+	local.Close()
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Server still serving a closed connection")
+	}
+}
+
+// countingConn counts the bytes written to a connection.
+type countingConn struct {
+	net.Conn
+	written *int64
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(c.written, int64(n))
+	return n, err
+}
+
+// syncOverPipe syncs cdir to sdir over an in-memory pipe, returning the number
+// of bytes written by the client.
+func syncOverPipe(t testing.TB, cdir, sdir string, sopts []betterbox.ServerOption, copts []betterbox.ClientOption) int64 {
+	t.Helper()
+	listener := newPipeListener()
+	defer listener.Close()
+	server, err := betterbox.NewServer(serverAddress, 0, sdir, append(sopts, betterbox.WithListener(listener))...)
+	if err != nil {
+		t.Fatalf("Can't instantiate new server: %v", err)
+	}
+	go server.Listen()
+	var written int64
+	dial := func(server string) (net.Conn, error) {
+		conn, err := listener.Dial(server)
+		return countingConn{Conn: conn, written: &written}, err
+	}
+	client, err := betterbox.NewClient(serverAddress, 0, cdir, append(copts, betterbox.WithDialer(dial))...)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+	return atomic.LoadInt64(&written)
+}
+
+func TestStreamCompression(t *testing.T) {
+	var tFiles []testEntry
+	for i := 0; i < 50; i++ {
+		tFiles = append(tFiles, testEntry{fmt.Sprintf("file%d", i), FILE, []byte(fmt.Sprintf("content of file %d", i))})
+	}
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	compress := []betterbox.ClientOption{betterbox.WithStreamCompression(), betterbox.WithBatchRequests()}
+	var written []int64
+	for _, tc := range []struct {
+		sopts []betterbox.ServerOption
+		copts []betterbox.ClientOption
+	}{
+		{nil, []betterbox.ClientOption{betterbox.WithBatchRequests()}},
+		// Servers not enabling it are sent plain streams.
+		{nil, compress},
+		{[]betterbox.ServerOption{betterbox.WithServerStreamCompression()}, compress},
+	} {
+		sdir := createTempDirWithFiles(t, nil)
+		defer os.RemoveAll(sdir)
+		written = append(written, syncOverPipe(t, cdir, sdir, tc.sopts, tc.copts))
+		compareDirectories(t, cdir, sdir)
+	}
+	// Only the handshake differs with a server without compression.
+	if written[1] > written[0]+int64(len("flate"))+8 {
+		t.Errorf("Client wrote %d bytes to a server without compression, %d plain", written[1], written[0])
+	}
+	if written[2] >= written[0] {
+		t.Errorf("Client wrote %d bytes compressed, %d plain", written[2], written[0])
+	}
+}
+
+// slowConn writes to a connection at a limited rate, in bytes per second.
+type slowConn struct {
+	net.Conn
+	rate int
+}
+
+func (c slowConn) Write(p []byte) (int, error) {
+	time.Sleep(time.Duration(len(p)) * time.Second / time.Duration(c.rate))
+	return c.Conn.Write(p)
+}
+
+func TestAdaptiveCompression(t *testing.T) {
+	var tFiles []testEntry
+	for i := 0; i < 4; i++ {
+		tFiles = append(tFiles, testEntry{fmt.Sprintf("file%d", i), FILE, bytes.Repeat([]byte(fmt.Sprintf("content of file %d\n", i)), 1000)})
+	}
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	if _, err := betterbox.NewClient(serverAddress, serverPort, cdir, betterbox.WithAdaptiveCompression(0)); err == nil {
+		t.Errorf("Client accepted a null compression threshold")
+	}
+	for _, tc := range []struct {
+		name string
+		rate int // 0 for unlimited.
+	}{
+		{"Slow", 128 << 10},
+		{"Fast", 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sdir := createTempDirWithFiles(t, nil)
+			defer os.RemoveAll(sdir)
+			listener := newPipeListener()
+			defer listener.Close()
+			server, err := betterbox.NewServer(serverAddress, 0, sdir, betterbox.WithListener(listener), betterbox.WithServerStreamCompression())
+			if err != nil {
+				t.Fatalf("Can't instantiate new server: %v", err)
+			}
+			go server.Listen()
+			var written int64
+			dial := func(server string) (net.Conn, error) {
+				conn, err := listener.Dial(server)
+				if tc.rate != 0 {
+					conn = slowConn{Conn: conn, rate: tc.rate}
+				}
+				return countingConn{Conn: conn, written: &written}, err
+			}
+			client, err := betterbox.NewClient(serverAddress, 0, cdir, betterbox.WithDialer(dial), betterbox.WithBatchRequests(), betterbox.WithAdaptiveCompression(512<<10))
+			if err != nil {
+				t.Fatalf("Can't instantiate new client: %v", err)
+			}
+			// Links are not compressed until measured.
+			if err = client.Sync(); err != nil {
+				t.Fatalf("Client can't send files to server: %v", err)
+			}
+			plain := atomic.SwapInt64(&written, 0)
+			if compressing := betterbox.Compressing(client); compressing != (tc.rate != 0) {
+				t.Fatalf("Client compressing: %v", compressing)
+			}
+			if err = client.Sync(); err != nil {
+				t.Fatalf("Client can't send files to server: %v", err)
+			}
+			compareDirectories(t, cdir, sdir)
+			if again := atomic.LoadInt64(&written); tc.rate != 0 && again >= plain/2 {
+				t.Errorf("Client wrote %d bytes compressed, %d plain", again, plain)
+			} else if tc.rate == 0 && again < plain/2 {
+				t.Errorf("Client wrote %d bytes over a fast link, %d at first", again, plain)
+			}
+		})
+	}
+}
+
+func BenchmarkStreamCompression(b *testing.B) {
+	var tFiles []testEntry
+	for i := 0; i < 10000; i++ {
+		tFiles = append(tFiles, testEntry{fmt.Sprintf("file%d", i), FILE, []byte(fmt.Sprintf("content of file %d\n", i))})
+	}
+	cdir := createTempDirWithFiles(b, tFiles)
+	defer os.RemoveAll(cdir)
+	// Files compressed one at a time, as per-field compression does, but
+	// stored compressed too.
+	perField := func(relPath string, data []byte) ([]byte, error) {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(data)
+		err := zw.Close()
+		return buf.Bytes(), err
+	}
+	for _, bc := range []struct {
+		name  string
+		sopts []betterbox.ServerOption
+		copts []betterbox.ClientOption
+	}{
+		{"None", nil, nil},
+		{"PerField", nil, []betterbox.ClientOption{betterbox.WithDataTransform(perField)}},
+		{"Stream", []betterbox.ServerOption{betterbox.WithServerStreamCompression()}, []betterbox.ClientOption{betterbox.WithStreamCompression()}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			var written int64
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				sdir := createTempDirWithFiles(b, nil)
+				b.StartTimer()
+				written += syncOverPipe(b, cdir, sdir, bc.sopts, append(bc.copts, betterbox.WithBatchRequests()))
+				b.StopTimer()
+				os.RemoveAll(sdir)
+			}
+			b.ReportMetric(float64(written)/float64(b.N), "wire-B/op")
+		})
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"dir1", DIR, nil},
+		{"dir1/file2", FILE, []byte("file2 content")},
+	}
+	sdir, err := ioutil.TempDir("", "betterbox_test")
+	if err != nil {
+		t.Fatalf("Can't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(sdir)
+	sockDir, err := ioutil.TempDir("", "betterbox_test")
+	if err != nil {
+		t.Fatalf("Can't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(sockDir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	// Without certificates in the working directory.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Can't get working directory: %v", err)
+	}
+	if err := os.Chdir(cdir); err != nil {
+		t.Fatalf("Can't change working directory: %v", err)
+	}
+	defer os.Chdir(wd)
+
+	socket := filepath.Join(sockDir, "betterbox.sock")
+	address := "unix://" + socket
+	server, err := betterbox.NewServer(address, 0, sdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new server: %v", err)
+	}
+	go server.Listen()
+	client, err := betterbox.NewClient(address, 0, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+	compareDirectories(t, cdir, sdir)
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatalf("Can't stat socket: %v", err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Errorf("Socket mode %v, expected %v", info.Mode(), os.ModeSocket|0600)
+	}
+	if s := server.String(); s != address+" -> "+sdir {
+		t.Errorf("Server string %q, expected %q", s, address+" -> "+sdir)
+	}
+}
+
+func TestClientString(t *testing.T) {
+	cdir := createTempDirWithFiles(t, nil)
+	defer os.RemoveAll(cdir)
+	// Relative path, resolved by the client.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Can't get working directory: %v", err)
+	}
+	relDir, err := filepath.Rel(wd, cdir)
+	if err != nil {
+		t.Fatalf("Can't get relative path: %v", err)
+	}
+	client, err := betterbox.NewClient(serverAddress, serverPort, relDir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	serverAddr := net.JoinHostPort(serverAddress, strconv.Itoa(serverPort))
+	for _, s := range []string{client.String(), client.Describe()} {
+		if !strings.Contains(s, cdir) || !strings.Contains(s, serverAddr) {
+			t.Errorf("Missing resolved path or server address: %s", s)
+		}
+	}
+}
+
+func TestReconcileEmptyDirectories(t *testing.T) {
+	tFiles := []testEntry{
+		{"dir1", DIR, nil},
+		{"dir1/empty1", DIR, nil},
+		{"empty2", DIR, nil},
+		{"other", DIR, nil},
+		{"file1", FILE, []byte("file1 content")},
+	}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	// A file on the server instead of a client's directory.
+	if err := ioutil.WriteFile(filepath.Join(sdir, "other"), []byte("other"), 0600); err != nil {
+		t.Fatalf("Can't write file: %v", err)
+	}
+	client, err := betterbox.NewClient(serverAddress, port, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Reconcile(); err != nil {
+		t.Fatalf("Reconciliation failed: %v", err)
+	}
+	compareDirectories(t, cdir, sdir)
+	// Existing empty directories are kept as they are.
+	before := client.Stats()
+	if err = client.Reconcile(); err != nil {
+		t.Fatalf("Reconciliation failed: %v", err)
+	}
+	compareDirectories(t, cdir, sdir)
+	if sent := client.Stats().Requests - before.Requests; sent != 0 {
+		t.Errorf("%d requests sent for an unchanged tree", sent)
+	}
+}
+
+func TestDataTransform(t *testing.T) {
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"secret", FILE, []byte("password")},
+		{"dir1", DIR, nil},
+		{"dir1/file2", FILE, []byte("file2 content")},
+	}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	upper := func(relPath string, data []byte) ([]byte, error) {
+		if relPath == "secret" {
+			return nil, fmt.Errorf("Secret file")
+		}
+		return bytes.ToUpper(data), nil
+	}
+	client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithDataTransform(upper))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+	for name, content := range map[string]string{"file1": "FILE1 CONTENT", "dir1/file2": "FILE2 CONTENT"} {
+		if data, err := ioutil.ReadFile(filepath.Join(sdir, name)); err != nil || string(data) != content {
+			t.Errorf("%s: Content '%s' stored, expected '%s'", name, data, content)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(sdir, "secret")); err == nil {
+		t.Errorf("File failing transform sent")
+	}
+}
+
+func TestCrossDeviceRename(t *testing.T) {
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"dir1", DIR, nil},
+		{"dir1/file2", FILE, []byte("file2 content")},
+	}
+	for _, tc := range []struct {
+		opts     []betterbox.ServerOption
+		clientOp []betterbox.ClientOption
+		failed   bool
+	}{
+		// Temporary files are next to the destination files.
+		{nil, nil, false},
+		// Files staged in another directory are copied.
+		{[]betterbox.ServerOption{betterbox.WithTransactionalBatches()}, []betterbox.ClientOption{betterbox.WithBatchRequests()}, true},
+	} {
+		sdir, port := newTestServer(t, tc.opts...)
+		defer os.RemoveAll(sdir)
+		cdir := createTempDirWithFiles(t, tFiles)
+		defer os.RemoveAll(cdir)
+		client, err := betterbox.NewClient(serverAddress, port, cdir, tc.clientOp...)
+		if err != nil {
+			t.Fatalf("Can't instantiate new client: %v", err)
+		}
+		restore := betterbox.SimulateCrossDeviceRenames()
+		err = client.Sync()
+		if failed := restore(); (failed > 0) != tc.failed {
+			t.Errorf("%d cross-device renames", failed)
+		}
+		if err != nil {
+			t.Fatalf("Client can't send files to server: %v", err)
+		}
+		// No temporary files left.
+		compareDirectories(t, cdir, sdir)
+	}
+}
+
+func TestFsync(t *testing.T) {
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"dir1", DIR, nil},
+		{"dir1/file2", FILE, []byte("file2 content")},
+	}
+	for _, tc := range []struct {
+		opts   []betterbox.ServerOption
+		fsyncs int
+	}{
+		{nil, 0},
+		{[]betterbox.ServerOption{betterbox.WithFsync(false)}, 2},
+		{[]betterbox.ServerOption{betterbox.WithFsync(true)}, 4},
+	} {
+		sdir, port := newTestServer(t, tc.opts...)
+		defer os.RemoveAll(sdir)
+		cdir := createTempDirWithFiles(t, tFiles)
+		defer os.RemoveAll(cdir)
+		client, err := betterbox.NewClient(serverAddress, port, cdir)
+		if err != nil {
+			t.Fatalf("Can't instantiate new client: %v", err)
+		}
+		count := betterbox.CountFsyncs()
+		err = client.Sync()
+		if fsyncs := count(); fsyncs != tc.fsyncs {
+			t.Errorf("%d fsyncs, expected %d", fsyncs, tc.fsyncs)
+		}
+		if err != nil {
+			t.Fatalf("Client can't send files to server: %v", err)
+		}
+		compareDirectories(t, cdir, sdir)
+	}
+}
+
+func BenchmarkFsync(b *testing.B) {
+	content := make([]byte, 4096)
+	var tFiles []testEntry
+	for i := 0; i < 50; i++ {
+		tFiles = append(tFiles, testEntry{fmt.Sprintf("file%d", i), FILE, content})
+	}
+	cdir := createTempDirWithFiles(b, tFiles)
+	defer os.RemoveAll(cdir)
+	for _, bc := range []struct {
+		name string
+		opts []betterbox.ServerOption
+	}{
+		{"NoFsync", nil},
+		{"Fsync", []betterbox.ServerOption{betterbox.WithFsync(true)}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.SetBytes(int64(len(tFiles) * len(content)))
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				sdir, port := newTestServer(b, bc.opts...)
+				client, err := betterbox.NewClient(serverAddress, port, cdir)
+				if err != nil {
+					b.Fatalf("Can't instantiate new client: %v", err)
+				}
+				b.StartTimer()
+				if err = client.Sync(); err != nil {
+					b.Fatalf("Client can't send files to server: %v", err)
+				}
+				b.StopTimer()
+				os.RemoveAll(sdir)
+			}
+		})
+	}
+}
+
+func TestBatchedFsync(t *testing.T) {
+	tFiles := []testEntry{{"dir1", DIR, nil}}
+	for i := 0; i < 10; i++ {
+		tFiles = append(tFiles, testEntry{fmt.Sprintf("file%d", i), FILE, []byte("content")})
+		tFiles = append(tFiles, testEntry{fmt.Sprintf("dir1/file%d", i), FILE, []byte("content")})
+	}
+	for _, tc := range []struct {
+		opts   []betterbox.ClientOption
+		fsyncs int
+	}{
+		{nil, 40},
+		// The directories are synced once per batch.
+		{[]betterbox.ClientOption{betterbox.WithBatchRequests()}, 22},
+	} {
+		sdir, port := newTestServer(t, betterbox.WithFsync(true))
+		defer os.RemoveAll(sdir)
+		cdir := createTempDirWithFiles(t, tFiles)
+		defer os.RemoveAll(cdir)
+		client, err := betterbox.NewClient(serverAddress, port, cdir, tc.opts...)
+		if err != nil {
+			t.Fatalf("Can't instantiate new client: %v", err)
+		}
+		count := betterbox.CountFsyncs()
+		err = client.Sync()
+		if fsyncs := count(); fsyncs != tc.fsyncs {
+			t.Errorf("%d fsyncs, expected %d", fsyncs, tc.fsyncs)
+		}
+		if err != nil {
+			t.Fatalf("Client can't send files to server: %v", err)
+		}
+		compareDirectories(t, cdir, sdir)
+	}
+}
+
+func TestTransactionFsyncFailure(t *testing.T) {
+	tFiles := []testEntry{{"file1", FILE, []byte("file1 content")}}
+	sdir, port := newTestServer(t, betterbox.WithFsync(true), betterbox.WithTransactionalBatches())
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithBatchRequests())
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	restore := betterbox.FailDirFsyncs()
+	err = client.Sync()
+	restore()
+	if _, ok := err.(*betterbox.RequestError); !ok {
+		t.Errorf("Expected request error, got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(sdir, "file1")); !os.IsNotExist(err) {
+		t.Errorf("Transaction not rolled back: %v", err)
+	}
+}
+
+func TestBatchFsyncFailure(t *testing.T) {
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"file2", FILE, []byte("file2 content")},
+	}
+	sdir, port := newTestServer(t, betterbox.WithFsync(true))
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithBatchRequests())
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	restore := betterbox.FailDirFsyncs()
+	err = client.Sync()
+	restore()
+	rerr, ok := err.(*betterbox.RequestError)
+	if !ok {
+		t.Fatalf("Expected request error, got: %v", err)
+	}
+	if !strings.Contains(rerr.Response.Message, "Syncing directories failed") {
+		t.Errorf("Unexpected error: %v", rerr)
+	}
+	// The last Request is reported as failed.
+	if stats := client.Stats(); stats.Requests != 1 {
+		t.Errorf("%d requests applied, expected 1", stats.Requests)
+	}
+}
+
+func BenchmarkBatchedFsync(b *testing.B) {
+	var tFiles []testEntry
+	for i := 0; i < 10000; i++ {
+		tFiles = append(tFiles, testEntry{fmt.Sprintf("file%d", i), FILE, []byte(fmt.Sprintf("content of file %d\n", i))})
+	}
+	cdir := createTempDirWithFiles(b, tFiles)
+	defer os.RemoveAll(cdir)
+	for _, bc := range []struct {
+		name string
+		opts []betterbox.ClientOption
+	}{
+		{"PerFile", nil},
+		{"Batched", []betterbox.ClientOption{betterbox.WithBatchRequests()}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			var fsyncs int
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				sdir := createTempDirWithFiles(b, nil)
+				count := betterbox.CountFsyncs()
+				b.StartTimer()
+				syncOverPipe(b, cdir, sdir, []betterbox.ServerOption{betterbox.WithFsync(true)}, bc.opts)
+				b.StopTimer()
+				fsyncs += count()
+				os.RemoveAll(sdir)
+			}
+			b.ReportMetric(float64(fsyncs)/float64(b.N), "fsyncs/op")
+		})
+	}
+}
+
+func TestDestinationRemoved(t *testing.T) {
+	defer betterbox.SetDestCheckInterval(0)()
+	tFiles := []testEntry{{"file1", FILE, []byte("file1 content")}}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+
+	// A recreated destination isn't the one the server was created with.
+	if err := os.RemoveAll(sdir); err != nil {
+		t.Fatalf("Can't remove destination: %v", err)
+	}
+	if err := os.Mkdir(sdir, 0700); err != nil {
+		t.Fatalf("Can't recreate destination: %v", err)
+	}
+	err = client.Sync()
+	if reqErr, ok := err.(*betterbox.RequestError); !ok || reqErr.Code() != betterbox.CodeUnavailable {
+		t.Errorf("Expected unavailable error, got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(sdir, "file1")); err == nil {
+		t.Errorf("File created in recreated destination")
+	}
+	if _, err := client.Preflight(); err == nil {
+		t.Errorf("Preflight succeeded with unavailable destination")
+	}
+}
+
+func TestReadOnlyServer(t *testing.T) {
+	tFiles := []testEntry{{"file1", FILE, []byte("file1 content")}}
+	sdir, port := newTestServer(t, betterbox.WithReadOnly())
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	if err := os.Mkdir(filepath.Join(sdir, "dir1"), 0700); err != nil {
+		t.Fatalf("Can't create directory on server: %v", err)
+	}
+	client, err := betterbox.NewClient(serverAddress, port, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	err = client.Sync()
+	if reqErr, ok := err.(*betterbox.RequestError); !ok || reqErr.Code() != betterbox.CodeReadOnly {
+		t.Errorf("Expected read-only error, got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(sdir, "file1")); err == nil {
+		t.Errorf("File created on read-only server")
+	}
+
+	rconn := dialTestServer(t, port)
+	defer rconn.Close()
+	var resp betterbox.ManifestResponse
+	if err := rconn.Call("Server.Manifest", &betterbox.ManifestRequest{}, &resp); err != nil {
+		t.Fatalf("Manifest failed on read-only server: %v", err)
+	}
+	if len(resp.Entries) != 1 || resp.Entries[0].Path != "dir1" {
+		t.Errorf("Unexpected manifest: %+v", resp.Entries)
+	}
+	if _, err := client.Preflight(); err != nil {
+		t.Errorf("Preflight failed on read-only server: %v", err)
+	}
+}
+
+func TestUnsupportedRequestType(t *testing.T) {
+	for _, opts := range [][]betterbox.ServerOption{nil, {betterbox.WithTransactionalBatches()}} {
+		sdir, port := newTestServer(t, opts...)
+		defer os.RemoveAll(sdir)
+		rconn := dialTestServer(t, port)
+		defer rconn.Close()
+
+		var resp betterbox.Response
+		if err := rconn.Call("Server.ApplyRequest", betterbox.NewUnknownRequest("file1"), &resp); err != nil {
+			t.Fatalf("Sending request failed: %v", err)
+		}
+		if resp.Code != betterbox.CodeUnsupported {
+			t.Errorf("Unexpected response: %s (code %d)", resp, resp.Code)
+		}
+		batch := &betterbox.BatchRequest{Requests: []*betterbox.Request{betterbox.NewUnknownRequest("file1")}}
+		var batchResp betterbox.BatchResponse
+		if err := rconn.Call("Server.BatchApplyRequest", batch, &batchResp); err != nil {
+			t.Fatalf("Sending batch failed: %v", err)
+		}
+		if len(batchResp.Responses) != 1 || batchResp.Responses[0].Code != betterbox.CodeUnsupported {
+			t.Errorf("Unexpected batch responses: %+v", batchResp.Responses)
+		}
+	}
+}
+
+// OldRequest is a Request as defined by an incompatible client.
+type OldRequest struct {
+	Type string
+	Path string
+}
+
+// OldHandshakeResponse is a HandshakeResponse as defined by an incompatible
+// server.
+type OldHandshakeResponse struct {
+	Nonce int
+}
+
+// incompatibleServer serves the handshakes of an incompatible server.
+type incompatibleServer struct{}
+
+func (incompatibleServer) Version(req *betterbox.VersionRequest, resp *betterbox.VersionResponse) error {
+	resp.Version = betterbox.ProtocolVersion
+	return nil
+}
+
+func (incompatibleServer) Handshake(req *betterbox.HandshakeRequest, resp *OldHandshakeResponse) error {
+	resp.Nonce = 42
+	return nil
+}
+
+func TestProtocolMismatch(t *testing.T) {
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	rconn := dialTestServer(t, port)
+	defer rconn.Close()
+	var resp betterbox.Response
+	err := rconn.Call("Server.ApplyRequest", &OldRequest{Type: "Create", Path: "file1"}, &resp)
+	if err == nil || !strings.HasPrefix(err.Error(), "Protocol mismatch decoding Server.ApplyRequest") {
+		t.Errorf("Expected protocol mismatch error, got: %v", err)
+	}
+	// The connection is still usable.
+	if err := rconn.Call("Server.ApplyRequest", betterbox.NewMkdirRequest("dir1"), &resp); err != nil || resp.Message != "" {
+		t.Errorf("Request failed after a mismatch: %v, %s", err, resp)
+	}
+
+	rpcServer := rpc.NewServer()
+	if err := rpcServer.RegisterName("Server", incompatibleServer{}); err != nil {
+		t.Fatalf("Can't register server: %v", err)
+	}
+	listener := newPipeListener()
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go rpcServer.ServeConn(conn)
+		}
+	}()
+	cdir := createTempDirWithFiles(t, []testEntry{{"file1", FILE, []byte("file1 content")}})
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, 0, cdir, betterbox.WithDialer(listener.Dial))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	err = client.Sync()
+	if incompatible, ok := errors.Cause(err).(*betterbox.IncompatibleServerError); !ok || incompatible.Method != "Server.Handshake" {
+		t.Errorf("Expected incompatible server error, got: %v", err)
+	}
+}
+
+func TestMkdirExisting(t *testing.T) {
+	for _, opts := range [][]betterbox.ServerOption{nil, {betterbox.WithTransactionalBatches()}} {
+		sdir, port := newTestServer(t, opts...)
+		defer os.RemoveAll(sdir)
+		if err := ioutil.WriteFile(filepath.Join(sdir, "file1"), []byte("file1 content"), 0600); err != nil {
+			t.Fatalf("Can't write file: %v", err)
+		}
+		rconn := dialTestServer(t, port)
+		defer rconn.Close()
+
+		for _, tc := range []struct {
+			path string
+			code betterbox.ErrorCode
+			ok   bool
+		}{
+			{"dir1", betterbox.CodeUnknown, true},
+			// Re-sent, as on a re-sync.
+			{"dir1", betterbox.CodeUnknown, true},
+			{"file1", betterbox.CodeConflict, false},
+		} {
+			batch := &betterbox.BatchRequest{Requests: []*betterbox.Request{betterbox.NewMkdirRequest(tc.path)}}
+			var resp betterbox.BatchResponse
+			if err := rconn.Call("Server.BatchApplyRequest", batch, &resp); err != nil {
+				t.Fatalf("Sending batch failed: %v", err)
+			}
+			if r := resp.Responses[0]; (r.Message == "") != tc.ok || r.Code != tc.code {
+				t.Errorf("Mkdir '%s': Unexpected response: %s (code %d)", tc.path, r, r.Code)
+			}
+		}
+		if info, err := os.Stat(filepath.Join(sdir, "file1")); err != nil || info.IsDir() {
+			t.Errorf("File clobbered by Mkdir")
+		}
+	}
+}
+
+func TestStrictRemoves(t *testing.T) {
+	for _, tc := range []struct {
+		opts   []betterbox.ServerOption
+		strict bool
+	}{
+		{nil, false},
+		{[]betterbox.ServerOption{betterbox.WithTransactionalBatches()}, false},
+		{[]betterbox.ServerOption{betterbox.WithStrictRemoves()}, true},
+		{[]betterbox.ServerOption{betterbox.WithStrictRemoves(), betterbox.WithTransactionalBatches()}, true},
+	} {
+		sdir, port := newTestServer(t, tc.opts...)
+		defer os.RemoveAll(sdir)
+		if err := os.MkdirAll(filepath.Join(sdir, "dir1", "dir2"), 0700); err != nil {
+			t.Fatalf("Can't create directory: %v", err)
+		}
+		rconn := dialTestServer(t, port)
+		defer rconn.Close()
+
+		// Empty directories are removed in both modes.
+		for _, path := range []string{"dir1", "dir1/dir2"} {
+			batch := &betterbox.BatchRequest{Requests: []*betterbox.Request{betterbox.NewRemoveRequest(path)}}
+			var resp betterbox.BatchResponse
+			if err := rconn.Call("Server.BatchApplyRequest", batch, &resp); err != nil {
+				t.Fatalf("Sending batch failed: %v", err)
+			}
+			r := resp.Responses[0]
+			_, err := os.Stat(filepath.Join(sdir, filepath.FromSlash(path)))
+			if path == "dir1" && tc.strict {
+				if r.Code != betterbox.CodeConflict || err != nil {
+					t.Errorf("Remove '%s' with strict removes: Unexpected response: %s (code %d)", path, r, r.Code)
+				}
+			} else if r.Message != "" || !os.IsNotExist(err) {
+				t.Errorf("Remove '%s': Unexpected response: %s (code %d)", path, r, r.Code)
+			}
+		}
+	}
+}
+
+func TestShouldApply(t *testing.T) {
+	for _, batch := range []bool{false, true} {
+		// Files are never shrunk.
+		noShrink := func(req *betterbox.Request, existing os.FileInfo) bool {
+			return req.Type.String() != "Create" || existing == nil || existing.Size() <= int64(len(req.Data))
+		}
+		sopts := []betterbox.ServerOption{betterbox.WithShouldApply(noShrink)}
+		var copts []betterbox.ClientOption
+		if batch {
+			sopts = append(sopts, betterbox.WithTransactionalBatches())
+			copts = append(copts, betterbox.WithBatchRequests())
+		}
+		tFiles := []testEntry{{"file1", FILE, []byte("file1 content")}}
+		sdir, port := newTestServer(t, sopts...)
+		defer os.RemoveAll(sdir)
+		cdir := createTempDirWithFiles(t, tFiles)
+		defer os.RemoveAll(cdir)
+		client, err := betterbox.NewClient(serverAddress, port, cdir, copts...)
+		if err != nil {
+			t.Fatalf("Can't instantiate new client: %v", err)
+		}
+		if err = client.Sync(); err != nil {
+			t.Fatalf("Client can't send files to server: %v", err)
+		}
+		// Growing the file is applied, but not shrinking it.
+		for _, tc := range []struct {
+			content string
+			applied bool
+		}{{"file1 longer content", true}, {"short", false}} {
+			if err := ioutil.WriteFile(filepath.Join(cdir, "file1"), []byte(tc.content), 0600); err != nil {
+				t.Fatalf("Can't write file: %v", err)
+			}
+			err = client.Sync()
+			if tc.applied && err != nil {
+				t.Errorf("Client can't send files to server: %v", err)
+			}
+			if reqErr, ok := err.(*betterbox.RequestError); !tc.applied && (!ok || reqErr.Code() != betterbox.CodeRejected) {
+				t.Errorf("Expected rejected error, got: %v", err)
+			}
+		}
+		if content, err := ioutil.ReadFile(filepath.Join(sdir, "file1")); err != nil || string(content) != "file1 longer content" {
+			t.Errorf("Server's file1 is '%s' (%v), expected the longer content", content, err)
+		}
+	}
+}
+
+func TestPathHooks(t *testing.T) {
+	if _, err := betterbox.NewServer(serverAddress, 0, t.TempDir(), betterbox.WithPathHook("[", func(string) {})); err == nil {
+		t.Errorf("Server created with an invalid hook pattern")
+	}
+	tFiles := []testEntry{
+		{"nginx.conf", FILE, []byte("nginx.conf content")},
+		{"sites", DIR, nil},
+		{"sites/default.conf", FILE, []byte("default.conf content")},
+		{"index.html", FILE, []byte("index.html content")},
+	}
+	fired := make(chan string, 10)
+	sdir, port := newTestServer(t, betterbox.WithPathHook("*.conf", func(path string) { fired <- path }))
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+	got := map[string]bool{}
+	for len(got) < 2 {
+		select {
+		case path := <-fired:
+			got[path] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Hooks fired for %v only", got)
+		}
+	}
+	if !got["nginx.conf"] || !got["sites/default.conf"] {
+		t.Errorf("Hooks fired for %v, expected the .conf files", got)
+	}
+	select {
+	case path := <-fired:
+		t.Errorf("Hook fired for unmatched '%s'", path)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestRefuseOverwriteNewer(t *testing.T) {
+	tFiles := []testEntry{
+		{"newer", FILE, []byte("client newer content")},
+		{"older", FILE, []byte("client older content")},
+		{"same", FILE, []byte("same content")},
+		{"missing", FILE, []byte("missing content")},
+	}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	past := time.Now().Add(-time.Hour)
+	for name, content := range map[string]string{"newer": "server newer content", "older": "server older content", "same": "same content"} {
+		if err := ioutil.WriteFile(filepath.Join(sdir, name), []byte(content), 0600); err != nil {
+			t.Fatalf("Can't write file: %v", err)
+		}
+	}
+	for _, name := range []string{"newer", "same"} {
+		if err := os.Chtimes(filepath.Join(cdir, name), past, past); err != nil {
+			t.Fatalf("Can't change file times: %v", err)
+		}
+	}
+	if err := os.Chtimes(filepath.Join(sdir, "older"), past, past); err != nil {
+		t.Fatalf("Can't change file times: %v", err)
+	}
+	client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithRefuseOverwriteNewer())
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	err = client.Sync()
+	if newerErr, ok := err.(*betterbox.NewerOnServerError); !ok || len(newerErr.Paths) != 1 || newerErr.Paths[0] != "newer" {
+		t.Errorf("Expected only 'newer' reported, got: %v", err)
+	}
+	for name, content := range map[string]string{
+		"newer":   "server newer content",
+		"older":   "client older content",
+		"same":    "same content",
+		"missing": "missing content",
+	} {
+		if data, err := ioutil.ReadFile(filepath.Join(sdir, name)); err != nil || string(data) != content {
+			t.Errorf("%s: Server's content is '%s' (%v), expected '%s'", name, data, err, content)
+		}
+	}
+}
+
+func TestSyncResult(t *testing.T) {
+	for _, batch := range []bool{false, true} {
+		tFiles := []testEntry{
+			{"file1", FILE, []byte("file1 content")},
+			{"same", FILE, []byte("same content")},
+			{"dir1", DIR, nil},
+			{"dir1/file2", FILE, []byte("file2 content")},
+		}
+		var sopts []betterbox.ServerOption
+		copts := []betterbox.ClientOption{betterbox.WithRefuseOverwriteNewer()}
+		if batch {
+			sopts = append(sopts, betterbox.WithTransactionalBatches())
+			copts = append(copts, betterbox.WithBatchRequests())
+		}
+		sdir, port := newTestServer(t, sopts...)
+		defer os.RemoveAll(sdir)
+		cdir := createTempDirWithFiles(t, tFiles)
+		defer os.RemoveAll(cdir)
+		// file1 is updated, and same skipped as up to date.
+		past := time.Now().Add(-time.Hour)
+		for name, content := range map[string]string{"file1": "old content", "same": "same content"} {
+			if err := ioutil.WriteFile(filepath.Join(sdir, name), []byte(content), 0600); err != nil {
+				t.Fatalf("Can't write file: %v", err)
+			}
+		}
+		if err := os.Chtimes(filepath.Join(sdir, "file1"), past, past); err != nil {
+			t.Fatalf("Can't change file times: %v", err)
+		}
+		if err := os.Chtimes(filepath.Join(cdir, "same"), past, past); err != nil {
+			t.Fatalf("Can't change file times: %v", err)
+		}
+		client, err := betterbox.NewClient(serverAddress, port, cdir, copts...)
+		if err != nil {
+			t.Fatalf("Can't instantiate new client: %v", err)
+		}
+		result, err := client.SyncWithResult()
+		if err != nil {
+			t.Fatalf("Client can't send files to server: %v", err)
+		}
+		expected := betterbox.SyncResult{
+			Created:     1,
+			Updated:     1,
+			Directories: 1,
+			Skipped:     1,
+			Bytes:       int64(len("file1 content") + len("file2 content")),
+		}
+		if result.Duration <= 0 {
+			t.Errorf("Sync result without duration")
+		}
+		result.Duration = 0
+		if *result != expected {
+			t.Errorf("Sync result is %+v, expected %+v", *result, expected)
+		}
+		compareDirectories(t, cdir, sdir)
+	}
+}
+
+func TestWriteRateLimit(t *testing.T) {
+	const limit = 512 << 10
+	var tFiles []testEntry
+	for i := 0; i < 4; i++ {
+		tFiles = append(tFiles, testEntry{fmt.Sprintf("file%d", i), FILE, bytes.Repeat([]byte{byte(i)}, limit/2)})
+	}
+	if _, err := betterbox.NewServer(serverAddress, 0, t.TempDir(), betterbox.WithWriteRateLimit(0)); err == nil {
+		t.Errorf("Server created with a zero write rate limit")
+	}
+	sdir, port := newTestServer(t, betterbox.WithWriteRateLimit(limit))
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	start := time.Now()
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+	elapsed := time.Since(start)
+	compareDirectories(t, cdir, sdir)
+	// After a burst of a second's worth of writes, the remaining ones are
+	// written at the limit.
+	expected := time.Duration(float64(len(tFiles)*limit/2-limit) / limit * float64(time.Second))
+	if elapsed < expected*9/10 || elapsed > expected+2*time.Second {
+		t.Errorf("Files written in %s, expected %s at the limit", elapsed, expected)
+	}
+}
+
+// breakingConn fails the first read completed once broken is set to 1, as if
+// the connection broke before the Response being read.
+type breakingConn struct {
+	net.Conn
+	broken *int32
+}
+
+func (c breakingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if atomic.CompareAndSwapInt32(c.broken, 1, 2) {
+		c.Conn.Close()
+		return 0, errors.New("Connection reset")
+	}
+	return n, err
+}
+
+func TestResumableSends(t *testing.T) {
+	defer betterbox.SetSyncRetryDelay(10 * time.Millisecond)()
+	var tFiles []testEntry
+	for i := 0; i < 5; i++ {
+		tFiles = append(tFiles, testEntry{fmt.Sprintf("file%d", i), FILE, []byte(fmt.Sprintf("content %d", i))})
+	}
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	sdir := createTempDirWithFiles(t, nil)
+	defer os.RemoveAll(sdir)
+	logDir := t.TempDir()
+
+	// The connection breaks after the server replaced the third file, before
+	// the client reads its Response.
+	var mutex sync.Mutex
+	applied := make(map[string]int)
+	var broken int32
+	shouldApply := func(req *betterbox.Request, existing os.FileInfo) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		applied[req.Path]++
+		if len(applied) == 3 {
+			atomic.CompareAndSwapInt32(&broken, 0, 1)
+		}
+		return true
+	}
+	listener := newPipeListener()
+	defer listener.Close()
+	server, err := betterbox.NewServer(serverAddress, 0, sdir, betterbox.WithListener(listener),
+		betterbox.WithAppliedLog(logDir), betterbox.WithShouldApply(shouldApply))
+	if err != nil {
+		t.Fatalf("Can't instantiate new server: %v", err)
+	}
+	go server.Listen()
+	for _, entry := range tFiles {
+		if err := ioutil.WriteFile(filepath.Join(sdir, entry.name), []byte("old"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dial := func(server string) (net.Conn, error) {
+		conn, err := listener.Dial(server)
+		return breakingConn{Conn: conn, broken: &broken}, err
+	}
+	client, err := betterbox.NewClient(serverAddress, 0, cdir, betterbox.WithDialer(dial), betterbox.WithResumableSends("client1"))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+	if atomic.LoadInt32(&broken) != 2 {
+		t.Fatalf("Connection not broken")
+	}
+	compareDirectories(t, cdir, sdir)
+	for _, entry := range tFiles {
+		if applied[entry.name] != 1 {
+			t.Errorf("File '%s' applied %d times, expected once", entry.name, applied[entry.name])
+		}
+	}
+
+	// A restarted client resumes from the log of a restarted server.
+	last, err := client.LastApplied()
+	if err != nil || last < uint64(len(tFiles)) {
+		t.Fatalf("Last applied request %d, error: %v", last, err)
+	}
+	listener.Close()
+	listener = newPipeListener()
+	defer listener.Close()
+	sdir2 := createTempDirWithFiles(t, nil)
+	defer os.RemoveAll(sdir2)
+	server, err = betterbox.NewServer(serverAddress, 0, sdir2, betterbox.WithListener(listener), betterbox.WithAppliedLog(logDir))
+	if err != nil {
+		t.Fatalf("Can't instantiate new server: %v", err)
+	}
+	go server.Listen()
+	client, err = betterbox.NewClient(serverAddress, 0, cdir, betterbox.WithDialer(listener.Dial), betterbox.WithResumableSends("client1"))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if resumed, err := client.LastApplied(); err != nil || resumed != last {
+		t.Fatalf("Last applied request %d after restart, expected %d, error: %v", resumed, last, err)
+	}
+	if err = client.SyncPaths([]string{"file0"}); err != nil {
+		t.Fatalf("Client can't send file to server: %v", err)
+	}
+	if resumed, err := client.LastApplied(); err != nil || resumed != last+1 {
+		t.Errorf("Last applied request %d, expected %d, error: %v", resumed, last+1, err)
+	}
+
+	// Batches are recorded with a single fsync.
+	client, err = betterbox.NewClient(serverAddress, 0, cdir, betterbox.WithDialer(listener.Dial),
+		betterbox.WithResumableSends("client1"), betterbox.WithBatchRequests())
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	before, _ := ioutil.ReadFile(filepath.Join(logDir, "client1"))
+	count := betterbox.CountFsyncs()
+	err = client.Sync()
+	if fsyncs := count(); fsyncs != 1 {
+		t.Errorf("%d fsyncs, expected 1", fsyncs)
+	}
+	if err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(logDir, "client1"))
+	if err != nil || !bytes.HasPrefix(content, before) || bytes.Count(content[len(before):], []byte("\n")) != 1 {
+		t.Errorf("Applied log is '%s' after '%s', error: %v", content, before, err)
+	}
+
+	// Invalid IDs are refused, as are servers without an applied log.
+	if _, err := betterbox.NewClient(serverAddress, 0, cdir, betterbox.WithResumableSends("../client")); err == nil {
+		t.Errorf("Client created with an invalid ID")
+	}
+	sdir3, port := newTestServer(t)
+	defer os.RemoveAll(sdir3)
+	client, err = betterbox.NewClient(serverAddress, port, cdir, betterbox.WithResumableSends("client1"))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err == nil {
+		t.Errorf("Resumable sync to a server without applied log succeeded")
+	}
+}
+
+func TestResumableSendsCertificate(t *testing.T) {
+	cert, leaf := newTestClientCert(t, "alice")
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	logDir := t.TempDir()
+	sdir, port := newTestServer(t, betterbox.WithClientCAs(pool), betterbox.WithAppliedLog(logDir))
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, []testEntry{{"file1", FILE, []byte("content")}})
+	defer os.RemoveAll(cdir)
+	// Clients with a certificate are identified by it, whatever their ID.
+	client, err := betterbox.NewClient(serverAddress, port, cdir,
+		betterbox.WithClientCertificate(cert), betterbox.WithResumableSends("bob"))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+	if last, err := client.LastApplied(); err != nil || last != 1 {
+		t.Errorf("Last applied request %d, error: %v", last, err)
+	}
+	if _, err := os.Stat(filepath.Join(logDir, "alice")); err != nil {
+		t.Errorf("Applied log not kept under the certificate's name: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(logDir, "bob")); !os.IsNotExist(err) {
+		t.Errorf("Applied log kept under the client's ID: %v", err)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	tFiles := []testEntry{{"media", DIR, nil}, {"settings", DIR, nil}}
+	for i := 0; i < 30; i++ {
+		tFiles = append(tFiles, testEntry{fmt.Sprintf("media/file%02d", i), FILE, bytes.Repeat([]byte{byte(i)}, 1024)})
+	}
+	tFiles = append(tFiles, testEntry{"settings/app.conf", FILE, []byte("key=value")})
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	var mutex sync.Mutex
+	var applied []string
+	record := func(path string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		applied = append(applied, path)
+	}
+	sdir, port := newTestServer(t, betterbox.WithPathHook("*", record))
+	defer os.RemoveAll(sdir)
+	priority := func(relPath string) int {
+		if strings.HasSuffix(relPath, ".conf") {
+			return 10
+		}
+		return 0
+	}
+	client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithPriority(priority), betterbox.WithRemotePrefix("backup"))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+	compareDirectories(t, cdir, filepath.Join(sdir, "backup"))
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		mutex.Lock()
+		done := len(applied) == len(tFiles)+1
+		mutex.Unlock()
+		if done {
+			break
+		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	// The configuration file, after the directories it's in, comes before the
+	// bulk, which stays in order.
+	expected := []string{"backup", "backup/settings", "backup/settings/app.conf", "backup/media"}
+	for i := 0; i < 30; i++ {
+		expected = append(expected, fmt.Sprintf("backup/media/file%02d", i))
+	}
+	if strings.Join(applied, ",") != strings.Join(expected, ",") {
+		t.Errorf("Requests applied in order %v, expected %v", applied, expected)
+	}
+}
+
+func TestRemoveGrace(t *testing.T) {
+	const grace = 200 * time.Millisecond
+	if _, err := betterbox.NewServer(serverAddress, 0, t.TempDir(), betterbox.WithRemoveGrace(0)); err == nil {
+		t.Errorf("Server created with a zero remove grace period")
+	}
+	sdir, port := newTestServer(t, betterbox.WithRemoveGrace(grace))
+	defer os.RemoveAll(sdir)
+	rpcClient := dialTestServer(t, port)
+	defer rpcClient.Close()
+	apply := func(req *betterbox.Request) {
+		t.Helper()
+		var resp betterbox.Response
+		if err := rpcClient.Call("Server.ApplyRequest", req, &resp); err != nil || resp.String() != "OK" {
+			t.Fatalf("Request %s failed: %v, %v", req, resp, err)
+		}
+	}
+	apply(betterbox.NewCreateRequest("flapping", []byte("content"), nil))
+	apply(betterbox.NewMkdirRequest("dir"))
+	apply(betterbox.NewCreateRequest("dir/file", []byte("content"), nil))
+	apply(betterbox.NewCreateRequest("removed", []byte("content"), nil))
+
+	// Removes are pending, until cancelled by requests for their entries or
+	// entries within them.
+	apply(betterbox.NewRemoveRequest("flapping"))
+	apply(betterbox.NewRemoveRequest("dir"))
+	apply(betterbox.NewRemoveRequest("removed"))
+	if _, err := os.Stat(filepath.Join(sdir, "removed")); err != nil {
+		t.Errorf("File removed before the grace period: %v", err)
+	}
+	apply(betterbox.NewCreateRequest("flapping", []byte("new content"), nil))
+	apply(betterbox.NewCreateRequest("dir/other", []byte("content"), nil))
+	// The former entries of re-created directories are removed.
+	if _, err := os.Stat(filepath.Join(sdir, "dir", "file")); !os.IsNotExist(err) {
+		t.Errorf("Former file of re-created directory kept: %v", err)
+	}
+	// Entries replaced by entries of other types are removed at once.
+	apply(betterbox.NewCreateRequest("file", []byte("content"), nil))
+	apply(betterbox.NewMkdirRequest("subdir"))
+	apply(betterbox.NewCreateRequest("subdir/file", []byte("content"), nil))
+	apply(betterbox.NewMkdirRequest("linkdir"))
+	apply(betterbox.NewRemoveRequest("file"))
+	apply(betterbox.NewRemoveRequest("subdir"))
+	apply(betterbox.NewRemoveRequest("linkdir"))
+	apply(betterbox.NewMkdirRequest("file"))
+	apply(betterbox.NewCreateRequest("subdir", []byte("subdir content"), nil))
+	apply(betterbox.NewSymlinkRequest("linkdir", "file"))
+	time.Sleep(2 * grace)
+	if content, err := ioutil.ReadFile(filepath.Join(sdir, "flapping")); err != nil || string(content) != "new content" {
+		t.Errorf("Re-created file has content %q, %v", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(sdir, "dir", "other")); err != nil {
+		t.Errorf("File in re-created directory removed: %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(sdir, "file")); err != nil || !info.IsDir() {
+		t.Errorf("File not replaced by a directory: %v", err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(sdir, "subdir")); err != nil || string(content) != "subdir content" {
+		t.Errorf("Directory replaced by a file with content %q, %v", content, err)
+	}
+	if target, err := os.Readlink(filepath.Join(sdir, "linkdir")); err != nil || target != "file" {
+		t.Errorf("Directory replaced by a symlink to %q, %v", target, err)
+	}
+	if _, err := os.Stat(filepath.Join(sdir, "removed")); !os.IsNotExist(err) {
+		t.Errorf("File not removed after the grace period: %v", err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	defer betterbox.SetSnapshotPageSize(4096)()
+	tFiles := []testEntry{
+		{"dir", DIR, nil},
+		{"dir/large", FILE, bytes.Repeat([]byte("0123456789"), 2000)},
+		{"dir/small", FILE, []byte("small content")},
+		{"empty", FILE, nil},
+		{"file", FILE, []byte("file content")},
+	}
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	if err := os.Symlink("dir/small", filepath.Join(cdir, "link")); err != nil {
+		t.Fatalf("Can't create symlink: %v", err)
+	}
+	sdir, port := newTestServer(t, betterbox.WithReadOnly())
+	defer os.RemoveAll(sdir)
+	for _, entry := range tFiles {
+		path := filepath.Join(sdir, entry.name)
+		var err error
+		if entry.ftype == DIR {
+			err = os.Mkdir(path, 0700)
+		} else {
+			err = ioutil.WriteFile(path, entry.content, 0600)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("dir/small", filepath.Join(sdir, "link")); err != nil {
+		t.Fatalf("Can't create symlink: %v", err)
+	}
+	client, err := betterbox.NewClient(serverAddress, port, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	var archive bytes.Buffer
+	if err := client.Snapshot(&archive); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+
+	// The archive, fetched in pages, extracts to the destination's content.
+	edir := t.TempDir()
+	tr := tar.NewReader(&archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Reading archive failed: %v", err)
+		}
+		path := filepath.Join(edir, filepath.FromSlash(hdr.Name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.Mkdir(path, 0700)
+		case tar.TypeSymlink:
+			err = os.Symlink(hdr.Linkname, path)
+		case tar.TypeReg:
+			var content []byte
+			if content, err = ioutil.ReadAll(tr); err == nil {
+				err = ioutil.WriteFile(path, content, 0600)
+			}
+		default:
+			t.Errorf("Unexpected entry %s of type %c", hdr.Name, hdr.Typeflag)
+		}
+		if err != nil {
+			t.Fatalf("Extracting %s failed: %v", hdr.Name, err)
+		}
+	}
+	compareDirectories(t, edir, sdir)
+	if link, err := os.Readlink(filepath.Join(edir, "link")); err != nil || link != "dir/small" {
+		t.Errorf("Link extracted to '%s', %v", link, err)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	defer betterbox.SetRemoteReadSize(1000)()
+	tFiles := []testEntry{
+		{"dir1", DIR, nil},
+		{"dir1/large", FILE, bytes.Repeat([]byte("0123456789"), 500)},
+		{"dir1/dir2", DIR, nil},
+		{"dir1/dir2/empty", FILE, nil},
+		{"file1", FILE, []byte("file1 content")},
+	}
+	setup := func(dir string) {
+		if err := os.Chmod(filepath.Join(dir, "file1"), 0640); err != nil {
+			t.Fatalf("Can't change mode: %v", err)
+		}
+		if err := os.Chmod(filepath.Join(dir, "dir1", "dir2"), 0750); err != nil {
+			t.Fatalf("Can't change mode: %v", err)
+		}
+		if err := os.Symlink("dir1/large", filepath.Join(dir, "link")); err != nil {
+			t.Fatalf("Can't create symlink: %v", err)
+		}
+	}
+	original := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(original)
+	setup(original)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	setup(cdir)
+	sdir, port := newTestServer(t, betterbox.WithServerPreserveMode())
+	defer os.RemoveAll(sdir)
+	key := bytes.Repeat([]byte{1}, 32)
+	opts := []betterbox.ClientOption{betterbox.WithPreserveMode(), betterbox.WithRemotePrefix("backup"), betterbox.WithEncryptionKey(key)}
+	client, err := betterbox.NewClient(serverAddress, port, cdir, opts...)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+	if err := client.Restore(); err == nil {
+		t.Errorf("Restored into a non-empty directory")
+	}
+
+	// Wipe the client's directory, and restore it.
+	entries, err := ioutil.ReadDir(cdir)
+	if err != nil {
+		t.Fatalf("Can't read directory: %v", err)
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(cdir, entry.Name())); err != nil {
+			t.Fatalf("Can't remove entry: %v", err)
+		}
+	}
+	if err := client.Restore(); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	diffs, err := betterbox.CompareTrees(original, cdir, betterbox.CompareContent|betterbox.CompareMode)
+	if err != nil || len(diffs) > 0 {
+		t.Errorf("Restored directory differs: %v, %v", diffs, err)
+	}
+	if link, err := os.Readlink(filepath.Join(cdir, "link")); err != nil || link != "dir1/large" {
+		t.Errorf("Link restored to '%s', %v", link, err)
+	}
+}
+
+// hostileServer serves a manifest of entries out of the clients' directories.
+type hostileServer struct {
+	entries []betterbox.ManifestEntry
+}
+
+func (hostileServer) Version(req *betterbox.VersionRequest, resp *betterbox.VersionResponse) error {
+	resp.Version = betterbox.ProtocolVersion
+	return nil
+}
+
+func (hostileServer) Handshake(req *betterbox.HandshakeRequest, resp *betterbox.HandshakeResponse) error {
+	resp.Nonce = []byte("nonce")
+	return nil
+}
+
+func (hs hostileServer) Manifest(req *betterbox.ManifestRequest, resp *betterbox.ManifestResponse) error {
+	resp.Entries, resp.Algorithm = hs.entries, req.Algorithm
+	return nil
+}
+
+func (hostileServer) ReadFile(req *betterbox.ReadFileRequest, resp *betterbox.ReadFileResponse) error {
+	resp.Data, resp.EOF = []byte("hostile content"), true
+	return nil
+}
+
+func TestRestoreHostile(t *testing.T) {
+	outside := t.TempDir()
+	for _, entries := range [][]betterbox.ManifestEntry{
+		{{Path: "../escaped"}},
+		{{Path: "dir1", LinkTarget: outside}, {Path: "dir1/escaped"}},
+	} {
+		rpcServer := rpc.NewServer()
+		if err := rpcServer.RegisterName("Server", hostileServer{entries}); err != nil {
+			t.Fatalf("Can't register server: %v", err)
+		}
+		listener := newPipeListener()
+		defer listener.Close()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go rpcServer.ServeConn(conn)
+			}
+		}()
+		cdir := filepath.Join(outside, "client")
+		if err := os.Mkdir(cdir, 0700); err != nil {
+			t.Fatalf("Can't create directory: %v", err)
+		}
+		client, err := betterbox.NewClient(serverAddress, 0, cdir, betterbox.WithDialer(listener.Dial))
+		if err != nil {
+			t.Fatalf("Can't instantiate new client: %v", err)
+		}
+		if err := client.Restore(); err == nil {
+			t.Errorf("Restored hostile entries %v", entries)
+		}
+		if _, err := os.Lstat(filepath.Join(outside, "escaped")); !os.IsNotExist(err) {
+			t.Errorf("File written out of the client's directory: %v", err)
+		}
+		if err := os.RemoveAll(cdir); err != nil {
+			t.Fatalf("Can't remove directory: %v", err)
+		}
+	}
+
+	// Servers don't read files through symlinks out of their destination.
+	secret := filepath.Join(outside, "secret")
+	if err := ioutil.WriteFile(secret, []byte("secret content"), 0600); err != nil {
+		t.Fatalf("Can't write file: %v", err)
+	}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	if err := os.Symlink(outside, filepath.Join(sdir, "dir1")); err != nil {
+		t.Fatalf("Can't create symlink: %v", err)
+	}
+	rconn := dialTestServer(t, port)
+	defer rconn.Close()
+	var resp betterbox.ReadFileResponse
+	if err := rconn.Call("Server.ReadFile", &betterbox.ReadFileRequest{Path: "dir1/secret"}, &resp); err == nil {
+		t.Errorf("Read file through a symlink out of the destination: '%s'", resp.Data)
+	}
+}
+
+func TestCustomRequest(t *testing.T) {
+	const reindex = betterbox.MinCustomRequestType
+	if _, err := betterbox.NewServer(serverAddress, serverPort, os.TempDir(), betterbox.WithCustomRequest(1, func(*betterbox.Request, string) error { return nil })); err == nil {
+		t.Errorf("Server accepted a custom request type of the core ones")
+	}
+	var handled []string
+	var mutex sync.Mutex
+	handler := func(req *betterbox.Request, absPath string) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		handled = append(handled, fmt.Sprintf("%s %s", absPath, req.Data))
+		return nil
+	}
+	sdir, port := newTestServer(t, betterbox.WithCustomRequest(reindex, handler))
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, nil)
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithRemotePrefix("backup"))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err := client.SendCustom(betterbox.NewCustomRequest(reindex, "dir1/file1", []byte("full"))); err != nil {
+		t.Fatalf("Client can't send custom request: %v", err)
+	}
+	mutex.Lock()
+	if expected := filepath.Join(sdir, "backup", "dir1", "file1") + " full"; len(handled) != 1 || handled[0] != expected {
+		t.Errorf("Custom requests handled: %q, expected %q", handled, expected)
+	}
+	mutex.Unlock()
+	// Types without handlers are unsupported.
+	err = client.SendCustom(betterbox.NewCustomRequest(reindex+1, "file1", nil))
+	if reqErr, ok := errors.Cause(err).(*betterbox.RequestError); !ok || reqErr.Code() != betterbox.CodeUnsupported {
+		t.Errorf("Expected unsupported error, got: %v", err)
+	}
+	if err := client.SendCustom(betterbox.NewCustomRequest(reindex, "../file1", nil)); err == nil {
+		t.Errorf("Client sent a custom request outside of its directory")
+	}
+}
+
+func TestTreeRoot(t *testing.T) {
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"dir1", DIR, nil},
+		{"dir1/file2", FILE, []byte("file2 content")},
+		{"dir1/dir2", DIR, nil},
+		{"dir1/dir2/file3", FILE, []byte("file3 content")},
+		{"dir3", DIR, nil},
+	}
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	if err := os.Symlink("dir1/file2", filepath.Join(cdir, "link1")); err != nil {
+		t.Fatalf("Can't create symlink: %v", err)
+	}
+	treeRoot := func(port uint16) []byte {
+		t.Helper()
+		rconn := dialTestServer(t, port)
+		defer rconn.Close()
+		var resp betterbox.TreeRootResponse
+		if err := rconn.Call("Server.TreeRoot", &betterbox.TreeRootRequest{}, &resp); err != nil {
+			t.Fatalf("Can't get tree root: %v", err)
+		}
+		return resp.Root
+	}
+	// Equal trees have equal roots, whether cached or not.
+	var clients []*betterbox.Client
+	var roots [][]byte
+	var ports []uint16
+	for _, opts := range [][]betterbox.ServerOption{nil, {betterbox.WithTreeCache()}} {
+		sdir, port := newTestServer(t, opts...)
+		defer os.RemoveAll(sdir)
+		client, err := betterbox.NewClient(serverAddress, port, cdir)
+		if err != nil {
+			t.Fatalf("Can't instantiate new client: %v", err)
+		}
+		if inSync, err := client.InSync(); err != nil || inSync {
+			t.Errorf("Client in sync with an empty server: %v, %v", inSync, err)
+		}
+		if err = client.Sync(); err != nil {
+			t.Fatalf("Client can't send files to server: %v", err)
+		}
+		if inSync, err := client.InSync(); err != nil || !inSync {
+			t.Errorf("Client not in sync after syncing: %v, %v", inSync, err)
+		}
+		clients, ports, roots = append(clients, client), append(ports, port), append(roots, treeRoot(port))
+	}
+	if !bytes.Equal(roots[0], roots[1]) {
+		t.Errorf("Different roots for equal trees: %x, %x", roots[0], roots[1])
+	}
+	// A single file's change flips the root.
+	appendFile(t, filepath.Join(cdir, "dir1", "dir2", "file3"), []byte(" modified"))
+	for i, client := range clients {
+		if inSync, err := client.InSync(); err != nil || inSync {
+			t.Errorf("Client in sync with a modified file: %v, %v", inSync, err)
+		}
+		if err := client.SyncPaths([]string{"dir1/dir2/file3"}); err != nil {
+			t.Fatalf("Client can't send file to server: %v", err)
+		}
+		if inSync, err := client.InSync(); err != nil || !inSync {
+			t.Errorf("Client not in sync after syncing: %v, %v", inSync, err)
+		}
+		if root := treeRoot(ports[i]); bytes.Equal(root, roots[i]) {
+			t.Errorf("Same root after modifying a file: %x", root)
+		}
+	}
+}
+
+func TestLocalTreeCache(t *testing.T) {
+	defer betterbox.SetRequestsWaitTime(50 * time.Millisecond)()
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"dir1", DIR, nil},
+		{"dir1/file2", FILE, []byte("file2 content")},
+		{"dir1/dir2", DIR, nil},
+		{"dir1/dir2/file3", FILE, []byte("file3 content")},
+	}
+	sdir, port := newTestServer(t, betterbox.WithTreeCache())
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	errc := startMonitoring(t, client, filepath.Join(sdir, "dir1", "dir2", "file3"), tFiles[4].content)
+	inSync := func() (bool, int) {
+		t.Helper()
+		count := betterbox.CountClientHashes()
+		inSync, err := client.InSync()
+		hashed := count()
+		if err != nil {
+			t.Fatalf("Can't compare trees: %v", err)
+		}
+		return inSync, hashed
+	}
+	// Unmodified trees are compared without hashing any file, once cached.
+	cached := false
+	for deadline := time.Now().Add(2 * time.Second); !cached && time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		_, hashed := inSync()
+		cached = hashed == 0
+	}
+	if !cached {
+		t.Errorf("Client's hashes not cached while monitoring")
+	}
+	// Only the modified file is hashed again.
+	appendFile(t, filepath.Join(cdir, "dir1", "dir2", "file3"), []byte(" modified"))
+	if !waitForFile(filepath.Join(sdir, "dir1", "dir2", "file3"), []byte("file3 content modified"), 2*time.Second) {
+		t.Fatalf("Modified file not synced")
+	}
+	if ok, hashed := inSync(); !ok || hashed != 1 {
+		t.Errorf("Client in sync: %t, after hashing %d files, expected 1", ok, hashed)
+	}
+	client.Close()
+	if err := <-errc; err != nil {
+		t.Errorf("Monitoring failed: %v", err)
+	}
+}
+
+func TestSkipOversized(t *testing.T) {
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"dir1", DIR, nil},
+		{"dir1/big", FILE, bytes.Repeat([]byte("big content\n"), 100)},
+	}
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	big := filepath.Join(cdir, "dir1", "big")
+	var readBig int32
+	defer betterbox.SetBeforeRead(func(path string) {
+		if path == big {
+			atomic.AddInt32(&readBig, 1)
+		}
+	})()
+	if _, err := betterbox.NewServer(serverAddress, serverPort, os.TempDir(), betterbox.WithMaxFileSize(0)); err == nil {
+		t.Errorf("Server accepted a null maximum file size")
+	}
+
+	// Rejected once sent, by default.
+	sdir, port := newTestServer(t, betterbox.WithMaxFileSize(100))
+	defer os.RemoveAll(sdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	err = client.Sync()
+	if reqErr, ok := err.(*betterbox.RequestError); !ok || reqErr.Code() != betterbox.CodeTooLarge {
+		t.Errorf("Expected too large error, got: %v", err)
+	}
+
+	sdir, port = newTestServer(t, betterbox.WithMaxFileSize(100))
+	defer os.RemoveAll(sdir)
+	client, err = betterbox.NewClient(serverAddress, port, cdir, betterbox.WithSkipOversized())
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	atomic.StoreInt32(&readBig, 0)
+	result, err := client.SyncWithResult()
+	if err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+	if result.Skipped != 1 {
+		t.Errorf("%d files skipped, expected 1", result.Skipped)
+	}
+	if n := atomic.LoadInt32(&readBig); n != 0 {
+		t.Errorf("Oversized file read %d times", n)
+	}
+	if err := os.Remove(big); err != nil {
+		t.Fatalf("Can't remove file: %v", err)
+	}
+	compareDirectories(t, cdir, sdir)
+}
+
+func TestMaxErrors(t *testing.T) {
+	var tFiles []testEntry
+	for i := 0; i < 20; i++ {
+		tFiles = append(tFiles, testEntry{fmt.Sprintf("file%02d", i), FILE, []byte("content")})
+	}
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	if _, err := betterbox.NewClient(serverAddress, serverPort, cdir, betterbox.WithMaxErrors(0)); err == nil {
+		t.Errorf("Client accepted a null maximum number of errors")
+	}
+	for _, tc := range []struct {
+		copts   []betterbox.ClientOption
+		sent    int
+		aborted bool
+	}{
+		{nil, 1, false},
+		{[]betterbox.ClientOption{betterbox.WithContinueOnError()}, 20, false},
+		{[]betterbox.ClientOption{betterbox.WithContinueOnError(), betterbox.WithMaxErrors(5)}, 5, true},
+		{[]betterbox.ClientOption{betterbox.WithContinueOnError(), betterbox.WithMaxErrors(5), betterbox.WithBatchRequests()}, 5, true},
+	} {
+		// The server fails every request.
+		var sent int32
+		failAll := func(req *betterbox.Request, existing os.FileInfo) bool {
+			atomic.AddInt32(&sent, 1)
+			return false
+		}
+		sdir, port := newTestServer(t, betterbox.WithShouldApply(failAll))
+		defer os.RemoveAll(sdir)
+		client, err := betterbox.NewClient(serverAddress, port, cdir, tc.copts...)
+		if err != nil {
+			t.Fatalf("Can't instantiate new client: %v", err)
+		}
+		err = client.Sync()
+		if n := atomic.LoadInt32(&sent); int(n) != tc.sent {
+			t.Errorf("%d requests sent, expected %d", n, tc.sent)
+		}
+		if tc.copts == nil {
+			if reqErr, ok := err.(*betterbox.RequestError); !ok || reqErr.Code() != betterbox.CodeRejected {
+				t.Errorf("Expected rejected error, got: %v", err)
+			}
+			continue
+		}
+		failed, ok := err.(*betterbox.FailedRequestsError)
+		if !ok {
+			t.Fatalf("Expected failed requests error, got: %v", err)
+		}
+		if failed.Failed != tc.sent || failed.Aborted != tc.aborted || len(failed.Errors) == 0 || failed.Errors[0].Code() != betterbox.CodeRejected {
+			t.Errorf("Unexpected failed requests error: %v (aborted: %t)", err, failed.Aborted)
+		}
+	}
+}
+
+func TestVersioning(t *testing.T) {
+	for _, batch := range []bool{false, true} {
+		sopts := []betterbox.ServerOption{betterbox.WithVersioning(".versions", 2)}
+		copts := []betterbox.ClientOption{betterbox.WithDeleteExcess()}
+		if batch {
+			sopts = append(sopts, betterbox.WithTransactionalBatches())
+			copts = append(copts, betterbox.WithBatchRequests())
+		}
+		tFiles := []testEntry{
+			{"dir1", DIR, nil},
+			{"dir1/file1", FILE, []byte("version 1")},
+		}
+		sdir, port := newTestServer(t, sopts...)
+		defer os.RemoveAll(sdir)
+		cdir := createTempDirWithFiles(t, tFiles)
+		defer os.RemoveAll(cdir)
+		client, err := betterbox.NewClient(serverAddress, port, cdir, copts...)
+		if err != nil {
+			t.Fatalf("Can't instantiate new client: %v", err)
+		}
+		if err = client.Sync(); err != nil {
+			t.Fatalf("Client can't send files to server: %v", err)
+		}
+		versions := func() []string {
+			dir := filepath.Join(sdir, ".versions", "dir1", "file1")
+			entries, err := ioutil.ReadDir(dir)
+			if err != nil {
+				t.Fatalf("Can't list versions: %v", err)
+			}
+			var contents []string
+			for _, entry := range entries {
+				content, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+				if err != nil {
+					t.Fatalf("Can't read version: %v", err)
+				}
+				contents = append(contents, string(content))
+			}
+			return contents
+		}
+
+		// Overwriting twice keeps both previous versions.
+		for _, content := range []string{"version 2", "version 3"} {
+			if err := ioutil.WriteFile(filepath.Join(cdir, "dir1", "file1"), []byte(content), 0600); err != nil {
+				t.Fatalf("Can't write file: %v", err)
+			}
+			if err = client.Sync(); err != nil {
+				t.Fatalf("Client can't send files to server: %v", err)
+			}
+		}
+		if v := versions(); fmt.Sprint(v) != "[version 1 version 2]" {
+			t.Errorf("Versions %q, expected the first two", v)
+		}
+		// Removing keeps the last version, dropping the oldest.
+		if err := os.RemoveAll(filepath.Join(cdir, "dir1")); err != nil {
+			t.Fatalf("Can't remove directory: %v", err)
+		}
+		if err = client.Reconcile(); err != nil {
+			t.Fatalf("Reconciliation failed: %v", err)
+		}
+		if v := versions(); fmt.Sprint(v) != "[version 2 version 3]" {
+			t.Errorf("Versions %q, expected the last two", v)
+		}
+		if diffs, err := client.Verify(); err != nil || len(diffs) != 0 {
+			t.Errorf("Verify returned %v, %v, expected no differences", diffs, err)
+		}
+
+		rconn := dialTestServer(t, port)
+		defer rconn.Close()
+		var resp betterbox.Response
+		if err := rconn.Call("Server.ApplyRequest", betterbox.NewRemoveRequest(".versions"), &resp); err != nil {
+			t.Fatalf("Sending request failed: %v", err)
+		}
+		if resp.Message == "" {
+			t.Errorf("Versions directory removed")
+		}
+	}
+}
+
+func TestLastSync(t *testing.T) {
+	tFiles := []testEntry{{"file1", FILE, []byte("file1 content")}}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if !client.LastSync().IsZero() {
+		t.Errorf("Last sync time set before any sync")
+	}
+	before := time.Now()
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+	lastSync := client.LastSync()
+	if lastSync.Before(before) {
+		t.Errorf("Last sync time not advanced: %v", lastSync)
+	}
+
+	// Syncing again fails, as the file exists as a directory on the server.
+	if err := os.Remove(filepath.Join(sdir, "file1")); err != nil {
+		t.Fatalf("Can't remove file: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(sdir, "file1"), 0700); err != nil {
+		t.Fatalf("Can't create directory: %v", err)
+	}
+	if err = client.Sync(); err == nil {
+		t.Fatalf("Sync succeeded despite failing request")
+	}
+	if !client.LastSync().Equal(lastSync) {
+		t.Errorf("Last sync time advanced after a failed sync")
+	}
+	if stats := client.Stats(); stats.Pending != 0 || stats.Lag != 0 {
+		t.Errorf("Unexpected pending changes: %+v", stats)
+	}
+}
+
+func TestMultipleServers(t *testing.T) {
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"dir1", DIR, nil},
+		{"dir1/file2", FILE, []byte("file2 content")},
+	}
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	addrport := func(port uint16) string {
+		return net.JoinHostPort(serverAddress, strconv.Itoa(int(port)))
+	}
+
+	// No server listening on the first port.
+	downPort := uint16(atomic.AddUint32(&lastPort, 1))
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	client, err := betterbox.NewClient(serverAddress, downPort, cdir, betterbox.WithServers(betterbox.ServersFailover, addrport(port)))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't fail over to second server: %v", err)
+	}
+	compareDirectories(t, cdir, sdir)
+
+	sdir1, port1 := newTestServer(t)
+	defer os.RemoveAll(sdir1)
+	sdir2, port2 := newTestServer(t)
+	defer os.RemoveAll(sdir2)
+	client, err = betterbox.NewClient(serverAddress, port1, cdir, betterbox.WithServers(betterbox.ServersFanOut, addrport(port2)))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to servers: %v", err)
+	}
+	compareDirectories(t, cdir, sdir1)
+	compareDirectories(t, cdir, sdir2)
+}
+
+func TestServerRejectsDestinationRoot(t *testing.T) {
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	if err := ioutil.WriteFile(filepath.Join(sdir, "file1"), []byte("file1 content"), 0600); err != nil {
+		t.Fatalf("Can't write file: %v", err)
+	}
+	rconn := dialTestServer(t, port)
+	defer rconn.Close()
+	for _, req := range []*betterbox.Request{
+		betterbox.NewRemoveRequest("."),
+		betterbox.NewMkdirRequest("."),
+		betterbox.NewRemoveRequest("dir1/.."),
+	} {
+		var resp betterbox.Response
+		if err := rconn.Call("Server.ApplyRequest", req, &resp); err != nil {
+			t.Fatalf("Sending request failed: %v", err)
+		}
+		if resp.Message == "" {
+			t.Errorf("Request '%s' accepted", req)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(sdir, "file1")); err != nil {
+		t.Errorf("Destination content removed: %v", err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	sdir, port := newTestServer(t, betterbox.WithIdleTimeout(300*time.Millisecond))
+	defer os.RemoveAll(sdir)
+	ping := func(rconn *rpc.Client) error {
+		var resp betterbox.PingResponse
+		return rconn.Call("Server.Ping", &betterbox.PingRequest{}, &resp)
+	}
+
+	// Active connections are kept.
+	rconn := dialTestServer(t, port)
+	defer rconn.Close()
+	for i := 0; i < 4; i++ {
+		time.Sleep(150 * time.Millisecond)
+		if err := ping(rconn); err != nil {
+			t.Fatalf("Active connection closed: %v", err)
+		}
+	}
+	time.Sleep(600 * time.Millisecond)
+	if err := ping(rconn); err == nil {
+		t.Errorf("Idle connection not closed")
+	}
+}
+
+func TestExpandPath(t *testing.T) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Skipf("No home directory: %v", err)
+	}
+	os.Setenv("BETTERBOX_TEST_DIR", "docs")
+	defer os.Unsetenv("BETTERBOX_TEST_DIR")
+	for _, tc := range []struct {
+		path, expanded string
+	}{
+		{"~", home},
+		{"~/Documents", filepath.Join(home, "Documents")},
+		{"~/$BETTERBOX_TEST_DIR/notes", filepath.Join(home, "docs", "notes")},
+		{"/srv/${BETTERBOX_TEST_DIR}", "/srv/docs"},
+		{"~other/Documents", "~other/Documents"},
+		{"relative/path", "relative/path"},
+	} {
+		expanded, err := betterbox.ExpandPath(tc.path)
+		if err != nil || expanded != tc.expanded {
+			t.Errorf("%s: Expanded to '%s' (%v), expected '%s'", tc.path, expanded, err, tc.expanded)
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+// jsonLogEntries parses the JSON log lines.
+func jsonLogEntries(t *testing.T, logs string) []map[string]interface{} {
+	t.Helper()
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(logs), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Log line isn't JSON: %s: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestJSONLogging(t *testing.T) {
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"secret", FILE, []byte("password")},
+	}
+	var serverLogs, clientLogs syncBuffer
+	sdir, port := newTestServer(t, betterbox.WithServerJSONLogging(&serverLogs))
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	skipSecret := func(relPath string, data []byte) ([]byte, error) {
+		if relPath == "secret" {
+			return nil, fmt.Errorf("Secret file")
+		}
+		return data, nil
+	}
+	client, err := betterbox.NewClient(serverAddress, port, cdir,
+		betterbox.WithJSONLogging(&clientLogs), betterbox.WithDataTransform(skipSecret))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+
+	found := false
+	for _, entry := range jsonLogEntries(t, serverLogs.String()) {
+		if entry["msg"] == "Received request" && entry["level"] == "info" &&
+			entry["request_type"] == "Create" && entry["path"] == "file1" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Missing received request in server logs: %s", serverLogs.String())
+	}
+	entries := jsonLogEntries(t, clientLogs.String())
+	if len(entries) != 1 || entries[0]["level"] != "warning" || entries[0]["path"] != "secret" ||
+		entries[0]["error"] == nil {
+		t.Errorf("Unexpected client logs: %s", clientLogs.String())
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"dir1", DIR, nil},
+	}
+	external := createTempDirWithFiles(t, []testEntry{
+		{"file2", FILE, []byte("file2 content")},
+		{"dir2", DIR, nil},
+		{"dir2/file3", FILE, []byte("file3 content")},
+	})
+	defer os.RemoveAll(external)
+	for _, batch := range []bool{false, true} {
+		var sopts []betterbox.ServerOption
+		var copts []betterbox.ClientOption
+		if batch {
+			sopts = append(sopts, betterbox.WithTransactionalBatches())
+			copts = append(copts, betterbox.WithBatchRequests())
+		}
+		sdir, port := newTestServer(t, sopts...)
+		defer os.RemoveAll(sdir)
+		cdir := createTempDirWithFiles(t, tFiles)
+		defer os.RemoveAll(cdir)
+		for link, target := range map[string]string{
+			"dir1/link1": "../file1",
+			"link2":      filepath.Join(external, "file2"),
+			"link3":      filepath.Join(external, "dir2"),
+			"dir1/loop":  cdir,
+		} {
+			if err := os.Symlink(target, filepath.Join(cdir, link)); err != nil {
+				t.Fatalf("Can't create symlink: %v", err)
+			}
+		}
+		// Loops through copied directories are cut.
+		if err := os.Symlink(external, filepath.Join(external, "dir2", "loop")); err != nil {
+			t.Fatalf("Can't create symlink: %v", err)
+		}
+		client, err := betterbox.NewClient(serverAddress, port, cdir, copts...)
+		if err != nil {
+			t.Fatalf("Can't instantiate new client: %v", err)
+		}
+		err = client.Sync()
+		os.Remove(filepath.Join(external, "dir2", "loop"))
+		if err != nil {
+			t.Fatalf("Client can't send files to server: %v", err)
+		}
+		// Internal targets are preserved.
+		for link, target := range map[string]string{"dir1/link1": "../file1", "dir1/loop": ".."} {
+			if got, err := os.Readlink(filepath.Join(sdir, link)); err != nil || got != target {
+				t.Errorf("%s: Link to '%s' stored, expected '%s' (%v)", link, got, target, err)
+			}
+		}
+		// External targets are copied.
+		for name, content := range map[string]string{
+			"link2":            "file2 content",
+			"link3/file3":      "file3 content",
+			"link3/loop/file2": "file2 content",
+		} {
+			info, err := os.Lstat(filepath.Join(sdir, name))
+			if err != nil || info.Mode()&os.ModeSymlink != 0 {
+				t.Errorf("%s: Not copied (%v)", name, err)
+				continue
+			}
+			if data, _ := ioutil.ReadFile(filepath.Join(sdir, name)); string(data) != content {
+				t.Errorf("%s: Content '%s' stored, expected '%s'", name, data, content)
+			}
+		}
+		if _, err := os.Lstat(filepath.Join(sdir, "link3", "loop", "dir2", "loop")); err == nil {
+			t.Errorf("Symlink loop copied")
+		}
+	}
+}
+
+func TestResyncSymlinks(t *testing.T) {
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"file2", FILE, []byte("file2 content")},
+	}
+	for _, batch := range []bool{false, true} {
+		var sopts []betterbox.ServerOption
+		var copts []betterbox.ClientOption
+		if batch {
+			sopts = append(sopts, betterbox.WithTransactionalBatches())
+			copts = append(copts, betterbox.WithBatchRequests())
+		}
+		sdir, port := newTestServer(t, sopts...)
+		defer os.RemoveAll(sdir)
+		cdir := createTempDirWithFiles(t, tFiles)
+		defer os.RemoveAll(cdir)
+		link := filepath.Join(cdir, "link")
+		if err := os.Symlink("file1", link); err != nil {
+			t.Fatalf("Can't create symlink: %v", err)
+		}
+		client, err := betterbox.NewClient(serverAddress, port, cdir, copts...)
+		if err != nil {
+			t.Fatalf("Can't instantiate new client: %v", err)
+		}
+		// Links already on the server are replaced.
+		for i := 0; i < 2; i++ {
+			if err = client.Sync(); err != nil {
+				t.Fatalf("Client can't send files to server: %v", err)
+			}
+		}
+		if err := os.Remove(link); err != nil {
+			t.Fatalf("Can't remove symlink: %v", err)
+		}
+		if err := os.Symlink("file2", link); err != nil {
+			t.Fatalf("Can't create symlink: %v", err)
+		}
+		if err = client.Sync(); err != nil {
+			t.Fatalf("Client can't send files to server: %v", err)
+		}
+		if target, err := os.Readlink(filepath.Join(sdir, "link")); err != nil || target != "file2" {
+			t.Errorf("Link to '%s' stored, expected 'file2' (%v)", target, err)
+		}
+		compareDirectories(t, cdir, sdir)
+	}
+}
+
+func TestServerRejectsLinkOutsideDestination(t *testing.T) {
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	rpcClient := dialTestServer(t, port)
+	defer rpcClient.Close()
+	for _, target := range []string{"/etc/passwd", "../outside", "dir/../../outside", ""} {
+		var resp betterbox.Response
+		req := betterbox.NewSymlinkRequest("link", target)
+		if err := rpcClient.Call("Server.ApplyRequest", req, &resp); err != nil {
+			t.Fatalf("Calling server failed: %v", err)
+		}
+		if resp.String() == "OK" {
+			t.Errorf("Link to '%s' accepted", target)
+		}
+	}
+
+	// Targets going up from symlinks already in the destination escape it,
+	// while looking confined.
+	for _, req := range []*betterbox.Request{
+		betterbox.NewMkdirRequest("sub"),
+		betterbox.NewSymlinkRequest("sub/up", ".."),
+		betterbox.NewSymlinkRequest("sub/self", "up/sub"),
+	} {
+		var resp betterbox.Response
+		if err := rpcClient.Call("Server.ApplyRequest", req, &resp); err != nil || resp.String() != "OK" {
+			t.Fatalf("Request %s failed: %v, %v", req, resp, err)
+		}
+	}
+	for _, target := range []string{"sub/up/..", "sub/self/up/../..", "sub/missing/../up/.."} {
+		var resp betterbox.Response
+		req := betterbox.NewSymlinkRequest("escape", target)
+		if err := rpcClient.Call("Server.ApplyRequest", req, &resp); err != nil {
+			t.Fatalf("Calling server failed: %v", err)
+		}
+		if resp.String() == "OK" {
+			t.Errorf("Link to '%s' accepted", target)
+		}
+	}
+}
+
+func TestUnconfinedSymlinks(t *testing.T) {
+	sdir, port := newTestServer(t, betterbox.WithUnconfinedSymlinks())
+	defer os.RemoveAll(sdir)
+	rpcClient := dialTestServer(t, port)
+	defer rpcClient.Close()
+	for i, target := range []string{"/etc/passwd", "../outside", "dir/../../outside"} {
+		var resp betterbox.Response
+		req := betterbox.NewSymlinkRequest(fmt.Sprintf("link%d", i), target)
+		if err := rpcClient.Call("Server.ApplyRequest", req, &resp); err != nil {
+			t.Fatalf("Calling server failed: %v", err)
+		}
+		if resp.String() != "OK" {
+			t.Errorf("Link to '%s' rejected: %s", target, resp)
+		}
+		if link, err := os.Readlink(filepath.Join(sdir, req.Path)); err != nil || link != target {
+			t.Errorf("Link to '%s' created to '%s', %v", target, link, err)
+		}
+	}
+	// Paths are still confined.
+	var resp betterbox.Response
+	if err := rpcClient.Call("Server.ApplyRequest", betterbox.NewSymlinkRequest("../link", "target"), &resp); err != nil {
+		t.Fatalf("Calling server failed: %v", err)
+	}
+	if resp.String() == "OK" {
+		t.Errorf("Link outside of destination accepted")
+	}
+}
+
+func TestPersistentQueue(t *testing.T) {
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"file2", FILE, []byte("file2 content")},
+	}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	qdir, err := ioutil.TempDir("", "betterbox-queue")
+	if err != nil {
+		t.Fatalf("Can't create queue directory: %v", err)
+	}
+	defer os.RemoveAll(qdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithPersistentQueue(qdir))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	// Changes are never sent on time.
+	restore := betterbox.SetRequestsWaitTime(time.Hour)
+	errc := startMonitoring(t, client, filepath.Join(sdir, "file2"), tFiles[1].content)
+	content := []byte("file1 new content")
+	if err := ioutil.WriteFile(filepath.Join(cdir, "file1"), content, 0600); err != nil {
+		t.Fatalf("Can't write file: %v", err)
+	}
+	if err := os.Remove(filepath.Join(cdir, "file2")); err != nil {
+		t.Fatalf("Can't remove file: %v", err)
+	}
+	queued := func() bool {
+		data, _ := ioutil.ReadFile(filepath.Join(qdir, "pending"))
+		return strings.Contains(string(data), `"file1"`) && strings.Contains(string(data), `"file2"`)
+	}
+	for deadline := time.Now().Add(5 * time.Second); !queued() && time.Now().Before(deadline); {
+		time.Sleep(50 * time.Millisecond)
+	}
+	// Crash, with the changes pending.
+	client.Close()
+	<-errc
+	restore()
+	if data, _ := ioutil.ReadFile(filepath.Join(sdir, "file1")); bytes.Equal(data, content) {
+		t.Fatalf("Pending change sent before restart")
+	}
+
+	// Restarted client.
+	client, err = betterbox.NewClient(serverAddress, port, cdir,
+		betterbox.WithPersistentQueue(qdir), betterbox.WithInitialSync(betterbox.InitialSyncNone))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	errc = startMonitoring(t, client, filepath.Join(sdir, "file1"), content)
+	client.Close()
+	if err := <-errc; err != nil {
+		t.Errorf("Monitoring failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(sdir, "file2")); !os.IsNotExist(err) {
+		t.Errorf("Pending removal not sent after restart")
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(qdir, "pending")); err != nil || len(data) > 0 {
+		t.Errorf("Queue not cleared after sending: '%s'", data)
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"dir1", DIR, nil},
+		{"dir1/file2", FILE, []byte("file1 content")},
+	}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	key := bytes.Repeat([]byte{0x42}, 32)
+	if _, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithEncryptionKey(key[:10])); err == nil {
+		t.Errorf("Invalid key size accepted")
+	}
+	client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithEncryptionKey(key))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+	var stored [][]byte
+	for _, name := range []string{"file1", "dir1/file2"} {
+		data, err := ioutil.ReadFile(filepath.Join(sdir, name))
+		if err != nil {
+			t.Fatalf("Can't read file: %v", err)
+		}
+		if bytes.Contains(data, []byte("content")) {
+			t.Errorf("%s: Plaintext stored on server", name)
+		}
+		plaintext, err := betterbox.Decrypt(key, name, data)
+		if err != nil || string(plaintext) != "file1 content" {
+			t.Errorf("%s: Decrypted '%s', expected 'file1 content' (%v)", name, plaintext, err)
+		}
+		stored = append(stored, data)
+	}
+	// Same content, but different nonces.
+	if bytes.Equal(stored[0], stored[1]) {
+		t.Errorf("Same ciphertext stored for same content")
+	}
+	if _, err := betterbox.Decrypt(bytes.Repeat([]byte{0x24}, 32), "file1", stored[0]); err == nil {
+		t.Errorf("Decrypted with wrong key")
+	}
+	// Contents swapped by the server don't decrypt.
+	if _, err := betterbox.Decrypt(key, "dir1/file2", stored[0]); err == nil {
+		t.Errorf("Decrypted content moved to another path")
+	}
+}
+
+func TestConnectedClients(t *testing.T) {
+	server, sdir, port := startTestServer(t, serverAddress)
+	defer os.RemoveAll(sdir)
+	waitForClients := func(count int) []betterbox.ClientInfo {
+		var clients []betterbox.ClientInfo
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+			if clients = server.ConnectedClients(); len(clients) == count {
+				break
+			}
+		}
+		return clients
+	}
+	var conns []*rpc.Client
+	for i := 0; i < 2; i++ {
+		conn := dialTestServer(t, port)
+		defer conn.Close()
+		// The TLS handshake is done on the first call.
+		var resp betterbox.Response
+		if err := conn.Call("Server.ApplyRequest", betterbox.NewMkdirRequest(fmt.Sprintf("dir%d", i)), &resp); err != nil {
+			t.Fatalf("Calling server failed: %v", err)
+		}
+		conns = append(conns, conn)
+	}
+	clients := waitForClients(2)
+	if len(clients) != 2 {
+		t.Fatalf("%d connected clients, expected 2", len(clients))
+	}
+	for _, info := range clients {
+		host, _, err := net.SplitHostPort(info.Address)
+		if err != nil || !net.ParseIP(host).IsLoopback() || info.ConnectedAt.IsZero() || info.LastRequest.Before(info.ConnectedAt) {
+			t.Errorf("Unexpected client info: %+v", info)
+		}
+	}
+	if clients[0].Address == clients[1].Address {
+		t.Errorf("Same address for both clients: %s", clients[0].Address)
+	}
+
+	conns[0].Close()
+	if clients := waitForClients(1); len(clients) != 1 {
+		t.Errorf("%d connected clients after disconnection, expected 1", len(clients))
+	}
+}
+
+func TestProtocolVersion(t *testing.T) {
+	tFiles := []testEntry{{"file1", FILE, []byte("file1 content")}}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	restore := betterbox.SetClientProtocolVersion(betterbox.ProtocolVersion + 1)
+	err = client.Sync()
+	restore()
+	if err == nil || !strings.Contains(err.Error(), "Incompatible protocol version") {
+		t.Errorf("Unexpected error with incompatible version: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(sdir, "file1")); err == nil {
+		t.Errorf("File sent with incompatible version")
+	}
+	if err = client.Sync(); err != nil {
+		t.Errorf("Client can't send files to server: %v", err)
+	}
+}
+
+// slowLogger slows the server down, by delaying each received request.
+type slowLogger struct {
+	delay time.Duration
+}
+
+func (l slowLogger) Log(level betterbox.Level, msg string, fields betterbox.Fields) {
+	if msg == "Received request" {
+		time.Sleep(l.delay)
+	}
+}
+
+func TestBackpressure(t *testing.T) {
+	defer betterbox.SetRequestsWaitTime(50 * time.Millisecond)()
+	tFiles := []testEntry{{"file0", FILE, []byte("initial content")}}
+	sdir, port := newTestServer(t, betterbox.WithServerLogger(slowLogger{5 * time.Millisecond}))
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	const capacity = 1
+	client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithSendQueue(capacity))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	errc := startMonitoring(t, client, filepath.Join(sdir, "file0"), tFiles[0].content)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for deadline, i := time.Now().Add(1500*time.Millisecond), 0; time.Now().Before(deadline); i++ {
+			name := filepath.Join(cdir, fmt.Sprintf("file%d", i%50))
+			if err := ioutil.WriteFile(name, []byte(fmt.Sprintf("content %d", i)), 0600); err != nil {
+				t.Errorf("Can't write file: %v", err)
+				return
+			}
+		}
+	}()
+	// At most the buffers in the send queue, the one being sent and the one
+	// being filled.
+	max := 0
+	for sampling := true; sampling; time.Sleep(5 * time.Millisecond) {
+		select {
+		case <-done:
+			sampling = false
+		default:
+		}
+		if stats := client.Stats(); stats.Pending+stats.InFlight > max {
+			max = stats.Pending + stats.InFlight
+		}
+	}
+	if limit := (capacity + 2) * betterbox.RequestsBufferSize; max > limit {
+		t.Errorf("%d requests buffered, expected at most %d", max, limit)
+	}
+	if max == 0 {
+		t.Errorf("No requests buffered")
+	}
+	last := []byte("last content")
+	if err := ioutil.WriteFile(filepath.Join(cdir, "file0"), last, 0600); err != nil {
+		t.Fatalf("Can't write file: %v", err)
+	}
+	if !waitForFile(filepath.Join(sdir, "file0"), last, 20*time.Second) {
+		t.Errorf("Last change not synced")
+	}
+	client.Close()
+	if err := <-errc; err != nil {
+		t.Errorf("Monitoring failed: %v", err)
+	}
+}
+
+// newTestClientCert creates a self-signed client certificate, with the
+// provided common name.
+func newTestClientCert(t testing.TB, name string) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Can't generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Can't create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Can't parse certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, cert
+}
+
+func TestPerClientDirs(t *testing.T) {
+	names := []string{"alice", "bob"}
+	pool := x509.NewCertPool()
+	certs := make(map[string]tls.Certificate)
+	for _, name := range names {
+		cert, leaf := newTestClientCert(t, name)
+		pool.AddCert(leaf)
+		certs[name] = cert
+	}
+	base := createTempDirWithFiles(t, nil)
+	defer os.RemoveAll(base)
+	if _, err := betterbox.NewServer(serverAddress, serverPort, base, betterbox.WithPerClientDirs(base)); err == nil {
+		t.Errorf("Per-client directories accepted without client certificates")
+	}
+	versions := createTempDirWithFiles(t, nil)
+	defer os.RemoveAll(versions)
+	logger := &receivedLogger{received: make(map[string]int)}
+	sdir, port := newTestServer(t, betterbox.WithClientCAs(pool), betterbox.WithPerClientDirs(base),
+		betterbox.WithVersioning(versions, 1), betterbox.WithServerLogger(logger))
+	defer os.RemoveAll(sdir)
+	for _, name := range names {
+		// Both clients sync the same file names.
+		cdir := createTempDirWithFiles(t, []testEntry{
+			{"file1", FILE, []byte(name + " content")},
+			{"dir1", DIR, nil},
+			{"dir1/file2", FILE, []byte(name + " file2 content")},
+		})
+		defer os.RemoveAll(cdir)
+		client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithClientCertificate(certs[name]))
+		if err != nil {
+			t.Fatalf("Can't instantiate new client: %v", err)
+		}
+		if err = client.Sync(); err != nil {
+			t.Fatalf("%s: Client can't send files to server: %v", name, err)
+		}
+		compareDirectories(t, cdir, filepath.Join(base, name))
+		// The clients' versions of the same files are kept apart.
+		if err := ioutil.WriteFile(filepath.Join(cdir, "file1"), []byte(name+" new content"), 0600); err != nil {
+			t.Fatalf("Can't write file: %v", err)
+		}
+		if err = client.Sync(); err != nil {
+			t.Fatalf("%s: Client can't send files to server: %v", name, err)
+		}
+	}
+	for _, name := range names {
+		dir := filepath.Join(versions, name, "file1")
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil || len(entries) != 1 {
+			t.Fatalf("%s: Versions of file1: %v, %v", name, entries, err)
+		}
+		if content, err := ioutil.ReadFile(filepath.Join(dir, entries[0].Name())); err != nil || string(content) != name+" content" {
+			t.Errorf("%s: Version of file1 is '%s' (%v)", name, content, err)
+		}
+	}
+	if entries, _ := ioutil.ReadDir(sdir); len(entries) != 0 {
+		t.Errorf("Files written to the server's destination")
+	}
+	// The clients' requests are logged by the server's logger.
+	logger.mutex.Lock()
+	if n := logger.received["file1"]; n != 2*len(names) {
+		t.Errorf("%d requests for file1 logged, expected %d", n, 2*len(names))
+	}
+	logger.mutex.Unlock()
+
+	// Clients without certificates are rejected.
+	cdir := createTempDirWithFiles(t, []testEntry{{"file1", FILE, []byte("content")}})
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err == nil {
+		t.Errorf("Client without certificate accepted")
+	}
+}
+
+func TestReconcileInterval(t *testing.T) {
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"dir1", DIR, nil},
+		{"dir1/file2", FILE, []byte("file2 content")},
+	}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	if _, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithReconcileInterval(0)); err == nil {
+		t.Errorf("Invalid reconcile interval accepted")
+	}
+	client, err := betterbox.NewClient(serverAddress, port, cdir,
+		betterbox.WithReconcileInterval(100*time.Millisecond), betterbox.WithDeleteExcess())
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	errc := startMonitoring(t, client, filepath.Join(sdir, "dir1", "file2"), tFiles[2].content)
+
+	// Out-of-band changes to the server.
+	if err := os.Remove(filepath.Join(sdir, "dir1", "file2")); err != nil {
+		t.Fatalf("Can't remove file: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(sdir, "excess", "dir"), 0700); err != nil {
+		t.Fatalf("Can't create directory: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(sdir, "excess", "dir", "file"), nil, 0600); err != nil {
+		t.Fatalf("Can't write file: %v", err)
+	}
+	if !waitForFile(filepath.Join(sdir, "dir1", "file2"), tFiles[2].content, 2*time.Second) {
+		t.Errorf("Removed file not restored")
+	}
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if _, err := os.Stat(filepath.Join(sdir, "excess")); os.IsNotExist(err) {
+			break
+		}
+	}
+	client.Close()
+	if err := <-errc; err != nil {
+		t.Errorf("Monitoring failed: %v", err)
+	}
+	compareDirectories(t, cdir, sdir)
+}
+
+func TestFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"file1":      {Data: []byte("file1 content"), Mode: 0600},
+		"dir1":       {Mode: fs.ModeDir | 0700},
+		"dir1/file2": {Data: []byte("file2 content"), Mode: 0600},
+		"dir2":       {Mode: fs.ModeDir | 0700},
+	}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	// The client's directory is left empty.
+	cdir := createTempDirWithFiles(t, nil)
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithFS(fsys))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+	for name, file := range fsys {
+		path := filepath.Join(sdir, filepath.FromSlash(name))
+		if file.Mode.IsDir() {
+			if info, err := os.Stat(path); err != nil || !info.IsDir() {
+				t.Errorf("%s: Directory not created", name)
+			}
+		} else if data, err := ioutil.ReadFile(path); err != nil || !bytes.Equal(data, file.Data) {
+			t.Errorf("%s: Content '%s' stored, expected '%s'", name, data, file.Data)
+		}
+	}
+}
+
+func TestRootRemoved(t *testing.T) {
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"file2", FILE, []byte("file2 content")},
+		{"file3", FILE, []byte("file3 content")},
+	}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	// The directory is removed while the walk reads its first file.
+	removeRoot := func(relPath string, data []byte) ([]byte, error) {
+		if relPath == "file1" {
+			if err := os.RemoveAll(cdir); err != nil {
+				t.Errorf("Can't remove directory: %v", err)
+			}
+		}
+		return data, nil
+	}
+	client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithDataTransform(removeRoot))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	err = client.Sync()
+	if rerr, ok := err.(*betterbox.RootRemovedError); !ok || rerr.Path != cdir {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if entries, _ := ioutil.ReadDir(sdir); len(entries) != 0 {
+		t.Errorf("Files sent after directory removal")
+	}
+}
+
+func TestHashCache(t *testing.T) {
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"file2", FILE, []byte("file2 content")},
+	}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	state, err := ioutil.TempFile("", "betterbox-hashes")
+	if err != nil {
+		t.Fatalf("Can't create state file: %v", err)
+	}
+	state.Close()
+	os.Remove(state.Name())
+	defer os.Remove(state.Name())
+	client, err := betterbox.NewClient(serverAddress, port, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+	// Each reconciliation is done by a restarted client.
+	reconcile := func() int {
+		t.Helper()
+		client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithHashCache(state.Name()))
+		if err != nil {
+			t.Fatalf("Can't instantiate new client: %v", err)
+		}
+		count := betterbox.CountClientHashes()
+		err = client.Reconcile()
+		hashed := count()
+		if err != nil {
+			t.Fatalf("Reconciliation failed: %v", err)
+		}
+		return hashed
+	}
+	if hashed := reconcile(); hashed != 2 {
+		t.Errorf("%d files hashed with empty cache, expected 2", hashed)
+	}
+	if hashed := reconcile(); hashed != 0 {
+		t.Errorf("%d untouched files hashed, expected 0", hashed)
+	}
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(cdir, "file1"), future, future); err != nil {
+		t.Fatalf("Can't change file times: %v", err)
+	}
+	if hashed := reconcile(); hashed != 1 {
+		t.Errorf("%d files hashed after touch, expected 1", hashed)
+	}
+
+	// Changes keeping the size and modification time are trusted to
+	// not have happened.
+	path := filepath.Join(cdir, "file2")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Can't stat file: %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte("file2 CONTENT"), 0600); err != nil {
+		t.Fatalf("Can't write file: %v", err)
+	}
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatalf("Can't change file times: %v", err)
+	}
+	if hashed := reconcile(); hashed != 0 {
+		t.Errorf("%d files hashed, expected 0", hashed)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(sdir, "file2")); !bytes.Equal(data, tFiles[1].content) {
+		t.Errorf("Cached file sent again")
+	}
+}
+
+func TestHashAlgorithm(t *testing.T) {
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"file2", FILE, []byte("file2 content")},
+	}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	if _, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithHashAlgorithm("md4")); err == nil {
+		t.Errorf("Unsupported hash algorithm accepted")
+	}
+	for _, algorithm := range []betterbox.HashAlgorithm{betterbox.HashSHA512, betterbox.HashFNV128a} {
+		client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithHashAlgorithm(algorithm))
+		if err != nil {
+			t.Fatalf("Can't instantiate new client: %v", err)
+		}
+		if err = client.Sync(); err != nil {
+			t.Fatalf("Client can't send files to server: %v", err)
+		}
+		untouched := filepath.Join(sdir, "file1")
+		past := time.Now().Add(-time.Hour).Truncate(time.Second)
+		if err := os.Chtimes(untouched, past, past); err != nil {
+			t.Fatalf("Can't change file times: %v", err)
+		}
+		content := []byte("file2 CONTENT")
+		if err := ioutil.WriteFile(filepath.Join(cdir, "file2"), content, 0600); err != nil {
+			t.Fatalf("Can't write file: %v", err)
+		}
+		if err = client.Reconcile(); err != nil {
+			t.Fatalf("%s: Reconciliation failed: %v", algorithm, err)
+		}
+		if info, err := os.Stat(untouched); err != nil || !info.ModTime().Equal(past) {
+			t.Errorf("%s: Unchanged file sent again", algorithm)
+		}
+		if !waitForFile(filepath.Join(sdir, "file2"), content, time.Second) {
+			t.Errorf("%s: Modified file not sent", algorithm)
+		}
+		if err := ioutil.WriteFile(filepath.Join(cdir, "file2"), tFiles[1].content, 0600); err != nil {
+			t.Fatalf("Can't write file: %v", err)
+		}
+	}
+
+	rpcClient := dialTestServer(t, port)
+	defer rpcClient.Close()
+	var resp betterbox.ManifestResponse
+	if err := rpcClient.Call("Server.Manifest", &betterbox.ManifestRequest{Algorithm: "md4"}, &resp); err == nil {
+		t.Errorf("Manifest with unsupported hash algorithm returned")
+	}
+}
+
+// receivedLogger counts the requests received by the server, by path.
+type receivedLogger struct {
+	mutex    sync.Mutex
+	received map[string]int
+}
+
+func (l *receivedLogger) Log(level betterbox.Level, msg string, fields betterbox.Fields) {
+	if msg == "Received request" {
+		l.mutex.Lock()
+		l.received[fields["path"].(string)]++
+		l.mutex.Unlock()
+	}
+}
+
+// startDroppingProxy forwards connections to a port, except the drop-th one
+// which is closed right away. It returns the port of the proxy.
+func startDroppingProxy(t testing.TB, port uint16, drop int) uint16 {
+	listener, err := net.Listen("tcp", net.JoinHostPort(serverAddress, "0"))
+	if err != nil {
+		t.Fatalf("Can't listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for count := 1; ; count++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if count == drop {
+				conn.Close()
+				continue
+			}
+			server, err := net.Dial("tcp", net.JoinHostPort(serverAddress, strconv.Itoa(int(port))))
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go func() {
+				io.Copy(server, conn)
+				server.Close()
+			}()
+			go func() {
+				io.Copy(conn, server)
+				conn.Close()
+			}()
+		}
+	}()
+	return uint16(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func TestSyncRetry(t *testing.T) {
+	defer betterbox.SetSyncRetryDelay(10 * time.Millisecond)()
+	var tFiles []testEntry
+	for i := 0; i < 6; i++ {
+		tFiles = append(tFiles, testEntry{fmt.Sprintf("file%d", i), FILE, []byte(fmt.Sprintf("content %d", i))})
+	}
+	logger := &receivedLogger{received: make(map[string]int)}
+	sdir, port := newTestServer(t, betterbox.WithServerLogger(logger))
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	// Requests are sent two by two, the second sending's connection is lost.
+	proxy := startDroppingProxy(t, port, 2)
+	client, err := betterbox.NewClient(serverAddress, proxy, cdir, betterbox.WithBufferBytes(15))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+	compareDirectories(t, cdir, sdir)
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+	for _, entry := range tFiles {
+		if n := logger.received[entry.name]; n != 1 {
+			t.Errorf("'%s' received %d times", entry.name, n)
+		}
+	}
+}
+
+// delayLogger slows the server down, by delaying the received requests of a
+// path.
+type delayLogger struct {
+	path  string
+	delay time.Duration
+}
+
+func (l delayLogger) Log(level betterbox.Level, msg string, fields betterbox.Fields) {
+	if msg == "Received request" && fields["path"] == l.path {
+		time.Sleep(l.delay)
+	}
+}
+
+// gateLogger counts the received requests, and blocks the first request of
+// path, once reached, until release is closed.
+type gateLogger struct {
+	*receivedLogger
+	path    string
+	reached chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (l *gateLogger) Log(level betterbox.Level, msg string, fields betterbox.Fields) {
+	l.receivedLogger.Log(level, msg, fields)
+	if msg == "Received request" && fields["path"] == l.path {
+		l.once.Do(func() {
+			close(l.reached)
+			<-l.release
+		})
+	}
+}
+
+func TestInitialCoalescing(t *testing.T) {
+	defer betterbox.SetRequestsWaitTime(50 * time.Millisecond)()
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"file2", FILE, []byte("file2 content")},
+		{"file3", FILE, []byte("file3 content")},
+	}
+	logger := &gateLogger{
+		receivedLogger: &receivedLogger{received: make(map[string]int)},
+		path:           "file1",
+		reached:        make(chan struct{}),
+		release:        make(chan struct{}),
+	}
+	sdir, port := newTestServer(t, betterbox.WithServerLogger(logger))
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithInitialCoalescing())
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- client.SyncAndMonitor() }()
+
+	// Rewrite a file as it was read by the initial sync, and modify another
+	// one, while it is being sent.
+	<-logger.reached
+	if err := ioutil.WriteFile(filepath.Join(cdir, "file2"), []byte("file2 content"), 0600); err != nil {
+		t.Fatalf("Can't write file: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(cdir, "file3"), []byte("file3 changed"), 0600); err != nil {
+		t.Fatalf("Can't write file: %v", err)
+	}
+	close(logger.release)
+	if !waitForFile(filepath.Join(sdir, "file3"), []byte("file3 changed"), 5*time.Second) {
+		t.Fatalf("Modified file not synced")
+	}
+	time.Sleep(200 * time.Millisecond)
+	client.Close()
+	if err := <-errc; err != nil {
+		t.Errorf("Monitoring failed: %v", err)
+	}
+	compareDirectories(t, cdir, sdir)
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+	for name, expected := range map[string]int{"file1": 1, "file2": 1, "file3": 2} {
+		if n := logger.received[name]; n != expected {
+			t.Errorf("'%s' received %d times, expected %d", name, n, expected)
+		}
+	}
+}
+
+func TestCloseWaitsForSending(t *testing.T) {
+	defer betterbox.SetRequestsWaitTime(50 * time.Millisecond)()
+	for _, test := range []struct {
+		name    string
+		timeout time.Duration
+		applied bool
+		err     error
+	}{
+		{"completed", 5 * time.Second, true, nil},
+		{"cancelled", 100 * time.Millisecond, false, betterbox.ErrClosed},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tFiles := []testEntry{{"file0", FILE, []byte("initial content")}}
+			sdir, port := newTestServer(t, betterbox.WithServerLogger(delayLogger{"slow", time.Second}))
+			defer os.RemoveAll(sdir)
+			cdir := createTempDirWithFiles(t, tFiles)
+			defer os.RemoveAll(cdir)
+			client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithCloseTimeout(test.timeout))
+			if err != nil {
+				t.Fatalf("Can't instantiate new client: %v", err)
+			}
+			errc := startMonitoring(t, client, filepath.Join(sdir, "file0"), tFiles[0].content)
+			if err := ioutil.WriteFile(filepath.Join(cdir, "slow"), []byte("slow content"), 0600); err != nil {
+				t.Fatalf("Can't write file: %v", err)
+			}
+			for deadline := time.Now().Add(5 * time.Second); client.Stats().InFlight == 0; time.Sleep(5 * time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatalf("Request not sent")
+				}
+			}
+			// Let the request reach the server.
+			time.Sleep(200 * time.Millisecond)
+			client.Close()
+			if err := <-errc; errors.Cause(err) != test.err {
+				t.Errorf("Unexpected monitoring error: %v", err)
+			}
+			_, err = os.Stat(filepath.Join(sdir, "slow"))
+			if applied := err == nil; applied != test.applied {
+				t.Errorf("Request applied on close: %v, expected %v", applied, test.applied)
+			}
+		})
+	}
+}
+
+func TestParallelChunks(t *testing.T) {
+	content := make([]byte, 1<<20+123)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatalf("Can't generate content: %v", err)
+	}
+	tFiles := []testEntry{
+		{"small", FILE, []byte("small content")},
+		{"dir1", DIR, nil},
+		{"dir1/large", FILE, content},
+	}
+	logger := &receivedLogger{received: make(map[string]int)}
+	sdir, port := newTestServer(t, betterbox.WithServerLogger(logger))
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	const chunkSize = 64 << 10
+	client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithParallelChunks(4, chunkSize))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	if err = client.Sync(); err != nil {
+		t.Fatalf("Client can't send files to server: %v", err)
+	}
+	compareDirectories(t, cdir, sdir)
+	logger.mutex.Lock()
+	// The chunks, then the finalization.
+	if n, expected := logger.received["dir1/large"], len(content)/chunkSize+2; n != expected {
+		t.Errorf("%d requests for the large file, expected %d", n, expected)
+	}
+	logger.mutex.Unlock()
+
+	// Chunks received out of order.
+	rconn := dialTestServer(t, port)
+	defer rconn.Close()
+	data := []byte("out of order content")
+	for _, req := range []*betterbox.Request{
+		betterbox.NewWriteAtRequest("reversed", data[10:], 10, int64(len(data))),
+		betterbox.NewWriteAtRequest("reversed", data[:10], 0, int64(len(data))),
+		betterbox.NewFinalizeRequest("reversed", int64(len(data))),
+	} {
+		var resp betterbox.Response
+		if err := rconn.Call("Server.ApplyRequest", req, &resp); err != nil {
+			t.Fatalf("Sending request failed: %v", err)
+		}
+		if resp.Message != "" {
+			t.Fatalf("Request '%s' failed: %s", req, resp.Message)
+		}
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(sdir, "reversed")); string(got) != string(data) {
+		t.Errorf("Unexpected content: '%s'", got)
+	}
+
+	// Uploads with a missing chunk aren't finalized.
+	for _, req := range []*betterbox.Request{
+		betterbox.NewWriteAtRequest("partial", data[:5], 0, int64(len(data))),
+		betterbox.NewWriteAtRequest("partial", data[10:], 10, int64(len(data))),
+	} {
+		var resp betterbox.Response
+		if err := rconn.Call("Server.ApplyRequest", req, &resp); err != nil || resp.Message != "" {
+			t.Fatalf("Request '%s' failed: %v, %s", req, err, resp.Message)
+		}
+	}
+	var resp betterbox.Response
+	if err := rconn.Call("Server.ApplyRequest", betterbox.NewFinalizeRequest("partial", int64(len(data))), &resp); err != nil {
+		t.Fatalf("Sending request failed: %v", err)
+	}
+	if !strings.Contains(resp.Message, "missing chunk at offset 5") {
+		t.Errorf("Incomplete upload finalized: '%s'", resp.Message)
+	}
+	if _, err := os.Stat(filepath.Join(sdir, "partial")); !os.IsNotExist(err) {
+		t.Errorf("Incomplete upload moved into place: %v", err)
+	}
+}
+
+// slowFS slows the reads of its files down.
+type slowFS struct {
+	fs.FS
+	delay time.Duration
+}
+
+func (fsys slowFS) Open(name string) (fs.File, error) {
+	f, err := fsys.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := f.Stat(); err != nil || info.IsDir() {
+		return f, err
+	}
+	return slowFile{f, fsys.delay}, nil
+}
+
+type slowFile struct {
+	fs.File
+	delay time.Duration
+}
+
+func (f slowFile) Read(p []byte) (int, error) {
+	time.Sleep(f.delay)
+	return f.File.Read(p)
+}
+
+func TestCloseDuringRead(t *testing.T) {
+	// Reading the whole file takes more than 6 seconds.
+	fsys := slowFS{fstest.MapFS{"large": {Data: make([]byte, 64<<20), Mode: 0600}}, 100 * time.Millisecond}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, nil)
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithFS(fsys))
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- client.Sync() }()
+	time.Sleep(300 * time.Millisecond)
+	closed := time.Now()
+	client.Close()
+	select {
+	case err := <-errc:
+		if errors.Cause(err) != betterbox.ErrClosed {
+			t.Errorf("Unexpected sync error: %v", err)
+		}
+		if d := time.Since(closed); d > time.Second {
+			t.Errorf("Sync returned %s after closing", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Sync not abandoned on close")
 	}
 }
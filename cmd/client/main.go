@@ -3,25 +3,99 @@ package main
 import (
 	"betterbox"
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"os"
+	"strings"
 )
 
+// validAddress checks that address is a hostname, an IPv4 address or an IPv6
+// address, optionally in brackets, or a unix:// socket address.
+func validAddress(address string) bool {
+	if strings.HasPrefix(address, "unix://") {
+		return len(address) > len("unix://")
+	}
+	address = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+	if strings.Contains(address, ":") {
+		return net.ParseIP(address) != nil
+	}
+	return address != ""
+}
+
 func main() {
-	path := flag.String("directory", "", "Directory to monitor and update")
-	address := flag.String("address", "localhost", "Network address to listen on")
+	path := flag.String("directory", "", "Directory, or single file, to monitor and update")
+	address := flag.String("address", "localhost", "Network address to listen on, or unix:// socket path")
 	port := flag.Int("port", 12345, "TCP port to listen on")
+	check := flag.Bool("check", false, "Check configuration and connectivity to the server, without syncing")
+	jsonLogs := flag.Bool("json-logs", false, "Log events as JSON objects")
+	version := flag.Bool("version", false, "Print the protocol version and exit")
+	deleteExcess := flag.Bool("delete-excess", false, "Remove the server's files missing locally on reconciliation")
+	reconcileInterval := flag.Duration("reconcile-interval", 0, "Interval of the reconciliations while monitoring, 0 to disable")
+	monitorDuration := flag.Duration("monitor-duration", 0, "How long to monitor for before exiting, 0 to monitor until killed")
+	initialSync := flag.String("initial-sync", "full", "Files to send before monitoring: full, none or reconcile")
+	keepNewer := flag.Bool("keep-newer", false, "Don't overwrite the server's files modified later than the local ones on the initial sync")
+	extensions := flag.String("extensions", "", "Comma-separated extensions of the only files to sync, as in \".md,.png\"")
+	skipPolicy := flag.String("skip-policy", "hash", "How reconciliations skip up to date files: hash or size-mtime")
 	flag.Parse()
-	if *path == "" || *address == "" || *port > 65535 || *port <= 0 {
+	if *version {
+		fmt.Printf("Protocol version %d\n", betterbox.ProtocolVersion)
+		return
+	}
+	modes := map[string]betterbox.InitialSyncMode{
+		"full":      betterbox.InitialSyncFull,
+		"none":      betterbox.InitialSyncNone,
+		"reconcile": betterbox.InitialSyncReconcile,
+	}
+	policies := map[string]betterbox.SkipPolicy{
+		"hash":       betterbox.SkipHash,
+		"size-mtime": betterbox.SkipSizeMTime,
+	}
+	mode, ok := modes[*initialSync]
+	policy, policyOk := policies[*skipPolicy]
+	if *path == "" || !validAddress(*address) || *port > 65535 || *port <= 0 || !ok || !policyOk {
 		flag.PrintDefaults()
 		os.Exit(0)
 	}
-	cl, err := betterbox.NewClient(*address, uint16(*port), *path)
+	dir, err := betterbox.ExpandPath(*path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var opts []betterbox.ClientOption
+	opts = append(opts, betterbox.WithInitialSync(mode), betterbox.WithSkipPolicy(policy))
+	if *jsonLogs {
+		opts = append(opts, betterbox.WithJSONLogging(os.Stderr))
+	}
+	if *deleteExcess {
+		opts = append(opts, betterbox.WithDeleteExcess())
+	}
+	if *keepNewer {
+		opts = append(opts, betterbox.WithRefuseOverwriteNewer())
+	}
+	if *extensions != "" {
+		opts = append(opts, betterbox.WithIncludeExtensions(strings.Split(*extensions, ",")...))
+	}
+	if *reconcileInterval > 0 {
+		opts = append(opts, betterbox.WithReconcileInterval(*reconcileInterval))
+	}
+	if *monitorDuration > 0 {
+		opts = append(opts, betterbox.WithMonitorDuration(*monitorDuration))
+	}
+	cl, err := betterbox.NewClient(*address, uint16(*port), dir, opts...)
 	if err != nil {
 		log.Fatal(err)
 		os.Exit(1)
 	}
 	defer cl.Close()
+	log.Println("Client: ", cl.Describe())
+	if *check {
+		result, err := cl.Preflight()
+		log.Printf("Preflight: %+v", *result)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	if err := cl.SyncAndMonitor(); err != nil {
 		log.Println(err)
 	}
@@ -3,20 +3,58 @@ package main
 import (
 	"betterbox"
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"os"
+	"strings"
 )
 
+// validAddress checks that address is a hostname, an IPv4 address or an IPv6
+// address, optionally in brackets, or a unix:// socket address.
+func validAddress(address string) bool {
+	if strings.HasPrefix(address, "unix://") {
+		return len(address) > len("unix://")
+	}
+	address = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+	if strings.Contains(address, ":") {
+		return net.ParseIP(address) != nil
+	}
+	return address != ""
+}
+
 func main() {
 	path := flag.String("directory", "", "Empty directory to write to")
-	address := flag.String("address", "localhost", "Network address to listen on")
+	address := flag.String("address", "localhost", "Network address to listen on, or unix:// socket path")
 	port := flag.Int("port", 12345, "TCP port to listen on")
+	readOnly := flag.Bool("read-only", false, "Reject all modifications of the directory")
+	strictRemoves := flag.Bool("strict-removes", false, "Refuse to remove non-empty directories")
+	version := flag.Bool("version", false, "Print the protocol version and exit")
+	jsonLogs := flag.Bool("json-logs", false, "Log events as JSON objects")
 	flag.Parse()
-	if *path == "" || *address == "" || *port > 65535 || *port <= 0 {
+	if *version {
+		fmt.Printf("Protocol version %d\n", betterbox.ProtocolVersion)
+		return
+	}
+	if *path == "" || !validAddress(*address) || *port > 65535 || *port <= 0 {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
-	sv, err := betterbox.NewServer(*address, uint16(*port), *path)
+	dir, err := betterbox.ExpandPath(*path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var opts []betterbox.ServerOption
+	if *readOnly {
+		opts = append(opts, betterbox.WithReadOnly())
+	}
+	if *strictRemoves {
+		opts = append(opts, betterbox.WithStrictRemoves())
+	}
+	if *jsonLogs {
+		opts = append(opts, betterbox.WithServerJSONLogging(os.Stderr))
+	}
+	sv, err := betterbox.NewServer(*address, uint16(*port), dir, opts...)
 	if err != nil {
 		log.Fatal(err)
 		os.Exit(1)
@@ -0,0 +1,94 @@
+package betterbox
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// WithInitialCoalescing makes SyncAndMonitor drop the requests of the events
+// fired during the initial sync, up to the first pause in the events, that
+// would send again what the initial sync sent, eg. files rewritten with the
+// same content while being sent. Requests of Remove events are always sent, as
+// are encrypted files, whose encryptions differ.
+func WithInitialCoalescing() ClientOption {
+	return func(c *Client) error {
+		c.initialCoalescing = true
+		return nil
+	}
+}
+
+// requestDigest returns a digest of what a Request applies to its path.
+func requestDigest(req *Request) [sha256.Size]byte {
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, []int64{int64(req.Type), int64(req.Mode), int64(len(req.LinkTarget))})
+	h.Write([]byte(req.LinkTarget))
+	h.Write(req.Data)
+	var digest [sha256.Size]byte
+	copy(digest[:], h.Sum(nil))
+	return digest
+}
+
+// startInitialCoalescing starts recording the Requests sent by the initial
+// sync, if the client coalesces its events.
+func (c *Client) startInitialCoalescing() {
+	if !c.initialCoalescing {
+		return
+	}
+	c.initialMutex.Lock()
+	defer c.initialMutex.Unlock()
+	c.initialSent = make(map[string][sha256.Size]byte)
+	c.recordingInitial = true
+}
+
+// stopRecordingInitial stops recording the Requests sent, once the initial sync
+// is done. Events' Requests are compared with the recorded ones from now on.
+func (c *Client) stopRecordingInitial() {
+	c.initialMutex.Lock()
+	defer c.initialMutex.Unlock()
+	c.recordingInitial = false
+}
+
+// stopInitialCoalescing forgets the Requests sent by the initial sync, once
+// the events fired during it are handled.
+func (c *Client) stopInitialCoalescing() {
+	c.initialMutex.Lock()
+	defer c.initialMutex.Unlock()
+	c.initialSent = nil
+}
+
+// recordInitial records the Requests sent by the initial sync, while it runs.
+func (c *Client) recordInitial(reqs []*Request) {
+	c.initialMutex.Lock()
+	defer c.initialMutex.Unlock()
+	if !c.recordingInitial {
+		return
+	}
+	for _, req := range reqs {
+		c.initialSent[req.Path] = requestDigest(req)
+	}
+}
+
+// coalesceInitial drops the Requests that apply what the initial sync sent to
+// their paths, while the events fired during it are handled. Removes make the
+// initial sync's Requests of the removed paths obsolete.
+func (c *Client) coalesceInitial(reqs []*Request) []*Request {
+	c.initialMutex.Lock()
+	defer c.initialMutex.Unlock()
+	if c.initialSent == nil || c.recordingInitial {
+		return reqs
+	}
+	kept := reqs[:0]
+	for _, req := range reqs {
+		if req.Type == requestRemove {
+			for path := range c.initialSent {
+				if path == req.Path || isWithin(path, req.Path) {
+					delete(c.initialSent, path)
+				}
+			}
+		} else if digest, ok := c.initialSent[req.Path]; ok && digest == requestDigest(req) {
+			continue
+		}
+		kept = append(kept, req)
+	}
+	return kept
+}
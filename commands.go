@@ -0,0 +1,259 @@
+package betterbox
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// requestType is the type of operation that a Request asks the server to apply.
+type requestType int
+
+const (
+	requestMkdir requestType = iota
+	requestCreate
+	requestRemove
+	requestSymlink
+	requestWriteAt
+	requestFinalize
+	requestChmod
+	requestMknod
+	requestAppend
+)
+
+func (t requestType) String() string {
+	switch t {
+	case requestMkdir:
+		return "Mkdir"
+	case requestCreate:
+		return "Create"
+	case requestRemove:
+		return "Remove"
+	case requestSymlink:
+		return "Symlink"
+	case requestWriteAt:
+		return "WriteAt"
+	case requestFinalize:
+		return "Finalize"
+	case requestChmod:
+		return "Chmod"
+	case requestMknod:
+		return "Mknod"
+	case requestAppend:
+		return "Append"
+	default:
+		if t >= MinCustomRequestType {
+			return fmt.Sprintf("Custom(%d)", int(t))
+		}
+		return fmt.Sprintf("Unknown(%d)", int(t))
+	}
+}
+
+// Request is sent by the client to the server, for each file or directory
+// creation, modification or deletion.
+type Request struct {
+	Type requestType
+	// Path of the file or directory, relative to the server's destination.
+	Path string
+	// Full content of the file, for Create requests, or a chunk of it, for
+	// WriteAt and Append requests.
+	Data []byte
+	// Offset of the chunk in the file, for WriteAt and Append requests.
+	Offset int64
+	// Size of the whole file, for WriteAt and Finalize requests.
+	Size int64
+	// Target of the link, for Symlink requests.
+	LinkTarget string
+	// Permission and special bits, for Mkdir, Create and Finalize requests of clients
+	// preserving modes, and for Chmod requests. 0 otherwise. Mknod requests
+	// carry the type of the special file too.
+	Mode os.FileMode
+	// Device number, for Mknod requests of device nodes.
+	Dev uint64
+	// Birth time, for Mkdir, Create and Finalize requests of clients
+	// preserving birth times, if known. Zero otherwise.
+	Btime time.Time
+	// POSIX access ACL, in the format of its extended attribute, for Mkdir,
+	// Create, Finalize and Chmod requests of clients preserving ACLs, if the
+	// entry has one. nil otherwise.
+	ACL []byte
+	// SHA-256 hash of Data, for Create requests. The server checks it before
+	// writing, if not empty.
+	Checksum []byte
+	// Nonce of the session the Request was sent in.
+	Nonce []byte
+	// Sequence number of the Request in its session, starting at 1.
+	Seq uint64
+	// Sequence number of the Request among all the client's, starting at 1,
+	// for clients with resumable sendings. 0 otherwise.
+	LogSeq uint64
+}
+
+func (req *Request) String() string {
+	return fmt.Sprintf("%s '%s' (%d bytes)", req.Type, req.Path, len(req.Data))
+}
+
+// responseType is the result of a Request applied by the server.
+type responseType int
+
+const (
+	responseOk responseType = iota
+	responseErr
+)
+
+// ErrorCode identifies the cause of a Request's failure.
+type ErrorCode int
+
+const (
+	// CodeUnknown is for failures without a more specific cause.
+	CodeUnknown ErrorCode = iota
+	// CodeReadOnly is for modifications rejected by a read-only server.
+	CodeReadOnly
+	// CodeUnsupported is for Requests of types unknown to the server, eg. sent
+	// by newer clients. They can fall back to other types of Requests.
+	CodeUnsupported
+	// CodeConflict is for Requests conflicting with an existing entry of
+	// another type, eg. a Mkdir where a file exists.
+	CodeConflict
+	// CodeUnavailable is for Requests received while the server's destination
+	// is unavailable, eg. removed or unmounted.
+	CodeUnavailable
+	// CodeRejected is for Requests vetoed by the server's ShouldApplyFunc.
+	CodeRejected
+	// CodeCorrupted is for Requests whose Data doesn't match their Checksum,
+	// eg. truncated in transfer.
+	CodeCorrupted
+	// CodeTooLarge is for Requests of files exceeding the server's maximum
+	// file size.
+	CodeTooLarge
+)
+
+// Response is sent back by the server for each received Request.
+type Response struct {
+	Type    responseType
+	Code    ErrorCode // Cause of the failure, for error Responses.
+	Message string
+	// Whether an existing file was replaced, for Create and Finalize
+	// Responses.
+	Replaced bool
+}
+
+// codedError is a server-side error, with the ErrorCode to respond with.
+type codedError struct {
+	code ErrorCode
+	msg  string
+}
+
+func (e *codedError) Error() string {
+	return e.msg
+}
+
+// newCodedError creates a new error with an ErrorCode.
+func newCodedError(code ErrorCode, format string, a ...interface{}) error {
+	return &codedError{code: code, msg: fmt.Sprintf(format, a...)}
+}
+
+// errorResponse returns an error Response for err.
+func errorResponse(err error) Response {
+	resp := Response{Type: responseErr, Code: CodeUnknown, Message: err.Error()}
+	if ce, ok := err.(*codedError); ok {
+		resp.Code = ce.code
+	}
+	return resp
+}
+
+// RequestError is returned by the client when the server fails to apply a
+// Request.
+type RequestError struct {
+	Request  *Request
+	Response Response
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("Sending request to server '%s' failed: %s", e.Request, e.Response)
+}
+
+// Code returns the cause of the Request's failure.
+func (e *RequestError) Code() ErrorCode {
+	return e.Response.Code
+}
+
+func (resp Response) String() string {
+	if resp.Type == responseOk {
+		return "OK"
+	}
+	return fmt.Sprintf("Error: %s", resp.Message)
+}
+
+// BatchRequest regroups Requests to be applied by the server in a single call.
+type BatchRequest struct {
+	Requests []*Request
+}
+
+// BatchResponse contains the Responses of the Requests of a BatchRequest, up
+// to the first failed one.
+type BatchResponse struct {
+	Responses []Response
+	// Whether the applied Requests were reverted after a failure.
+	RolledBack bool
+}
+
+// err returns the error of the batch's failed Request, if any.
+func (resp *BatchResponse) err(batch *BatchRequest) error {
+	for i, r := range resp.Responses {
+		if r.Type == responseErr {
+			return &RequestError{Request: batch.Requests[i], Response: r}
+		}
+	}
+	return nil
+}
+
+// PingRequest asks the server to report its health.
+type PingRequest struct{}
+
+// PingResponse is the server's health report.
+type PingResponse struct {
+	Healthy bool
+	Message string
+}
+
+// HandshakeRequest asks the server to establish a new session.
+type HandshakeRequest struct {
+	// Compression of the RPC stream the client asks for, if not "".
+	Compression string
+	// ID of the client in the server's applied log, if it has no
+	// certificate.
+	ClientID string
+}
+
+// HandshakeResponse carries the nonce of a new session.
+type HandshakeResponse struct {
+	Nonce []byte
+	// Compression of the RPC stream from now on, if not "".
+	Compression string
+	// Maximum size of the files accepted by the server, 0 for none.
+	MaxFileSize int64
+}
+
+// LastAppliedRequest asks the server for the sequence number of the last of a
+// client's Requests it applied.
+type LastAppliedRequest struct {
+	ClientID string
+}
+
+// LastAppliedResponse is the sequence number of the last of the client's
+// Requests applied by the server, 0 if none.
+type LastAppliedResponse struct {
+	Seq uint64
+}
+
+// UsageRequest asks the server to report the usage of its destination's
+// filesystem.
+type UsageRequest struct{}
+
+// UsageResponse is the usage of the server destination's filesystem, in bytes.
+type UsageResponse struct {
+	Total uint64
+	Free  uint64 // Available to the server, excluding reserved blocks.
+	Used  uint64
+}
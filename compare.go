@@ -0,0 +1,178 @@
+package betterbox
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// CompareFlags selects the attributes of the entries compared by CompareTrees.
+type CompareFlags int
+
+const (
+	// CompareContent compares the content of files, and the targets of
+	// symbolic links.
+	CompareContent CompareFlags = 1 << iota
+	// CompareMode compares the permission and special bits.
+	CompareMode
+	// CompareMTime compares the modification times.
+	CompareMTime
+)
+
+// DiffKind is the attribute of an entry that differs between two trees.
+type DiffKind int
+
+const (
+	// DiffMissing is for entries existing in only one of the trees.
+	DiffMissing DiffKind = iota
+	// DiffType is for entries of different types, eg. a file and a
+	// directory.
+	DiffType
+	DiffContent
+	DiffMode
+	DiffMTime
+)
+
+func (k DiffKind) String() string {
+	switch k {
+	case DiffMissing:
+		return "Missing"
+	case DiffType:
+		return "Type"
+	case DiffContent:
+		return "Content"
+	case DiffMode:
+		return "Mode"
+	case DiffMTime:
+		return "MTime"
+	default:
+		return fmt.Sprintf("Unknown(%d)", int(k))
+	}
+}
+
+// Difference is an attribute of an entry that differs between two trees.
+type Difference struct {
+	Path string // Path of the entry, relative to the trees' roots.
+	Kind DiffKind
+	// Values of the attribute in each tree, for display.
+	A, B string
+}
+
+func (d Difference) String() string {
+	return fmt.Sprintf("%s: %s differs (%s, %s)", d.Path, d.Kind, d.A, d.B)
+}
+
+// CompareTrees compares the entries of two directory trees, returning their
+// differences sorted by path. The existence and type of the entries are always
+// compared, and their attributes selected by flags.
+func CompareTrees(a, b string, flags CompareFlags) ([]Difference, error) {
+	entriesA, err := treeEntries(a)
+	if err != nil {
+		return nil, err
+	}
+	entriesB, err := treeEntries(b)
+	if err != nil {
+		return nil, err
+	}
+	var diffs []Difference
+	for path, infoA := range entriesA {
+		infoB, ok := entriesB[path]
+		if !ok {
+			diffs = append(diffs, Difference{Path: path, Kind: DiffMissing, A: "present", B: "missing"})
+			continue
+		}
+		diff, err := compareEntries(filepath.Join(a, path), filepath.Join(b, path), infoA, infoB, flags)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range diff {
+			d.Path = path
+			diffs = append(diffs, d)
+		}
+	}
+	for path := range entriesB {
+		if _, ok := entriesA[path]; !ok {
+			diffs = append(diffs, Difference{Path: path, Kind: DiffMissing, A: "missing", B: "present"})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		if diffs[i].Path != diffs[j].Path {
+			return diffs[i].Path < diffs[j].Path
+		}
+		return diffs[i].Kind < diffs[j].Kind
+	})
+	return diffs, nil
+}
+
+// treeEntries returns the file info of the entries under root, keyed by path
+// relative to it.
+func treeEntries(root string) (map[string]os.FileInfo, error) {
+	entries := make(map[string]os.FileInfo)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if relPath != "." {
+			entries[relPath] = info
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// compareEntries compares the attributes selected by flags of two entries.
+func compareEntries(pathA, pathB string, infoA, infoB os.FileInfo, flags CompareFlags) ([]Difference, error) {
+	typeA, typeB := infoA.Mode()&os.ModeType, infoB.Mode()&os.ModeType
+	if typeA != typeB {
+		return []Difference{{Kind: DiffType, A: typeA.String(), B: typeB.String()}}, nil
+	}
+	var diffs []Difference
+	if flags&CompareContent != 0 {
+		var contentA, contentB []byte
+		var err error
+		switch {
+		case isSymlink(infoA):
+			contentA, contentB, err = readBoth(pathA, pathB, func(path string) ([]byte, error) {
+				target, err := os.Readlink(path)
+				return []byte(target), err
+			})
+		case infoA.Mode().IsRegular():
+			contentA, contentB, err = readBoth(pathA, pathB, ioutil.ReadFile)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(contentA, contentB) {
+			diffs = append(diffs, Difference{
+				Kind: DiffContent,
+				A:    fmt.Sprintf("%d bytes", len(contentA)),
+				B:    fmt.Sprintf("%d bytes", len(contentB)),
+			})
+		}
+	}
+	modeA, modeB := infoA.Mode()&(os.ModePerm|specialModes), infoB.Mode()&(os.ModePerm|specialModes)
+	if flags&CompareMode != 0 && modeA != modeB {
+		diffs = append(diffs, Difference{Kind: DiffMode, A: modeA.String(), B: modeB.String()})
+	}
+	if flags&CompareMTime != 0 && !infoA.ModTime().Equal(infoB.ModTime()) {
+		diffs = append(diffs, Difference{Kind: DiffMTime, A: infoA.ModTime().String(), B: infoB.ModTime().String()})
+	}
+	return diffs, nil
+}
+
+// readBoth reads two entries with read.
+func readBoth(pathA, pathB string, read func(string) ([]byte, error)) ([]byte, []byte, error) {
+	contentA, err := read(pathA)
+	if err != nil {
+		return nil, nil, err
+	}
+	contentB, err := read(pathB)
+	return contentA, contentB, err
+}
@@ -0,0 +1,123 @@
+package betterbox
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+)
+
+// maxReportedErrors is the number of failed Requests detailed by a
+// FailedRequestsError, the following ones being only counted.
+const maxReportedErrors = 10
+
+// WithContinueOnError makes the client carry on sending the following
+// Requests when the server fails to apply one, instead of stopping, logging a
+// warning for each failure. Sync then returns a FailedRequestsError once all
+// the files are sent, and monitoring goes on. Transport errors, and the
+// batches the server rolls back, still stop the sending, as does any failure
+// in fan-out mode.
+func WithContinueOnError() ClientOption {
+	return func(c *Client) error {
+		c.continueOnError = true
+		return nil
+	}
+}
+
+// WithMaxErrors makes a client continuing on error abort once n Requests
+// failed, since its sync started, so that a systemic failure, eg. of the
+// server's disk being full, doesn't have it send every file in vain. The
+// sending then fails with an aborted FailedRequestsError.
+func WithMaxErrors(n int) ClientOption {
+	return func(c *Client) error {
+		if n <= 0 {
+			return fmt.Errorf("Invalid maximum number of errors: %d", n)
+		}
+		c.maxErrors = n
+		return nil
+	}
+}
+
+// FailedRequestsError summarizes the Requests the server failed to apply
+// while the client continued on error.
+type FailedRequestsError struct {
+	Failed int             // Number of failed Requests.
+	Errors []*RequestError // Errors of the first failed Requests.
+	// Whether the sending was aborted as the maximum number of errors was
+	// reached.
+	Aborted bool
+}
+
+func (e *FailedRequestsError) Error() string {
+	if e.Aborted {
+		return fmt.Sprintf("Sending stopped after %d failed requests, first: %s", e.Failed, e.Errors[0])
+	}
+	return fmt.Sprintf("%d requests failed, first: %s", e.Failed, e.Errors[0])
+}
+
+// resetFailures forgets the Requests that failed before a sync starts.
+func (c *Client) resetFailures() {
+	c.failedMutex.Lock()
+	defer c.failedMutex.Unlock()
+	c.failed = nil
+}
+
+// recordFailure records a Request that failed, returning an aborted
+// FailedRequestsError once the maximum number of errors is reached.
+func (c *Client) recordFailure(rerr *RequestError) error {
+	c.logger.Log(LevelWarning, "Request failed, continuing", Fields{"request": rerr.Request.String(), "error": rerr.Response.Message})
+	c.failedMutex.Lock()
+	defer c.failedMutex.Unlock()
+	if c.failed == nil {
+		c.failed = &FailedRequestsError{}
+	}
+	c.failed.Failed++
+	if len(c.failed.Errors) < maxReportedErrors {
+		c.failed.Errors = append(c.failed.Errors, rerr)
+	}
+	if c.maxErrors == 0 || c.failed.Failed < c.maxErrors {
+		return nil
+	}
+	c.logger.Log(LevelError, "Maximum number of errors reached, aborting", Fields{"failed": c.failed.Failed})
+	aborted := *c.failed
+	aborted.Aborted = true
+	return &aborted
+}
+
+// failures returns the FailedRequestsError of the Requests that failed since
+// the sync started, nil if none.
+func (c *Client) failures() error {
+	c.failedMutex.Lock()
+	defer c.failedMutex.Unlock()
+	if c.failed == nil {
+		return nil
+	}
+	failed := *c.failed
+	return &failed
+}
+
+// sendContinuing sends a list of Requests on a server connection as
+// sendAppending does. When continuing on error, the Requests following a
+// failed one are sent nonetheless, the failure being recorded instead of
+// returned, until the maximum number of errors is reached.
+func (c *Client) sendContinuing(rconn *serverConn, reqs []*Request) (int, error) {
+	if !c.continueOnError {
+		return c.sendAppending(rconn, reqs)
+	}
+	for pending := reqs; len(pending) > 0; {
+		applied, err := c.sendAppending(rconn, pending)
+		if err == nil {
+			break
+		}
+		sent := len(reqs) - len(pending)
+		rerr, ok := errors.Cause(err).(*RequestError)
+		// Rolled back batches have their failed Request after unapplied
+		// ones, and the Creates replacing rejected Appends aren't in the list.
+		if !ok || applied >= len(pending) || pending[applied] != rerr.Request {
+			return sent + applied, err
+		}
+		if err := c.recordFailure(rerr); err != nil {
+			return sent + applied + 1, err
+		}
+		pending = pending[applied+1:]
+	}
+	return len(reqs), nil
+}
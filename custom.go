@@ -0,0 +1,82 @@
+package betterbox
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"path/filepath"
+)
+
+// MinCustomRequestType is the lowest type code of the custom Requests, the
+// lower ones being reserved to the core types.
+const MinCustomRequestType = 1000
+
+// CustomHandler applies a custom Request to the server's destination, eg.
+// triggering the reindexing of the entry at absPath, its path in the
+// destination, which may not exist. Its error is reported to the client.
+type CustomHandler func(req *Request, absPath string) error
+
+// WithCustomRequest makes the server apply the Requests of type code, at least
+// MinCustomRequestType, with handler, for operations specific to an
+// application. Their paths are validated as for the core types, and the
+// server's hooks run once they are applied. They are unsupported in
+// transactional batches, as they can't be rolled back.
+func WithCustomRequest(code int, handler CustomHandler) ServerOption {
+	return func(sv *Server) error {
+		if code < MinCustomRequestType {
+			return fmt.Errorf("Invalid custom request type: %d", code)
+		}
+		if handler == nil {
+			return fmt.Errorf("Missing handler for custom request type: %d", code)
+		}
+		if _, ok := sv.customHandlers[requestType(code)]; ok {
+			return fmt.Errorf("Custom request type already registered: %d", code)
+		}
+		if sv.customHandlers == nil {
+			sv.customHandlers = make(map[requestType]CustomHandler)
+		}
+		sv.customHandlers[requestType(code)] = handler
+		return nil
+	}
+}
+
+// applyCustom applies a Request of a type unknown to the core with its
+// registered handler.
+func (sv *Server) applyCustom(req *Request, absPath string) error {
+	handler, ok := sv.customHandlers[req.Type]
+	if !ok {
+		return newCodedError(CodeUnsupported, "Unsupported request type: %s", req.Type)
+	}
+	return handler(req, absPath)
+}
+
+// NewCustomRequest creates a new Request of the custom type code, for the
+// entry at path, relative to the client's directory, carrying data, to send
+// with Client.SendCustom.
+func NewCustomRequest(code int, path string, data []byte) *Request {
+	return &Request{Type: requestType(code), Path: path, Data: data}
+}
+
+// SendCustom sends custom Requests to the server, as created by
+// NewCustomRequest, stopping on the first failing one. Their paths are mapped
+// under the client's remote prefix, but their Data is sent as is, neither
+// transformed nor encrypted.
+func (c *Client) SendCustom(reqs ...*Request) error {
+	remote := make([]*Request, len(reqs))
+	for i, req := range reqs {
+		if req.Type < MinCustomRequestType {
+			return fmt.Errorf("Not a custom request: %s", req)
+		}
+		localPath := filepath.Clean(filepath.FromSlash(req.Path))
+		if filepath.IsAbs(localPath) || !isLocalPath(localPath) || localPath == "." {
+			return fmt.Errorf("%s: Path not relative within the client's directory", req.Path)
+		}
+		r := *req
+		r.Path = c.remotePath(localPath)
+		remote[i] = &r
+	}
+	// Not as part of a sync, which would record them as the initial one's.
+	if _, err := c.sendCounted(remote); err != nil {
+		return errors.Wrap(err, "Sending custom requests failed")
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package betterbox
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"github.com/pkg/errors"
+)
+
+// newAEAD returns the AES-GCM cipher of an AES-128, AES-192 or AES-256 key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid encryption key")
+	}
+	return cipher.NewGCM(block)
+}
+
+// WithEncryptionKey encrypts the files' content with AES-GCM before sending
+// it, so that the server only stores ciphertext. key is 16, 24 or 32 bytes
+// long, for AES-128, AES-192 or AES-256. Each file is encrypted with a new
+// random nonce, prepended to its ciphertext, and authenticated along with its
+// path on the server, so that the server can't swap the contents of files,
+// see Decrypt. As the server's content changes on every sending, Reconcile
+// sends all the files again.
+func WithEncryptionKey(key []byte) ClientOption {
+	return func(c *Client) error {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return err
+		}
+		c.aead = aead
+		return nil
+	}
+}
+
+// encrypt seals the content of the file at the remote path name, prepending
+// the random nonce it was sealed with.
+func (c *Client) encrypt(name string, content []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(content)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, content, []byte(name)), nil
+}
+
+// Decrypt returns the plaintext of a file's content stored by a server for a
+// client with the provided encryption key, at path, slash-separated and
+// relative to the server's destination. Content moved from another path
+// fails to decrypt.
+func Decrypt(key []byte, path string, data []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return open(aead, path, data)
+}
+
+// decrypt opens the content of the file at the remote path name, sealed by
+// encrypt.
+func (c *Client) decrypt(name string, data []byte) ([]byte, error) {
+	return open(c.aead, name, data)
+}
+
+// open opens data sealed with aead for the remote path name, prefixed with
+// its nonce.
+func open(aead cipher.AEAD, name string, data []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("Encrypted data too short: %d bytes", len(data))
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, []byte(name))
+}
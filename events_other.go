@@ -0,0 +1,13 @@
+//go:build !windows
+// +build !windows
+
+package betterbox
+
+import "github.com/fsnotify/fsnotify"
+
+// normalizeEvent adapts a filesystem event to what handleEvent expects,
+// returning false for events to ignore. Events need no adaptation on this
+// platform.
+func (c *Client) normalizeEvent(event fsnotify.Event) (fsnotify.Event, bool) {
+	return event, true
+}
@@ -0,0 +1,35 @@
+//go:build windows
+// +build windows
+
+package betterbox
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"path/filepath"
+	"strings"
+)
+
+// longPathPrefix is the prefix of Windows extended-length paths.
+const longPathPrefix = `\\?\`
+
+// normalizeEvent adapts a filesystem event to what handleEvent expects,
+// returning false for events to ignore.
+//
+// On Windows, renames are reported as a Rename event of the old name followed
+// by a Create event of the new one, which handleEvent already maps to a Remove
+// and a Create. Attribute changes are reported as Chmod events. But changes to
+// a directory's entries are also reported as Write events of the directory
+// itself, and paths are case-insensitive.
+func (c *Client) normalizeEvent(event fsnotify.Event) (fsnotify.Event, bool) {
+	name := filepath.Clean(strings.TrimPrefix(event.Name, longPathPrefix))
+	root := filepath.Clean(strings.TrimPrefix(c.path, longPathPrefix))
+	// Keep the client's spelling of its directory, for relative paths.
+	if len(name) >= len(root) && strings.EqualFold(name[:len(root)], root) {
+		name = c.path + name[len(root):]
+	}
+	event.Name = name
+	if event.Op == fsnotify.Write && isDirectory(event.Name) {
+		return event, false
+	}
+	return event, true
+}
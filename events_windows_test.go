@@ -0,0 +1,74 @@
+//go:build windows
+// +build windows
+
+package betterbox_test
+
+import (
+	"betterbox"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWindowsEvents(t *testing.T) {
+	defer betterbox.SetRequestsWaitTime(200 * time.Millisecond)()
+	tFiles := []testEntry{
+		{"file1", FILE, []byte("file1 content")},
+		{"dir1", DIR, nil},
+	}
+	sdir, port := newTestServer(t)
+	defer os.RemoveAll(sdir)
+	cdir := createTempDirWithFiles(t, tFiles)
+	defer os.RemoveAll(cdir)
+	client, err := betterbox.NewClient(serverAddress, port, cdir)
+	if err != nil {
+		t.Fatalf("Can't instantiate new client: %v", err)
+	}
+	errc := startMonitoring(t, client, filepath.Join(sdir, "file1"), tFiles[0].content)
+
+	// Create, within a subdirectory as well.
+	content := []byte("file2 content")
+	if err := ioutil.WriteFile(filepath.Join(cdir, "dir1", "file2"), content, 0600); err != nil {
+		t.Fatalf("Can't write file: %v", err)
+	}
+	if !waitForFile(filepath.Join(sdir, "dir1", "file2"), content, 2*time.Second) {
+		t.Fatalf("Created file not synced")
+	}
+	// Modify.
+	content = []byte("file1 new content")
+	if err := ioutil.WriteFile(filepath.Join(cdir, "file1"), content, 0600); err != nil {
+		t.Fatalf("Can't write file: %v", err)
+	}
+	if !waitForFile(filepath.Join(sdir, "file1"), content, 2*time.Second) {
+		t.Fatalf("Modified file not synced")
+	}
+	// Rename.
+	if err := os.Rename(filepath.Join(cdir, "file1"), filepath.Join(cdir, "file3")); err != nil {
+		t.Fatalf("Can't rename file: %v", err)
+	}
+	if !waitForFile(filepath.Join(sdir, "file3"), content, 2*time.Second) {
+		t.Fatalf("Renamed file not synced")
+	}
+	if _, err := os.Stat(filepath.Join(sdir, "file1")); !os.IsNotExist(err) {
+		t.Errorf("Renamed file not removed")
+	}
+	// Delete.
+	if err := os.Remove(filepath.Join(cdir, "dir1", "file2")); err != nil {
+		t.Fatalf("Can't remove file: %v", err)
+	}
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if _, err := os.Stat(filepath.Join(sdir, "dir1", "file2")); os.IsNotExist(err) {
+			break
+		}
+	}
+	if _, err := os.Stat(filepath.Join(sdir, "dir1", "file2")); !os.IsNotExist(err) {
+		t.Errorf("Removed file not removed")
+	}
+
+	client.Close()
+	if err := <-errc; err != nil {
+		t.Errorf("Monitoring failed: %v", err)
+	}
+}
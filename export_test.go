@@ -0,0 +1,256 @@
+package betterbox
+
+import (
+	"errors"
+	"github.com/fsnotify/fsnotify"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// SetRequestsWaitTime sets the time of requests buffering before sending them to
+// the server, returning a function to restore the previous value.
+func SetRequestsWaitTime(d time.Duration) func() {
+	previous := requestsWaitTime
+	requestsWaitTime = d
+	return func() { requestsWaitTime = previous }
+}
+
+// SetDestCheckInterval sets how long the result of checking the server's
+// destination is reused for, returning a function to restore the previous
+// value.
+func SetDestCheckInterval(d time.Duration) func() {
+	previous := destCheckInterval
+	destCheckInterval = d
+	return func() { destCheckInterval = previous }
+}
+
+// SimulateCrossDeviceRenames makes renames between different directories fail
+// with EXDEV, returning a function to restore renames and the number of
+// failed ones.
+func SimulateCrossDeviceRenames() func() int {
+	failed := 0
+	rename = func(oldpath, newpath string) error {
+		if filepath.Dir(oldpath) != filepath.Dir(newpath) {
+			failed++
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+		}
+		return os.Rename(oldpath, newpath)
+	}
+	return func() int {
+		rename = os.Rename
+		return failed
+	}
+}
+
+// CountFsyncs counts the calls to fsync, returning a function to stop counting
+// and return the count.
+func CountFsyncs() func() int {
+	var count int32
+	syncFile = func(f *os.File) error {
+		atomic.AddInt32(&count, 1)
+		return f.Sync()
+	}
+	return func() int {
+		syncFile = (*os.File).Sync
+		return int(atomic.LoadInt32(&count))
+	}
+}
+
+// FailDirFsyncs makes the calls to fsync on directories fail, returning a
+// function to restore them.
+func FailDirFsyncs() func() {
+	syncFile = func(f *os.File) error {
+		if info, err := f.Stat(); err == nil && info.IsDir() {
+			return &os.PathError{Op: "sync", Path: f.Name(), Err: syscall.EIO}
+		}
+		return f.Sync()
+	}
+	return func() { syncFile = (*os.File).Sync }
+}
+
+// FailWatchers makes the creation of filesystem events watchers fail,
+// returning a function to restore it.
+func FailWatchers() func() {
+	newWatcher = func() (*fsnotify.Watcher, error) {
+		return nil, errors.New("Watchers unsupported")
+	}
+	return func() { newWatcher = fsnotify.NewWatcher }
+}
+
+// SetBeforeRead sets the function called with the path of every file read by
+// clients, before opening it, returning a function to restore it.
+func SetBeforeRead(fn func(path string)) func() {
+	previous := beforeRead
+	beforeRead = fn
+	return func() { beforeRead = previous }
+}
+
+// ErrBtimeUnsupported is returned by SetBirthTime on platforms that don't
+// support setting birth times.
+var ErrBtimeUnsupported = errBtimeUnsupported
+
+// BirthTime returns the birth time of the file or directory at path, if known.
+func BirthTime(path string) (time.Time, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return birthTime(path, info)
+}
+
+// SetBirthTime sets the birth time of the file or directory at path.
+func SetBirthTime(path string, btime time.Time) error {
+	return setBirthTime(path, btime)
+}
+
+// InjectWatcherErrors makes the created filesystem events watchers report the
+// errors sent on the returned channel, returning a function to restore them.
+func InjectWatcherErrors() (chan<- error, func()) {
+	errc := make(chan error)
+	newWatcher = func() (*fsnotify.Watcher, error) {
+		watcher, err := fsnotify.NewWatcher()
+		if err == nil {
+			go func() {
+				for err := range errc {
+					watcher.Errors <- err
+				}
+			}()
+		}
+		return watcher, err
+	}
+	return errc, func() {
+		close(errc)
+		newWatcher = fsnotify.NewWatcher
+	}
+}
+
+// HandleEvent handles a filesystem event as a monitoring client does, returning
+// the Requests to send for it.
+func HandleEvent(c *Client, event fsnotify.Event) ([]*Request, error) {
+	return c.handleEvent(event)
+}
+
+// AppendRequests appends the Requests of an event to the buffered ones, as a
+// monitoring client does.
+func AppendRequests(reqs, eventReqs []*Request) []*Request {
+	return appendRequests(reqs, eventReqs)
+}
+
+// NewMkdirRequest creates a new Mkdir Request.
+func NewMkdirRequest(path string) *Request {
+	return newMkdirRequest(path)
+}
+
+// NewRemoveRequest creates a new Remove Request.
+func NewRemoveRequest(path string) *Request {
+	return newRemoveRequest(path)
+}
+
+// NewSymlinkRequest creates a new Symlink Request.
+func NewSymlinkRequest(path, target string) *Request {
+	return newSymlinkRequest(path, target)
+}
+
+// NewWriteAtRequest creates a new WriteAt Request, for a chunk of a file of
+// size bytes.
+func NewWriteAtRequest(path string, data []byte, offset, size int64) *Request {
+	return &Request{Type: requestWriteAt, Path: path, Data: data, Offset: offset, Size: size}
+}
+
+// NewCreateRequest creates a new Create Request, with the checksum of its
+// data.
+func NewCreateRequest(path string, data, checksum []byte) *Request {
+	return &Request{Type: requestCreate, Path: path, Data: data, Checksum: checksum}
+}
+
+// NewFinalizeRequest creates a new Finalize Request, for a file of size bytes.
+func NewFinalizeRequest(path string, size int64) *Request {
+	return &Request{Type: requestFinalize, Path: path, Size: size}
+}
+
+// NewUnknownRequest creates a new Request of a type unknown to the server.
+func NewUnknownRequest(path string) *Request {
+	return &Request{Type: requestFinalize + 100, Path: path}
+}
+
+// SetClientProtocolVersion sets the protocol version that clients claim to
+// speak, returning a function to restore the previous value.
+func SetClientProtocolVersion(version int) func() {
+	previous := clientProtocolVersion
+	clientProtocolVersion = version
+	return func() { clientProtocolVersion = previous }
+}
+
+// RequestsBufferSize is the number of buffered requests that are sent without
+// waiting.
+const RequestsBufferSize = requestsBufferSize
+
+// SetSnapshotPageSize sets the size beyond which the pages of a snapshot end,
+// returning a function to restore the previous value.
+func SetSnapshotPageSize(size int) func() {
+	previous := snapshotPageSize
+	snapshotPageSize = size
+	return func() { snapshotPageSize = previous }
+}
+
+// SetRemoteReadSize sets the size of the chunks read from the server's files
+// at once, returning a function to restore the previous value.
+func SetRemoteReadSize(size int) func() {
+	previous := remoteReadSize
+	remoteReadSize = size
+	return func() { remoteReadSize = previous }
+}
+
+// Compressing checks whether a client with adaptive compression asks for the
+// compression of the RPC streams of its new connections.
+func Compressing(c *Client) bool {
+	return c.compressStreams()
+}
+
+// SetManifestPageSize sets the number of entries fetched at once from the
+// server's manifest, returning a function to restore the previous value.
+func SetManifestPageSize(size int) func() {
+	previous := manifestPageSize
+	manifestPageSize = size
+	return func() { manifestPageSize = previous }
+}
+
+// CountClientHashes counts the files hashed by clients, returning a function
+// to stop counting and return the count.
+func CountClientHashes() func() int {
+	var count int32
+	hashLocal = func(algorithm HashAlgorithm, r io.Reader) ([]byte, error) {
+		atomic.AddInt32(&count, 1)
+		return hashContent(algorithm, r)
+	}
+	return func() int {
+		hashLocal = hashContent
+		return int(atomic.LoadInt32(&count))
+	}
+}
+
+// SetSyncRetryDelay sets the delay before retrying the sending of a sync's
+// Requests, returning a function to restore the previous value.
+func SetSyncRetryDelay(d time.Duration) func() {
+	previous := syncRetryDelay
+	syncRetryDelay = d
+	return func() { syncRetryDelay = previous }
+}
+
+// WatchedDirs returns the directories watched by a client, relative to its
+// directory and sorted. The client must not be monitoring.
+func WatchedDirs(c *Client) []string {
+	var dirs []string
+	for path := range c.watched {
+		if relPath, err := filepath.Rel(c.path, path); err == nil {
+			dirs = append(dirs, filepath.ToSlash(relPath))
+		}
+	}
+	sort.Strings(dirs)
+	return dirs
+}
@@ -0,0 +1,175 @@
+package betterbox
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// ExpandPath expands a leading "~" to the user's home directory, and the
+// environment variables (eg. $HOME), in a path. NewClient and NewServer take
+// their path literally, the command-line tools expand it with ExpandPath.
+func ExpandPath(path string) (string, error) {
+	if path == "~" || strings.HasPrefix(path, "~"+string(filepath.Separator)) || strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(home, path[1:])
+	}
+	return os.ExpandEnv(path), nil
+}
+
+// rename renames files, replaceable to simulate cross-device renames.
+var rename = os.Rename
+
+// syncFile commits a file's content to stable storage, replaceable to count
+// calls.
+var syncFile = (*os.File).Sync
+
+// syncDir commits a directory's entries to stable storage, so that a renamed
+// file is durably linked in it.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return syncFile(dir)
+}
+
+// dirSyncs collects the directories to sync once a batch of Requests is
+// applied, so that each is synced once for all the files written in it. A nil
+// dirSyncs syncs them immediately.
+type dirSyncs map[string]struct{}
+
+// sync syncs the directory at path, or collects it to sync on flush.
+func (ds dirSyncs) sync(path string) error {
+	if ds == nil {
+		return syncDir(path)
+	}
+	ds[path] = struct{}{}
+	return nil
+}
+
+// flush syncs the collected directories, returning the first error.
+func (ds dirSyncs) flush() error {
+	var first error
+	for path := range ds {
+		if err := syncDir(path); err != nil && first == nil {
+			first = err
+		}
+		delete(ds, path)
+	}
+	return first
+}
+
+// isCrossDevice checks whether a rename failed as its source and destination
+// were on different filesystems.
+func isCrossDevice(err error) bool {
+	linkErr, ok := err.(*os.LinkError)
+	return ok && linkErr.Err == syscall.EXDEV
+}
+
+// writeFileAtomic writes data to a temporary file in the directory of path, and
+// then renames it to path, so that a partially written file is never visible.
+// The temporary file being on the same filesystem, the rename doesn't fail
+// with EXDEV. With fsync, the content is synced before the rename.
+func writeFileAtomic(path string, data []byte, perm os.FileMode, fsync bool) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil && fsync {
+		err = syncFile(tmp)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err == nil {
+		err = rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// symlinkAtomic creates a symlink to target at path, replacing any entry but a
+// directory already there, by renaming a temporary symlink over it.
+func symlinkAtomic(target, path string) error {
+	if info, err := os.Lstat(path); err == nil && info.IsDir() {
+		return fmt.Errorf("%s: Is a directory", path)
+	}
+	for {
+		// Reserves a temporary name, which the symlink takes over.
+		tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+		if err != nil {
+			return err
+		}
+		tmp.Close()
+		if err := os.Remove(tmp.Name()); err != nil {
+			return err
+		}
+		err = os.Symlink(target, tmp.Name())
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err = rename(tmp.Name(), path); err != nil {
+			os.Remove(tmp.Name())
+		}
+		return err
+	}
+}
+
+// moveFile renames the file src to dst. If they are on different filesystems,
+// src is copied to a temporary file next to dst, synced, renamed to dst and
+// then removed.
+func moveFile(src, dst string) error {
+	err := rename(src, dst)
+	if !isCrossDevice(err) {
+		return err
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, in)
+	if err == nil {
+		err = syncFile(tmp)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), info.Mode().Perm())
+	}
+	if err == nil {
+		err = rename(tmp.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,187 @@
+package betterbox
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WithFS makes the client read the files and directories to sync from fsys,
+// eg. an embedded filesystem, instead of its directory on the OS filesystem.
+// Paths in fsys are the paths relative to the client's directory. Symbolic
+// links and monitoring are only supported on the OS filesystem.
+func WithFS(fsys fs.FS) ClientOption {
+	return func(c *Client) error {
+		c.fsys = fsys
+		return nil
+	}
+}
+
+// fsPath returns the path in the client's filesystem of a path within the
+// client's directory.
+func (c *Client) fsPath(path string) (string, error) {
+	relPath, err := filepath.Rel(c.path, path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(relPath), nil
+}
+
+// readChunkSize is the size of the chunks files are read in, checking between
+// them whether the client is closing.
+const readChunkSize = 64 << 10
+
+// readFile reads the content of the file at path, within the client's
+// directory, from the client's filesystem. The reading is abandoned with
+// ErrClosed once the client is closing, eg. for large files.
+func (c *Client) readFile(path string) ([]byte, error) {
+	beforeRead(path)
+	f, err := c.openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// The opened file is checked, as the entry at path may have been replaced
+	// since it was stat'ed, eg. by a directory.
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, &notRegularError{path: path, mode: info.Mode()}
+	}
+	var buf bytes.Buffer
+	buf.Grow(int(info.Size()) + bytes.MinRead)
+	if _, err := buf.ReadFrom(&closingReader{Reader: f, closing: c.closing}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// beforeRead is called with the path of every file read, before opening it.
+// Replaceable for tests.
+var beforeRead = func(path string) {}
+
+// notRegularError is returned when reading a file that turns out to be another
+// type of entry.
+type notRegularError struct {
+	path string
+	mode os.FileMode
+}
+
+func (e *notRegularError) Error() string {
+	return fmt.Sprintf("%s: Not a regular file (%s)", e.path, e.mode.Type())
+}
+
+// closingReader reads in chunks of at most readChunkSize, failing with
+// ErrClosed once closing is closed.
+type closingReader struct {
+	io.Reader
+	closing <-chan struct{}
+}
+
+func (r *closingReader) Read(p []byte) (int, error) {
+	select {
+	case <-r.closing:
+		return 0, ErrClosed
+	default:
+	}
+	if len(p) > readChunkSize {
+		p = p[:readChunkSize]
+	}
+	return r.Reader.Read(p)
+}
+
+// openFile opens the file at path, within the client's directory, from the
+// client's filesystem.
+func (c *Client) openFile(path string) (fs.File, error) {
+	name, err := c.fsPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return c.fsys.Open(name)
+}
+
+// stat returns the file info of the file or directory at path, within the
+// client's directory, from the client's filesystem. Symbolic links are
+// followed.
+func (c *Client) stat(path string) (os.FileInfo, error) {
+	name, err := c.fsPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return fs.Stat(c.fsys, name)
+}
+
+// included checks whether the file or directory at localPath, relative to the
+// client's directory, is synced. Only its file is, for a single file client,
+// and none deeper than the maximum depth.
+func (c *Client) included(localPath string) bool {
+	return (c.file == "" || localPath == c.file) && !c.tooDeep(localPath)
+}
+
+// extensionExcluded checks whether the file at localPath, relative to the
+// client's directory, is left out for its extension.
+func (c *Client) extensionExcluded(localPath string) bool {
+	if len(c.extensions) == 0 {
+		return false
+	}
+	ext := filepath.Ext(localPath)
+	for _, included := range c.extensions {
+		if ext == included {
+			return false
+		}
+	}
+	return true
+}
+
+// tooDeep checks whether the file or directory at localPath, relative to the
+// client's directory, is deeper than the maximum depth.
+func (c *Client) tooDeep(localPath string) bool {
+	return c.maxDepth > 0 && pathDepth(localPath) > c.maxDepth
+}
+
+// pathDepth returns the depth of localPath, relative to the client's directory:
+// 0 for the directory itself, 1 for its entries, and so on.
+func pathDepth(localPath string) int {
+	if localPath == "." {
+		return 0
+	}
+	return strings.Count(filepath.ToSlash(localPath), "/") + 1
+}
+
+// walk walks the client's filesystem, calling fn with the absolute path and
+// file info of every synced file and directory, the client's directory
+// included. Symbolic links aren't followed.
+func (c *Client) walk(fn filepath.WalkFunc) error {
+	return c.walkFrom(".", fn)
+}
+
+// walkFrom walks the client's filesystem as walk does, from the file or
+// directory at root, a slash-separated path relative to the client's directory.
+func (c *Client) walkFrom(root string, fn filepath.WalkFunc) error {
+	return fs.WalkDir(c.fsys, root, func(name string, d fs.DirEntry, err error) error {
+		if name != "." && !c.included(filepath.FromSlash(name)) {
+			if c.tooDeep(filepath.FromSlash(name)) {
+				c.logger.Log(LevelInfo, "Skipping entry beyond maximum depth", Fields{"path": name})
+			}
+			if err == nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		path := filepath.Join(c.path, filepath.FromSlash(name))
+		if err != nil {
+			return fn(path, nil, err)
+		}
+		if !d.IsDir() && c.extensionExcluded(name) {
+			return nil
+		}
+		info, err := d.Info()
+		return fn(path, info, err)
+	})
+}
@@ -1,9 +1,9 @@
 module betterbox
 
-go 1.12
+go 1.16
 
 require (
 	github.com/fsnotify/fsnotify v1.4.7
 	github.com/pkg/errors v0.8.1
-	golang.org/x/sys v0.0.0-20190804053845-51ab0e2deafa // indirect
+	golang.org/x/sys v0.0.0-20190804053845-51ab0e2deafa
 )
@@ -0,0 +1,151 @@
+package betterbox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// WithRemoveGrace makes the server delay the Remove requests by d, removing
+// the entries only if no request for them, or for entries within them, comes
+// in the meantime, eg. a client reporting files removed then created again
+// while they flap, or a client bug reporting all its files removed. Entries
+// replaced by entries of another type are removed at once, and directories
+// receiving new entries lose their former ones. Removes
+// are reported applied when received, and removes in transactional batches
+// are applied at once. The pending removes are lost if the server stops.
+func WithRemoveGrace(d time.Duration) ServerOption {
+	return func(sv *Server) error {
+		if d <= 0 {
+			return fmt.Errorf("Invalid remove grace period: %s", d)
+		}
+		sv.removeGrace = d
+		sv.pendingRemoves = make(map[string]*time.Timer)
+		return nil
+	}
+}
+
+// delayRemove schedules a Remove request to be applied once the grace period
+// expires, unless cancelled by then. A pending Remove of the same path is
+// scheduled again.
+func (sv *Server) delayRemove(req *Request, absPath string) error {
+	if err := sv.checkRemovable(absPath); err != nil {
+		return err
+	}
+	sv.removesMutex.Lock()
+	defer sv.removesMutex.Unlock()
+	if timer, ok := sv.pendingRemoves[req.Path]; ok {
+		timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(sv.removeGrace, func() {
+		sv.removesMutex.Lock()
+		defer sv.removesMutex.Unlock()
+		if sv.pendingRemoves[req.Path] != timer {
+			return
+		}
+		delete(sv.pendingRemoves, req.Path)
+		err := sv.remove(absPath, req.Path)
+		sv.treeCache.invalidate(req)
+		if err != nil {
+			sv.logger.Log(LevelError, "Delayed remove failed", Fields{"path": req.Path, "error": err})
+			return
+		}
+		sv.runHooks(req)
+	})
+	sv.pendingRemoves[req.Path] = timer
+	return nil
+}
+
+// resolveRemoves resolves the pending Removes of a request's path and of its
+// parent directories, before the request is applied. The Remove of the path is
+// cancelled, keeping the entry, unless the request replaces it with an entry
+// of another type, which it then removes right away. The Removes of parent
+// directories are cancelled too, but their former entries are removed, as
+// the directories only keep the entries requested since.
+func (sv *Server) resolveRemoves(req *Request) error {
+	if sv.removeGrace == 0 {
+		return nil
+	}
+	sv.removesMutex.Lock()
+	defer sv.removesMutex.Unlock()
+	for dir := req.Path; dir != "." && dir != "/"; dir = filepath.ToSlash(filepath.Dir(dir)) {
+		timer, ok := sv.pendingRemoves[dir]
+		if !ok {
+			continue
+		}
+		timer.Stop()
+		delete(sv.pendingRemoves, dir)
+		absPath := filepath.Join(sv.path, dir)
+		var err error
+		switch {
+		case dir != req.Path:
+			sv.logger.Log(LevelInfo, "Emptying directory pending remove", Fields{"path": dir, "request": req.Path})
+			err = sv.removeEntries(absPath, dir)
+			sv.treeCache.invalidate(newRemoveRequest(dir))
+		case replacesType(req, absPath):
+			sv.logger.Log(LevelInfo, "Applying pending remove of replaced entry", Fields{"path": dir})
+			err = sv.remove(absPath, dir)
+			sv.treeCache.invalidate(newRemoveRequest(dir))
+		default:
+			sv.logger.Log(LevelInfo, "Cancelled pending remove", Fields{"path": dir, "request": req.Path})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replacesType checks whether a request replaces the entry at absPath with
+// an entry of another type, among directories, regular files, symlinks and
+// special files.
+func replacesType(req *Request, absPath string) bool {
+	info, err := os.Lstat(absPath)
+	if err != nil {
+		return false
+	}
+	switch req.Type {
+	case requestMkdir:
+		return !info.IsDir()
+	case requestCreate, requestWriteAt, requestFinalize, requestAppend:
+		return !info.Mode().IsRegular()
+	case requestSymlink:
+		return !isSymlink(info)
+	case requestMknod:
+		return !isSpecial(info)
+	}
+	return false
+}
+
+// removeEntries removes the entries of the directory at path, named name in
+// the destination, saving their versions first, if it is a directory.
+func (sv *Server) removeEntries(path, name string) error {
+	if !isDirectory(path) {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := sv.remove(filepath.Join(path, entry.Name()), name+"/"+entry.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove removes the entry at path, named name in the destination, saving its
+// versions first.
+func (sv *Server) remove(path, name string) error {
+	if err := sv.checkRemovable(path); err != nil {
+		return err
+	}
+	if err := sv.saveVersions(path, name); err != nil {
+		return err
+	}
+	return os.RemoveAll(path)
+}
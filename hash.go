@@ -0,0 +1,74 @@
+package betterbox
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"os"
+)
+
+// HashAlgorithm identifies the algorithm of the content hashes compared by
+// Reconcile.
+type HashAlgorithm string
+
+const (
+	// HashSHA256 is the default algorithm.
+	HashSHA256 HashAlgorithm = "sha256"
+	// HashSHA512 is usually faster than SHA-256 on 64-bit platforms.
+	HashSHA512 HashAlgorithm = "sha512"
+	// HashFNV128a is much faster, but not collision resistant: files
+	// modified by an attacker may be seen as unchanged.
+	HashFNV128a HashAlgorithm = "fnv128a"
+)
+
+// newHash returns a new hash of the algorithm. The empty algorithm, from
+// clients predating the choice, is SHA-256.
+func newHash(algorithm HashAlgorithm) (hash.Hash, error) {
+	switch algorithm {
+	case HashSHA256, "":
+		return sha256.New(), nil
+	case HashSHA512:
+		return sha512.New(), nil
+	case HashFNV128a:
+		return fnv.New128a(), nil
+	default:
+		return nil, fmt.Errorf("Unsupported hash algorithm: '%s'", algorithm)
+	}
+}
+
+// WithHashAlgorithm selects the algorithm of the content hashes compared by
+// Reconcile, which the server computes as well. Defaults to HashSHA256.
+func WithHashAlgorithm(algorithm HashAlgorithm) ClientOption {
+	return func(c *Client) error {
+		if _, err := newHash(algorithm); err != nil {
+			return err
+		}
+		c.hashAlgorithm = algorithm
+		return nil
+	}
+}
+
+// hashFile returns the hash of a file's content.
+func hashFile(algorithm HashAlgorithm, path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return hashContent(algorithm, f)
+}
+
+// hashContent returns the hash of the content read from r.
+func hashContent(algorithm HashAlgorithm, r io.Reader) ([]byte, error) {
+	h, err := newHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,99 @@
+package betterbox
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// hashCacheEntry is the content hash of a file, valid as long as the file's
+// size and modification time are unchanged.
+type hashCacheEntry struct {
+	Size      int64
+	ModTime   time.Time
+	Algorithm HashAlgorithm
+	Hash      []byte
+}
+
+// hashCache caches the content hashes of the client's files, by path in the
+// client's filesystem, so that unchanged files aren't hashed on every
+// reconciliation. It is persisted to a state file.
+type hashCache struct {
+	path    string // Path of the state file.
+	mutex   sync.Mutex
+	entries map[string]hashCacheEntry
+	// Entries of the files hashed or looked up since loading, which are the
+	// ones saved.
+	used map[string]hashCacheEntry
+}
+
+// loadHashCache loads the hash cache from the state file at path, if it
+// exists.
+func loadHashCache(path string) (*hashCache, error) {
+	hc := &hashCache{path: path, entries: make(map[string]hashCacheEntry), used: make(map[string]hashCacheEntry)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return hc, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &hc.entries); err != nil {
+		return nil, err
+	}
+	return hc, nil
+}
+
+// lookup returns the cached hash of a file, if its size and modification time
+// are unchanged.
+func (hc *hashCache) lookup(name string, algorithm HashAlgorithm, info os.FileInfo) ([]byte, bool) {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	entry, ok := hc.entries[name]
+	if !ok || entry.Algorithm != algorithm || entry.Size != info.Size() || !entry.ModTime.Equal(info.ModTime()) {
+		return nil, false
+	}
+	hc.used[name] = entry
+	return entry.Hash, true
+}
+
+// store caches the hash of a file.
+func (hc *hashCache) store(name string, algorithm HashAlgorithm, info os.FileInfo, hash []byte) {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	entry := hashCacheEntry{Size: info.Size(), ModTime: info.ModTime(), Algorithm: algorithm, Hash: hash}
+	hc.entries[name] = entry
+	hc.used[name] = entry
+}
+
+// save writes the used entries to the state file, dropping the ones of files
+// that weren't hashed or looked up, eg. removed ones.
+func (hc *hashCache) save() error {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	data, err := json.Marshal(hc.used)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(hc.path, data, 0600, false); err != nil {
+		return err
+	}
+	hc.entries, hc.used = hc.used, make(map[string]hashCacheEntry)
+	return nil
+}
+
+// WithHashCache caches the content hashes computed by Reconcile in the state
+// file at path, across runs. Files are hashed again only if their size or
+// modification time changed. Not used with data transforms.
+func WithHashCache(path string) ClientOption {
+	return func(c *Client) error {
+		hc, err := loadHashCache(path)
+		if err != nil {
+			return err
+		}
+		c.hashCache = hc
+		return nil
+	}
+}
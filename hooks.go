@@ -0,0 +1,82 @@
+package betterbox
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// hookQueueSize is the number of applied paths waiting for their hooks to run.
+// Past it, the hooks of newly applied paths are dropped, with a warning.
+const hookQueueSize = 100
+
+// pathHook is a function called with the paths matching its pattern.
+type pathHook struct {
+	pattern string
+	fn      func(path string)
+}
+
+// WithPathHook makes the server call fn with the path of every entry created,
+// modified or removed by a Request matching pattern, eg. to reload a service
+// when its configuration files change. pattern has the syntax of path.Match,
+// and is matched against the slash-separated paths relative to the
+// destination, or against the base names for patterns without a slash. It can
+// be used multiple times. Hooks run after the Requests are applied, one at a
+// time and in order, on a goroutine of their own, so that they don't hold up
+// the clients.
+func WithPathHook(pattern string, fn func(path string)) ServerOption {
+	return func(sv *Server) error {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid hook pattern '%s': %v", pattern, err)
+		}
+		sv.hooks = append(sv.hooks, pathHook{pattern: pattern, fn: fn})
+		return nil
+	}
+}
+
+// startHooks starts the goroutine running the server's hooks, if any.
+func (sv *Server) startHooks() {
+	if len(sv.hooks) == 0 {
+		return
+	}
+	sv.hookQueue = make(chan string, hookQueueSize)
+	go func() {
+		for relPath := range sv.hookQueue {
+			for _, hook := range sv.hooks {
+				if hookMatches(hook.pattern, relPath) {
+					hook.fn(relPath)
+				}
+			}
+		}
+	}()
+}
+
+// hookMatches checks whether a slash-separated path matches a hook's pattern.
+func hookMatches(pattern, relPath string) bool {
+	target := relPath
+	if !strings.Contains(pattern, "/") {
+		target = path.Base(relPath)
+	}
+	matched, _ := path.Match(pattern, target)
+	return matched
+}
+
+// runHooks queues the path of an applied Request for the server's hooks.
+// Chunks are skipped, the hooks running once their upload is finalized.
+func (sv *Server) runHooks(req *Request) {
+	if sv.hookQueue == nil || req.Type == requestWriteAt {
+		return
+	}
+	matched := false
+	for _, hook := range sv.hooks {
+		matched = matched || hookMatches(hook.pattern, req.Path)
+	}
+	if !matched {
+		return
+	}
+	select {
+	case sv.hookQueue <- req.Path:
+	default:
+		sv.logger.Log(LevelWarning, "Dropping hooks, queue full", Fields{"path": req.Path})
+	}
+}
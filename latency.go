@@ -0,0 +1,80 @@
+package betterbox
+
+import (
+	"sort"
+	"time"
+)
+
+// latencySamples is the number of most recent durations kept per type of
+// request, to compute their percentiles.
+const latencySamples = 1000
+
+// batchLatency is the key of the latencies of batches, sent in single calls.
+const batchLatency = "Batch"
+
+// Latency aggregates the durations of the calls sending a type of request to
+// the server, until their Response is received.
+type Latency struct {
+	Count int
+	Min   time.Duration
+	Max   time.Duration
+	Avg   time.Duration
+	// 99th percentile, of the most recent calls only.
+	P99 time.Duration
+}
+
+// latencyRecord accumulates the durations of a type of request's calls.
+type latencyRecord struct {
+	count    int
+	total    time.Duration
+	min, max time.Duration
+	recent   []time.Duration // Ring of the most recent durations.
+	next     int             // Index in recent of the next duration.
+}
+
+// add records the duration of a call.
+func (r *latencyRecord) add(d time.Duration) {
+	if r.count == 0 || d < r.min {
+		r.min = d
+	}
+	if d > r.max {
+		r.max = d
+	}
+	r.count++
+	r.total += d
+	if len(r.recent) < latencySamples {
+		r.recent = append(r.recent, d)
+	} else {
+		r.recent[r.next] = d
+	}
+	r.next = (r.next + 1) % latencySamples
+}
+
+// latency returns the aggregated durations of the calls.
+func (r *latencyRecord) latency() Latency {
+	sorted := append([]time.Duration(nil), r.recent...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return Latency{
+		Count: r.count,
+		Min:   r.min,
+		Max:   r.max,
+		Avg:   r.total / time.Duration(r.count),
+		P99:   sorted[(len(sorted)*99+99)/100-1],
+	}
+}
+
+// recordLatency records the duration of a call sending requests of a type, or
+// a batch of requests.
+func (c *Client) recordLatency(key string, d time.Duration) {
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+	if c.latencies == nil {
+		c.latencies = make(map[string]*latencyRecord)
+	}
+	r, ok := c.latencies[key]
+	if !ok {
+		r = &latencyRecord{}
+		c.latencies[key] = r
+	}
+	r.add(d)
+}
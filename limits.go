@@ -0,0 +1,92 @@
+package betterbox
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+)
+
+// WithMaxFileSize makes the server reject the files bigger than size bytes,
+// with CodeTooLarge. The limit is advertised to the clients on handshake, so
+// that they can skip such files without sending them.
+func WithMaxFileSize(size int64) ServerOption {
+	return func(sv *Server) error {
+		if size <= 0 {
+			return fmt.Errorf("Invalid maximum file size: %d", size)
+		}
+		sv.maxFileSize = size
+		return nil
+	}
+}
+
+// checkFileSize checks that the file written by a Request doesn't exceed the
+// server's maximum file size.
+func (sv *Server) checkFileSize(req *Request) error {
+	if sv.maxFileSize == 0 {
+		return nil
+	}
+	var size int64
+	switch req.Type {
+	case requestCreate:
+		size = int64(len(req.Data))
+	case requestWriteAt, requestFinalize:
+		size = req.Size
+	case requestAppend:
+		size = req.Offset + int64(len(req.Data))
+	}
+	if size > sv.maxFileSize {
+		return newCodedError(CodeTooLarge, "%s: File of %d bytes exceeds the maximum of %d bytes", req.Path, size, sv.maxFileSize)
+	}
+	return nil
+}
+
+// WithSkipOversized makes the client learn the maximum file size of the
+// server on handshake, connecting beforehand if needed, and skip the files
+// exceeding it with a warning, instead of having them rejected once sent.
+// Files are skipped before being read, unless transformed or encrypted, which
+// changes their size.
+func WithSkipOversized() ClientOption {
+	return func(c *Client) error {
+		c.skipOversized = true
+		return nil
+	}
+}
+
+// recordMaxFileSize records the maximum file size advertised by a server on
+// handshake, 0 for none.
+func (c *Client) recordMaxFileSize(size int64) {
+	c.limitsMutex.Lock()
+	defer c.limitsMutex.Unlock()
+	c.maxFileSize, c.limitsKnown = size, true
+}
+
+// serverMaxFileSize returns the maximum file size of the server, connecting to
+// it to learn it if no handshake was done yet.
+func (c *Client) serverMaxFileSize() (int64, error) {
+	c.limitsMutex.Lock()
+	size, known := c.maxFileSize, c.limitsKnown
+	c.limitsMutex.Unlock()
+	if known {
+		return size, nil
+	}
+	rconn, err := c.serverConnect()
+	if err != nil {
+		return 0, errors.Wrap(err, "Connection to server failed")
+	}
+	rconn.Close()
+	return rconn.maxFileSize, nil
+}
+
+// oversized checks whether a file of size bytes, named name on the server,
+// exceeds the server's maximum file size, and has to be skipped.
+func (c *Client) oversized(name string, size int64) (bool, error) {
+	if !c.skipOversized {
+		return false, nil
+	}
+	max, err := c.serverMaxFileSize()
+	if err != nil || max == 0 || size <= max {
+		return false, err
+	}
+	c.logger.Log(LevelWarning, "Skipping file exceeding the server's maximum size", Fields{"path": name, "size": size, "max": max})
+	c.recordSkipped()
+	return true, nil
+}
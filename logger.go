@@ -0,0 +1,89 @@
+package betterbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a logged event.
+type Level string
+
+const (
+	LevelInfo    Level = "info"
+	LevelWarning Level = "warning"
+	LevelError   Level = "error"
+)
+
+// Fields are the attributes of a logged event, eg. "path".
+type Fields map[string]interface{}
+
+// Logger logs the events of clients and servers.
+type Logger interface {
+	Log(level Level, msg string, fields Fields)
+}
+
+// stdLogger logs events as free-form lines, with the standard library's
+// default logger.
+type stdLogger struct{}
+
+func (stdLogger) Log(level Level, msg string, fields Fields) {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var line strings.Builder
+	if level != LevelInfo {
+		fmt.Fprintf(&line, "%s: ", strings.ToUpper(string(level)))
+	}
+	line.WriteString(msg)
+	for _, key := range keys {
+		fmt.Fprintf(&line, " %s=%v", key, fields[key])
+	}
+	log.Println(line.String())
+}
+
+// jsonLogger logs events as JSON objects, one per line.
+type jsonLogger struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+// NewJSONLogger creates a Logger writing each event to w as a JSON object on
+// its own line, with the "time", "level" and "msg" fields, and the event's
+// fields.
+func NewJSONLogger(w io.Writer) Logger {
+	return &jsonLogger{w: w}
+}
+
+func (l *jsonLogger) Log(level Level, msg string, fields Fields) {
+	entry := make(map[string]interface{}, len(fields)+3)
+	for key, value := range fields {
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		entry[key] = value
+	}
+	entry["time"] = time.Now().Format(time.RFC3339Nano)
+	entry["level"] = level
+	entry["msg"] = msg
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Println("Encoding log entry: ", err)
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.w.Write(append(data, '\n'))
+}
+
+// requestFields returns the Fields describing a Request.
+func requestFields(req *Request) Fields {
+	return Fields{"request_type": req.Type.String(), "path": req.Path, "size": len(req.Data)}
+}
@@ -0,0 +1,496 @@
+package betterbox
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ManifestRequest asks the server for the list of entries under Path,
+// relative to its destination. An empty Path is for the whole destination.
+type ManifestRequest struct {
+	Path string
+	// Algorithm of the files' hashes.
+	Algorithm HashAlgorithm
+	// Maximum number of entries in the response, 0 for all of them. The
+	// remaining ones are listed by the next requests, after the last entry.
+	Limit int
+	// Path of the last entry of the previous response, "" for the first one.
+	After string
+	// Leave out the files' hashes, which are costly to compute.
+	NoHashes bool
+}
+
+// ManifestEntry describes a file or directory of the server's destination.
+type ManifestEntry struct {
+	Path  string // Relative to the server's destination.
+	IsDir bool
+	Size  int64
+	Hash  []byte // Hash of the file's content.
+	// Modification time of the file.
+	ModTime time.Time
+	// Target of the entry, if it is a symbolic link.
+	LinkTarget string
+	// Type of the entry, if it is a special file, eg. os.ModeNamedPipe.
+	Special os.FileMode
+	// Permission and special bits of the file or directory.
+	Mode os.FileMode
+}
+
+// ManifestResponse lists the entries under the requested path, and the
+// requested path and its parent directories if they exist. Entries are in walk
+// order: each directory comes before its entries, sorted by name.
+type ManifestResponse struct {
+	Entries []ManifestEntry
+	// Algorithm of the files' hashes.
+	Algorithm HashAlgorithm
+	// Path of the last entry, if the limit was reached and more entries may
+	// follow. "" otherwise.
+	Next string
+}
+
+// hashLocal hashes the content of the client's files.
+var hashLocal = hashContent
+
+// contentHash returns the hash of a file's content, as it is sent to the
+// server.
+func (c *Client) contentHash(path string) ([]byte, error) {
+	if c.transform == nil && c.hashCache != nil {
+		return c.cachedHash(path)
+	}
+	if c.transform == nil {
+		f, err := c.openFile(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return hashLocal(c.hashAlgorithm, f)
+	}
+	content, err := c.readContent(path)
+	if err != nil {
+		return nil, err
+	}
+	return hashContent(c.hashAlgorithm, bytes.NewReader(content))
+}
+
+// cachedHash returns the hash of a file's content from the hash cache,
+// or hashes it if it changed.
+func (c *Client) cachedHash(path string) ([]byte, error) {
+	name, err := c.fsPath(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := c.openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if hash, ok := c.hashCache.lookup(name, c.hashAlgorithm, info); ok {
+		return hash, nil
+	}
+	hash, err := hashLocal(c.hashAlgorithm, f)
+	if err != nil {
+		return nil, err
+	}
+	c.hashCache.store(name, c.hashAlgorithm, info, hash)
+	return hash, nil
+}
+
+// Manifest lists the files and directories of the server's destination, under
+// the requested path.
+func (sv *Server) Manifest(req *ManifestRequest, resp *ManifestResponse) error {
+	if _, err := newHash(req.Algorithm); err != nil {
+		return err
+	}
+	resp.Algorithm = req.Algorithm
+	root := filepath.Clean(req.Path)
+	if root == "." {
+		root = ""
+	} else if err := sv.validatePath(root); err != nil {
+		return err
+	}
+	// Parents of the requested path, which don't get walked through.
+	var parents []ManifestEntry
+	for dir := filepath.Dir(root); dir != "." && req.After == ""; dir = filepath.Dir(dir) {
+		if isDirectory(filepath.Join(sv.path, dir)) {
+			parents = append([]ManifestEntry{{Path: filepath.ToSlash(dir), IsDir: true}}, parents...)
+		}
+	}
+	resp.Entries = parents
+	err := filepath.Walk(filepath.Join(sv.path, root), func(absPath string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && absPath == filepath.Join(sv.path, root) {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(sv.path, absPath)
+		if err != nil {
+			return err
+		}
+		if relPath == stagingDirName || relPath == sv.versionsRel {
+			return filepath.SkipDir
+		}
+		if relPath == "." {
+			return nil
+		}
+		path := filepath.ToSlash(relPath)
+		// Entries up to the previous response's last one were listed.
+		if req.After != "" && !walkBefore(req.After, path) {
+			if info.IsDir() && path != req.After && !isWithin(req.After, path) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if req.Limit > 0 && len(resp.Entries) >= req.Limit {
+			resp.Next = resp.Entries[len(resp.Entries)-1].Path
+			return errManifestLimit
+		}
+		entry, err := manifestEntry(absPath, path, info, req.Algorithm, req.NoHashes)
+		if err != nil {
+			return err
+		}
+		resp.Entries = append(resp.Entries, entry)
+		return nil
+	})
+	if err == filepath.SkipDir || err == errManifestLimit {
+		err = nil
+	}
+	return err
+}
+
+// StatFileRequest asks the server to describe the entry at Path, relative to
+// its destination.
+type StatFileRequest struct {
+	Path string
+	// Algorithm of the file's hash.
+	Algorithm HashAlgorithm
+}
+
+// StatFileResponse describes the requested entry, if it exists.
+type StatFileResponse struct {
+	Exists bool
+	Entry  ManifestEntry
+}
+
+// StatFile describes a single entry of the server's destination, as Manifest
+// does, without walking through its parent directory.
+func (sv *Server) StatFile(req *StatFileRequest, resp *StatFileResponse) error {
+	if _, err := newHash(req.Algorithm); err != nil {
+		return err
+	}
+	path := filepath.Clean(req.Path)
+	if path == "." {
+		return fmt.Errorf("Missing path to describe")
+	}
+	if err := sv.validatePath(path); err != nil {
+		return err
+	}
+	absPath := filepath.Join(sv.path, path)
+	info, err := os.Lstat(absPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Entry, err = manifestEntry(absPath, filepath.ToSlash(path), info, req.Algorithm, false)
+	resp.Exists = err == nil
+	return err
+}
+
+// manifestEntry describes the entry at absPath, whose slash-separated path
+// relative to the destination is path, with the hash of its content for files
+// unless noHashes is set.
+func manifestEntry(absPath, path string, info os.FileInfo, algorithm HashAlgorithm, noHashes bool) (ManifestEntry, error) {
+	entry := ManifestEntry{Path: path, IsDir: info.IsDir()}
+	var err error
+	if isSymlink(info) {
+		entry.LinkTarget, err = os.Readlink(absPath)
+		return entry, err
+	}
+	if isSpecial(info) {
+		// Special files have no content to hash, eg. named pipes would
+		// block.
+		entry.Special = info.Mode().Type()
+		return entry, nil
+	}
+	entry.Mode = info.Mode() & (os.ModePerm | specialModes)
+	if !info.IsDir() {
+		entry.Size, entry.ModTime = info.Size(), info.ModTime()
+		if !noHashes {
+			entry.Hash, err = hashFile(algorithm, absPath)
+		}
+	}
+	return entry, err
+}
+
+// errManifestLimit stops the walk of the destination once a manifest response
+// has its limit of entries.
+var errManifestLimit = errors.New("Manifest limit reached")
+
+// walkBefore checks whether the slash-separated path a comes before b in walk
+// order, where each directory comes before its entries, sorted by name.
+func walkBefore(a, b string) bool {
+	as, bs := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] != bs[i] {
+			return as[i] < bs[i]
+		}
+	}
+	return len(as) < len(bs)
+}
+
+// manifestPageSize is the number of entries fetched at once from the server's
+// manifest, bounding the memory used by reconciliations.
+var manifestPageSize = 1000
+
+// manifestStream iterates over the server's manifest entries under the client's
+// remote prefix, in walk order, fetching them a page at a time.
+type manifestStream struct {
+	c     *Client
+	rconn *serverConn
+	page  []ManifestEntry // Fetched entries not iterated over yet.
+	next  string          // Path after which the next page starts.
+	done  bool            // Whether the last page was fetched.
+	// Whether the entries are listed without hashes.
+	noHashes bool
+}
+
+// openManifest connects to the server to stream its manifest.
+func (c *Client) openManifest() (*manifestStream, error) {
+	rconn, err := c.serverConnect()
+	if err != nil {
+		return nil, errors.Wrap(err, "Connection to server failed")
+	}
+	return &manifestStream{c: c, rconn: rconn}, nil
+}
+
+// Close closes the stream's connection to the server.
+func (s *manifestStream) Close() error {
+	return s.rconn.Close()
+}
+
+// peek returns the next entry without iterating over it, nil after the last
+// one.
+func (s *manifestStream) peek() (*ManifestEntry, error) {
+	for len(s.page) == 0 && !s.done {
+		var resp ManifestResponse
+		req := &ManifestRequest{Path: s.c.prefix, Algorithm: s.c.hashAlgorithm, Limit: manifestPageSize, After: s.next, NoHashes: s.noHashes}
+		if err := s.rconn.Call("Server.Manifest", req, &resp); err != nil {
+			return nil, errors.Wrap(err, "Fetching server manifest failed")
+		}
+		// Servers predating the choice of algorithm always use SHA-256.
+		if resp.Algorithm != s.c.hashAlgorithm && !(s.c.hashAlgorithm == HashSHA256 && resp.Algorithm == "") {
+			return nil, fmt.Errorf("Server manifest hashed with '%s', instead of '%s'", resp.Algorithm, s.c.hashAlgorithm)
+		}
+		// Servers predating pagination list all the entries at once.
+		s.page, s.next, s.done = resp.Entries, resp.Next, resp.Next == ""
+	}
+	if len(s.page) == 0 {
+		return nil, nil
+	}
+	return &s.page[0], nil
+}
+
+// advance iterates over the entries before path in walk order, which are
+// passed to skipped, and returns the entry of path if there is one.
+func (s *manifestStream) advance(path string, skipped func(ManifestEntry)) (*ManifestEntry, error) {
+	for {
+		entry, err := s.peek()
+		if err != nil || entry == nil {
+			return nil, err
+		}
+		if !walkBefore(entry.Path, path) {
+			if entry.Path != path {
+				return nil, nil
+			}
+			s.page = s.page[1:]
+			return entry, nil
+		}
+		s.page = s.page[1:]
+		skipped(*entry)
+	}
+}
+
+// drain iterates over the remaining entries, which are passed to skipped.
+func (s *manifestStream) drain(skipped func(ManifestEntry)) error {
+	for {
+		entry, err := s.peek()
+		if err != nil || entry == nil {
+			return err
+		}
+		s.page = s.page[1:]
+		skipped(*entry)
+	}
+}
+
+// Reconcile sends to the server the files and directories of the client's
+// directory that are missing or differ on the server, according to its
+// manifest. As the manifest lists directories, empty ones are created too.
+// Entries of another type on the server (eg. a file instead of a directory) are
+// replaced. Files and directories that only exist on the server are kept, or
+// removed with WithDeleteExcess.
+func (c *Client) Reconcile() error {
+	remote, err := c.openManifest()
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+	remote.noHashes = c.skipPolicy == SkipSizeMTime
+	// The server's entries missing locally are removed, unless they are
+	// within the copies of symlinks' targets, or removed directories.
+	var excess []*Request
+	links := make(map[string]bool)
+	removed := ""
+	// Excess directories with protected entries are kept, which is only known
+	// after their entries, so all of them are listed.
+	var protected []string
+	skipped := func(entry ManifestEntry) {
+		if !c.deleteExcess || !isWithin(entry.Path, c.remotePath("")) || (c.file != "" && entry.Path != c.remotePath(c.file)) {
+			return
+		}
+		if removed != "" && isWithin(entry.Path, removed) {
+			return
+		}
+		for dir := filepath.ToSlash(filepath.Dir(entry.Path)); dir != "." && dir != "/"; dir = filepath.ToSlash(filepath.Dir(dir)) {
+			if links[dir] {
+				return
+			}
+		}
+		if c.protected(entry.Path) {
+			protected = append(protected, entry.Path)
+			return
+		}
+		excess = append(excess, newRemoveRequest(entry.Path))
+		if len(c.protectedPaths) == 0 {
+			removed = entry.Path
+		}
+	}
+	var reqs []*Request
+	for _, req := range c.prefixRequests() {
+		entry, err := remote.advance(req.Path, skipped)
+		if err != nil {
+			return err
+		}
+		if entry == nil || !entry.IsDir {
+			reqs = append(reqs, req)
+		}
+	}
+	err = c.sync(reqs, func(absPath, relPath string, info os.FileInfo) (bool, bool, error) {
+		if isSymlink(info) {
+			links[relPath] = true
+		}
+		entry, err := remote.advance(relPath, skipped)
+		if err != nil || entry == nil {
+			return false, false, err
+		}
+		if isSymlink(info) {
+			localPath, err := filepath.Rel(c.path, absPath)
+			if err != nil {
+				return false, false, err
+			}
+			target, internal, err := c.internalLinkTarget(absPath, localPath)
+			if err == nil && internal && entry.LinkTarget == target {
+				return true, false, nil
+			}
+			// Copies of external targets are sent again.
+			return false, true, nil
+		}
+		if isSpecial(info) {
+			same := entry.Special == info.Mode().Type()
+			return same, !same && entry.IsDir, nil
+		}
+		if entry.IsDir != info.IsDir() || entry.LinkTarget != "" || entry.Special != 0 {
+			// The entries within the replaced directory go with it.
+			removed = relPath
+			return false, true, nil
+		}
+		if info.IsDir() {
+			return true, false, nil
+		}
+		if c.transform == nil && entry.Size != info.Size() {
+			return false, false, nil
+		}
+		if c.skipPolicy == SkipSizeMTime {
+			// The server's copy is as recent, or newer.
+			return !entry.ModTime.Before(info.ModTime()), false, nil
+		}
+		hash, err := c.contentHash(absPath)
+		if _, ok := err.(*transformError); ok {
+			c.logger.Log(LevelWarning, "Skipping file", Fields{"path": relPath, "error": err})
+			return true, false, nil
+		}
+		if err != nil {
+			return false, false, err
+		}
+		return bytes.Equal(hash, entry.Hash), false, nil
+	})
+	if err == nil && c.deleteExcess {
+		// The remaining entries come after all the local ones.
+		if err = remote.drain(skipped); err == nil {
+			err = c.sendRequests(keepProtected(excess, protected))
+		}
+	}
+	if err == nil && c.hashCache != nil {
+		err = errors.Wrap(c.hashCache.save(), "Saving hash cache failed")
+	}
+	return err
+}
+
+// protected checks whether the slash-separated path, or one of its parent
+// directories, matches a protected path pattern.
+func (c *Client) protected(relPath string) bool {
+	for p := relPath; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+		for _, pattern := range c.protectedPaths {
+			target := p
+			if !strings.Contains(pattern, "/") {
+				target = path.Base(p)
+			}
+			if matched, _ := path.Match(pattern, target); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// keepProtected filters the Remove requests of excess entries, in walk order,
+// dropping those of the directories containing protected entries, and of the
+// entries within removed directories.
+func keepProtected(excess []*Request, protected []string) []*Request {
+	var reqs []*Request
+	removed := ""
+	for _, req := range excess {
+		if removed != "" && isWithin(req.Path, removed) {
+			continue
+		}
+		kept := false
+		for _, p := range protected {
+			if isWithin(p, req.Path) {
+				kept = true
+				break
+			}
+		}
+		if !kept {
+			reqs = append(reqs, req)
+			removed = req.Path
+		}
+	}
+	return reqs
+}
+
+// isWithin checks whether the slash-separated path is strictly within dir, or
+// "" for the root.
+func isWithin(path, dir string) bool {
+	return dir == "" || strings.HasPrefix(path, dir+"/")
+}
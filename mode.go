@@ -0,0 +1,146 @@
+package betterbox
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// specialModes are the mode bits, besides permissions, that are preserved.
+const specialModes = os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// WithPreserveMode sends the permission bits of the files and directories,
+// along with their setuid, setgid and sticky bits, for servers preserving
+// modes to apply them.
+func WithPreserveMode() ClientOption {
+	return func(c *Client) error {
+		c.preserveMode = true
+		return nil
+	}
+}
+
+// WithServerPreserveMode applies the modes sent by clients preserving modes to
+// the created files and directories, instead of 0600 and 0700. Special bits
+// that the server lacks the privilege to set are dropped, with a warning.
+func WithServerPreserveMode() ServerOption {
+	return func(sv *Server) error {
+		sv.preserveMode = true
+		return nil
+	}
+}
+
+// WithSyncChmod makes the client send the mode changes of the monitored files
+// and directories, for servers preserving modes to apply them, if enabled.
+// Mode changes aren't sent by default.
+func WithSyncChmod(enabled bool) ClientOption {
+	return func(c *Client) error {
+		c.syncChmod = enabled
+		return nil
+	}
+}
+
+// setMode sets the mode of the file or directory at path to a Request, if
+// modes are preserved, its birth time, if birth times are, and its access ACL,
+// if ACLs are.
+func (c *Client) setMode(req *Request, path string) (*Request, error) {
+	if !c.preserveMode && !c.preserveBtime && !c.preserveACLs {
+		return req, nil
+	}
+	info, err := c.stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if c.preserveMode {
+		req.Mode = info.Mode() & (os.ModePerm | specialModes)
+	}
+	if c.preserveBtime {
+		req.Btime, _ = birthTime(path, info)
+	}
+	if c.preserveACLs {
+		req.ACL = accessACL(path, info)
+	}
+	return req, nil
+}
+
+// newDirRequest creates a new Mkdir Request for the directory at path.
+func (c *Client) newDirRequest(path, name string) (*Request, error) {
+	return c.setMode(newMkdirRequest(name), path)
+}
+
+// chmodRequests returns the Chmod Request of the file or directory at path,
+// if mode changes are sent. Symbolic links have no mode of their own.
+func (c *Client) chmodRequests(path, name string) ([]*Request, error) {
+	if !c.syncChmod {
+		return nil, nil
+	}
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) || (err == nil && isSymlink(info)) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	req := &Request{Type: requestChmod, Path: name, Mode: info.Mode() & (os.ModePerm | specialModes)}
+	if c.preserveACLs {
+		req.ACL = accessACL(path, info)
+	}
+	return []*Request{req}, nil
+}
+
+// applyMode applies the mode of a Request to the file or directory it created,
+// if modes are preserved, its birth time, if birth times are, and its access
+// ACL, if ACLs are. The special bits are set with an explicit chmod, as the
+// mode of file creations ignores them.
+func (sv *Server) applyMode(req *Request, path string) error {
+	if err := sv.applyBtime(req, path); err != nil {
+		return err
+	}
+	if sv.preserveMode && req.Mode != 0 {
+		if err := sv.chmod(req, path); err != nil {
+			return err
+		}
+	}
+	// Last, as the ACL's entries make up the permission bits.
+	return sv.applyACL(req, path)
+}
+
+// applyChmod applies a Chmod Request, if modes or ACLs are preserved.
+// Symbolic links aren't followed. ACLs removed from the client's entry aren't
+// removed from the server's.
+func (sv *Server) applyChmod(req *Request, path string) error {
+	if !sv.preserveMode && !sv.preserveACLs {
+		return nil
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if isSymlink(info) {
+		return fmt.Errorf("%s: Can't change the mode of a symbolic link", req.Path)
+	}
+	if sv.preserveMode {
+		if err := sv.chmod(req, path); err != nil {
+			return err
+		}
+	}
+	return sv.applyACL(req, path)
+}
+
+// chmod sets the mode of a Request to the file or directory at path, dropping
+// the special bits that the server lacks the privilege to set.
+func (sv *Server) chmod(req *Request, path string) error {
+	err := os.Chmod(path, req.Mode)
+	if req.Mode&specialModes == 0 || !isPermissionError(err) {
+		return err
+	}
+	sv.logger.Log(LevelWarning, "Dropping special mode bits", Fields{"path": req.Path, "mode": req.Mode.String(), "error": err})
+	return os.Chmod(path, req.Mode.Perm())
+}
+
+// isPermissionError checks whether err is caused by a lack of privilege.
+func isPermissionError(err error) bool {
+	if pathErr, ok := err.(*os.PathError); ok {
+		err = pathErr.Err
+	}
+	return err == syscall.EPERM || os.IsPermission(err)
+}
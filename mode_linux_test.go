@@ -0,0 +1,97 @@
+package betterbox_test
+
+import (
+	"betterbox"
+	"github.com/fsnotify/fsnotify"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPreserveSetgid(t *testing.T) {
+	tFiles := []testEntry{
+		{"dir1", DIR, nil},
+		{"dir1/file1", FILE, []byte("file1 content")},
+	}
+	for _, batch := range []bool{false, true} {
+		sopts := []betterbox.ServerOption{betterbox.WithServerPreserveMode()}
+		copts := []betterbox.ClientOption{betterbox.WithPreserveMode()}
+		if batch {
+			sopts = append(sopts, betterbox.WithTransactionalBatches())
+			copts = append(copts, betterbox.WithBatchRequests())
+		}
+		sdir, port := newTestServer(t, sopts...)
+		defer os.RemoveAll(sdir)
+		cdir := createTempDirWithFiles(t, tFiles)
+		defer os.RemoveAll(cdir)
+		modes := map[string]os.FileMode{
+			"dir1":       os.ModeDir | os.ModeSetgid | 0750,
+			"dir1/file1": 0640,
+		}
+		for name, mode := range modes {
+			if err := os.Chmod(filepath.Join(cdir, name), mode); err != nil {
+				t.Fatalf("Can't change mode: %v", err)
+			}
+		}
+		client, err := betterbox.NewClient(serverAddress, port, cdir, copts...)
+		if err != nil {
+			t.Fatalf("Can't instantiate new client: %v", err)
+		}
+		if err = client.Sync(); err != nil {
+			t.Fatalf("Client can't send files to server: %v", err)
+		}
+		for name, mode := range modes {
+			info, err := os.Stat(filepath.Join(sdir, name))
+			if err != nil {
+				t.Fatalf("Can't stat file: %v", err)
+			}
+			if info.Mode() != mode {
+				t.Errorf("%s: Mode %v stored, expected %v", name, info.Mode(), mode)
+			}
+		}
+	}
+}
+
+func TestSyncChmod(t *testing.T) {
+	defer betterbox.SetRequestsWaitTime(50 * time.Millisecond)()
+	for _, enabled := range []bool{false, true} {
+		tFiles := []testEntry{{"file1", FILE, []byte("file1 content")}}
+		sdir, port := newTestServer(t, betterbox.WithServerPreserveMode())
+		defer os.RemoveAll(sdir)
+		cdir := createTempDirWithFiles(t, tFiles)
+		defer os.RemoveAll(cdir)
+		client, err := betterbox.NewClient(serverAddress, port, cdir, betterbox.WithSyncChmod(enabled))
+		if err != nil {
+			t.Fatalf("Can't instantiate new client: %v", err)
+		}
+		path := filepath.Join(cdir, "file1")
+		if err := os.Chmod(path, 0640); err != nil {
+			t.Fatalf("Can't change mode: %v", err)
+		}
+		reqs, err := betterbox.HandleEvent(client, fsnotify.Event{Name: path, Op: fsnotify.Chmod})
+		if err != nil {
+			t.Fatalf("Handling event failed: %v", err)
+		}
+		if sent := len(reqs) == 1 && reqs[0].Type.String() == "Chmod" && reqs[0].Mode == 0640; sent != enabled {
+			t.Errorf("Sync chmod %v: Unexpected requests: %v", enabled, reqs)
+		}
+
+		errc := startMonitoring(t, client, filepath.Join(sdir, "file1"), tFiles[0].content)
+		if err := os.Chmod(path, 0604); err != nil {
+			t.Fatalf("Can't change mode: %v", err)
+		}
+		applied := false
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline) && !applied; time.Sleep(50 * time.Millisecond) {
+			info, err := os.Stat(filepath.Join(sdir, "file1"))
+			applied = err == nil && info.Mode() == 0604
+		}
+		if applied != enabled {
+			t.Errorf("Sync chmod %v: Mode change applied: %v", enabled, applied)
+		}
+		client.Close()
+		if err := <-errc; err != nil {
+			t.Errorf("Monitoring failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package betterbox
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// WithRefuseOverwriteNewer makes Sync skip the files whose copy on the server
+// was modified later than the local one, and differs from it, instead of
+// overwriting them, eg. after edits made on the server. The skipped files are
+// logged, and reported by a NewerOnServerError once the other files are sent.
+// It relies on the client's and server's clocks being in sync. Files with the
+// same content as the server's are skipped too.
+func WithRefuseOverwriteNewer() ClientOption {
+	return func(c *Client) error {
+		c.refuseNewer = true
+		return nil
+	}
+}
+
+// NewerOnServerError is returned by Sync when files weren't sent, as their
+// copies on the server are newer.
+type NewerOnServerError struct {
+	Paths []string // Remote paths of the skipped files.
+}
+
+func (e *NewerOnServerError) Error() string {
+	return fmt.Sprintf("Files newer on the server not overwritten: %s", strings.Join(e.Paths, ", "))
+}
+
+// syncKeepingNewer sends all the files and subdirectories in the client's
+// directory, as Sync does, except the files whose copy on the server is newer.
+func (c *Client) syncKeepingNewer() error {
+	remote, err := c.openManifest()
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+	var newer []string
+	err = c.sync(c.prefixRequests(), func(absPath, relPath string, info os.FileInfo) (bool, bool, error) {
+		if !info.Mode().IsRegular() {
+			return false, false, nil
+		}
+		entry, err := remote.advance(relPath, func(ManifestEntry) {})
+		if err != nil || entry == nil || entry.IsDir || entry.LinkTarget != "" || entry.Special != 0 {
+			return false, false, err
+		}
+		if !entry.ModTime.After(info.ModTime()) {
+			return false, false, nil
+		}
+		if c.transform != nil || entry.Size == info.Size() {
+			hash, err := c.contentHash(absPath)
+			if _, ok := err.(*transformError); ok {
+				// Skipped when sent.
+				return false, false, nil
+			}
+			if err != nil {
+				return false, false, err
+			}
+			if bytes.Equal(hash, entry.Hash) {
+				return true, false, nil
+			}
+		}
+		c.logger.Log(LevelWarning, "Skipping file newer on server", Fields{"path": relPath, "modified": entry.ModTime})
+		newer = append(newer, relPath)
+		return true, false, nil
+	})
+	if err == nil && len(newer) > 0 {
+		err = &NewerOnServerError{Paths: newer}
+	}
+	return err
+}
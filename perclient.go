@@ -0,0 +1,139 @@
+package betterbox
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// WithClientCAs requires the clients to authenticate with a certificate signed
+// by one of the pool's certificate authorities.
+func WithClientCAs(pool *x509.CertPool) ServerOption {
+	return func(sv *Server) error {
+		sv.config.ClientCAs = pool
+		sv.config.ClientAuth = tls.RequireAndVerifyClientCert
+		return nil
+	}
+}
+
+// WithClientCertificate makes the client authenticate to the server with cert,
+// for servers requiring client certificates.
+func WithClientCertificate(cert tls.Certificate) ClientOption {
+	return func(c *Client) error {
+		c.config.Certificates = []tls.Certificate{cert}
+		return nil
+	}
+}
+
+// WithPerClientDirs applies the requests of each client into its own
+// directory under base, named after the common name of the client's
+// certificate, instead of the server's destination. Requires WithClientCAs.
+func WithPerClientDirs(base string) ServerOption {
+	return func(sv *Server) error {
+		absBase, err := filepath.Abs(base)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(absBase, 0700|os.ModeDir); err != nil {
+			return err
+		}
+		sv.perClientBase = absBase
+		return nil
+	}
+}
+
+// connServer returns the Server applying the Requests of the client
+// authenticated on conn, in its own directory.
+func (sv *Server) connServer(conn net.Conn) (*Server, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, fmt.Errorf("Not a TLS connection")
+	}
+	if sv.idleTimeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(sv.idleTimeout))
+		defer tlsConn.SetDeadline(time.Time{})
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("Missing client certificate")
+	}
+	return sv.clientServer(certs[0].Subject.CommonName)
+}
+
+// clientServer returns the Server applying the Requests of the client with the
+// provided common name, with the same settings as sv. It is created on the
+// client's first connection, sharing sv's logger, write rate limit, applied
+// log and hooks, with its own pending removes and tree cache.
+func (sv *Server) clientServer(name string) (*Server, error) {
+	if !validClientName(name) {
+		return nil, fmt.Errorf("Erroneous client name: '%s'", name)
+	}
+	sv.clientsMutex.Lock()
+	defer sv.clientsMutex.Unlock()
+	if child, ok := sv.perClient[name]; ok {
+		return child, nil
+	}
+	path := filepath.Join(sv.perClientBase, name)
+	if err := os.MkdirAll(path, 0700|os.ModeDir); err != nil {
+		return nil, err
+	}
+	child := &Server{
+		address:           sv.address,
+		port:              sv.port,
+		path:              path,
+		config:            sv.config,
+		transactional:     sv.transactional,
+		replayProtection:  sv.replayProtection,
+		fsync:             sv.fsync,
+		fsyncDir:          sv.fsyncDir,
+		readOnly:          sv.readOnly,
+		preserveMode:      sv.preserveMode,
+		preserveBtime:     sv.preserveBtime,
+		preserveACLs:      sv.preserveACLs,
+		streamCompression: sv.streamCompression,
+		writeLimiter:      sv.writeLimiter,
+		appliedLog:        sv.appliedLog,
+		strictRemoves:     sv.strictRemoves,
+		removeGrace:       sv.removeGrace,
+		maxFileSize:       sv.maxFileSize,
+		customHandlers:    sv.customHandlers,
+		shouldApply:       sv.shouldApply,
+		versionsDir:       sv.versionsDir,
+		versionsRel:       sv.versionsRel,
+		keepVersions:      sv.keepVersions,
+		idleTimeout:       sv.idleTimeout,
+		logger:            sv.logger,
+		onSecurityReject:  sv.onSecurityReject,
+		pathTransform:     sv.pathTransform,
+		unconfinedLinks:   sv.unconfinedLinks,
+		hooks:             sv.hooks,
+		hookQueue:         sv.hookQueue,
+		clients:           make(map[*session]struct{}),
+	}
+	if err := child.openDestination(); err != nil {
+		return nil, err
+	}
+	if sv.pendingRemoves != nil {
+		child.pendingRemoves = make(map[string]*time.Timer)
+	}
+	if sv.treeCache != nil {
+		child.treeCache = newTreeCache()
+	}
+	// Versions within the destination are within the client's directory,
+	// and clients sharing a versions directory out of their directories keep
+	// their versions apart.
+	if sv.versionsRel != "" {
+		child.versionsDir = filepath.Join(path, sv.versionsRel)
+	} else if sv.versionsDir != "" {
+		child.versionsDir = filepath.Join(sv.versionsDir, name)
+	}
+	sv.perClient[name] = child
+	return child, nil
+}
@@ -0,0 +1,57 @@
+package betterbox
+
+import (
+	"sort"
+	"strings"
+)
+
+// PriorityFunc returns the priority of the Requests for the file or directory
+// at relPath, relative to the client's directory and slash-separated. Higher
+// priorities are sent first.
+type PriorityFunc func(relPath string) int
+
+// WithPriority makes the client send the buffered Requests of higher priority
+// first, eg. small configuration files before bulk data on a large initial
+// sync. Requests are otherwise sent in order, and a Request is never sent
+// before one it depends on, such as the Mkdir of its parent directory, whose
+// priority is raised to its own.
+func WithPriority(fn PriorityFunc) ClientOption {
+	return func(c *Client) error {
+		c.priority = fn
+		return nil
+	}
+}
+
+// prioritize sorts reqs by decreasing priority, in place, keeping the order of
+// the Requests of a path and of its parent directories.
+func (c *Client) prioritize(reqs []*Request) {
+	if c.priority == nil || len(reqs) < 2 {
+		return
+	}
+	prefix := ""
+	if c.prefix != "" {
+		prefix = c.remotePath("") + "/"
+	}
+	priorities := make(map[*Request]int, len(reqs))
+	for _, req := range reqs {
+		priorities[req] = c.priority(strings.TrimPrefix(req.Path, prefix))
+	}
+	// A Request's priority is final once the ones after it raised it, in
+	// reverse order.
+	for i := len(reqs) - 1; i > 0; i-- {
+		for _, req := range reqs[:i] {
+			if dependent(reqs[i], req) && priorities[req] < priorities[reqs[i]] {
+				priorities[req] = priorities[reqs[i]]
+			}
+		}
+	}
+	sort.SliceStable(reqs, func(i, j int) bool {
+		return priorities[reqs[i]] > priorities[reqs[j]]
+	})
+}
+
+// dependent checks whether two Requests have to be applied in order, as they
+// are for the same path, or one of them for a parent directory of the other's.
+func dependent(a, b *Request) bool {
+	return a.Path == b.Path || isWithin(a.Path, b.Path) || isWithin(b.Path, a.Path)
+}
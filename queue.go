@@ -0,0 +1,182 @@
+package betterbox
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// queueFileName is the file, within the persistent queue's directory, logging
+// the paths of the pending changes.
+const queueFileName = "pending"
+
+// pendingQueue is a write-ahead log of the paths of the changes not sent to
+// the server yet. Only paths are logged: the changes are read again from the
+// client's directory when replayed.
+type pendingQueue struct {
+	path  string     // Path of the log file.
+	file  *os.File   // Log file, opened for appending.
+	mutex sync.Mutex // Protects file and added.
+	added int        // Number of paths logged since opening.
+}
+
+// openQueue opens the persistent queue in directory dir, creating it if
+// needed.
+func openQueue(dir string) (*pendingQueue, error) {
+	if err := os.MkdirAll(dir, 0700|os.ModeDir); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, queueFileName)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &pendingQueue{path: path, file: file}, nil
+}
+
+// add logs the path of a pending change, relative to the client's directory.
+// The log is synced to stable storage before returning.
+func (q *pendingQueue) add(relPath string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.added++
+	if _, err := q.file.WriteString(strconv.Quote(relPath) + "\n"); err != nil {
+		return err
+	}
+	return syncFile(q.file)
+}
+
+// load returns the logged paths, without duplicates, in order of their first
+// change.
+func (q *pendingQueue) load() ([]string, error) {
+	file, err := os.Open(q.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var paths []string
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		path, err := strconv.Unquote(scanner.Text())
+		if err != nil {
+			// Incomplete last line, from a crash while logging.
+			continue
+		}
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	return paths, scanner.Err()
+}
+
+// count returns the number of paths logged since opening.
+func (q *pendingQueue) count() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.added
+}
+
+// clear empties the log, once the changes of the first logged paths are sent.
+// The log is kept if paths were logged since, as their changes are still
+// pending.
+func (q *pendingQueue) clear(sent int) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if sent != q.added {
+		return nil
+	}
+	if err := q.file.Truncate(0); err != nil {
+		return err
+	}
+	return syncFile(q.file)
+}
+
+// WithPersistentQueue logs the paths of the monitored changes to directory
+// dir until they are sent to the server. Changes not sent when the client
+// stops, eg. on a crash, are sent by the next SyncAndMonitor before
+// monitoring.
+func WithPersistentQueue(dir string) ClientOption {
+	return func(c *Client) error {
+		q, err := openQueue(dir)
+		if err != nil {
+			return err
+		}
+		c.queue = q
+		return nil
+	}
+}
+
+// replayRequests returns the Requests of the changes logged in the persistent
+// queue, from the current state of the client's directory.
+func (c *Client) replayRequests() ([]*Request, error) {
+	paths, err := c.queue.load()
+	if err != nil {
+		return nil, err
+	}
+	var reqs []*Request
+	for _, relPath := range paths {
+		absPath := filepath.Join(c.path, relPath)
+		info, err := os.Lstat(absPath)
+		if os.IsNotExist(err) {
+			reqs = append(reqs, newRemoveRequest(c.remotePath(relPath)))
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var pathReqs []*Request
+		switch {
+		case isSymlink(info):
+			pathReqs, err = c.linkRequests(absPath, relPath, map[string]bool{})
+		case info.IsDir():
+			var req *Request
+			if req, err = c.newDirRequest(absPath, c.remotePath(relPath)); err == nil {
+				pathReqs = []*Request{req}
+			}
+		case isSpecial(info):
+			pathReqs = c.specialRequests(absPath, c.remotePath(relPath), info)
+		default:
+			pathReqs, err = c.createRequests(absPath, c.remotePath(relPath))
+		}
+		if err != nil {
+			return nil, err
+		}
+		reqs = append(reqs, pathReqs...)
+	}
+	return reqs, nil
+}
+
+// replayQueue sends the changes logged in the persistent queue, if any.
+func (c *Client) replayQueue() error {
+	reqs, err := c.replayRequests()
+	if err != nil || len(reqs) == 0 {
+		return err
+	}
+	c.logger.Log(LevelInfo, "Replaying pending changes", Fields{"count": len(reqs)})
+	return c.flush(&pendingBatch{reqs: reqs, queued: c.queue.count()})
+}
+
+// pendingBatch is a buffer of Requests handed off for sending.
+type pendingBatch struct {
+	reqs []*Request
+	// Number of paths logged in the persistent queue when handed off.
+	queued int
+	// Reconcile the server instead of sending requests.
+	reconcile bool
+}
+
+// flush sends a buffer of Requests to the server, then clears the persistent
+// queue.
+func (c *Client) flush(batch *pendingBatch) error {
+	if err := c.sendRequests(batch.reqs); err != nil {
+		return err
+	}
+	if c.queue != nil {
+		return c.queue.clear(batch.queued)
+	}
+	return nil
+}
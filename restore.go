@@ -0,0 +1,199 @@
+package betterbox
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// remoteReadSize is the size of the chunks of content read from the server's
+// files at once, bounding the memory used by the server.
+var remoteReadSize = 1 << 20
+
+// ReadFileRequest asks the server for a chunk of the content of the file at
+// Path, relative to its destination, starting at Offset.
+type ReadFileRequest struct {
+	Path   string
+	Offset int64
+}
+
+// ReadFileResponse is a chunk of a file's content.
+type ReadFileResponse struct {
+	Data []byte
+	// Whether the chunk is the last one of the file.
+	EOF bool
+}
+
+// ReadFile reads a chunk of the content of a file of the server's destination.
+func (sv *Server) ReadFile(req *ReadFileRequest, resp *ReadFileResponse) error {
+	if err := sv.validatePath(req.Path); err != nil {
+		return err
+	}
+	if req.Offset < 0 {
+		return fmt.Errorf("Erroneous read offset: %d", req.Offset)
+	}
+	if !sv.parentConfined(req.Path) {
+		return fmt.Errorf("Path outside of destination through symlinks: '%s'", req.Path)
+	}
+	path := filepath.Join(sv.path, req.Path)
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s: Not a regular file", req.Path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	resp.Data = make([]byte, remoteReadSize)
+	n, err := f.ReadAt(resp.Data, req.Offset)
+	resp.Data = resp.Data[:n]
+	if err == io.EOF {
+		resp.EOF, err = true, nil
+	}
+	return err
+}
+
+// Restore recreates the client's directory from the server's copy of it, eg.
+// after losing it, downloading all the files, with their modes and
+// modification times, and recreating the directories and symlinks. The
+// directory has to be empty, so that no local file is overwritten. Encrypted
+// files are decrypted, but data transforms can't be reverted, and special
+// files are skipped.
+func (c *Client) Restore() error {
+	if c.file != "" {
+		return fmt.Errorf("%s: Restoring a single file unsupported", c.file)
+	}
+	dir, err := os.Open(c.path)
+	if err != nil {
+		return err
+	}
+	_, err = dir.Readdirnames(1)
+	dir.Close()
+	if err != io.EOF {
+		return fmt.Errorf("%s: Directory is not empty", c.path)
+	}
+	remote, err := c.openManifest()
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+	remote.noHashes = true
+	root := c.remotePath("")
+	var dirs []ManifestEntry
+	for {
+		entry, err := remote.peek()
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			break
+		}
+		remote.page = remote.page[1:]
+		if !isWithin(entry.Path, root) {
+			// Parents of the remote prefix.
+			continue
+		}
+		localPath, err := c.restorePath(entry.Path)
+		if err != nil {
+			return err
+		}
+		if err := c.restoreEntry(remote.rconn, *entry, localPath); err != nil {
+			return errors.Wrapf(err, "Restoring '%s' failed", entry.Path)
+		}
+		if entry.IsDir {
+			dirs = append(dirs, *entry)
+		}
+	}
+	// Directories get their modes once their entries are restored, in case
+	// they are read-only.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if dirs[i].Mode == 0 {
+			continue
+		}
+		localPath, err := c.restorePath(dirs[i].Path)
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(localPath, dirs[i].Mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restorePath returns the local path of an entry at the remote path within
+// the client's remote prefix. Paths from the server are checked to stay
+// within the client's directory, without going through the symlinks already
+// restored, so that a hostile server can't have files written elsewhere.
+func (c *Client) restorePath(remotePath string) (string, error) {
+	if root := c.remotePath(""); root != "" {
+		remotePath = strings.TrimPrefix(remotePath, root+"/")
+	}
+	localPath := filepath.Clean(filepath.FromSlash(remotePath))
+	if filepath.IsAbs(localPath) || !isLocalPath(localPath) || localPath == "." {
+		return "", fmt.Errorf("%s: Path not within the client's directory", remotePath)
+	}
+	for dir := filepath.Dir(localPath); dir != "."; dir = filepath.Dir(dir) {
+		info, err := os.Lstat(filepath.Join(c.path, dir))
+		if err != nil {
+			return "", err
+		}
+		if isSymlink(info) {
+			return "", fmt.Errorf("%s: Path through the symlink '%s'", remotePath, filepath.ToSlash(dir))
+		}
+	}
+	return filepath.Join(c.path, localPath), nil
+}
+
+// restoreEntry recreates the server's entry at localPath.
+func (c *Client) restoreEntry(rconn *serverConn, entry ManifestEntry, localPath string) error {
+	switch {
+	case entry.IsDir:
+		return os.Mkdir(localPath, 0700|os.ModeDir)
+	case entry.LinkTarget != "":
+		return os.Symlink(entry.LinkTarget, localPath)
+	case entry.Special != 0:
+		c.logger.Log(LevelWarning, "Skipping special file", Fields{"path": entry.Path, "type": entry.Special.String()})
+		return nil
+	}
+	content, err := readRemoteFile(rconn, entry.Path)
+	if err != nil {
+		return err
+	}
+	if c.aead != nil {
+		if content, err = c.decrypt(entry.Path, content); err != nil {
+			return err
+		}
+	}
+	mode := entry.Mode
+	if mode == 0 {
+		mode = 0600
+	}
+	if err := writeFileAtomic(localPath, content, mode, false); err != nil {
+		return err
+	}
+	return os.Chtimes(localPath, entry.ModTime, entry.ModTime)
+}
+
+// readRemoteFile reads the content of the server's file at path, a chunk at a
+// time.
+func readRemoteFile(rconn *serverConn, path string) ([]byte, error) {
+	var content []byte
+	for {
+		var resp ReadFileResponse
+		if err := rconn.Call("Server.ReadFile", &ReadFileRequest{Path: path, Offset: int64(len(content))}, &resp); err != nil {
+			return nil, err
+		}
+		content = append(content, resp.Data...)
+		if resp.EOF {
+			return content, nil
+		}
+	}
+}
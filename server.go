@@ -1,15 +1,19 @@
 package betterbox
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
 	"fmt"
 	"github.com/pkg/errors"
 	"io"
-	"io/ioutil"
-	"log"
-	"net/rpc"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Server struct {
@@ -19,9 +23,225 @@ type Server struct {
 	port uint16
 	// Destination path of the files received from the client.
 	path string
+	// Destination directory the server was created with, to detect its
+	// removal or unmounting. It is kept open so that its inode isn't reused.
+	dest          *os.File
+	destInfo      os.FileInfo
+	destMutex     sync.Mutex // Protects destChecked and destAvailable.
+	destChecked   time.Time  // Time of the last check of the destination.
+	destAvailable bool       // Result of the last check of the destination.
 	// TLS configuration of the server.
 	config *tls.Config
-	// XXX Add custom logger
+	// Listener of the client connections instead of TLS, if not nil.
+	listener net.Listener
+	// Connection of the only client, served instead of listening, if not nil.
+	conn net.Conn
+	// Apply batches of requests as all-or-nothing transactions.
+	transactional bool
+	// Serializes the transactions, which share a staging directory.
+	txMutex sync.Mutex
+	// Reject requests not sent in a session established by a handshake.
+	replayProtection bool
+	// Sync written files, and their parent directories, to stable storage.
+	fsync    bool
+	fsyncDir bool
+	// Reject all the requests modifying the destination.
+	readOnly bool
+	// Apply the modes sent by clients.
+	preserveMode bool
+	// Apply the birth times sent by clients.
+	preserveBtime bool
+	// Apply the access ACLs sent by clients.
+	preserveACLs bool
+	// Compress the RPC streams of the clients asking for it.
+	streamCompression bool
+	// Limits the rate of the writes of all the clients, if not nil.
+	writeLimiter *rateLimiter
+	// Log of the last request applied for each client, nil if disabled.
+	appliedLog *appliedLog
+	// Refuse to remove non-empty directories.
+	strictRemoves bool
+	// Delay of the removes, if not 0, and their timers by path until they
+	// are applied or cancelled.
+	removeGrace    time.Duration
+	removesMutex   sync.Mutex // Protects pendingRemoves.
+	pendingRemoves map[string]*time.Timer
+	// Maximum size of the written files, if not 0.
+	maxFileSize int64
+	// Hashes of the destination's entries, nil if not kept.
+	treeCache *treeCache
+	// Handlers of the custom Requests, by type.
+	customHandlers map[requestType]CustomHandler
+	// Decides whether to apply the requests replacing or removing entries, if
+	// not nil.
+	shouldApply ShouldApplyFunc
+	// Directory of the replaced and removed files' versions, if not "", its
+	// path relative to the destination if within it, and the number of
+	// versions kept per file.
+	versionsDir  string
+	versionsRel  string
+	keepVersions int
+	// Close client connections without requests for this long, if not 0.
+	idleTimeout time.Duration
+	// Logger of the server's events.
+	logger Logger
+	// Called for the requests rejected for security reasons, if not nil.
+	onSecurityReject SecurityRejectFunc
+	// Transforms the requests' paths into the stored ones, if not nil.
+	pathTransform func(string) string
+	// Accept symlinks with absolute targets, or targets outside the
+	// destination.
+	unconfinedLinks bool
+	// Hooks called with the applied paths matching their pattern, and the
+	// queue of the paths they are called with, if any.
+	hooks     []pathHook
+	hookQueue chan string
+
+	// Base of the per-client directories, if clients get their own.
+	perClientBase string
+
+	clientsMutex sync.Mutex            // Protects clients and perClient.
+	clients      map[*session]struct{} // Sessions of the connected clients.
+	perClient    map[string]*Server    // Per-client Servers, by common name.
+}
+
+// ServerOption configures optional Server settings in NewServer.
+type ServerOption func(*Server) error
+
+// WithReplayProtection makes the server reject the requests that aren't sent in
+// a session established by a handshake, in sequence. Requests captured from a
+// session can't be replayed in another one. Without it, the requests of a
+// session are checked as well, but the ones sent without a handshake, eg. by
+// clients predating sessions, are accepted, so that replays stay possible
+// outside sessions: enable it unless such clients have to be served.
+func WithReplayProtection() ServerOption {
+	return func(sv *Server) error {
+		sv.replayProtection = true
+		return nil
+	}
+}
+
+// WithFsync makes the server sync the written files to stable storage before
+// responding, and their parent directories too with syncDir, so that the
+// client's files survive a power loss once applied. This lowers throughput.
+func WithFsync(syncDir bool) ServerOption {
+	return func(sv *Server) error {
+		sv.fsync = true
+		sv.fsyncDir = syncDir
+		return nil
+	}
+}
+
+// WithReadOnly makes the server reject all the requests modifying its
+// destination, with CodeReadOnly. Informational calls, such as Ping and
+// Manifest, still work.
+func WithReadOnly() ServerOption {
+	return func(sv *Server) error {
+		sv.readOnly = true
+		return nil
+	}
+}
+
+// WithStrictRemoves makes the server refuse to remove non-empty directories,
+// with CodeConflict, instead of removing them with all their entries. Clients
+// then have to remove the entries first, which Reconcile with WithDeleteExcess
+// doesn't do.
+func WithStrictRemoves() ServerOption {
+	return func(sv *Server) error {
+		sv.strictRemoves = true
+		return nil
+	}
+}
+
+// ShouldApplyFunc is called with a request replacing or removing an entry, and
+// the existing entry, nil if there is none, returning whether to apply it.
+// req.Type.String() tells the type of request.
+type ShouldApplyFunc func(req *Request, existing os.FileInfo) bool
+
+// WithShouldApply sets a function deciding whether the server applies the
+// Create, Finalize and Remove requests, eg. to never shrink files, or never
+// remove them after business hours. Vetoed requests are rejected with
+// CodeRejected. It is called concurrently for the requests of different
+// clients.
+func WithShouldApply(fn ShouldApplyFunc) ServerOption {
+	return func(sv *Server) error {
+		sv.shouldApply = fn
+		return nil
+	}
+}
+
+// WithIdleTimeout makes the server close the client connections that receive
+// no request for timeout, eg. from clients that went away without closing.
+func WithIdleTimeout(timeout time.Duration) ServerOption {
+	return func(sv *Server) error {
+		if timeout <= 0 {
+			return fmt.Errorf("Invalid idle timeout: %s", timeout)
+		}
+		sv.idleTimeout = timeout
+		return nil
+	}
+}
+
+// WithListener makes the server accept client connections from listener,
+// instead of listening over TLS on its address and port, eg. on an in-memory
+// pipe in tests with clients using WithDialer. The server's TLS configuration
+// isn't needed then, but per-client directories require it.
+func WithListener(listener net.Listener) ServerOption {
+	return func(sv *Server) error {
+		sv.listener = listener
+		return nil
+	}
+}
+
+// WithServerLogger sets the Logger of the server's events. Defaults to
+// free-form lines logged with the standard library's logger.
+func WithServerLogger(logger Logger) ServerOption {
+	return func(sv *Server) error {
+		sv.logger = logger
+		return nil
+	}
+}
+
+// SecurityRejectFunc is called with the address of a client, and the request it
+// sent that was rejected for security reasons.
+type SecurityRejectFunc func(remoteAddr string, req *Request)
+
+// WithOnSecurityReject sets a function called whenever the server rejects a
+// request for security reasons, such as a path or link target outside of the
+// destination, which may be an attack attempt. It is called before the request
+// is responded to, and must not block.
+func WithOnSecurityReject(fn SecurityRejectFunc) ServerOption {
+	return func(sv *Server) error {
+		sv.onSecurityReject = fn
+		return nil
+	}
+}
+
+// WithPathTransform makes the server store the received files and directories
+// under the paths returned by transform, eg. lowercased for case-insensitive
+// systems. It receives and returns slash-separated paths, relative to the
+// destination, which are validated after the transform. Symlinks' targets are
+// stored as is, and manifests list the stored paths.
+func WithPathTransform(transform func(string) string) ServerOption {
+	return func(sv *Server) error {
+		sv.pathTransform = transform
+		return nil
+	}
+}
+
+// WithServerJSONLogging makes the server log its events to w as JSON objects,
+// one per line.
+func WithServerJSONLogging(w io.Writer) ServerOption {
+	return WithServerLogger(NewJSONLogger(w))
+}
+
+// WithTransactionalBatches makes BatchApplyRequest apply a batch of requests
+// entirely, or not at all if any of them fails.
+func WithTransactionalBatches() ServerOption {
+	return func(sv *Server) error {
+		sv.transactional = true
+		return nil
+	}
 }
 
 // checkOrMakeEmptyDirectory checks that the provided path is an empty
@@ -48,8 +268,24 @@ func checkOrMakeEmptyDirectory(path string) error {
 }
 
 // NewServer creates a new server, using the provided IP address, TCP port and
-// destination path for the received files.
-func NewServer(address string, port uint16, path string) (*Server, error) {
+// destination path for the received files. A unix:// address, as in
+// "unix:///run/betterbox.sock", makes the server listen on a Unix domain socket
+// instead, without TLS and ignoring port.
+func NewServer(address string, port uint16, path string, opts ...ServerOption) (*Server, error) {
+	return newServer(unbracketHost(address), port, path, nil, opts)
+}
+
+// NewServerWithConn creates a new server, as NewServer does, serving the
+// client at the other end of conn instead of listening for clients, eg. over a
+// connection already established and authenticated by the caller, such as an
+// SSH tunnel or a multiplexed stream, from a client created with
+// NewClientWithConn. Listen serves conn until it is closed.
+func NewServerWithConn(conn net.Conn, path string, opts ...ServerOption) (*Server, error) {
+	return newServer(conn.LocalAddr().String(), 0, path, conn, opts)
+}
+
+// newServer creates a new server on address and port, serving conn if not nil.
+func newServer(address string, port uint16, path string, conn net.Conn, opts []ServerOption) (*Server, error) {
 	// Validate provided parameters.
 	absPath, err := filepath.Abs(path)
 	if err != nil {
@@ -58,15 +294,61 @@ func NewServer(address string, port uint16, path string) (*Server, error) {
 	if err := checkOrMakeEmptyDirectory(path); err != nil {
 		return nil, err
 	}
-	config, err := newServerTLSConfig()
-	if err != nil {
+	// Servers with a listener or a connection, or on a Unix socket, don't
+	// need a TLS config.
+	config, configErr := newServerTLSConfig()
+	if configErr != nil {
+		config = &tls.Config{}
+	}
+	sv := &Server{
+		address:   address,
+		port:      port,
+		path:      absPath,
+		conn:      conn,
+		config:    config,
+		logger:    stdLogger{},
+		clients:   make(map[*session]struct{}),
+		perClient: make(map[string]*Server),
+	}
+	if err := sv.openDestination(); err != nil {
 		return nil, err
 	}
-	return &Server{address: address, port: port, path: absPath, config: config}, nil
+	for _, opt := range opts {
+		if err := opt(sv); err != nil {
+			return nil, err
+		}
+	}
+	_, unix := unixSocketPath(sv.address)
+	if configErr != nil && ((sv.listener == nil && sv.conn == nil && !unix) || sv.perClientBase != "") {
+		return nil, configErr
+	}
+	if sv.perClientBase != "" && sv.config.ClientAuth != tls.RequireAndVerifyClientCert {
+		return nil, fmt.Errorf("Per-client directories require client certificates")
+	}
+	sv.startHooks()
+	return sv, nil
 }
 
 func (sv *Server) String() string {
-	return fmt.Sprintf("%s:%d -> %s", sv.address, sv.port, sv.path)
+	return fmt.Sprintf("%s -> %s", sv.listenAddress(), sv.path)
+}
+
+// listenAddress returns the address:port the server listens on, with IPv6
+// addresses in brackets, its unix:// address, or its connection's address.
+func (sv *Server) listenAddress() string {
+	if _, ok := unixSocketPath(sv.address); ok || sv.conn != nil {
+		return sv.address
+	}
+	return net.JoinHostPort(sv.address, strconv.Itoa(int(sv.port)))
+}
+
+// unbracketHost removes the brackets around an IPv6 address, as in "[::1]",
+// which net.JoinHostPort adds back.
+func unbracketHost(address string) string {
+	if strings.HasPrefix(address, "[") && strings.HasSuffix(address, "]") {
+		return address[1 : len(address)-1]
+	}
+	return address
 }
 
 // newServerTLSConfig creates a new TLS config for the server.
@@ -81,67 +363,393 @@ func newServerTLSConfig() (*tls.Config, error) {
 	}, nil
 }
 
-// Listen listens for client connections on the provided address and port and
-// executes the received RPC commands.
+// Listen listens for client connections on the provided address and port, or
+// Unix socket, or accepts them from the server's listener, and executes the
+// received RPC commands. Servers created with NewServerWithConn execute the
+// commands received on their connection instead, until it is closed.
 func (sv *Server) Listen() {
-	// Using default RPC server.
-	if err := rpc.Register(sv); err != nil {
-		log.Println("Registering RPC service", err)
+	if sv.conn != nil {
+		sv.serveConn(sv.conn)
 		return
 	}
-	listener, err := tls.Listen("tcp", fmt.Sprintf("%s:%d", sv.address, sv.port), sv.config)
-	if err != nil {
-		log.Println("Starting TCP listener: ", err)
-		return
+	listener := sv.listener
+	if socket, ok := unixSocketPath(sv.address); ok && listener == nil {
+		var err error
+		if listener, err = listenUnix(socket); err != nil {
+			sv.logger.Log(LevelError, "Starting Unix socket listener failed", Fields{"error": err})
+			return
+		}
+	}
+	if listener == nil {
+		var err error
+		if listener, err = tls.Listen("tcp", sv.listenAddress(), sv.config); err != nil {
+			sv.logger.Log(LevelError, "Starting TCP listener failed", Fields{"error": err})
+			return
+		}
 	}
 	// XXX Synchronous, blocking handling of client(s) as the order of Requests (eg.
 	// creating a file, and removing it) is not interchangeable.
 	// Would synchronizing operations on directory be sufficient ?
-	rpc.Accept(listener)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			sv.logger.Log(LevelError, "Accepting connection failed", Fields{"error": err})
+			return
+		}
+		go sv.serveConn(conn)
+	}
+}
+
+// transformPath replaces the path of a received Request with its stored path,
+// if the server transforms paths.
+func (sv *Server) transformPath(req *Request) {
+	if sv.pathTransform != nil {
+		req.Path = sv.pathTransform(req.Path)
+	}
 }
 
-// validateRequest validates that a received Request doesn't contain erroneous information.
+// validateRequest validates that a received Request doesn't contain erroneous
+// information, and is allowed by the server.
 func (sv *Server) validateRequest(req *Request) error {
-	if req.Path == "" {
+	if sv.readOnly {
+		return newCodedError(CodeReadOnly, "Read-only server")
+	}
+	if err := sv.checkDestination(); err != nil {
+		return err
+	}
+	// XXX More sanity checks
+	if err := sv.validatePaths(req); err != nil {
+		return err
+	}
+	if err := sv.checkFileSize(req); err != nil {
+		return err
+	}
+	switch req.Type {
+	case requestWriteAt:
+		if req.Offset < 0 || req.Offset+int64(len(req.Data)) > req.Size {
+			return fmt.Errorf("Erroneous chunk: %d bytes at offset %d of %d", len(req.Data), req.Offset, req.Size)
+		}
+	case requestAppend:
+		if req.Offset < 0 {
+			return fmt.Errorf("Erroneous append offset: %d", req.Offset)
+		}
+	}
+	if len(req.Checksum) > 0 {
+		if sum := sha256.Sum256(req.Data); !bytes.Equal(sum[:], req.Checksum) {
+			return newCodedError(CodeCorrupted, "%s: Content doesn't match its checksum", req.Path)
+		}
+	}
+	return nil
+}
+
+// openDestination opens the destination directory, to check later that it is
+// still the same one.
+func (sv *Server) openDestination() error {
+	dest, err := os.Open(sv.path)
+	if err != nil {
+		return err
+	}
+	info, err := dest.Stat()
+	if err != nil {
+		dest.Close()
+		return err
+	}
+	sv.dest, sv.destInfo = dest, info
+	return nil
+}
+
+// destCheckInterval is how long the result of checking the destination is
+// reused for, sparing a stat per request.
+var destCheckInterval = time.Second
+
+// checkDestination checks that the destination is still the directory the
+// server was created with. Otherwise, eg. once removed and recreated, or
+// unmounted, requests would be applied to the wrong directory.
+func (sv *Server) checkDestination() error {
+	sv.destMutex.Lock()
+	defer sv.destMutex.Unlock()
+	if now := time.Now(); now.Sub(sv.destChecked) >= destCheckInterval {
+		info, err := os.Stat(sv.path)
+		sv.destChecked, sv.destAvailable = now, err == nil && os.SameFile(info, sv.destInfo)
+	}
+	if !sv.destAvailable {
+		return newCodedError(CodeUnavailable, "Destination directory unavailable: %s", sv.path)
+	}
+	return nil
+}
+
+// validatePaths validates that a received Request's path, and link target for
+// Symlink requests, stay within the destination. Failing it is a security
+// rejection.
+func (sv *Server) validatePaths(req *Request) error {
+	if err := sv.validatePath(req.Path); err != nil {
+		return err
+	}
+	if req.Type == requestSymlink {
+		return sv.validateLinkTarget(req.Path, req.LinkTarget)
+	}
+	return nil
+}
+
+// validateLinkTarget validates that a symlink's target is relative, and
+// resolves within the destination, following the symlinks already in it,
+// unless the server allows unconfined symlinks.
+func (sv *Server) validateLinkTarget(path, target string) error {
+	if target == "" {
+		return fmt.Errorf("Erroneous link target: '%s'", target)
+	}
+	if sv.unconfinedLinks {
+		return nil
+	}
+	if filepath.IsAbs(target) {
+		return fmt.Errorf("Erroneous link target: '%s'", target)
+	}
+	relPath, err := filepath.Rel(sv.path, filepath.Join(sv.path, filepath.Dir(path), target))
+	if err != nil || !isLocalPath(relPath) {
+		return fmt.Errorf("Link target outside of destination: '%s'", target)
+	}
+	if !sv.linkConfined(path, target) {
+		return fmt.Errorf("Link target outside of destination through symlinks: '%s'", target)
+	}
+	return nil
+}
+
+// validatePath validates that a received path, relative to the destination,
+// stays within it.
+func (sv *Server) validatePath(path string) error {
+	if path == "" {
 		return fmt.Errorf("Missing request path")
 	}
-	if req.Path != filepath.Clean(req.Path) {
+	// Paths are slash-separated, whatever the platforms.
+	if filepath.FromSlash(path) != filepath.Clean(path) {
 		// XXX Catches all path traversal attempts ?
 		// Does also exclude "valid" path values such as "foo/bar/../somefile"
-		return fmt.Errorf("Erroneous path value: '%s'", req.Path)
+		return fmt.Errorf("Erroneous path value: '%s'", path)
+	}
+	// The joined path must stay within the destination directory.
+	relPath, err := filepath.Rel(sv.path, filepath.Join(sv.path, path))
+	if err != nil || filepath.IsAbs(path) || !isLocalPath(relPath) {
+		return fmt.Errorf("Path outside of destination: '%s'", path)
+	}
+	// eg. removing "." would remove the whole destination.
+	if relPath == "." {
+		return fmt.Errorf("Path is the destination itself: '%s'", path)
+	}
+	for _, reserved := range []string{stagingDirName, sv.versionsRel} {
+		if reserved != "" && (relPath == reserved || strings.HasPrefix(relPath, reserved+string(filepath.Separator))) {
+			return fmt.Errorf("Reserved path value: '%s'", path)
+		}
 	}
-	// XXX More sanity checks
 	return nil
 }
 
 // ApplyRequest applies the provided Request, and returns a Response adequately.
 func (sv *Server) ApplyRequest(req *Request, resp *Response) error {
-	log.Println("Received request: ", req)
+	sv.logger.Log(LevelInfo, "Received request", requestFields(req))
+	sv.applyRequest(req, resp, nil)
+	return nil
+}
+
+// applyRequest applies the provided Request, setting the Response accordingly.
+// The directories to sync are collected in syncs, if not nil.
+func (sv *Server) applyRequest(req *Request, resp *Response, syncs dirSyncs) {
 	var err error
-	resp.Type = responseOk
-	resp.Message = ""
+	*resp = Response{Type: responseOk}
+	sv.transformPath(req)
 	if err = sv.validateRequest(req); err != nil {
-		resp.Type = responseErr
-		resp.Message = err.Error()
-		return nil
+		*resp = errorResponse(err)
+		return
 	}
 	absPath := filepath.Join(sv.path, req.Path)
+	if err = sv.checkShouldApply(req, absPath); err != nil {
+		*resp = errorResponse(err)
+		return
+	}
+	sv.throttleWrite(req)
+	if req.Type != requestRemove {
+		if err = sv.resolveRemoves(req); err != nil {
+			*resp = errorResponse(err)
+			return
+		}
+	}
 	switch req.Type {
 	case requestMkdir:
-		err = os.Mkdir(absPath, 0700|os.ModeDir)
+		if _, err = makeDir(absPath); err == nil {
+			err = sv.applyMode(req, absPath)
+		}
 	case requestCreate:
 		// XXX Create parent directories if they don't exist ? Not
 		// needed, as client does / has to send Mkdir before that.
-		err = ioutil.WriteFile(absPath, req.Data, 0600)
+		resp.Replaced = exists(absPath)
+		if err = sv.saveFileVersion(absPath, req.Path); err == nil {
+			err = sv.writeFile(absPath, req.Data, syncs)
+		}
+		if err == nil {
+			err = sv.applyMode(req, absPath)
+		}
 	case requestRemove:
-		err = os.RemoveAll(absPath)
+		if sv.removeGrace == 0 {
+			err = sv.remove(absPath, req.Path)
+		} else if err = sv.delayRemove(req, absPath); err == nil {
+			// Hooks run once the entry is removed.
+			return
+		}
+	case requestSymlink:
+		if err = sv.saveFileVersion(absPath, req.Path); err == nil {
+			err = symlinkAtomic(req.LinkTarget, absPath)
+		}
+	case requestWriteAt:
+		err = sv.writeChunk(req)
+	case requestFinalize:
+		resp.Replaced = exists(absPath)
+		if err = sv.saveFileVersion(absPath, req.Path); err == nil {
+			err = sv.finalizeUpload(req, absPath, syncs)
+		}
+		if err == nil {
+			err = sv.applyMode(req, absPath)
+		}
+	case requestChmod:
+		err = sv.applyChmod(req, absPath)
+	case requestMknod:
+		if err = sv.saveFileVersion(absPath, req.Path); err == nil {
+			err = sv.applyMknod(req, absPath)
+		}
+	case requestAppend:
+		err = sv.appendFile(req, absPath)
 	default:
-		err = fmt.Errorf("Unhandled request: %s", req)
+		err = sv.applyCustom(req, absPath)
 	}
+	sv.treeCache.invalidate(req)
 	if err != nil {
-		resp.Type = responseErr
 		// XXX Information disclosure to the client.
-		resp.Message = err.Error()
+		*resp = errorResponse(err)
+		return
+	}
+	sv.runHooks(req)
+}
+
+// checkShouldApply checks that the server's ShouldApplyFunc, if any, doesn't
+// veto a Create, Finalize or Remove request.
+func (sv *Server) checkShouldApply(req *Request, absPath string) error {
+	if sv.shouldApply == nil {
+		return nil
+	}
+	switch req.Type {
+	case requestCreate, requestFinalize, requestRemove:
+	default:
+		return nil
+	}
+	existing, err := os.Lstat(absPath)
+	if os.IsNotExist(err) {
+		existing = nil
+	} else if err != nil {
+		return err
+	}
+	if !sv.shouldApply(req, existing) {
+		return newCodedError(CodeRejected, "%s: Rejected by the server", req.Path)
+	}
+	return nil
+}
+
+// checkRemovable checks that an entry can be removed, which non-empty
+// directories can't with strict removes.
+func (sv *Server) checkRemovable(path string) error {
+	if !sv.strictRemoves || !isDirectory(path) {
+		return nil
+	}
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if _, err = dir.Readdirnames(1); err != io.EOF {
+		return newCodedError(CodeConflict, "%s: Directory is not empty", path)
+	}
+	return nil
+}
+
+// exists checks whether an entry exists at path.
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// makeDir creates a directory, returning whether it was created. Directories
+// that already exist are kept as is, but other existing entries are conflicts.
+func makeDir(path string) (bool, error) {
+	err := os.Mkdir(path, 0700|os.ModeDir)
+	if os.IsExist(err) {
+		info, lerr := os.Lstat(path)
+		if lerr != nil {
+			return false, err
+		}
+		if !info.IsDir() {
+			return false, newCodedError(CodeConflict, "%s: Exists and is not a directory", path)
+		}
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Ping reports whether the server is able to apply requests, without modifying
+// its destination.
+func (sv *Server) Ping(req *PingRequest, resp *PingResponse) error {
+	resp.Healthy, resp.Message = true, "OK"
+	if err := sv.checkDestination(); err != nil {
+		resp.Healthy, resp.Message = false, err.Error()
+	}
+	return nil
+}
+
+// Usage reports the usage of the destination's filesystem, so that clients
+// can check that their files fit.
+func (sv *Server) Usage(req *UsageRequest, resp *UsageResponse) error {
+	usage, err := diskUsage(sv.path)
+	if err != nil {
+		return err
+	}
+	*resp = usage
+	return nil
+}
+
+// writeFile writes a received file's content to path, syncing it to stable
+// storage depending on the server's settings. Its directory is synced, or
+// collected in syncs if not nil.
+func (sv *Server) writeFile(path string, data []byte, syncs dirSyncs) error {
+	if err := writeFileAtomic(path, data, 0600, sv.fsync); err != nil {
+		return err
+	}
+	if sv.fsyncDir {
+		return syncs.sync(filepath.Dir(path))
+	}
+	return nil
+}
+
+// BatchApplyRequest applies the provided Requests in order, stopping on the
+// first one that fails. In transactional mode, a failure rolls back the
+// Requests of the batch that were already applied. The directories of the
+// written files are synced once the batch is applied, once each, rather than
+// after every file, and failing to sync them fails the whole batch.
+func (sv *Server) BatchApplyRequest(batch *BatchRequest, resp *BatchResponse) error {
+	sv.logger.Log(LevelInfo, "Received batch", Fields{"requests": len(batch.Requests)})
+	if sv.transactional {
+		sv.applyTransaction(batch, resp)
+		return nil
+	}
+	resp.Responses = make([]Response, 0, len(batch.Requests))
+	syncs := make(dirSyncs)
+	for _, req := range batch.Requests {
+		var r Response
+		sv.applyRequest(req, &r, syncs)
+		resp.Responses = append(resp.Responses, r)
+		if r.Type == responseErr {
+			break
+		}
+	}
+	if err := syncs.flush(); err != nil {
+		// The Requests may not have durably applied: report the last one as
+		// failed, for the client to send it again.
+		resp.Responses[len(resp.Responses)-1] = errorResponse(errors.Wrap(err, "Syncing directories failed"))
 	}
 	return nil
 }
@@ -0,0 +1,274 @@
+package betterbox
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+)
+
+// nonceSize is the size of the random nonces identifying sessions.
+const nonceSize = 16
+
+// session is the state of a client's connection to the server. It receives the
+// connection's RPC calls, and forwards them to the Server.
+type session struct {
+	*Server
+	conn        net.Conn
+	connectedAt time.Time
+
+	mutex       sync.Mutex // Protects nonce, seq, clientID and lastRequest.
+	nonce       []byte     // Session's nonce, set on handshake.
+	clientID    string     // Client's ID in the applied log, set on handshake.
+	seq         uint64     // Sequence number of the last received Request.
+	lastRequest time.Time  // Reception time of the last Request.
+}
+
+// ClientInfo describes a client connected to the server.
+type ClientInfo struct {
+	Address     string    // Client's address:port.
+	ConnectedAt time.Time // Time of the connection.
+	// Reception time of the client's last Request, zero if none.
+	LastRequest time.Time
+}
+
+// serveConn serves the RPC calls of a client's connection, until it is closed.
+func (sv *Server) serveConn(conn net.Conn) {
+	dest := sv
+	if sv.perClientBase != "" {
+		var err error
+		if dest, err = sv.connServer(conn); err != nil {
+			sv.logger.Log(LevelWarning, "Rejected client", Fields{"address": conn.RemoteAddr().String(), "error": err})
+			conn.Close()
+			return
+		}
+	}
+	if sv.idleTimeout > 0 {
+		conn = &idleConn{Conn: conn, timeout: sv.idleTimeout}
+	}
+	s := &session{Server: dest, conn: conn, connectedAt: time.Now()}
+	rpcServer := rpc.NewServer()
+	if err := rpcServer.RegisterName("Server", s); err != nil {
+		sv.logger.Log(LevelError, "Registering RPC service failed", Fields{"error": err})
+		conn.Close()
+		return
+	}
+	sv.clientsMutex.Lock()
+	sv.clients[s] = struct{}{}
+	sv.clientsMutex.Unlock()
+	defer func() {
+		sv.clientsMutex.Lock()
+		delete(sv.clients, s)
+		sv.clientsMutex.Unlock()
+	}()
+	rpcServer.ServeCodec(&streamServerCodec{streamCodec: newStreamCodec(conn), accept: sv.streamCompression})
+}
+
+// ConnectedClients returns the clients currently connected to the server, in
+// order of connection.
+func (sv *Server) ConnectedClients() []ClientInfo {
+	sv.clientsMutex.Lock()
+	defer sv.clientsMutex.Unlock()
+	clients := make([]ClientInfo, 0, len(sv.clients))
+	for s := range sv.clients {
+		s.mutex.Lock()
+		clients = append(clients, ClientInfo{
+			Address:     s.conn.RemoteAddr().String(),
+			ConnectedAt: s.connectedAt,
+			LastRequest: s.lastRequest,
+		})
+		s.mutex.Unlock()
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ConnectedAt.Before(clients[j].ConnectedAt) })
+	return clients
+}
+
+// touch records the reception of a Request.
+func (s *session) touch() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lastRequest = time.Now()
+}
+
+// idleConn is a connection that is closed after timeout without receiving
+// anything, as its read deadline is pushed back before every read.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+// Handshake establishes a new session, returning the nonce that the session's
+// Requests have to carry. The RPC stream is compressed from then on if the
+// client asks for it, and the server enables it.
+func (s *session) Handshake(req *HandshakeRequest, resp *HandshakeResponse) error {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nonce = nonce
+	s.seq = 0
+	// Clients with a certificate can't use another client's ID.
+	if s.clientID = peerName(s.conn); s.clientID == "" && validClientName(req.ClientID) {
+		s.clientID = req.ClientID
+	}
+	resp.Nonce = nonce
+	if s.streamCompression && req.Compression == streamCompression {
+		resp.Compression = streamCompression
+	}
+	resp.MaxFileSize = s.maxFileSize
+	return nil
+}
+
+// checkReplay checks that Requests belong to the current session and come in
+// sequence, so that Requests captured from other sessions, or earlier in this
+// one, are rejected. Requests are checked once a handshake was done, or
+// always with replay protection. The session's sequence number is advanced
+// only if all of them are accepted, so that a rejected batch can be sent
+// again.
+func (s *session) checkReplay(reqs ...*Request) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.nonce == nil {
+		if s.replayProtection {
+			return fmt.Errorf("Missing session handshake")
+		}
+		return nil
+	}
+	for i, req := range reqs {
+		if !bytes.Equal(req.Nonce, s.nonce) {
+			return fmt.Errorf("Request nonce doesn't match session")
+		}
+		if req.Seq != s.seq+uint64(i)+1 {
+			return fmt.Errorf("Unexpected request sequence number %d", req.Seq)
+		}
+	}
+	s.seq += uint64(len(reqs))
+	return nil
+}
+
+// logRejected logs a Request rejected for not belonging to the session.
+func (s *session) logRejected(req *Request, err error) {
+	fields := requestFields(req)
+	fields["error"] = err
+	s.logger.Log(LevelWarning, "Rejected request", fields)
+}
+
+// ApplyRequest applies the provided Request if it belongs to the session.
+func (s *session) ApplyRequest(req *Request, resp *Response) error {
+	s.touch()
+	if err := s.checkReplay(req); err != nil {
+		s.logRejected(req, err)
+		*resp = errorResponse(err)
+		return nil
+	}
+	s.checkSecurity(req)
+	if err := s.Server.ApplyRequest(req, resp); err != nil {
+		return err
+	}
+	s.recordApplied([]*Request{req}, []Response{*resp})
+	return nil
+}
+
+// BatchApplyRequest applies the provided Requests if they all belong to the
+// session.
+func (s *session) BatchApplyRequest(batch *BatchRequest, resp *BatchResponse) error {
+	s.touch()
+	if err := s.checkReplay(batch.Requests...); err != nil {
+		s.logger.Log(LevelWarning, "Rejected batch", Fields{"requests": len(batch.Requests), "error": err})
+		// None of the Requests is applied.
+		resp.Responses = make([]Response, len(batch.Requests))
+		for i := range resp.Responses {
+			resp.Responses[i] = errorResponse(err)
+		}
+		resp.RolledBack = true
+		return nil
+	}
+	for _, req := range batch.Requests {
+		s.checkSecurity(req)
+	}
+	if err := s.Server.BatchApplyRequest(batch, resp); err != nil {
+		return err
+	}
+	if !resp.RolledBack {
+		s.recordApplied(batch.Requests, resp.Responses)
+	}
+	return nil
+}
+
+// checkSecurity reports a Request that the server rejects for security reasons
+// to its callback, along with the client's address.
+func (s *session) checkSecurity(req *Request) {
+	if s.onSecurityReject == nil {
+		return
+	}
+	if err := s.validatePaths(req); err != nil {
+		s.onSecurityReject(s.conn.RemoteAddr().String(), req)
+	}
+}
+
+// serverConn is a client's RPC connection to the server, for a session
+// established by a handshake.
+type serverConn struct {
+	*rpc.Client
+	server string // Server's address:port.
+	nonce  []byte // Session's nonce.
+	seq    uint64 // Sequence number of the last sent Request.
+	// Whether the connection is the client's, kept open for all its
+	// sendings.
+	shared bool
+	// Whether to ask for the compression of the RPC stream on handshake.
+	compress bool
+	// Client's ID in the server's applied log, if not "", and sequence
+	// number of its last Request applied by the server.
+	clientID    string
+	lastApplied uint64
+	// Maximum file size advertised by the server, 0 for none.
+	maxFileSize int64
+	// Counts the bytes written to the connection, if the client measures
+	// its throughput.
+	metered *meteredConn
+}
+
+// Close closes the connection, unless it is shared.
+func (sc *serverConn) Close() error {
+	if sc.shared {
+		return nil
+	}
+	return sc.Client.Close()
+}
+
+// handshake establishes a new session with the server.
+func (sc *serverConn) handshake() error {
+	req := &HandshakeRequest{ClientID: sc.clientID}
+	if sc.compress {
+		req.Compression = streamCompression
+	}
+	var resp HandshakeResponse
+	if err := sc.Call("Server.Handshake", req, &resp); err != nil {
+		return err
+	}
+	sc.nonce = resp.Nonce
+	sc.seq = 0
+	sc.maxFileSize = resp.MaxFileSize
+	return nil
+}
+
+// stamp sets the session's nonce and next sequence number to a Request.
+func (sc *serverConn) stamp(req *Request) {
+	sc.seq++
+	req.Nonce = sc.nonce
+	req.Seq = sc.seq
+}
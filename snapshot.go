@@ -0,0 +1,197 @@
+package betterbox
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// snapshotPageSize is the size, in bytes, beyond which a page of a snapshot
+// ends, bounding the memory used by the server and the client.
+var snapshotPageSize = 1 << 20
+
+// SnapshotRequest asks the server for the next page of a tar archive of the
+// entries under Path, relative to its destination. An empty Path is for the
+// whole destination. The archive's paths are relative to Path.
+type SnapshotRequest struct {
+	Path string
+	// Where the previous page ended, "" for the first one, as set in its
+	// response.
+	After  string
+	Offset int64
+	Size   int64
+}
+
+// SnapshotResponse is a page of a snapshot's tar archive, whose pages make
+// up the archive once concatenated.
+type SnapshotResponse struct {
+	Data []byte
+	// Entry the page ended with, and if it ended within the entry's content,
+	// the offset where it did and the content's size. 0 otherwise.
+	After  string
+	Offset int64
+	Size   int64
+	// Whether the page is the archive's last one.
+	Done bool
+}
+
+// errSnapshotPage stops the walk of the destination once a snapshot page is
+// full.
+var errSnapshotPage = errors.New("Snapshot page full")
+
+// Snapshot archives the entries of the server's destination under the
+// requested path, a page at a time, in walk order. Files modified while being
+// archived fail the snapshot.
+func (sv *Server) Snapshot(req *SnapshotRequest, resp *SnapshotResponse) error {
+	root := filepath.Clean(req.Path)
+	if root == "." {
+		root = ""
+	} else if err := sv.validatePath(root); err != nil {
+		return err
+	}
+	base := filepath.Join(sv.path, root)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	resp.After = req.After
+	err := filepath.Walk(base, func(absPath string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && absPath == base {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(sv.path, absPath)
+		if err != nil {
+			return err
+		}
+		if relPath == stagingDirName || relPath == sv.versionsRel {
+			return filepath.SkipDir
+		}
+		name, err := filepath.Rel(base, absPath)
+		if err != nil || name == "." {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		// Entries up to the previous page's last one were archived, but for
+		// the rest of its content.
+		if req.After != "" && !walkBefore(req.After, name) {
+			if name == req.After && req.Offset > 0 {
+				return snapshotContent(&buf, &buf, absPath, name, req.Offset, req.Size, resp)
+			}
+			if info.IsDir() && name != req.After && !isWithin(req.After, name) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if buf.Len() >= snapshotPageSize {
+			return errSnapshotPage
+		}
+		if info.Mode()&os.ModeSocket != 0 {
+			// Sockets can't be archived.
+			return nil
+		}
+		link := ""
+		if isSymlink(info) {
+			if link, err = os.Readlink(absPath); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		resp.After, resp.Offset, resp.Size = name, 0, 0
+		if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+			// The tar writer pads the content.
+			if err := snapshotContent(&buf, tw, absPath, name, 0, hdr.Size, resp); err != nil {
+				return err
+			}
+		}
+		return tw.Flush()
+	})
+	switch err {
+	case nil, filepath.SkipDir:
+		err = tw.Close()
+		resp.Done = true
+	case errSnapshotPage:
+		err = nil
+	}
+	resp.Data = buf.Bytes()
+	return err
+}
+
+// snapshotContent archives the content of the file at absPath, of the
+// provided size, from offset, to w up to the end of the page. On reaching it,
+// the response is set to continue from there. The content is padded to the
+// tar block size when written to the page directly.
+func snapshotContent(page *bytes.Buffer, w io.Writer, absPath, name string, offset, size int64, resp *SnapshotResponse) error {
+	f, err := os.Open(absPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	// Pages end within the content after some of it, to make progress.
+	n := int64(snapshotPageSize - page.Len())
+	if n < tarBlockSize {
+		n = tarBlockSize
+	}
+	if n > size-offset {
+		n = size - offset
+	}
+	if _, err := io.CopyN(w, f, n); err == io.EOF {
+		return fmt.Errorf("%s: File modified during snapshot", name)
+	} else if err != nil {
+		return err
+	}
+	if offset+n < size {
+		resp.After, resp.Offset, resp.Size = name, offset+n, size
+		return errSnapshotPage
+	}
+	resp.After, resp.Offset, resp.Size = name, 0, 0
+	if w == io.Writer(page) {
+		page.Write(make([]byte, (tarBlockSize-size%tarBlockSize)%tarBlockSize))
+	}
+	return nil
+}
+
+// tarBlockSize is the size of the blocks tar archives are padded to.
+const tarBlockSize = 512
+
+// Snapshot writes a tar archive of the server's copy of the client's directory
+// to w, eg. for backups, or to compare it locally. The archive is fetched a
+// page at a time, and nothing is modified on the server.
+func (c *Client) Snapshot(w io.Writer) error {
+	rconn, err := c.serverConnect()
+	if err != nil {
+		return errors.Wrap(err, "Connection to server failed")
+	}
+	defer rconn.Close()
+	req := &SnapshotRequest{Path: c.prefix}
+	for {
+		var resp SnapshotResponse
+		if err := rconn.Call("Server.Snapshot", req, &resp); err != nil {
+			return errors.Wrap(err, "Fetching server snapshot failed")
+		}
+		if _, err := w.Write(resp.Data); err != nil {
+			return err
+		}
+		if resp.Done {
+			return nil
+		}
+		req.After, req.Offset, req.Size = resp.After, resp.Offset, resp.Size
+	}
+}
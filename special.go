@@ -0,0 +1,72 @@
+package betterbox
+
+import (
+	"fmt"
+	"os"
+)
+
+// specialTypes are the types of the special files, which aren't regular files,
+// directories nor symbolic links.
+const specialTypes = os.ModeNamedPipe | os.ModeDevice | os.ModeCharDevice | os.ModeSocket | os.ModeIrregular
+
+// creatableTypes are the types of the special files that can be recreated on
+// the server.
+const creatableTypes = os.ModeNamedPipe | os.ModeDevice | os.ModeCharDevice
+
+// WithSyncSpecialFiles makes the client send its named pipes and device nodes,
+// for the server to recreate them, instead of skipping them. Recreating device
+// nodes requires privileges on the server, and is only supported on Linux.
+// Sockets are always skipped.
+func WithSyncSpecialFiles() ClientOption {
+	return func(c *Client) error {
+		c.syncSpecial = true
+		return nil
+	}
+}
+
+// isSpecial checks whether info is of a special file.
+func isSpecial(info os.FileInfo) bool {
+	return info.Mode()&specialTypes != 0
+}
+
+// specialRequests returns the Mknod Request recreating the special file at
+// path, if special files are synced and it can be recreated.
+func (c *Client) specialRequests(path, name string, info os.FileInfo) []*Request {
+	if !c.syncSpecial {
+		return nil
+	}
+	if info.Mode()&specialTypes&^creatableTypes != 0 {
+		c.logger.Log(LevelWarning, "Skipping special file", Fields{"path": name, "mode": info.Mode().String()})
+		return nil
+	}
+	req := &Request{Type: requestMknod, Path: name, Mode: info.Mode().Type()}
+	if c.preserveMode {
+		req.Mode |= info.Mode() & (os.ModePerm | specialModes)
+	}
+	if info.Mode()&os.ModeDevice != 0 {
+		req.Dev = deviceNumber(info)
+	}
+	return []*Request{req}
+}
+
+// applyMknod applies a Mknod Request, replacing any existing entry but
+// directories. The mode sent is applied if modes are preserved, 0600
+// otherwise.
+func (sv *Server) applyMknod(req *Request, path string) error {
+	if req.Mode&specialTypes&^creatableTypes != 0 || req.Mode&creatableTypes == 0 {
+		return fmt.Errorf("Erroneous special file type: %s", req.Mode.Type())
+	}
+	perm := os.FileMode(0600)
+	if sv.preserveMode && req.Mode.Perm() != 0 {
+		perm = req.Mode.Perm()
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.IsDir() {
+			return fmt.Errorf("%s: Is a directory", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return mknod(path, req.Mode.Type()|perm, req.Dev)
+}
@@ -0,0 +1,36 @@
+//go:build linux
+// +build linux
+
+package betterbox
+
+import (
+	"os"
+	"syscall"
+)
+
+// mknod creates the special file of the given type and permissions at path,
+// with the device number dev for device nodes.
+func mknod(path string, mode os.FileMode, dev uint64) error {
+	var kind uint32
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		kind = syscall.S_IFIFO
+	case mode&os.ModeCharDevice != 0:
+		kind = syscall.S_IFCHR
+	default:
+		kind = syscall.S_IFBLK
+	}
+	if err := syscall.Mknod(path, kind|uint32(mode.Perm()), int(dev)); err != nil {
+		return &os.PathError{Op: "mknod", Path: path, Err: err}
+	}
+	// Undo the umask's reduction of the permissions.
+	return os.Chmod(path, mode.Perm())
+}
+
+// deviceNumber returns the device number of the device node of info.
+func deviceNumber(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Rdev)
+	}
+	return 0
+}
@@ -0,0 +1,66 @@
+package betterbox_test
+
+import (
+	"betterbox"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestSyncSpecialFiles(t *testing.T) {
+	tFiles := []testEntry{
+		{"dir1", DIR, nil},
+		{"file1", FILE, []byte("file1 content")},
+	}
+	for _, batch := range []bool{false, true} {
+		var sopts []betterbox.ServerOption
+		var copts []betterbox.ClientOption
+		if batch {
+			sopts = append(sopts, betterbox.WithTransactionalBatches())
+			copts = append(copts, betterbox.WithBatchRequests())
+		}
+		sdir, port := newTestServer(t, sopts...)
+		defer os.RemoveAll(sdir)
+		cdir := createTempDirWithFiles(t, tFiles)
+		defer os.RemoveAll(cdir)
+		if err := syscall.Mkfifo(filepath.Join(cdir, "dir1", "fifo"), 0600); err != nil {
+			t.Fatalf("Can't create named pipe: %v", err)
+		}
+
+		// Skipped by default.
+		client, err := betterbox.NewClient(serverAddress, port, cdir, copts...)
+		if err != nil {
+			t.Fatalf("Can't instantiate new client: %v", err)
+		}
+		if err = client.Sync(); err != nil {
+			t.Fatalf("Client can't send files to server: %v", err)
+		}
+		if _, err := os.Lstat(filepath.Join(sdir, "dir1", "fifo")); !os.IsNotExist(err) {
+			t.Errorf("Named pipe synced by default: %v", err)
+		}
+
+		client, err = betterbox.NewClient(serverAddress, port, cdir, append(copts, betterbox.WithSyncSpecialFiles())...)
+		if err != nil {
+			t.Fatalf("Can't instantiate new client: %v", err)
+		}
+		if err = client.Sync(); err != nil {
+			t.Fatalf("Client can't send files to server: %v", err)
+		}
+		info, err := os.Lstat(filepath.Join(sdir, "dir1", "fifo"))
+		if err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+			t.Fatalf("Named pipe not recreated: %v", err)
+		}
+		// Reconciliations leave it as is, and don't read it.
+		before := client.Stats()
+		if err = client.Reconcile(); err != nil {
+			t.Fatalf("Reconciliation failed: %v", err)
+		}
+		if sent := client.Stats().Requests - before.Requests; sent != 0 {
+			t.Errorf("%d requests sent, expected none", sent)
+		}
+		if diffs, err := client.Verify(); err != nil || len(diffs) != 0 {
+			t.Errorf("Verify returned %v, %v, expected no differences", diffs, err)
+		}
+	}
+}
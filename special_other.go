@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package betterbox
+
+import "os"
+
+// mknod creates the special file of the given type and permissions at path,
+// with the device number dev for device nodes.
+func mknod(path string, mode os.FileMode, dev uint64) error {
+	return newCodedError(CodeUnsupported, "Special files unsupported on this platform")
+}
+
+// deviceNumber returns the device number of the device node of info. Device
+// nodes are only recreated on Linux.
+func deviceNumber(info os.FileInfo) uint64 {
+	return 0
+}
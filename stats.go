@@ -0,0 +1,205 @@
+package betterbox
+
+import "time"
+
+// Stats are counters of the client's transfers to the server.
+type Stats struct {
+	Flushes  int   // Number of buffers of requests sent to the server.
+	Requests int   // Number of requests applied by the server.
+	Bytes    int64 // Total size of the files' content applied by the server.
+	// Time of the last buffer of requests entirely applied by the server.
+	LastSync time.Time
+	// Number of monitored changes buffered, not sent yet.
+	Pending int
+	// Number of requests handed off for sending, not sent yet.
+	InFlight int
+	// Time since the last successful flush, while changes are pending.
+	Lag time.Duration
+	// Number of buffers of monitored changes handed off for sending because
+	// they hit the count or byte cap, and because no change followed for the
+	// requests wait time. Frequent cap-triggered flushes signal that the
+	// server can't keep up.
+	CapFlushes   int
+	TimerFlushes int
+	// Latencies of the calls sending requests, by type of request ("Mkdir",
+	// "Create" etc.), or "Batch" for batches sent in single calls.
+	Latencies map[string]Latency
+	// Number of errors reported by the filesystem events watcher, of which
+	// the overflows of its queue of events, each dropping an unknown number
+	// of events. Only reported on Linux, where the queue's size is
+	// fs.inotify.max_queued_events.
+	WatcherErrors  int
+	EventOverflows int
+	// Number of directories watched while monitoring. On Linux, they are
+	// limited by fs.inotify.max_user_watches.
+	ActiveWatches int
+
+	pendingSince time.Time // When changes started being pending.
+}
+
+// Stats returns a snapshot of the client's transfer counters.
+func (c *Client) Stats() Stats {
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+	stats := c.stats
+	if stats.Pending > 0 {
+		since := stats.LastSync
+		if since.IsZero() {
+			since = stats.pendingSince
+		}
+		stats.Lag = time.Since(since)
+	}
+	stats.Latencies = make(map[string]Latency, len(c.latencies))
+	for key, r := range c.latencies {
+		stats.Latencies[key] = r.latency()
+	}
+	return stats
+}
+
+// LastSync returns the time of the last buffer of requests entirely applied by
+// the server, or the zero time if none was.
+func (c *Client) LastSync() time.Time {
+	return c.Stats().LastSync
+}
+
+// recordSync records that a buffer of requests was entirely applied by the
+// server.
+func (c *Client) recordSync() {
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+	c.stats.LastSync = time.Now()
+}
+
+// recordPending records the number of monitored changes not sent yet.
+func (c *Client) recordPending(pending int) {
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+	if c.stats.Pending == 0 && pending > 0 {
+		c.stats.pendingSince = time.Now()
+	}
+	c.stats.Pending = pending
+}
+
+// flushTrigger is what triggers the hand off of a buffer of monitored changes.
+type flushTrigger int
+
+const (
+	triggerOther flushTrigger = iota // eg. resuming, or a reconciliation.
+	triggerCap
+	triggerTimer
+)
+
+// recordHandOff records that the pending requests were handed off for sending.
+func (c *Client) recordHandOff(count int, trigger flushTrigger) {
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+	c.stats.Pending = 0
+	c.stats.InFlight += count
+	switch trigger {
+	case triggerCap:
+		c.stats.CapFlushes++
+	case triggerTimer:
+		c.stats.TimerFlushes++
+	}
+}
+
+// recordWatcherError counts an error reported by the watcher, and whether it
+// is an overflow of its queue of events.
+func (c *Client) recordWatcherError(overflow bool) {
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+	c.stats.WatcherErrors++
+	if overflow {
+		c.stats.EventOverflows++
+	}
+}
+
+// recordWatches records the number of watched directories.
+func (c *Client) recordWatches(count int) {
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+	c.stats.ActiveWatches = count
+}
+
+// recordInFlight adds delta to the number of requests handed off for sending.
+func (c *Client) recordInFlight(delta int) {
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+	c.stats.InFlight += delta
+}
+
+// recordFlush counts a buffer of requests sent to the server.
+func (c *Client) recordFlush() {
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+	c.stats.Flushes++
+}
+
+// recordApplied counts requests successfully applied by the server, given
+// their Responses.
+func (c *Client) recordApplied(reqs []*Request, resps []Response) {
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+	for i, req := range reqs {
+		c.stats.Requests++
+		c.stats.Bytes += int64(len(req.Data))
+		if c.result != nil {
+			c.result.add(req, resps[i])
+		}
+	}
+}
+
+// recordSkipped counts a file left out of the running sync.
+func (c *Client) recordSkipped() {
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+	if c.result != nil {
+		c.result.Skipped++
+	}
+}
+
+// SyncResult summarizes what the server applied during a sync.
+type SyncResult struct {
+	Created     int // Files, symbolic links and special files created.
+	Updated     int // Existing files replaced, or appended to.
+	Directories int // Directories created, or already existing.
+	Removed     int // Entries removed, eg. replaced by entries of another type.
+	Skipped     int // Files not sent, eg. up to date, or newer on the server.
+	// Total size of the files' content applied by the server.
+	Bytes    int64
+	Duration time.Duration
+}
+
+// add counts a Request applied by the server, given its Response.
+func (r *SyncResult) add(req *Request, resp Response) {
+	r.Bytes += int64(len(req.Data))
+	switch req.Type {
+	case requestCreate, requestFinalize:
+		if resp.Replaced {
+			r.Updated++
+		} else {
+			r.Created++
+		}
+	case requestAppend:
+		r.Updated++
+	case requestSymlink, requestMknod:
+		r.Created++
+	case requestMkdir:
+		r.Directories++
+	case requestRemove:
+		r.Removed++
+	}
+}
+
+// fields returns the result's counters as log fields.
+func (r *SyncResult) fields() Fields {
+	return Fields{
+		"created":     r.Created,
+		"updated":     r.Updated,
+		"directories": r.Directories,
+		"removed":     r.Removed,
+		"skipped":     r.Skipped,
+		"bytes":       r.Bytes,
+		"duration":    r.Duration,
+	}
+}
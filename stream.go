@@ -0,0 +1,204 @@
+package betterbox
+
+import (
+	"bufio"
+	"compress/flate"
+	"encoding/gob"
+	"io"
+	"net/rpc"
+	"sync"
+)
+
+// streamCompression is the compression of the RPC streams, negotiated on
+// handshake.
+const streamCompression = "flate"
+
+// WithStreamCompression makes the client ask the servers to compress the whole
+// RPC stream of its connections, rather than individual files, which benefits
+// the many small files whose contents compress poorly on their own. Servers
+// that don't support it, or don't enable it, are sent plain streams.
+func WithStreamCompression() ClientOption {
+	return func(c *Client) error {
+		c.streamCompression = true
+		return nil
+	}
+}
+
+// WithServerStreamCompression makes the server compress the RPC streams of the
+// clients asking for it on handshake.
+func WithServerStreamCompression() ServerOption {
+	return func(sv *Server) error {
+		sv.streamCompression = true
+		return nil
+	}
+}
+
+// streamReader reads a connection's stream, buffered, switching to a
+// decompressed stream after the handshake.
+type streamReader struct {
+	r *bufio.Reader
+}
+
+func (sr *streamReader) Read(p []byte) (int, error) {
+	return sr.r.Read(p)
+}
+
+// ReadByte spares gob.Decoder to buffer the stream on its own, which would
+// read ahead of the switch to the decompressed stream.
+func (sr *streamReader) ReadByte() (byte, error) {
+	return sr.r.ReadByte()
+}
+
+// streamCodec encodes RPC calls with gob, as the default codecs of net/rpc do,
+// over a stream that can be switched to compressed after the handshake. The
+// plain streams are compatible with the default codecs'.
+type streamCodec struct {
+	conn io.ReadWriteCloser
+	in   streamReader
+	dec  *gob.Decoder
+	// Compressed reads, once switched to.
+	compressed bool
+
+	mutex sync.Mutex    // Protects the writing and switching of out and zw.
+	out   *bufio.Writer // Buffered writes to the connection.
+	zw    *flate.Writer // Compressed writes to out, once switched to.
+	enc   *gob.Encoder
+}
+
+// newStreamCodec creates a new codec of conn, with plain streams.
+func newStreamCodec(conn io.ReadWriteCloser) *streamCodec {
+	sc := &streamCodec{conn: conn, in: streamReader{r: bufio.NewReader(conn)}, out: bufio.NewWriter(conn)}
+	sc.dec = gob.NewDecoder(&sc.in)
+	sc.enc = gob.NewEncoder(writerFunc(sc.write))
+	return sc
+}
+
+// writerFunc is an io.Writer calling its function.
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// write writes p to the compressed stream once switched to, or to the plain
+// one.
+func (sc *streamCodec) write(p []byte) (int, error) {
+	if sc.zw != nil {
+		return sc.zw.Write(p)
+	}
+	return sc.out.Write(p)
+}
+
+// encode writes an RPC header and body, flushing them to the connection.
+func (sc *streamCodec) encode(header, body interface{}) error {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	if err := sc.enc.Encode(header); err != nil {
+		return err
+	}
+	if err := sc.enc.Encode(body); err != nil {
+		return err
+	}
+	if sc.zw != nil {
+		if err := sc.zw.Flush(); err != nil {
+			return err
+		}
+	}
+	return sc.out.Flush()
+}
+
+// compressReads switches to reading the decompressed stream. Bytes of the
+// plain stream already buffered are decompressed too.
+func (sc *streamCodec) compressReads() {
+	if !sc.compressed {
+		sc.in.r = bufio.NewReader(flate.NewReader(sc.in.r))
+		sc.compressed = true
+	}
+}
+
+// compressWrites switches to writing a compressed stream.
+func (sc *streamCodec) compressWrites() {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	if sc.zw == nil {
+		// Only fails on invalid levels.
+		sc.zw, _ = flate.NewWriter(sc.out, flate.DefaultCompression)
+	}
+}
+
+func (sc *streamCodec) Close() error {
+	return sc.conn.Close()
+}
+
+// streamServerCodec is the server's streamCodec, compressing the streams of the
+// clients asking for it if accept is set.
+type streamServerCodec struct {
+	*streamCodec
+	accept bool
+	// RPC of the request being read.
+	method string
+}
+
+func (sc *streamServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	err := sc.dec.Decode(r)
+	sc.method = r.ServiceMethod
+	return err
+}
+
+// ReadRequestBody switches to reading the decompressed stream after reading a
+// handshake asking for it, as the client then sends compressed requests.
+// Arguments that don't match the server's definitions are reported to the
+// client as a protocol mismatch.
+func (sc *streamServerCodec) ReadRequestBody(body interface{}) error {
+	if err := sc.dec.Decode(body); err != nil {
+		return mismatchError(sc.method, err)
+	}
+	if req, ok := body.(*HandshakeRequest); ok && sc.accept && req.Compression == streamCompression {
+		sc.compressReads()
+	}
+	return nil
+}
+
+// WriteResponse switches to writing a compressed stream after responding to a
+// handshake with compression.
+func (sc *streamServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if err := sc.encode(r, body); err != nil {
+		sc.Close()
+		return err
+	}
+	if resp, ok := body.(*HandshakeResponse); ok && resp.Compression == streamCompression {
+		sc.compressWrites()
+	}
+	return nil
+}
+
+// streamClientCodec is the client's streamCodec.
+type streamClientCodec struct {
+	*streamCodec
+	// RPC of the response being read.
+	method string
+}
+
+func (sc *streamClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	return sc.encode(r, body)
+}
+
+func (sc *streamClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	err := sc.dec.Decode(r)
+	sc.method = r.ServiceMethod
+	return err
+}
+
+// ReadResponseBody switches to compressed streams after reading a handshake's
+// response with compression, before the next request is sent. Results that
+// don't match the client's definitions are reported as a protocol mismatch.
+func (sc *streamClientCodec) ReadResponseBody(body interface{}) error {
+	if err := sc.dec.Decode(body); err != nil {
+		return mismatchError(sc.method, err)
+	}
+	if resp, ok := body.(*HandshakeResponse); ok && resp.Compression == streamCompression {
+		sc.compressReads()
+		sc.compressWrites()
+	}
+	return nil
+}
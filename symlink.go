@@ -0,0 +1,215 @@
+package betterbox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WithUnconfinedSymlinks makes the server accept symlinks with absolute
+// targets, or relative targets resolving outside its destination, which it
+// rejects by default as later operations could follow them out of it. Only
+// use it with trusted clients.
+func WithUnconfinedSymlinks() ServerOption {
+	return func(sv *Server) error {
+		sv.unconfinedLinks = true
+		return nil
+	}
+}
+
+// maxLinkDepth is the number of symlinks followed when resolving a path, as
+// by Linux, beyond which it is considered a loop.
+const maxLinkDepth = 40
+
+// linkConfined checks whether the target of a symlink at path, relative to the
+// destination, resolves within the destination when following the symlinks
+// already in it, such as a target going up from a symlink to a directory,
+// which the target's lexical check misses. Missing entries are resolved
+// lexically, as they may be created later.
+func (sv *Server) linkConfined(path, target string) bool {
+	root, err := filepath.EvalSymlinks(sv.path)
+	if err != nil {
+		return false
+	}
+	dir := filepath.Join(root, filepath.Dir(filepath.FromSlash(path)))
+	resolved, err := resolveLink(dir, target, 0)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(root, resolved)
+	return err == nil && isLocalPath(rel)
+}
+
+// parentConfined checks that the parent directory of the entry at path,
+// relative to the destination, resolves within it, following the symlinks in
+// it, whether the server allows unconfined symlinks or not.
+func (sv *Server) parentConfined(path string) bool {
+	root, err := filepath.EvalSymlinks(sv.path)
+	if err != nil {
+		return false
+	}
+	resolved, err := resolveLink(root, filepath.Dir(filepath.FromSlash(path)), 0)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(root, resolved)
+	return err == nil && isLocalPath(rel)
+}
+
+// resolveLink resolves target relative to dir, component by component,
+// following the symlinks at depth of others.
+func resolveLink(dir, target string, depth int) (string, error) {
+	if depth > maxLinkDepth {
+		return "", fmt.Errorf("Too many levels of symbolic links")
+	}
+	target = filepath.FromSlash(target)
+	if filepath.IsAbs(target) {
+		dir = filepath.VolumeName(target) + string(filepath.Separator)
+		target = target[len(dir):]
+	}
+	for _, name := range strings.Split(target, string(filepath.Separator)) {
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			dir = filepath.Dir(dir)
+			continue
+		}
+		next := filepath.Join(dir, name)
+		info, err := os.Lstat(next)
+		if err != nil || !isSymlink(info) {
+			dir = next
+			continue
+		}
+		link, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if dir, err = resolveLink(dir, link, depth+1); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// newSymlinkRequest creates a new Symlink Request.
+func newSymlinkRequest(name, target string) *Request {
+	return &Request{Type: requestSymlink, Path: name, LinkTarget: target}
+}
+
+// isSymlink checks whether file info is of a symbolic link.
+func isSymlink(info os.FileInfo) bool {
+	return info.Mode()&os.ModeSymlink != 0
+}
+
+// internalLinkTarget returns the target of the symlink at absPath, relative
+// to the directory of the link at relPath within the client's directory, if
+// the symlink resolves within the client's directory.
+func (c *Client) internalLinkTarget(absPath, relPath string) (string, bool, error) {
+	realPath, err := filepath.EvalSymlinks(absPath)
+	if err != nil {
+		return "", false, err
+	}
+	root, err := filepath.EvalSymlinks(c.path)
+	if err != nil {
+		return "", false, err
+	}
+	if rel, err := filepath.Rel(root, realPath); err != nil || !isLocalPath(rel) {
+		return "", false, nil
+	}
+	target, err := filepath.Rel(filepath.Join(root, filepath.Dir(relPath)), realPath)
+	if err != nil {
+		return "", false, err
+	}
+	return target, true, nil
+}
+
+// linkRequests returns the requests syncing the symlink at absPath, at relPath
+// within the client's directory, as walkLink passes them.
+func (c *Client) linkRequests(absPath, relPath string, ancestors map[string]bool) ([]*Request, error) {
+	var reqs []*Request
+	err := c.walkLink(absPath, relPath, ancestors, func(entryReqs ...*Request) error {
+		reqs = append(reqs, entryReqs...)
+		return nil
+	})
+	return reqs, err
+}
+
+// walkLink passes the requests syncing the symlink at absPath, at relPath
+// within the client's directory, to emit, an entry at a time. Symlinks to
+// targets within the client's directory are preserved, with relative targets.
+// Others are replaced by copies of their targets, walked through so that
+// large copies can be sent as they go. ancestors are the real paths of the
+// directories being copied, to not follow symlink loops forever.
+func (c *Client) walkLink(absPath, relPath string, ancestors map[string]bool, emit func(...*Request) error) error {
+	target, internal, err := c.internalLinkTarget(absPath, relPath)
+	if os.IsNotExist(err) {
+		c.logger.Log(LevelWarning, "Skipping dangling symlink", Fields{"path": relPath})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if internal {
+		return emit(newSymlinkRequest(c.remotePath(relPath), target))
+	}
+	return c.walkCopy(absPath, relPath, ancestors, emit)
+}
+
+// walkCopy passes the requests copying the file or directory at absPath, at
+// relPath within the client's directory, following symlinks, to emit, an
+// entry at a time.
+func (c *Client) walkCopy(absPath, relPath string, ancestors map[string]bool, emit func(...*Request) error) error {
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return err
+	}
+	if isSpecial(info) {
+		return emit(c.specialRequests(absPath, c.remotePath(relPath), info)...)
+	}
+	if !info.IsDir() {
+		req, err := c.newCreateRequest(absPath, c.remotePath(relPath))
+		if err != nil || req == nil {
+			return err
+		}
+		return emit(req)
+	}
+	realPath, err := filepath.EvalSymlinks(absPath)
+	if err != nil {
+		return err
+	}
+	if ancestors[realPath] {
+		c.logger.Log(LevelWarning, "Skipping symlink loop", Fields{"path": relPath})
+		return nil
+	}
+	ancestors[realPath] = true
+	defer delete(ancestors, realPath)
+
+	req, err := c.newDirRequest(absPath, c.remotePath(relPath))
+	if err != nil {
+		return err
+	}
+	if err := emit(req); err != nil {
+		return err
+	}
+	// Entries are read through the symlink, to stay within the client's
+	// directory.
+	entries, err := ioutil.ReadDir(absPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		entryPath, entryRelPath := filepath.Join(absPath, entry.Name()), filepath.Join(relPath, entry.Name())
+		if isSymlink(entry) {
+			err = c.walkLink(entryPath, entryRelPath, ancestors, emit)
+		} else {
+			err = c.walkCopy(entryPath, entryRelPath, ancestors, emit)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package betterbox
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// WithWriteRateLimit limits the aggregate rate at which the server writes the
+// content of the files it receives, of all its clients, to bytesPerSec. Writes
+// wait for their turn before being applied, after bursts of up to a second's
+// worth of writes.
+func WithWriteRateLimit(bytesPerSec int64) ServerOption {
+	return func(sv *Server) error {
+		if bytesPerSec <= 0 {
+			return fmt.Errorf("Invalid write rate limit: %d", bytesPerSec)
+		}
+		sv.writeLimiter = newRateLimiter(float64(bytesPerSec))
+		return nil
+	}
+}
+
+// rateLimiter is a token bucket, holding up to a second's worth of tokens.
+type rateLimiter struct {
+	rate   float64 // Tokens added per second.
+	mutex  sync.Mutex
+	tokens float64   // Available tokens, negative when owed by waiters.
+	last   time.Time // Time tokens were last added.
+}
+
+// newRateLimiter creates a new rate limiter, with a full bucket.
+func newRateLimiter(rate float64) *rateLimiter {
+	return &rateLimiter{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// wait takes n tokens, waiting for them to be added if the bucket doesn't hold
+// them. n may exceed the bucket's size.
+func (l *rateLimiter) wait(n int) {
+	l.mutex.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mutex.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// throttleWrite waits for the server's write rate limit, if any, to allow
+// writing the content of a Request.
+func (sv *Server) throttleWrite(req *Request) {
+	if sv.writeLimiter != nil && len(req.Data) > 0 {
+		sv.writeLimiter.wait(len(req.Data))
+	}
+}
@@ -0,0 +1,272 @@
+package betterbox
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// stagingDirName is the directory, within the server's destination, where
+// transactional batches stage their changes. Requests can't target it.
+const stagingDirName = ".betterbox-staging"
+
+// transaction applies filesystem changes while keeping track of how to undo
+// them. Replaced or removed entries are moved to the staging directory instead
+// of being deleted, so that they can be restored.
+type transaction struct {
+	dir   string         // Staging directory of the transaction.
+	undo  []func() error // Undo operations, in order of application.
+	count int            // Number of staged entries, for unique names.
+	fsync bool           // Sync staged files to stable storage.
+	// Entries moved aside, by original path, to keep their versions.
+	asides map[string]string
+}
+
+// stagedPath returns a new unique path in the transaction's staging directory.
+func (tx *transaction) stagedPath() string {
+	tx.count++
+	return filepath.Join(tx.dir, strconv.Itoa(tx.count))
+}
+
+// stage writes a file's content to the staging directory, returning its path.
+func (tx *transaction) stage(data []byte) (string, error) {
+	path := tx.stagedPath()
+	return path, writeFileAtomic(path, data, 0600, tx.fsync)
+}
+
+// moveAside moves an existing entry to the staging directory, to be restored
+// on rollback. Nothing is done if the entry doesn't exist.
+func (tx *transaction) moveAside(path string) error {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return nil
+	}
+	staged := tx.stagedPath()
+	if err := os.Rename(path, staged); err != nil {
+		return err
+	}
+	tx.undo = append(tx.undo, func() error { return os.Rename(staged, path) })
+	// The first version of a path moved aside is its version before the
+	// transaction.
+	if _, ok := tx.asides[path]; !ok {
+		tx.asides[path] = staged
+	}
+	return nil
+}
+
+// mkdir creates a new directory, to be removed on rollback. Existing
+// directories are kept, even on rollback.
+func (tx *transaction) mkdir(path string) error {
+	created, err := makeDir(path)
+	if created {
+		tx.undo = append(tx.undo, func() error { return os.Remove(path) })
+	}
+	return err
+}
+
+// symlink creates a new symbolic link, replacing the existing entry, to be
+// removed on rollback.
+func (tx *transaction) symlink(target, path string) error {
+	if info, err := os.Lstat(path); err == nil && info.IsDir() {
+		return fmt.Errorf("%s: Is a directory", path)
+	}
+	if err := tx.moveAside(path); err != nil {
+		return err
+	}
+	if err := os.Symlink(target, path); err != nil {
+		return err
+	}
+	tx.undo = append(tx.undo, func() error { return os.Remove(path) })
+	return nil
+}
+
+// chmod changes the mode of an existing entry with apply, to be restored on
+// rollback.
+func (tx *transaction) chmod(path string, apply func() error) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if err := apply(); err != nil {
+		return err
+	}
+	mode := info.Mode() & (os.ModePerm | specialModes)
+	tx.undo = append(tx.undo, func() error { return os.Chmod(path, mode) })
+	return nil
+}
+
+// mknod creates a special file with apply, replacing any existing entry, to be
+// removed on rollback.
+func (tx *transaction) mknod(path string, apply func() error) error {
+	if info, err := os.Lstat(path); err == nil && info.IsDir() {
+		return fmt.Errorf("%s: Is a directory", path)
+	}
+	if err := tx.moveAside(path); err != nil {
+		return err
+	}
+	if err := apply(); err != nil {
+		return err
+	}
+	tx.undo = append(tx.undo, func() error { return os.Remove(path) })
+	return nil
+}
+
+// create moves a staged file into place, replacing any existing file.
+func (tx *transaction) create(staged, path string) error {
+	if info, err := os.Lstat(path); err == nil && info.IsDir() {
+		return fmt.Errorf("%s: Is a directory", path)
+	}
+	if err := tx.moveAside(path); err != nil {
+		return err
+	}
+	// The destination may be on another filesystem than the staging
+	// directory, eg. a mount point.
+	if err := moveFile(staged, path); err != nil {
+		return err
+	}
+	tx.undo = append(tx.undo, func() error { return os.Remove(path) })
+	return nil
+}
+
+// rollback undoes all the applied changes, in reverse order.
+func (tx *transaction) rollback(logger Logger) {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		if err := tx.undo[i](); err != nil {
+			logger.Log(LevelError, "Rolling back transaction failed", Fields{"error": err})
+		}
+	}
+	tx.undo = nil
+}
+
+// applyTransaction applies a batch of Requests entirely or not at all. File
+// contents are first staged, then all the changes are applied with renames,
+// and rolled back on the first failure.
+func (sv *Server) applyTransaction(batch *BatchRequest, resp *BatchResponse) {
+	sv.txMutex.Lock()
+	defer sv.txMutex.Unlock()
+	resp.Responses = make([]Response, 0, len(batch.Requests))
+	// Applied or rolled back, the hashes of the entries may be stale.
+	defer func() {
+		for _, req := range batch.Requests {
+			sv.treeCache.invalidate(req)
+		}
+	}()
+	fail := func(err error) {
+		resp.Responses = append(resp.Responses, errorResponse(err))
+		resp.RolledBack = true
+	}
+	root := filepath.Join(sv.path, stagingDirName)
+	if err := os.MkdirAll(root, 0700|os.ModeDir); err != nil {
+		fail(err)
+		return
+	}
+	defer os.Remove(root)
+	dir, err := ioutil.TempDir(root, "txn")
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	tx := &transaction{dir: dir, fsync: sv.fsync, asides: make(map[string]string)}
+
+	// Validate and stage all the Requests before applying any of them.
+	staged := make([]string, len(batch.Requests))
+	for i, req := range batch.Requests {
+		sv.transformPath(req)
+		err := sv.validateRequest(req)
+		if err == nil {
+			sv.throttleWrite(req)
+		}
+		if err == nil && req.Type == requestCreate {
+			staged[i], err = tx.stage(req.Data)
+		}
+		if err != nil {
+			fail(err)
+			return
+		}
+		resp.Responses = append(resp.Responses, Response{Type: responseOk})
+	}
+	// Report the Responses of applying the Requests from now on.
+	resp.Responses = resp.Responses[:0]
+
+	for i, req := range batch.Requests {
+		absPath := filepath.Join(sv.path, req.Path)
+		if err = sv.checkShouldApply(req, absPath); err != nil {
+			tx.rollback(sv.logger)
+			fail(err)
+			return
+		}
+		if req.Type != requestRemove {
+			if err = sv.resolveRemoves(req); err != nil {
+				tx.rollback(sv.logger)
+				fail(err)
+				return
+			}
+		}
+		r := Response{Type: responseOk}
+		switch req.Type {
+		case requestMkdir:
+			if err = tx.mkdir(absPath); err == nil {
+				err = sv.applyMode(req, absPath)
+			}
+		case requestCreate:
+			r.Replaced = exists(absPath)
+			if err = tx.create(staged[i], absPath); err == nil {
+				err = sv.applyMode(req, absPath)
+			}
+		case requestRemove:
+			if err = sv.checkRemovable(absPath); err == nil {
+				err = tx.moveAside(absPath)
+			}
+		case requestSymlink:
+			err = tx.symlink(req.LinkTarget, absPath)
+		case requestChmod:
+			err = tx.chmod(absPath, func() error { return sv.applyChmod(req, absPath) })
+		case requestMknod:
+			err = tx.mknod(absPath, func() error { return sv.applyMknod(req, absPath) })
+		case requestAppend:
+			err = tx.appendFile(req, absPath)
+		default:
+			err = newCodedError(CodeUnsupported, "Unsupported request type: %s", req.Type)
+		}
+		if err != nil {
+			tx.rollback(sv.logger)
+			fail(err)
+			return
+		}
+		resp.Responses = append(resp.Responses, r)
+	}
+	if sv.fsyncDir {
+		// Once per directory.
+		syncs := make(dirSyncs)
+		for _, req := range batch.Requests {
+			if req.Type == requestCreate {
+				syncs.sync(filepath.Dir(filepath.Join(sv.path, req.Path)))
+			}
+		}
+		// The transaction isn't durable, reported as failed at its last
+		// Request.
+		if err := syncs.flush(); err != nil {
+			tx.rollback(sv.logger)
+			resp.Responses = resp.Responses[:len(resp.Responses)-1]
+			fail(errors.Wrap(err, "Syncing directories failed"))
+			return
+		}
+	}
+	// The replaced and removed entries are in the staging directory until it
+	// is removed.
+	for path, staged := range tx.asides {
+		relPath, err := filepath.Rel(sv.path, path)
+		if err == nil {
+			err = sv.saveVersions(staged, filepath.ToSlash(relPath))
+		}
+		if err != nil {
+			sv.logger.Log(LevelError, "Saving versions failed", Fields{"path": path, "error": err})
+		}
+	}
+	for _, req := range batch.Requests {
+		sv.runHooks(req)
+	}
+}
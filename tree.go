@@ -0,0 +1,409 @@
+package betterbox
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+)
+
+// Kinds of the entries hashed in their directory's tree hash.
+const (
+	treeFile    = 'f'
+	treeDir     = 'd'
+	treeLink    = 'l'
+	treeSpecial = 's'
+)
+
+// treeHasher computes the tree hash of a directory, a Merkle tree's node, from
+// the names, kinds and values of its entries, added in name order. The value of
+// a file is its content hash, the one of a directory its tree hash.
+type treeHasher struct {
+	h hash.Hash
+}
+
+func newTreeHasher(algorithm HashAlgorithm) (*treeHasher, error) {
+	h, err := newHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return &treeHasher{h: h}, nil
+}
+
+// add adds an entry to the directory, its name and value prefixed with their
+// lengths so that different entries never hash the same bytes.
+func (th *treeHasher) add(name string, kind byte, value []byte) {
+	var n [binary.MaxVarintLen64]byte
+	th.h.Write([]byte{kind})
+	th.h.Write(n[:binary.PutUvarint(n[:], uint64(len(name)))])
+	th.h.Write([]byte(name))
+	th.h.Write(n[:binary.PutUvarint(n[:], uint64(len(value)))])
+	th.h.Write(value)
+}
+
+func (th *treeHasher) sum() []byte {
+	return th.h.Sum(nil)
+}
+
+// WithTreeCache makes the server keep the tree hashes of its directories and
+// the content hashes of its files between TreeRoot calls, recomputing only the
+// ones of the entries modified by requests since, so that checking an
+// unmodified tree is immediate. Entries modified by other means than the
+// clients' requests aren't noticed.
+func WithTreeCache() ServerOption {
+	return func(sv *Server) error {
+		sv.treeCache = newTreeCache()
+		return nil
+	}
+}
+
+// treeCache keeps the hashes of the entries of a server's destination, or of a
+// client's directory, by algorithm and slash-separated path, "" for the
+// destination or directory itself.
+type treeCache struct {
+	mutex  sync.Mutex
+	hashes map[HashAlgorithm]map[string][]byte
+	// Incremented on invalidations, so that hashes computed meanwhile, which
+	// may be stale, aren't stored.
+	generation uint64
+}
+
+func newTreeCache() *treeCache {
+	return &treeCache{hashes: make(map[HashAlgorithm]map[string][]byte)}
+}
+
+// lookup returns the stored hash of the entry at path, if any.
+func (tc *treeCache) lookup(algorithm HashAlgorithm, path string) ([]byte, bool) {
+	if tc == nil {
+		return nil, false
+	}
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	hash, ok := tc.hashes[algorithm][path]
+	return hash, ok
+}
+
+// start returns the generation of the cache before computing hashes.
+func (tc *treeCache) start() uint64 {
+	if tc == nil {
+		return 0
+	}
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	return tc.generation
+}
+
+// store stores the hash of the entry at path, computed since the generation,
+// unless the cache was invalidated meanwhile.
+func (tc *treeCache) store(algorithm HashAlgorithm, path string, hash []byte, generation uint64) {
+	if tc == nil {
+		return
+	}
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	if generation != tc.generation {
+		return
+	}
+	if tc.hashes[algorithm] == nil {
+		tc.hashes[algorithm] = make(map[string][]byte)
+	}
+	tc.hashes[algorithm][path] = hash
+}
+
+// invalidate drops the hashes of the entry at path, modified by a Request, and
+// of its parent directories. Removes, which may remove whole directories, drop
+// all the hashes.
+func (tc *treeCache) invalidate(req *Request) {
+	tc.invalidatePath(req.Path, req.Type == requestRemove)
+}
+
+// invalidatePath drops the hashes of the entry at the slash-separated path,
+// and of its parent directories, or all of them.
+func (tc *treeCache) invalidatePath(name string, all bool) {
+	if tc == nil {
+		return
+	}
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	tc.generation++
+	if all {
+		tc.hashes = make(map[HashAlgorithm]map[string][]byte)
+		return
+	}
+	for _, hashes := range tc.hashes {
+		for dir := name; dir != "."; dir = path.Dir(dir) {
+			delete(hashes, dir)
+		}
+		delete(hashes, "")
+	}
+}
+
+// TreeRootRequest asks the server for the root hash of the Merkle tree of the
+// entries under Path, relative to its destination. An empty Path is for the
+// whole destination.
+type TreeRootRequest struct {
+	Path string
+	// Algorithm of the hashes.
+	Algorithm HashAlgorithm
+}
+
+// TreeRootResponse is the root hash of the requested tree, if it exists.
+type TreeRootResponse struct {
+	Exists bool
+	Root   []byte
+}
+
+// TreeRoot computes the root hash of the Merkle tree of the entries under the
+// requested path, the tree hash of its directory, hashing the names, types,
+// contents and link targets of all the entries. Equal trees have equal roots.
+func (sv *Server) TreeRoot(req *TreeRootRequest, resp *TreeRootResponse) error {
+	if _, err := newHash(req.Algorithm); err != nil {
+		return err
+	}
+	algorithm := req.Algorithm
+	if algorithm == "" {
+		algorithm = HashSHA256
+	}
+	root := filepath.Clean(req.Path)
+	if root == "." {
+		root = ""
+	} else if err := sv.validatePath(root); err != nil {
+		return err
+	}
+	if !isDirectory(filepath.Join(sv.path, root)) {
+		return nil
+	}
+	var err error
+	resp.Root, err = sv.treeHash(filepath.ToSlash(root), algorithm, sv.treeCache.start())
+	resp.Exists = err == nil
+	return err
+}
+
+// treeHash returns the tree hash of the directory at dir, a slash-separated
+// path relative to the destination, with the hashes of the cache's
+// generation.
+func (sv *Server) treeHash(dir string, algorithm HashAlgorithm, generation uint64) ([]byte, error) {
+	if hash, ok := sv.treeCache.lookup(algorithm, dir); ok {
+		return hash, nil
+	}
+	absDir := filepath.Join(sv.path, filepath.FromSlash(dir))
+	infos, err := ioutil.ReadDir(absDir)
+	if err != nil {
+		return nil, err
+	}
+	th, err := newTreeHasher(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		relPath := path.Join(dir, info.Name())
+		if osPath := filepath.FromSlash(relPath); osPath == stagingDirName || osPath == sv.versionsRel {
+			continue
+		}
+		absPath := filepath.Join(absDir, info.Name())
+		switch {
+		case isSymlink(info):
+			target, err := os.Readlink(absPath)
+			if err != nil {
+				return nil, err
+			}
+			th.add(info.Name(), treeLink, []byte(target))
+		case isSpecial(info):
+			th.add(info.Name(), treeSpecial, []byte(info.Mode().Type().String()))
+		case info.IsDir():
+			hash, err := sv.treeHash(relPath, algorithm, generation)
+			if err != nil {
+				return nil, err
+			}
+			th.add(info.Name(), treeDir, hash)
+		default:
+			hash, ok := sv.treeCache.lookup(algorithm, relPath)
+			if !ok {
+				if hash, err = hashFile(algorithm, absPath); err != nil {
+					return nil, err
+				}
+				sv.treeCache.store(algorithm, relPath, hash, generation)
+			}
+			th.add(info.Name(), treeFile, hash)
+		}
+	}
+	hash := th.sum()
+	sv.treeCache.store(algorithm, dir, hash, generation)
+	return hash, nil
+}
+
+// errTreeIncomparable stops the walk of the client's directory once an entry
+// is found whose server's copy can't be hashed the same, eg. a copied symlink
+// target.
+var errTreeIncomparable = errors.New("Tree incomparable")
+
+// InSync checks whether the server's copy of the client's directory is fully
+// in sync with it, comparing the root hashes of the Merkle trees of both,
+// which the server can keep cached with WithTreeCache. Only the local files
+// are hashed, nothing is transferred, so that the common case of unmodified
+// trees is quick to check. While monitoring with filesystem events, the client
+// keeps its hashes cached as well, recomputing only the ones of the entries
+// modified since, otherwise its whole directory is hashed on every call. When
+// they differ, Verify reports their differences. Trees with symlinks copied
+// rather than recreated, or files skipped by the data transform, are never
+// reported in sync.
+func (c *Client) InSync() (bool, error) {
+	if c.file != "" {
+		return false, fmt.Errorf("%s: Comparing a single file's tree unsupported", c.file)
+	}
+	if c.aead != nil {
+		// Files are encrypted with random nonces.
+		return false, fmt.Errorf("Comparing trees of encrypted files unsupported")
+	}
+	local, err := c.treeRoot()
+	if err == errTreeIncomparable {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	rconn, err := c.serverConnect()
+	if err != nil {
+		return false, errors.Wrap(err, "Connection to server failed")
+	}
+	defer rconn.Close()
+	var resp TreeRootResponse
+	req := &TreeRootRequest{Path: c.remotePath(""), Algorithm: c.hashAlgorithm}
+	if err := rconn.Call("Server.TreeRoot", req, &resp); err != nil {
+		return false, errors.Wrap(err, "Fetching tree root failed")
+	}
+	return resp.Exists && bytes.Equal(local, resp.Root), nil
+}
+
+// localTreeCache returns the cache of the hashes of the client's entries, nil
+// unless monitoring with filesystem events, which invalidate them.
+func (c *Client) localTreeCache() *treeCache {
+	c.treeMutex.Lock()
+	defer c.treeMutex.Unlock()
+	return c.treeCache
+}
+
+// setLocalTreeCache sets the cache of the hashes of the client's entries.
+func (c *Client) setLocalTreeCache(tc *treeCache) {
+	c.treeMutex.Lock()
+	defer c.treeMutex.Unlock()
+	c.treeCache = tc
+}
+
+// invalidateTree drops the cached hashes of the entries modified by a
+// filesystem event. Only writes of files are narrowed down to their paths, as
+// the entries of created, removed or renamed directories may change without
+// their own events.
+func (c *Client) invalidateTree(event fsnotify.Event) {
+	tc := c.localTreeCache()
+	if tc == nil {
+		return
+	}
+	localPath, err := filepath.Rel(c.path, event.Name)
+	if err != nil || !isLocalPath(localPath) {
+		return
+	}
+	all := event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 || (event.Op&fsnotify.Create != 0 && isDirectory(event.Name))
+	tc.invalidatePath(filepath.ToSlash(localPath), all)
+}
+
+// treeRoot computes the root hash of the Merkle tree of the client's
+// directory, as the server does for its copy, walking through it. The cached
+// hashes of unmodified entries are reused.
+func (c *Client) treeRoot() ([]byte, error) {
+	type treeDirHasher struct {
+		path string
+		th   *treeHasher
+	}
+	cache := c.localTreeCache()
+	generation := cache.start()
+	if root, ok := cache.lookup(c.hashAlgorithm, ""); ok {
+		return root, nil
+	}
+	th, err := newTreeHasher(c.hashAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	// Directories being hashed, from the client's one.
+	stack := []treeDirHasher{{".", th}}
+	// pop adds the innermost directory to its parent, once all its entries
+	// are added.
+	pop := func() {
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		hash := top.th.sum()
+		cache.store(c.hashAlgorithm, filepath.ToSlash(top.path), hash, generation)
+		stack[len(stack)-1].th.add(filepath.Base(top.path), treeDir, hash)
+	}
+	err = c.walk(func(absPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if absPath == c.path {
+			return nil
+		}
+		localPath, err := filepath.Rel(c.path, absPath)
+		if err != nil {
+			return err
+		}
+		for stack[len(stack)-1].path != filepath.Dir(localPath) {
+			pop()
+		}
+		parent := stack[len(stack)-1].th
+		switch {
+		case isSymlink(info):
+			target, internal, err := c.internalLinkTarget(absPath, localPath)
+			if err != nil {
+				return err
+			}
+			if !internal {
+				return errTreeIncomparable
+			}
+			parent.add(info.Name(), treeLink, []byte(target))
+		case isSpecial(info):
+			if c.syncSpecial {
+				parent.add(info.Name(), treeSpecial, []byte(info.Mode().Type().String()))
+			}
+		case info.IsDir():
+			if hash, ok := cache.lookup(c.hashAlgorithm, filepath.ToSlash(localPath)); ok {
+				parent.add(info.Name(), treeDir, hash)
+				return filepath.SkipDir
+			}
+			th, err := newTreeHasher(c.hashAlgorithm)
+			if err != nil {
+				return err
+			}
+			stack = append(stack, treeDirHasher{localPath, th})
+		default:
+			hash, ok := cache.lookup(c.hashAlgorithm, filepath.ToSlash(localPath))
+			if !ok {
+				hash, err = c.contentHash(absPath)
+				if _, ok := err.(*transformError); ok {
+					return errTreeIncomparable
+				}
+				if err != nil {
+					return err
+				}
+				cache.store(c.hashAlgorithm, filepath.ToSlash(localPath), hash, generation)
+			}
+			parent.add(info.Name(), treeFile, hash)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for len(stack) > 1 {
+		pop()
+	}
+	root := stack[0].th.sum()
+	cache.store(c.hashAlgorithm, "", root, generation)
+	return root, nil
+}
@@ -0,0 +1,46 @@
+package betterbox
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// unixScheme prefixes the addresses of servers listening on a Unix domain
+// socket, as in "unix:///run/betterbox.sock". Connections over the socket
+// aren't encrypted nor authenticated with TLS, access to them is controlled by
+// the socket's permissions instead.
+const unixScheme = "unix://"
+
+// unixSocketPath returns the path of the socket of a unix:// address, and
+// whether address is one.
+func unixSocketPath(address string) (string, bool) {
+	if !strings.HasPrefix(address, unixScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(address, unixScheme), true
+}
+
+// listenUnix listens on a Unix domain socket at path, only accessible to the
+// server's user. A stale socket left at path, eg. by a server that crashed, is
+// replaced.
+func listenUnix(path string) (net.Listener, error) {
+	if path == "" {
+		return nil, fmt.Errorf("Missing Unix socket path")
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
@@ -0,0 +1,11 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package betterbox
+
+import "fmt"
+
+// diskUsage returns the usage of the filesystem containing path.
+func diskUsage(path string) (UsageResponse, error) {
+	return UsageResponse{}, fmt.Errorf("Disk usage unsupported on this platform")
+}
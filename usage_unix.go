@@ -0,0 +1,20 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package betterbox
+
+import "syscall"
+
+// diskUsage returns the usage of the filesystem containing path.
+func diskUsage(path string) (UsageResponse, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return UsageResponse{}, err
+	}
+	bsize := uint64(st.Bsize)
+	return UsageResponse{
+		Total: st.Blocks * bsize,
+		Free:  st.Bavail * bsize,
+		Used:  (st.Blocks - st.Bfree) * bsize,
+	}, nil
+}
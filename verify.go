@@ -0,0 +1,197 @@
+package betterbox
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+)
+
+// Verify compares the client's directory with the server's copy of it,
+// according to its manifest, returning their differences sorted in walk order.
+// Paths are relative to the server's destination, values of A are the local
+// ones and values of B the server's. Nothing is sent nor modified on either
+// side.
+func (c *Client) Verify() ([]Difference, error) {
+	remote, err := c.openManifest()
+	if err != nil {
+		return nil, err
+	}
+	defer remote.Close()
+	// The server's entries missing locally are extra, unless they are within
+	// the copies of symlinks' targets, or within extra or replaced entries.
+	var diffs []Difference
+	links := make(map[string]bool)
+	reported := ""
+	skipped := func(entry ManifestEntry) {
+		if !isWithin(entry.Path, c.remotePath("")) || (c.file != "" && entry.Path != c.remotePath(c.file)) {
+			return
+		}
+		if reported != "" && isWithin(entry.Path, reported) {
+			return
+		}
+		for dir := filepath.ToSlash(filepath.Dir(entry.Path)); dir != "." && dir != "/"; dir = filepath.ToSlash(filepath.Dir(dir)) {
+			if links[dir] {
+				return
+			}
+		}
+		diffs = append(diffs, Difference{Path: entry.Path, Kind: DiffMissing, A: "missing", B: "present"})
+		reported = entry.Path
+	}
+	err = c.walk(func(absPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if absPath == c.path {
+			return nil
+		}
+		localPath, err := filepath.Rel(c.path, absPath)
+		if err != nil {
+			return err
+		}
+		relPath := c.remotePath(localPath)
+		if isSpecial(info) && !c.syncSpecial {
+			return nil
+		}
+		entry, err := remote.advance(relPath, skipped)
+		if err != nil {
+			return err
+		}
+		diff, err := c.verifyEntry(absPath, localPath, info, entry)
+		if err != nil {
+			return err
+		}
+		if diff == nil {
+			if isSymlink(info) {
+				links[relPath] = true
+			}
+			return nil
+		}
+		diff.Path = relPath
+		diffs = append(diffs, *diff)
+		if diff.Kind == DiffMissing || diff.Kind == DiffType {
+			// The entries within the missing or replaced one aren't reported.
+			reported = relPath
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		// The remaining entries come after all the local ones.
+		err = remote.drain(skipped)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return diffs, nil
+}
+
+// VerifyFile compares the file at relPath, relative to the client's directory,
+// with the server's copy of it, returning their difference if any, as Verify
+// does for the whole directory. With repair, the file is sent again when they
+// differ. Nothing else is sent nor modified.
+func (c *Client) VerifyFile(relPath string, repair bool) (*Difference, error) {
+	localPath := filepath.Clean(filepath.FromSlash(relPath))
+	if filepath.IsAbs(localPath) || !isLocalPath(localPath) || localPath == "." {
+		return nil, fmt.Errorf("%s: Path not relative within the client's directory", relPath)
+	}
+	absPath := filepath.Join(c.path, localPath)
+	info, err := os.Lstat(absPath)
+	if err != nil {
+		return nil, err
+	}
+	rconn, err := c.serverConnect()
+	if err != nil {
+		return nil, errors.Wrap(err, "Connection to server failed")
+	}
+	var resp StatFileResponse
+	req := &StatFileRequest{Path: c.remotePath(localPath), Algorithm: c.hashAlgorithm}
+	err = rconn.Call("Server.StatFile", req, &resp)
+	rconn.Close()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Describing server file '%s' failed", req.Path)
+	}
+	var entry *ManifestEntry
+	if resp.Exists {
+		entry = &resp.Entry
+	}
+	diff, err := c.verifyEntry(absPath, localPath, info, entry)
+	if err != nil || diff == nil {
+		return nil, err
+	}
+	diff.Path = req.Path
+	if repair {
+		c.logger.Log(LevelInfo, "Repairing file", Fields{"path": relPath, "difference": diff.Kind})
+		if err := c.SyncPaths([]string{relPath}); err != nil {
+			return diff, errors.Wrapf(err, "Repairing file '%s' failed", relPath)
+		}
+	}
+	return diff, nil
+}
+
+// verifyEntry compares a local entry with the server's one, nil if it is
+// missing, returning their difference if any. Copies of symlinks' targets
+// aren't compared.
+func (c *Client) verifyEntry(absPath, localPath string, info os.FileInfo, entry *ManifestEntry) (*Difference, error) {
+	if entry == nil {
+		return &Difference{Kind: DiffMissing, A: "present", B: "missing"}, nil
+	}
+	if isSymlink(info) {
+		target, internal, err := c.internalLinkTarget(absPath, localPath)
+		if err != nil || !internal {
+			return nil, err
+		}
+		if entry.LinkTarget == "" {
+			return &Difference{Kind: DiffType, A: "symlink", B: entryType(entry)}, nil
+		}
+		if entry.LinkTarget != target {
+			return &Difference{Kind: DiffContent, A: target, B: entry.LinkTarget}, nil
+		}
+		return nil, nil
+	}
+	local := "file"
+	if info.IsDir() {
+		local = "directory"
+	} else if isSpecial(info) {
+		local = info.Mode().Type().String()
+	}
+	if entry.IsDir != info.IsDir() || entry.LinkTarget != "" || entry.Special != info.Mode()&specialTypes {
+		return &Difference{Kind: DiffType, A: local, B: entryType(entry)}, nil
+	}
+	if info.IsDir() || isSpecial(info) {
+		return nil, nil
+	}
+	hash, err := c.contentHash(absPath)
+	if _, ok := err.(*transformError); ok {
+		c.logger.Log(LevelWarning, "Skipping file", Fields{"path": localPath, "error": err})
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hash, entry.Hash) {
+		return &Difference{
+			Kind: DiffContent,
+			A:    fmt.Sprintf("%d bytes", info.Size()),
+			B:    fmt.Sprintf("%d bytes", entry.Size),
+		}, nil
+	}
+	return nil, nil
+}
+
+// entryType returns the type of a manifest entry, for display.
+func entryType(entry *ManifestEntry) string {
+	switch {
+	case entry.LinkTarget != "":
+		return "symlink"
+	case entry.IsDir:
+		return "directory"
+	case entry.Special != 0:
+		return entry.Special.String()
+	default:
+		return "file"
+	}
+}
@@ -0,0 +1,88 @@
+package betterbox
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+// ProtocolVersion is the version of the protocol between clients and servers.
+// It is increased on every incompatible change of the RPCs, or of the Requests
+// and Responses that they carry.
+const ProtocolVersion = 1
+
+// clientProtocolVersion is the protocol version that the client claims to
+// speak.
+var clientProtocolVersion = ProtocolVersion
+
+// VersionRequest carries the protocol version of the client.
+type VersionRequest struct {
+	Version int
+}
+
+// VersionResponse carries the protocol version of the server.
+type VersionResponse struct {
+	Version int
+}
+
+// Version reports the server's protocol version, failing if the client's is
+// incompatible.
+func (sv *Server) Version(req *VersionRequest, resp *VersionResponse) error {
+	resp.Version = ProtocolVersion
+	if req.Version != ProtocolVersion {
+		return fmt.Errorf("Incompatible protocol version %d, server speaks version %d", req.Version, ProtocolVersion)
+	}
+	return nil
+}
+
+// checkVersion checks that the server speaks the client's protocol version.
+func (sc *serverConn) checkVersion() error {
+	var resp VersionResponse
+	// Servers reject incompatible clients, and servers predating protocol
+	// versioning don't have the RPC.
+	if err := sc.Call("Server.Version", &VersionRequest{Version: clientProtocolVersion}, &resp); err != nil {
+		return errors.Wrap(err, "Protocol version check failed")
+	}
+	if resp.Version != clientProtocolVersion {
+		return fmt.Errorf("Incompatible server protocol version %d, client speaks version %d", resp.Version, clientProtocolVersion)
+	}
+	return nil
+}
+
+// protocolMismatch prefixes the errors of decoding RPC arguments or results
+// whose definitions differ between the client and the server.
+const protocolMismatch = "Protocol mismatch"
+
+// mismatchError returns the error of decoding the arguments or results of an
+// RPC, clarified if their definitions differ between the client and the
+// server, as reported by gob.
+func mismatchError(method string, err error) error {
+	if err == nil || !strings.HasPrefix(err.Error(), "gob: ") {
+		return err
+	}
+	return fmt.Errorf("%s decoding %s: %v", protocolMismatch, method, err)
+}
+
+// IncompatibleServerError is returned when the client and the server can't
+// decode each other's RPC arguments or results, as their definitions differ,
+// eg. between incompatible versions not checked by Server.Version.
+type IncompatibleServerError struct {
+	Method string // RPC that failed.
+	Err    error  // Decoding error, on either side.
+}
+
+func (e *IncompatibleServerError) Error() string {
+	return fmt.Sprintf("Server incompatible with the client, check their versions: %v", e.Err)
+}
+
+// Call calls an RPC of the server, as rpc.Client does, returning an
+// IncompatibleServerError if either side fails to decode it.
+func (sc *serverConn) Call(method string, args, reply interface{}) error {
+	// Mismatches are reported by the server as errors, and by the client's
+	// codec as failures to read the results.
+	err := sc.Client.Call(method, args, reply)
+	if err != nil && strings.Contains(err.Error(), protocolMismatch) {
+		return &IncompatibleServerError{Method: method, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,136 @@
+package betterbox
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// versionTimeFormat is the format of the names of the files' versions, which
+// sort in order of time.
+const versionTimeFormat = "20060102T150405.000000000Z"
+
+// WithVersioning makes the server keep the previous versions of the files that
+// requests replace or remove, up to keep of them per file, for point-in-time
+// recovery. A file's versions are stored in dir as <dir>/<path>/<time>, time
+// being the UTC time of their replacement. dir is relative to the destination,
+// unless absolute, and requests can't target it. With WithPerClientDirs, each
+// client has its versions in its own directory, under an absolute dir in a
+// subdirectory named after the client.
+func WithVersioning(dir string, keep int) ServerOption {
+	return func(sv *Server) error {
+		if keep < 1 {
+			return fmt.Errorf("Invalid number of versions to keep: %d", keep)
+		}
+		if dir == "" {
+			return fmt.Errorf("Missing versions directory")
+		}
+		sv.versionsDir, sv.versionsRel = dir, ""
+		if !filepath.IsAbs(dir) {
+			rel := filepath.Clean(dir)
+			if !isLocalPath(rel) || rel == "." || rel == stagingDirName {
+				return fmt.Errorf("Erroneous versions directory: '%s'", dir)
+			}
+			sv.versionsDir, sv.versionsRel = filepath.Join(sv.path, rel), rel
+		}
+		sv.keepVersions = keep
+		return nil
+	}
+}
+
+// saveVersions keeps the current versions of the file at path, or of the files
+// within the directory at path, whose path relative to the destination is
+// name, before they get replaced or removed. Versions are hard links, or copies
+// if the versions directory is on another filesystem.
+func (sv *Server) saveVersions(path, name string) error {
+	if sv.versionsDir == "" {
+		return nil
+	}
+	stamp := time.Now().UTC().Format(versionTimeFormat)
+	return filepath.Walk(path, func(filePath string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && filePath == path {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		relPath, err := filepath.Rel(path, filePath)
+		if err != nil {
+			return err
+		}
+		dir := filepath.Join(sv.versionsDir, filepath.FromSlash(name), relPath)
+		if err := os.MkdirAll(dir, 0700|os.ModeDir); err != nil {
+			return err
+		}
+		version := filepath.Join(dir, stamp)
+		if err := os.Link(filePath, version); err != nil {
+			if !isCrossDevice(err) {
+				return err
+			}
+			if err := copyFile(filePath, version); err != nil {
+				return err
+			}
+		}
+		return sv.pruneVersions(dir)
+	})
+}
+
+// saveFileVersion keeps the current version of the file at path, as
+// saveVersions does, before it gets replaced. Directories, which can't be
+// replaced by files, are left to fail the replacement.
+func (sv *Server) saveFileVersion(path, name string) error {
+	if isDirectory(path) {
+		return nil
+	}
+	return sv.saveVersions(path, name)
+}
+
+// pruneVersions removes the oldest versions in a file's versions directory,
+// beyond the number of versions to keep.
+func (sv *Server) pruneVersions(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	// Subdirectories are of the files of a directory of the same path.
+	var versions []string
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() {
+			versions = append(versions, entry.Name())
+		}
+	}
+	for len(versions) > sv.keepVersions {
+		if err := os.Remove(filepath.Join(dir, versions[0])); err != nil {
+			return err
+		}
+		versions = versions[1:]
+	}
+	return nil
+}
+
+// copyFile copies the content of the file src to the new file dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}